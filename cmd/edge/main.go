@@ -1,323 +1,150 @@
 package main
 
 import (
-    crand "crypto/rand"
-    "crypto/sha256"
-    "golang.org/x/crypto/hkdf"
+    "context"
+    "errors"
     "flag"
     "fmt"
-    "math/rand"
-    "net"
-    "io"
     "os"
+    "os/signal"
+    "syscall"
     "time"
-    "n2n-go/pkg/tap"
-    "n2n-go/pkg/transport"
-    "n2n-go/pkg/wire"
-    "n2n-go/pkg/crypto"
-    "n2n-go/pkg/compress"
-    "n2n-go/pkg/portmap"
-    "n2n-go/pkg/management"
+    "n2n-go/pkg/config"
+    "n2n-go/pkg/edge"
     "n2n-go/pkg/logx"
 )
 
-func main() {
-    var dev string
-    var lport int
-    var bind string
-    var snAddr string
-    var community string
-    var key string
-    var cipher string
-    var cmpr string
-    var secure bool
-    var mport int
-    var v int
-    flag.StringVar(&dev, "dev", "tap0", "tap device name")
-    flag.StringVar(&bind, "bind", "0.0.0.0", "bind address")
-    flag.IntVar(&lport, "p", 7655, "local UDP port")
-    flag.StringVar(&snAddr, "l", "127.0.0.1:7654", "supernode host:port")
-    flag.StringVar(&community, "c", "community", "community name")
-    flag.StringVar(&key, "k", "", "encryption key")
-    flag.StringVar(&cipher, "A", "null", "cipher: aes|chacha|null")
-    flag.StringVar(&cmpr, "z", "none", "compression: none|zstd")
-    flag.BoolVar(&secure, "H", false, "secure header mode")
-    flag.IntVar(&mport, "t", 5644, "management UDP port")
-    flag.IntVar(&v, "v", 0, "verbose level")
-    flag.Parse()
-    os.Setenv("N2N_EDGE_TRACE", fmt.Sprintf("%d", v))
-    os.Setenv("N2N_TRACE", fmt.Sprintf("%d", v))
-    logx.InitFromEnv()
-    logx.Printf(1, "edge start dev=%s bind=%s lport=%d sn=%s", dev, bind, lport, snAddr)
+// options are the edge settings from the command line and the optional
+// configuration file.
+type options struct {
+    config        string
+    dev           string
+    tun           bool
+    queues        int
+    offload       bool
+    tcp           bool
+    ws            string
+    wsCA          string
+    lport         int
+    bind          string
+    snAddr        string
+    community     string
+    key           string
+    keyFile       string
+    keyRing       string
+    kdfSpec       string
+    cipher        string
+    cmpr          string
+    secure        bool
+    peerKeys      bool
+    rekey         int
+    identity      string
+    peerTrust     string
+    mport         int
+    httpAddr      string
+    mgmtPass      string
+    mgmtReadPass  string
+    mgmtAudit     string
+    mgmtSock      string
+    mgmtSockMode  uint
+    mgmtSockOwner string
+    v             int
+}
 
-    d, err := tap.Open(dev, 1500)
-    if err != nil {
-        fmt.Println("tap open error:", err)
-        os.Exit(2)
-    }
-    defer d.Close()
-    logx.Printf(1, "tap opened name=%s", dev)
+func newFlags(o *options) *flag.FlagSet {
+    fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+    fs.StringVar(&o.config, "config", "", "configuration file (C n2n -opt=value lines or JSON); may also be given as the first argument")
+    fs.StringVar(&o.dev, "dev", "tap0", "tap device name")
+    fs.BoolVar(&o.tun, "tun", false, "open -dev as a TUN device and carry IP packets only (layer 3)")
+    fs.IntVar(&o.queues, "queues", 1, "device queues and packet workers (multi-queue TAP/TUN, Linux only)")
+    fs.BoolVar(&o.offload, "offload", false, "let the TAP device pass TCP super-frames and checksum offload (virtio-net header, Linux only)")
+    fs.StringVar(&o.bind, "bind", "0.0.0.0", "bind address")
+    fs.BoolVar(&o.tcp, "S2", false, "connect to the supernode over TCP (for networks that block UDP)")
+    fs.StringVar(&o.ws, "ws", "", "connect to the supernode through this ws:// or wss:// URL (for networks that only allow HTTP)")
+    fs.StringVar(&o.wsCA, "ws-ca", "", "PEM certificates to verify a wss:// supernode with instead of the system roots")
+    fs.IntVar(&o.lport, "p", 7655, "local UDP port")
+    fs.StringVar(&o.snAddr, "l", "127.0.0.1:7654", "supernode host:port")
+    fs.StringVar(&o.community, "c", "community", "community name")
+    fs.StringVar(&o.key, "k", "", "encryption key (prefer -k-file, $N2N_KEY or the n2n-key systemd credential)")
+    fs.StringVar(&o.keyFile, "k-file", "", "read encryption key from file (mode 600)")
+    fs.StringVar(&o.keyRing, "keyring", "", "key ring file (overrides -k)")
+    fs.StringVar(&o.kdfSpec, "kdf", "hkdf", "key derivation: hkdf|scrypt[:n=,r=,p=]|argon2id[:t=,m=,p=]")
+    config.Choice(fs, &o.cipher, "A", "null", "cipher: aes|chacha|null", "aes", "chacha", "null")
+    config.Choice(fs, &o.cmpr, "z", "none", "compression: none|zstd", "none", "zstd")
+    fs.BoolVar(&o.secure, "H", false, "secure header mode")
+    fs.BoolVar(&o.peerKeys, "peer-keys", false, "negotiate per-peer session keys (X25519)")
+    fs.IntVar(&o.rekey, "rekey", 600, "session key lifetime in seconds")
+    fs.StringVar(&o.identity, "identity", "", "Ed25519 identity file to sign session key exchanges with (created if missing)")
+    fs.StringVar(&o.peerTrust, "peer-trust", "", "file of \"<mac> <public key>\" lines; only these peers may negotiate session keys")
+    fs.IntVar(&o.mport, "t", 5644, "management UDP port (0 disables it)")
+    fs.StringVar(&o.mgmtSock, "management-socket", "", "management unix socket: unixgram:<path> or unix:<path> (stream)")
+    fs.UintVar(&o.mgmtSockMode, "management-socket-mode", 0600, "management unix socket file mode")
+    fs.StringVar(&o.mgmtSockOwner, "management-socket-owner", "", "management unix socket owner user[:group]")
+    fs.StringVar(&o.httpAddr, "http", "", "REST management listener host:port or unix:<path> (disabled when empty)")
+    fs.StringVar(&o.mgmtPass, "management-password", "", "read-write management password or hash (n2nctl hash-password)")
+    fs.StringVar(&o.mgmtReadPass, "management-password-ro", "", "read-only management password or hash")
+    fs.StringVar(&o.mgmtAudit, "management-audit", "", "append management write requests to this file")
+    fs.IntVar(&o.v, "v", 0, "verbose level")
+    return fs
+}
 
-    udp, err := transport.ListenUDP(bind, lport)
+func (o *options) edge() edge.Options {
+    return edge.Options{Dev: o.dev, TUN: o.tun, Queues: o.queues, Offload: o.offload, TCP: o.tcp, WebSocket: o.ws, WebSocketCA: o.wsCA, Bind: o.bind, Port: o.lport, Supernode: o.snAddr, Community: o.community, Key: o.key, KeyFile: o.keyFile, KeyRing: o.keyRing, KDF: o.kdfSpec, Cipher: o.cipher, Compression: o.cmpr, SecureHeader: o.secure, PeerKeys: o.peerKeys, Rekey: time.Duration(o.rekey) * time.Second, Identity: o.identity, PeerTrust: o.peerTrust,
+        MgmtPort: o.mport, MgmtSocket: o.mgmtSock, MgmtSocketMode: os.FileMode(o.mgmtSockMode), MgmtSocketOwner: o.mgmtSockOwner, HTTPAddr: o.httpAddr, MgmtPassword: o.mgmtPass, MgmtReadPassword: o.mgmtReadPass, MgmtAudit: o.mgmtAudit, Verbose: o.v}
+}
+
+func main() {
+    var o options
+    cfg, _, err := config.Parse(newFlags(&o), os.Args[1:])
     if err != nil {
-        fmt.Println("udp open error:", err)
+        fmt.Println("config error:", err)
         os.Exit(2)
     }
-    defer udp.Close()
-    logx.Printf(1, "udp opened bind=%s lport=%d", bind, lport)
-    pm := portmap.New()
-    pm.TryMap(lport)
-    traceLevel := v
-    mgmt := &management.Server{Password: "", KeepRunning: nil, TraceLevel: &traceLevel}
-    mgmt.HandleFunc = func(method string, params []string) []map[string]any {
-        var rows []map[string]any
-        switch method {
-        case "portmap.status":
-            st := pm.Status()
-            rows = append(rows, map[string]any{"enabled": st.Enabled, "last_ok": st.LastOK.Unix(), "last_err": st.LastErr})
-        case "portmap.refresh":
-            ok := pm.TryMap(lport)
-            st := pm.Status()
-            rows = append(rows, map[string]any{"ok": ok, "enabled": st.Enabled, "last_err": st.LastErr})
-        case "tap.configure":
-            var name, ip, mask string
-            var metric int
-            if len(params) >= 1 { name = params[0] }
-            if len(params) >= 3 { ip = params[1]; mask = params[2] }
-            if len(params) >= 4 { fmt.Sscanf(params[3], "%d", &metric) }
-            tap.ConfigureIPv4(name, ip, mask, metric)
-            rows = append(rows, map[string]any{"ok": true})
-        }
-        return rows
-    }
-    mgmtConn, _ := mgmt.Listen("127.0.0.1", mport)
-    stopCh := make(chan struct{})
-    go mgmt.Handle(mgmtConn, stopCh)
+    os.Setenv("N2N_EDGE_TRACE", fmt.Sprintf("%d", o.v))
+    os.Setenv("N2N_TRACE", fmt.Sprintf("%d", o.v))
+    logx.InitFromEnv()
 
-    raddr, err := net.ResolveUDPAddr("udp", snAddr)
+    e, err := edge.New(o.edge())
+    o.key = ""
     if err != nil {
-        fmt.Println("resolve supernode error:", err)
+        fmt.Println("edge error:", err)
         os.Exit(2)
     }
 
-    regc := wire.Common{TTL: 2, PC: wire.MsgRegisterSuper, Flags: 0}
-    copy(regc.Community[:], []byte(community))
-    reg := wire.RegisterSuper{}
-    reg.Cookie = uint32(rand.Uint32())
-    reg.Sock.Family = 2
-    reg.Sock.Type = 2
-    reg.Sock.Port = uint16(lport)
-    if ip := net.ParseIP(bind).To4(); ip != nil {
-        copy(reg.Sock.AddrV4[:], ip)
-    }
-    reg.DevAddr.Bitlen = 24
-    reg.KeyTime = uint32(time.Now().Unix())
-    b := make([]byte, 256)
-    rl := wire.EncodeRegisterSuper(regc, reg, b)
-    udp.WriteTo(b[:rl], raddr)
-    logx.Printf(1, "register sent cookie=%d community=%s", reg.Cookie, community)
-
-    lastReg := time.Now()
-    regInterval := 20
-
-    tapBuf := make([]byte, 2048)
-    var aead crypto.AEAD
-    var codec compress.Codec = compress.Null{}
-    if cmpr == "zstd" {
-        z, err := compress.NewZstd()
-        if err == nil { codec = z }
-    }
-    var mk []byte
-    if key != "" {
-        mk = make([]byte, 32)
-        salt := []byte(community)
-        rdr := hkdf.New(sha256.New, []byte(key), salt, nil)
-        io.ReadFull(rdr, mk)
-    }
-    if cipher == "aes" && len(mk) == 32 {
-        a, err := crypto.NewAESGCM(mk)
-        if err == nil { aead = a }
-    }
-    if cipher == "chacha" && len(mk) == 32 {
-        a, err := crypto.NewChaCha(mk)
-        if err == nil { aead = a }
-    }
-    var lastSrcMac wire.Mac
-    go func() {
-        for {
-            n, err := d.Read(tapBuf)
-            if err != nil {
-                return
-            }
-            payload := tapBuf[:n]
-            cdata, _ := codec.Compress(nil, payload)
-            pc := wire.Common{TTL: 2, PC: wire.MsgPacket, Flags: 0}
-            copy(pc.Community[:], []byte(community))
-            pkt := wire.Packet{}
-            if n >= 14 {
-                copy(pkt.DstMac[:], payload[0:6])
-                copy(pkt.SrcMac[:], payload[6:12])
-                lastSrcMac = pkt.SrcMac
-            }
-            pkt.Sock = reg.Sock
-            pkt.Transform = wire.TransformNull
-            pkt.Compression = wire.CompressionNone
-            if aead != nil {
-                if cipher == "aes" { pkt.Transform = wire.TransformAES }
-                if cipher == "chacha" { pkt.Transform = wire.TransformChaCha20 }
-            }
-            if cmpr == "zstd" { pkt.Compression = wire.CompressionZstd }
-            if aead != nil && secure {
-                nonce := make([]byte, aead.NonceSize())
-                _, _ = crand.Read(nonce)
-                inner := make([]byte, 2+len(cdata))
-                inner[0] = pkt.Compression
-                inner[1] = pkt.Transform
-                copy(inner[2:], cdata)
-                ad := make([]byte, 64)
-                ai := 0
-                ai += wire.EncodeCommon(pc, ad[ai:])
-                copy(ad[ai:ai+6], pkt.SrcMac[:])
-                ai += 6
-                copy(ad[ai:ai+6], pkt.DstMac[:])
-                ai += 6
-                ai += wire.EncodeSock(pkt.Sock, ad[ai:])
-                ad[ai] = wire.CompressionNone
-                ai++
-                ad[ai] = wire.TransformNull
-                ai++
-                cp := aead.Seal(nil, nonce, inner, ad[:ai])
-                cdata = append(nonce, cp...)
-                pkt.Compression = wire.CompressionNone
-                pkt.Transform = wire.TransformNull
-            } else if aead != nil {
-                nonce := make([]byte, aead.NonceSize())
-                _, _ = crand.Read(nonce)
-                ad := make([]byte, 64)
-                ai := 0
-                ai += wire.EncodeCommon(pc, ad[ai:])
-                copy(ad[ai:ai+6], pkt.SrcMac[:])
-                ai += 6
-                copy(ad[ai:ai+6], pkt.DstMac[:])
-                ai += 6
-                ai += wire.EncodeSock(pkt.Sock, ad[ai:])
-                ad[ai] = pkt.Compression
-                ai++
-                ad[ai] = pkt.Transform
-                ai++
-                cp := aead.Seal(nil, nonce, cdata, ad[:ai])
-                cdata = append(nonce, cp...)
-            }
-            out := make([]byte, 4096)
-            m := wire.EncodePacket(pc, pkt, cdata, out)
-            udp.WriteTo(out[:m], raddr)
-            logx.Printf(2, "packet out src=%02x:%02x:%02x:%02x:%02x:%02x dst=%02x:%02x:%02x:%02x:%02x:%02x bytes=%d", pkt.SrcMac[0], pkt.SrcMac[1], pkt.SrcMac[2], pkt.SrcMac[3], pkt.SrcMac[4], pkt.SrcMac[5], pkt.DstMac[0], pkt.DstMac[1], pkt.DstMac[2], pkt.DstMac[3], pkt.DstMac[4], pkt.DstMac[5], n)
-        }
-    }()
-
-    rbuf := make([]byte, 2048)
-    for {
-        udp.Conn.SetReadDeadline(time.Now().Add(time.Second))
-        n, _, err := udp.Read(rbuf)
-        if err != nil {
-            if ne, ok := err.(net.Error); ok && ne.Timeout() {
-                if time.Since(lastReg) >= time.Duration(regInterval)*time.Second {
-                    reg.Cookie = uint32(rand.Uint32())
-                    rl = wire.EncodeRegisterSuper(regc, reg, b)
-                    udp.WriteTo(b[:rl], raddr)
-                    lastReg = time.Now()
-                }
-                continue
-            }
-            break
+    // reload parses the command line and the configuration file again and
+    // hands the result to the edge, which applies what can change at runtime
+    reload := func() {
+        if cfg == "" {
+            e.Reload(o.edge())
+            return
         }
-        i := 0
-        c, ok := wire.DecodeCommon(rbuf[:n], &i)
-        if !ok {
-            continue
+        var n options
+        if _, _, err := config.Parse(newFlags(&n), os.Args[1:]); err != nil {
+            logx.Printf(0, "config reload failed: %v", err)
+            return
         }
-        if c.PC == wire.MsgRegisterSuperAck {
-            _, aok := wire.DecodeRegisterSuperAck(rbuf[:n], &i)
-            if !aok {
-                continue
-            }
-            lastReg = time.Now()
-            logx.Printf(1, "register ack received")
-            qc := wire.Common{TTL: 2, PC: wire.MsgQueryPeer, Flags: 0}
-            copy(qc.Community[:], []byte(community))
-            q := wire.QueryPeer{}
-            q.AFlags = 0
-            copy(q.SrcMac[:], lastSrcMac[:])
-            q.Sock = reg.Sock
-            out := make([]byte, 128)
-            l := wire.EncodeQueryPeer(qc, q, out)
-            udp.WriteTo(out[:l], raddr)
-            logx.Printf(1, "query peer sent src=%02x:%02x:%02x:%02x:%02x:%02x", lastSrcMac[0], lastSrcMac[1], lastSrcMac[2], lastSrcMac[3], lastSrcMac[4], lastSrcMac[5])
-            continue
-        }
-        if c.PC == wire.MsgPeerInfo {
-            _, pok := wire.DecodePeerInfo(rbuf[:n], &i)
-            if !pok {
+        e.Reload(n.edge())
+        n.key = ""
+        a, b := o, n
+        for _, x := range []*options{&a, &b} { x.v, x.snAddr, x.mgmtPass, x.mgmtReadPass = 0, "", "", "" }
+        if a != b { logx.Printf(0, "config reload: changes to other options need a restart") }
+        o = n
+        logx.Printf(0, "reloaded %s", cfg)
+    }
+    ctx, cancel := context.WithCancelCause(context.Background())
+    sigs := make(chan os.Signal, 1)
+    signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+    go func() {
+        for sig := range sigs {
+            if sig == syscall.SIGHUP {
+                reload()
                 continue
             }
-            logx.Printf(1, "peer info received")
-            continue
-        }
-        if c.PC == wire.MsgPacket {
-            p := make([]byte, 4096)
-            pkt, ok, _ := wire.DecodePacket(rbuf[:n], &i, p)
-            if !ok { continue }
-            if aead == nil && (pkt.Transform == wire.TransformAES || pkt.Transform == wire.TransformChaCha20) { continue }
-            data := pkt.Payload
-            if aead != nil && secure {
-                nonceSize := aead.NonceSize()
-                if len(data) < nonceSize { continue }
-                nonce := data[:nonceSize]
-                body := data[nonceSize:]
-                ad := make([]byte, 64)
-                ai := 0
-                ai += wire.EncodeCommon(c, ad[ai:])
-                copy(ad[ai:ai+6], pkt.SrcMac[:])
-                ai += 6
-                copy(ad[ai:ai+6], pkt.DstMac[:])
-                ai += 6
-                ai += wire.EncodeSock(pkt.Sock, ad[ai:])
-                ad[ai] = wire.CompressionNone
-                ai++
-                ad[ai] = wire.TransformNull
-                ai++
-                dec, err := aead.Open(nil, nonce, body, ad[:ai])
-                if err == nil { data = dec } else { continue }
-                if len(data) < 2 { continue }
-                ccode := data[0]
-                tcode := data[1]
-                data = data[2:]
-                pkt.Transform = tcode
-                pkt.Compression = ccode
-            } else if aead != nil {
-                nonceSize := aead.NonceSize()
-                if len(data) < nonceSize { continue }
-                nonce := data[:nonceSize]
-                body := data[nonceSize:]
-                ad := make([]byte, 64)
-                ai := 0
-                ai += wire.EncodeCommon(c, ad[ai:])
-                copy(ad[ai:ai+6], pkt.SrcMac[:])
-                ai += 6
-                copy(ad[ai:ai+6], pkt.DstMac[:])
-                ai += 6
-                ai += wire.EncodeSock(pkt.Sock, ad[ai:])
-                ad[ai] = pkt.Compression
-                ai++
-                ad[ai] = pkt.Transform
-                ai++
-                dec, err := aead.Open(nil, nonce, body, ad[:ai])
-                if err == nil { data = dec } else { continue }
-            }
-            dec, _ := codec.Decompress(nil, data)
-            if len(dec) > 0 { d.Write(dec) }
-            logx.Printf(2, "packet in bytes=%d", len(dec))
-            continue
+            cancel(errors.New(sig.String()))
         }
+    }()
+    if err := e.Run(ctx); err != nil {
+        fmt.Println("edge error:", err)
+        os.Exit(2)
     }
 }
@@ -0,0 +1,179 @@
+package main
+
+import (
+    "bufio"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "net"
+    "os"
+    "os/signal"
+    "sort"
+    "strconv"
+    "strings"
+    "text/tabwriter"
+    "time"
+    "n2n-go/pkg/management"
+)
+
+func main() {
+    var host string
+    var mport int
+    var pass string
+    var asJSON bool
+    var timeout time.Duration
+    var retries int
+    var since int64
+    var sock string
+    flag.StringVar(&host, "host", "127.0.0.1", "management host")
+    flag.IntVar(&mport, "t", 5644, "management UDP port (edge 5644, supernode 5645)")
+    flag.StringVar(&sock, "socket", "", "management unix socket unixgram:<path> or unix:<path> (overrides -host and -t)")
+    flag.StringVar(&pass, "password", os.Getenv("N2N_MGMT_PASSWORD"), "management password (default $N2N_MGMT_PASSWORD)")
+    flag.BoolVar(&asJSON, "json", false, "print JSON instead of a table")
+    flag.DurationVar(&timeout, "timeout", time.Second, "wait per reply")
+    flag.IntVar(&retries, "retries", 2, "re-send a read request this often when no reply arrives")
+    flag.Int64Var(&since, "since", -1, "subscribe: replay buffered events after this sequence number (-1: none)")
+    flag.Usage = func() {
+        fmt.Fprintln(os.Stderr, "usage: n2nctl [options] <command> [params...]")
+        fmt.Fprintln(os.Stderr, "       n2nctl [options] subscribe <topic>")
+        fmt.Fprintln(os.Stderr, "       n2nctl hash-password < password")
+        fmt.Fprintln(os.Stderr, "run \"n2nctl help\" to list the commands of the daemon")
+        flag.PrintDefaults()
+    }
+    flag.Parse()
+    if flag.NArg() < 1 {
+        flag.Usage()
+        os.Exit(2)
+    }
+    if flag.Arg(0) == "hash-password" {
+        hashPassword()
+        return
+    }
+    addr := net.JoinHostPort(host, strconv.Itoa(mport))
+    if sock != "" { addr = sock }
+    c, err := management.Dial(addr)
+    if err != nil { fail(err) }
+    defer c.Close()
+    c.Password = pass
+    c.Timeout = timeout
+    c.Retries = retries
+
+    method, params := flag.Arg(0), flag.Args()[1:]
+    if method == "subscribe" {
+        topic := "debug"
+        if len(params) > 0 { topic = params[0] }
+        sig := make(chan os.Signal, 1)
+        signal.Notify(sig, os.Interrupt)
+        go func() {
+            <-sig
+            c.Unsubscribe(topic)
+            c.Close()
+        }()
+        err := c.Subscribe(topic, since, func(ev map[string]any) bool {
+            printEvent(ev, asJSON)
+            return true
+        })
+        if err != nil && !errors.Is(err, net.ErrClosed) { fail(err) }
+        return
+    }
+    write, err := isWrite(c, method, params)
+    if err != nil { fail(err) }
+    call := c.Call
+    if write { call = c.Write }
+    rows, err := call(method, params...)
+    if err != nil { fail(err) }
+    if asJSON {
+        if rows == nil { rows = []map[string]any{} }
+        enc := json.NewEncoder(os.Stdout)
+        enc.SetIndent("", "  ")
+        enc.Encode(rows)
+        return
+    }
+    printTable(rows)
+}
+
+// isWrite tells from the help of the daemon whether method must be sent as
+// a write request; verbose is one when it sets the level.
+func isWrite(c *management.Client, method string, params []string) (bool, error) {
+    if method == "verbose" { return len(params) > 0, nil }
+    if method == "help" { return false, nil }
+    rows, err := c.Call("help")
+    if err != nil { return false, err }
+    for _, r := range rows {
+        if r["cmd"] == method { return r["write"] == true, nil }
+    }
+    return false, nil
+}
+
+// hashPassword reads a password from the first line of stdin and prints the
+// spec to pass to -management-password or -management-password-ro.
+func hashPassword() {
+    line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+    if err != nil && line == "" { fail(err) }
+    pw := strings.TrimRight(line, "\r\n")
+    if pw == "" { fail(errors.New("empty password")) }
+    spec, err := management.HashPassword(pw)
+    if err != nil { fail(err) }
+    fmt.Println(spec)
+}
+
+func fail(err error) {
+    fmt.Fprintln(os.Stderr, "n2nctl:", err)
+    os.Exit(1)
+}
+
+// columns returns the union of the row keys, sorted.
+func columns(rows []map[string]any) []string {
+    seen := map[string]bool{}
+    var cols []string
+    for _, r := range rows {
+        for k := range r {
+            if !seen[k] {
+                seen[k] = true
+                cols = append(cols, k)
+            }
+        }
+    }
+    sort.Strings(cols)
+    return cols
+}
+
+func printTable(rows []map[string]any) {
+    if len(rows) == 0 { return }
+    cols := columns(rows)
+    w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+    fmt.Fprintln(w, strings.ToUpper(strings.Join(cols, "\t")))
+    for _, r := range rows {
+        vals := make([]string, len(cols))
+        for i, k := range cols { vals[i] = format(r[k]) }
+        fmt.Fprintln(w, strings.Join(vals, "\t"))
+    }
+    w.Flush()
+}
+
+func printEvent(ev map[string]any, asJSON bool) {
+    if asJSON {
+        b, _ := json.Marshal(ev)
+        fmt.Println(string(b))
+        return
+    }
+    var kv []string
+    for _, k := range columns([]map[string]any{ev}) { kv = append(kv, k+"="+format(ev[k])) }
+    fmt.Println(time.Now().Format("15:04:05"), strings.Join(kv, " "))
+}
+
+func format(v any) string {
+    switch x := v.(type) {
+    case nil:
+        return "-"
+    case string:
+        return x
+    case float64:
+        return strconv.FormatFloat(x, 'f', -1, 64)
+    case bool:
+        return strconv.FormatBool(x)
+    }
+    b, _ := json.Marshal(v)
+    return string(b)
+}
@@ -3,21 +3,105 @@ package main
 import (
     "flag"
     "fmt"
+    "os"
+    "os/signal"
+    "syscall"
+    "n2n-go/pkg/config"
     "n2n-go/pkg/sn"
-    
 )
 
+// options are the supernode settings from the command line and the
+// optional configuration file.
+type options struct {
+    config        string
+    lport         int
+    mport         int
+    workers       int
+    tcp           bool
+    ws            string
+    wsCert        string
+    wsKey         string
+    bind          string
+    communityFile string
+    defaultPool   string
+    rejectConflicts bool
+    httpAddr      string
+    mgmtPass      string
+    mgmtReadPass  string
+    mgmtAudit     string
+    mgmtSock      string
+    mgmtSockMode  uint
+    mgmtSockOwner string
+    stateFile     string
+    successor     string
+    v             int
+}
+
+func newFlags(o *options) *flag.FlagSet {
+    fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+    fs.StringVar(&o.config, "config", "", "configuration file (C n2n -opt=value lines or JSON); may also be given as the first argument")
+    fs.StringVar(&o.bind, "bind", "0.0.0.0", "bind address")
+    fs.IntVar(&o.lport, "p", 7654, "local UDP port")
+    fs.IntVar(&o.mport, "t", 5645, "management UDP port (0 disables it)")
+    fs.IntVar(&o.workers, "workers", 1, "sockets on -p (SO_REUSEPORT) with a packet worker each")
+    fs.BoolVar(&o.tcp, "tcp", false, "also accept edges connecting over TCP on -p (edge -S2)")
+    fs.StringVar(&o.ws, "ws", "", "also accept edges connecting over WebSocket on this host:port (edge -ws)")
+    fs.StringVar(&o.wsCert, "ws-cert", "", "PEM certificate to serve -ws as wss:// with")
+    fs.StringVar(&o.wsKey, "ws-key", "", "PEM private key of -ws-cert")
+    fs.StringVar(&o.mgmtSock, "management-socket", "", "management unix socket: unixgram:<path> or unix:<path> (stream)")
+    fs.UintVar(&o.mgmtSockMode, "management-socket-mode", 0600, "management unix socket file mode")
+    fs.StringVar(&o.mgmtSockOwner, "management-socket-owner", "", "management unix socket owner user[:group]")
+    fs.StringVar(&o.communityFile, "c", "", "allowed communities file (one per line, optional net/bitlen)")
+    fs.StringVar(&o.defaultPool, "a", "10.0.0.0/24", "address pool net/bitlen for communities without one")
+    fs.BoolVar(&o.rejectConflicts, "reject-mac-conflicts", false, "refuse the registration of a MAC held by another community or device instead of replacing it")
+    fs.StringVar(&o.httpAddr, "http", "", "REST management listener host:port or unix:<path> (disabled when empty)")
+    fs.StringVar(&o.mgmtPass, "management-password", "", "read-write management password or hash (n2nctl hash-password)")
+    fs.StringVar(&o.mgmtReadPass, "management-password-ro", "", "read-only management password or hash")
+    fs.StringVar(&o.mgmtAudit, "management-audit", "", "append management write requests to this file")
+    fs.StringVar(&o.stateFile, "state", "", "keep leases and registered edges in this file across restarts")
+    fs.StringVar(&o.successor, "successor", "", "supernode host:port edges are redirected to on shutdown")
+    fs.IntVar(&o.v, "v", 0, "verbose level")
+    return fs
+}
+
+func (o *options) sn() sn.Options {
+    return sn.Options{Bind: o.bind, Port: o.lport, MgmtPort: o.mport, Workers: o.workers, TCP: o.tcp, WebSocket: o.ws, WebSocketCert: o.wsCert, WebSocketKey: o.wsKey, CommunityFile: o.communityFile, DefaultPool: o.defaultPool, RejectConflicts: o.rejectConflicts, HTTPAddr: o.httpAddr, MgmtPassword: o.mgmtPass, MgmtReadPassword: o.mgmtReadPass, MgmtAudit: o.mgmtAudit, MgmtSocket: o.mgmtSock, MgmtSocketMode: os.FileMode(o.mgmtSockMode), MgmtSocketOwner: o.mgmtSockOwner, StateFile: o.stateFile, Successor: o.successor, Verbose: o.v}
+}
+
 func main() {
-    var lport int
-    var mport int
-    var bind string
-    var v int
-    flag.StringVar(&bind, "bind", "0.0.0.0", "bind address")
-    flag.IntVar(&lport, "p", 7654, "local UDP port")
-    flag.IntVar(&mport, "t", 5645, "management UDP port")
-    flag.IntVar(&v, "v", 0, "verbose level")
-    flag.Parse()
-    fmt.Printf("supernode bind %s:%d\n", bind, lport)
+    var o options
+    cfg, _, err := config.Parse(newFlags(&o), os.Args[1:])
+    if err != nil {
+        fmt.Println("config error:", err)
+        os.Exit(2)
+    }
+    fmt.Printf("supernode bind %s:%d\n", o.bind, o.lport)
     fmt.Println("supernode started, press Ctrl+C to stop")
-    sn.Run(bind, lport, mport)
+    stop := make(chan struct{})
+    reload := make(chan sn.Options, 1)
+    sigs := make(chan os.Signal, 1)
+    signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+    go func() {
+        for sig := range sigs {
+            if sig == syscall.SIGHUP {
+                // parse everything again so the command line still wins
+                var n options
+                if _, _, err := config.Parse(newFlags(&n), os.Args[1:]); err != nil {
+                    fmt.Println("reload failed:", err)
+                    continue
+                }
+                if cfg != "" { fmt.Println("supernode reloading", cfg) }
+                reload <- n.sn()
+                continue
+            }
+            fmt.Println("supernode stopping on", sig)
+            close(stop)
+            signal.Stop(sigs)
+            return
+        }
+    }()
+    opts := o.sn()
+    opts.Stop = stop
+    opts.Reload = reload
+    sn.RunOptions(opts)
 }
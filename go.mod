@@ -4,5 +4,5 @@ go 1.22
 
 require (
     golang.org/x/sys v0.23.0
-    golang.org/x/crypto v0.28.0
+    golang.org/x/crypto v0.26.0
 )
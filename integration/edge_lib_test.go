@@ -0,0 +1,58 @@
+package integration
+
+import (
+    "context"
+    "net"
+    "testing"
+    "time"
+    "n2n-go/pkg/edge"
+    "n2n-go/pkg/sn"
+    "n2n-go/pkg/tap"
+    "n2n-go/pkg/transport"
+    "n2n-go/pkg/wire"
+)
+
+func TestEdgeLibraryRun(t *testing.T) {
+    lp, mp := 8778, 5778
+    stop := make(chan struct{})
+    done := make(chan error, 1)
+    go func() { done <- sn.RunOptions(sn.Options{Bind: "127.0.0.1", Port: lp, MgmtPort: mp, Stop: stop}) }()
+    defer func() {
+        close(stop)
+        <-done
+    }()
+    time.Sleep(100 * time.Millisecond)
+
+    // a transport of our own also skips the port mapping attempt
+    conn, err := transport.ListenUDP("127.0.0.1", 7741)
+    if err != nil { t.Fatal(err) }
+    mac := wire.Mac{0x02, 0, 0, 0, 0, 0x41}
+    e, err := edge.New(edge.Options{Device: tap.NewMemory("mem0", 16), Transport: conn, MAC: mac, Bind: "127.0.0.1", Port: 7741, Supernode: "127.0.0.1:8778", Community: "community", Cipher: "null", Compression: "none", KDF: "hkdf"})
+    if err != nil { t.Fatal(err) }
+    ctx, cancel := context.WithCancel(context.Background())
+    ran := make(chan error, 1)
+    go func() { ran <- e.Run(ctx) }()
+
+    deadline := time.Now().Add(2 * time.Second)
+    for e.Status().LastSuper.IsZero() {
+        if time.Now().After(deadline) { t.Fatal("no register ack") }
+        time.Sleep(20 * time.Millisecond)
+    }
+    st := e.Status()
+    if st.MAC != mac || st.Community != "community" || st.Supernode != "127.0.0.1:8778" { t.Fatalf("status %+v", st) }
+
+    mc, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: mp})
+    if err != nil { t.Fatal(err) }
+    defer mc.Close()
+    if rows := mgmtRows(t, mc, "r 1 edges"); len(rows) != 1 || rows[0]["macaddr"] != "02:00:00:00:00:41" { t.Fatalf("edges %v", rows) }
+
+    cancel()
+    select {
+    case err := <-ran:
+        if err != nil { t.Fatal(err) }
+    case <-time.After(3 * time.Second):
+        t.Fatal("Run did not return")
+    }
+    time.Sleep(100 * time.Millisecond)
+    if rows := mgmtRows(t, mc, "r 2 edges"); len(rows) != 0 { t.Fatalf("edge still registered: %v", rows) }
+}
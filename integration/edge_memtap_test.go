@@ -0,0 +1,180 @@
+package integration
+
+import (
+    "bytes"
+    "context"
+    "encoding/binary"
+    "fmt"
+    "testing"
+    "time"
+    "n2n-go/pkg/edge"
+    "n2n-go/pkg/sn"
+    "n2n-go/pkg/tap"
+    "n2n-go/pkg/transport"
+    "n2n-go/pkg/wire"
+)
+
+// memEdge runs an edge on an in-memory TAP until the test ends, bound to
+// o.Bind (default 127.0.0.1).
+func memEdge(t *testing.T, o edge.Options, port int) (*edge.Edge, *tap.Memory) {
+    t.Helper()
+    dev := tap.NewMemory(fmt.Sprintf("mem%d", port), 16)
+    if o.Bind == "" { o.Bind = "127.0.0.1" }
+    var conn edge.Transport
+    switch {
+    case o.TCP:
+        conn = transport.NewTCPClient()
+    case o.WebSocket != "":
+        // edge.New connects it
+    default:
+        udp, err := transport.ListenUDP(o.Bind, port)
+        if err != nil { t.Fatal(err) }
+        conn = udp
+    }
+    o.Device, o.Transport, o.Port = dev, conn, port
+    e, err := edge.New(o)
+    if err != nil { t.Fatal(err) }
+    ctx, cancel := context.WithCancel(context.Background())
+    done := make(chan error, 1)
+    go func() { done <- e.Run(ctx) }()
+    t.Cleanup(func() {
+        cancel()
+        <-done
+    })
+    deadline := time.Now().Add(2 * time.Second)
+    for e.Status().LastSuper.IsZero() {
+        if time.Now().After(deadline) { t.Fatal("no register ack") }
+        time.Sleep(10 * time.Millisecond)
+    }
+    return e, dev
+}
+
+func expectFrame(t *testing.T, dev *tap.Memory, want []byte) {
+    t.Helper()
+    select {
+    case got := <-dev.Out:
+        if !bytes.Equal(got, want) { t.Fatalf("frame mismatch\ngot  %x\nwant %x", got, want) }
+    case <-time.After(2 * time.Second):
+        t.Fatalf("no frame on %s", dev.Name)
+    }
+}
+
+func ethFrame(dst, src wire.Mac, typ uint16, payload []byte) []byte {
+    f := make([]byte, 14, 14+len(payload))
+    copy(f[0:6], dst[:])
+    copy(f[6:12], src[:])
+    binary.BigEndian.PutUint16(f[12:14], typ)
+    return append(f, payload...)
+}
+
+func arpFrame(op uint16, dst, sha wire.Mac, spa, tpa [4]byte) []byte {
+    p := make([]byte, 28)
+    binary.BigEndian.PutUint16(p[0:], 1)
+    binary.BigEndian.PutUint16(p[2:], 0x0800)
+    p[4], p[5] = 6, 4
+    binary.BigEndian.PutUint16(p[6:], op)
+    copy(p[8:14], sha[:])
+    copy(p[14:18], spa[:])
+    if op == 2 { copy(p[18:24], dst[:]) }
+    copy(p[24:28], tpa[:])
+    return ethFrame(dst, sha, 0x0806, p)
+}
+
+func checksum(b []byte) uint16 {
+    var s uint32
+    for i := 0; i+1 < len(b); i += 2 { s += uint32(binary.BigEndian.Uint16(b[i:])) }
+    if len(b)%2 == 1 { s += uint32(b[len(b)-1]) << 8 }
+    for s > 0xffff { s = s>>16 + s&0xffff }
+    return ^uint16(s)
+}
+
+// pingFrame is an ICMP echo request (typ 8) or reply (typ 0) with a 56 byte
+// payload, like ping sends.
+func pingFrame(typ uint8, dst, src wire.Mac, sip, dip [4]byte, seq uint16) []byte {
+    icmp := make([]byte, 8+56)
+    icmp[0] = typ
+    binary.BigEndian.PutUint16(icmp[4:], 0x4242)
+    binary.BigEndian.PutUint16(icmp[6:], seq)
+    for i := 8; i < len(icmp); i++ { icmp[i] = byte(i) }
+    binary.BigEndian.PutUint16(icmp[2:], checksum(icmp))
+    ip := make([]byte, 20)
+    ip[0] = 0x45
+    binary.BigEndian.PutUint16(ip[2:], uint16(20+len(icmp)))
+    ip[8], ip[9] = 64, 1
+    copy(ip[12:16], sip[:])
+    copy(ip[16:20], dip[:])
+    binary.BigEndian.PutUint16(ip[10:], checksum(ip))
+    return ethFrame(dst, src, 0x0800, append(ip, icmp...))
+}
+
+func TestEdgeMemoryTapEndToEnd(t *testing.T) {
+    lp := 8779
+    stop := make(chan struct{})
+    done := make(chan error, 1)
+    go func() { done <- sn.RunOptions(sn.Options{Bind: "127.0.0.1", Port: lp, MgmtPort: 5779, Stop: stop}) }()
+    defer func() {
+        close(stop)
+        <-done
+    }()
+    time.Sleep(100 * time.Millisecond)
+
+    for i, c := range []struct {
+        name string
+        o    edge.Options
+    }{
+        {"null", edge.Options{Cipher: "null"}},
+        {"aes", edge.Options{Cipher: "aes", Key: "secret"}},
+        {"chacha-secure-header", edge.Options{Cipher: "chacha", Key: "secret", SecureHeader: true}},
+        {"zstd", edge.Options{Cipher: "null", Compression: "zstd"}},
+        {"aes-zstd", edge.Options{Cipher: "aes", Key: "secret", Compression: "zstd"}},
+        {"peer-keys", edge.Options{Cipher: "aes", Key: "secret", PeerKeys: true, Rekey: time.Minute}},
+    } {
+        t.Run(c.name, func(t *testing.T) {
+            o := c.o
+            o.Supernode = fmt.Sprintf("127.0.0.1:%d", lp)
+            o.Community = "mem-" + c.name
+            if o.Compression == "" { o.Compression = "none" }
+            macA, macB := wire.Mac{0x02, 0, 0, 0, byte(i), 0x0a}, wire.Mac{0x02, 0, 0, 0, byte(i), 0x0b}
+            ipA, ipB := [4]byte{10, 42, byte(i), 1}, [4]byte{10, 42, byte(i), 2}
+            oa, ob := o, o
+            oa.MAC, ob.MAC = macA, macB
+            a, devA := memEdge(t, oa, 7800+2*i)
+            b, devB := memEdge(t, ob, 7801+2*i)
+
+            // ARP: the request is broadcast, the reply comes back unicast
+            req := arpFrame(1, wire.Mac{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, macA, ipA, ipB)
+            devA.In <- req
+            expectFrame(t, devB, req)
+            rep := arpFrame(2, macA, macB, ipB, ipA)
+            devB.In <- rep
+            expectFrame(t, devA, rep)
+
+            for seq := uint16(1); seq <= 3; seq++ {
+                ping := pingFrame(8, macB, macA, ipA, ipB, seq)
+                devA.In <- ping
+                expectFrame(t, devB, ping)
+                pong := pingFrame(0, macA, macB, ipB, ipA, seq)
+                devB.In <- pong
+                expectFrame(t, devA, pong)
+            }
+
+            if st := b.Status(); st.SuperRx+st.SuperBcastRx != 4 { t.Fatalf("b received %+v", st) }
+            if st := a.Status(); o.Cipher != "null" && st.TransopTx != 4 { t.Fatalf("a did not encrypt: %+v", st) }
+            if ps := b.Peers(); len(ps) != 1 || ps[0].MAC != macA { t.Fatalf("b peers %+v", ps) }
+        })
+    }
+    t.Run("wrong-key", func(t *testing.T) {
+        o := edge.Options{Supernode: fmt.Sprintf("127.0.0.1:%d", lp), Community: "mem-wrong-key", Cipher: "aes", Compression: "none"}
+        oa, ob := o, o
+        oa.MAC, oa.Key = wire.Mac{0x02, 0, 0, 0, 0x10, 0x0a}, "secret"
+        ob.MAC, ob.Key = wire.Mac{0x02, 0, 0, 0, 0x10, 0x0b}, "other"
+        _, devA := memEdge(t, oa, 7830)
+        _, devB := memEdge(t, ob, 7831)
+        devA.In <- pingFrame(8, ob.MAC, oa.MAC, [4]byte{10, 42, 16, 1}, [4]byte{10, 42, 16, 2}, 1)
+        select {
+        case f := <-devB.Out:
+            t.Fatalf("frame decrypted with the wrong key: %x", f)
+        case <-time.After(300 * time.Millisecond):
+        }
+    })
+}
@@ -0,0 +1,165 @@
+package integration
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+    "n2n-go/pkg/tap"
+)
+
+const (
+    // offloadMSS is the segment size of the super-frames, a 1500 byte MTU
+    // less the IPv4 and TCP headers and the n2n overhead
+    offloadMSS = 1400
+    tcpHdrEnd  = 14 + 20 + 20
+)
+
+// tcpSuperFrame is a TCPv4 frame from queueMacA to queueMacB with n bytes
+// of payload behind the virtio-net header the kernel puts in front of a
+// TSO frame: the checksum field holds the pseudo header sum.
+func tcpSuperFrame(n int, seq uint32) []byte {
+    f := make([]byte, tap.VnetHdrLen+tcpHdrEnd+n)
+    tap.VnetHdr{Flags: tap.VnetNeedsCsum, GSOType: tap.GSOTCPv4, HdrLen: tcpHdrEnd, GSOSize: offloadMSS, CsumStart: 14 + 20, CsumOffset: 16}.Encode(f)
+    e := f[tap.VnetHdrLen:]
+    copy(e[0:6], queueMacB[:])
+    copy(e[6:12], queueMacA[:])
+    binary.BigEndian.PutUint16(e[12:], 0x0800)
+    ip := e[14:]
+    ip[0], ip[8], ip[9] = 0x45, 64, 6
+    binary.BigEndian.PutUint16(ip[2:], uint16(20+20+n))
+    copy(ip[12:20], []byte{10, 0, 0, 1, 10, 0, 0, 2})
+    binary.BigEndian.PutUint16(ip[10:], checksum(ip[:20]))
+    tcp := ip[20:]
+    binary.BigEndian.PutUint16(tcp[0:], 40000)
+    binary.BigEndian.PutUint16(tcp[2:], 5201)
+    binary.BigEndian.PutUint32(tcp[4:], seq)
+    binary.BigEndian.PutUint32(tcp[8:], 1)
+    tcp[12], tcp[13] = 5<<4, 0x10
+    binary.BigEndian.PutUint16(tcp[14:], 502)
+    for i := range tcp[20:] { tcp[20+i] = byte(i * 7) }
+    var ps [12]byte
+    copy(ps[:8], ip[12:20])
+    ps[9] = 6
+    binary.BigEndian.PutUint16(ps[10:], uint16(20+n))
+    binary.BigEndian.PutUint16(tcp[16:], ^checksum(ps[:]))
+    return f
+}
+
+func TestEdgeOffload(t *testing.T) {
+    o := pairOptions
+    o.Offload = true
+    a, b := queuePair(t, 1, 7870, 7871, o)
+    super := tcpSuperFrame(10*offloadMSS, 1000)
+    a[0].In <- super
+
+    // the ten segments cross the wire one by one and come out merged again
+    var payload []byte
+    merged := false
+    deadline := time.After(2 * time.Second)
+    for len(payload) < 10*offloadMSS {
+        select {
+        case f := <-b[0].Out:
+            h, ok := tap.DecodeVnetHdr(f)
+            if !ok || len(f) < tap.VnetHdrLen+tcpHdrEnd { t.Fatalf("frame %x", f) }
+            if h.GSOType == tap.GSOTCPv4 {
+                merged = true
+                if h.GSOSize != offloadMSS || h.HdrLen != tcpHdrEnd { t.Fatalf("header %+v", h) }
+            }
+            if seq := binary.BigEndian.Uint32(f[tap.VnetHdrLen+14+20+4:]); seq != 1000+uint32(len(payload)) { t.Fatalf("seq %d after %d bytes", seq, len(payload)) }
+            payload = append(payload, f[tap.VnetHdrLen+tcpHdrEnd:]...)
+        case <-deadline:
+            t.Fatalf("%d bytes received", len(payload))
+        }
+    }
+    if !bytes.Equal(payload, super[tap.VnetHdrLen+tcpHdrEnd:]) { t.Fatal("payload differs") }
+    if !merged { t.Fatal("no segments merged") }
+
+    // frames other than TCP pass unchanged behind an empty header
+    ping := pingFrame(8, queueMacB, queueMacA, [4]byte{10, 0, 0, 1}, [4]byte{10, 0, 0, 2}, 1)
+    a[0].In <- append(make([]byte, tap.VnetHdrLen), ping...)
+    expectFrame(t, b[0], append(make([]byte, tap.VnetHdrLen), ping...))
+}
+
+// BenchmarkEdgeOffload measures the TCP payload one edge gets through to
+// another, fed as MTU sized segments or as 63000 byte super-frames with
+// -offload. An op is one super-frame of payload delivered.
+func BenchmarkEdgeOffload(b *testing.B) {
+    const perOp = 45 * offloadMSS
+    for i, offload := range []bool{false, true} {
+        b.Run(fmt.Sprintf("offload=%v", offload), func(b *testing.B) {
+            o := pairOptions
+            o.Offload = offload
+            src, dst := queuePair(b, 1, 7872+2*i, 7873+2*i, o)
+            super := tcpSuperFrame(perOp, 1)
+            in := [][]byte{super}
+            hdr := tap.VnetHdrLen + tcpHdrEnd
+            if !offload {
+                in, hdr = nil, tcpHdrEnd
+                h, _ := tap.DecodeVnetHdr(super)
+                tap.Segment(h, super[tap.VnetHdrLen:], make([]byte, 2048), func(f []byte) { in = append(in, append([]byte(nil), f...)) })
+            }
+            var got atomic.Int64
+            stop := make(chan struct{})
+            var wg sync.WaitGroup
+            wg.Add(2)
+            go func() {
+                defer wg.Done()
+                for {
+                    select {
+                    case f := <-dst[0].Out:
+                        got.Add(int64(len(f) - hdr))
+                    case <-stop:
+                        return
+                    }
+                }
+            }()
+            // like BenchmarkEdgeQueues, a window of payload is kept in
+            // flight and what gets lost anyway is written off
+            const window = 64 * offloadMSS
+            var sent, lost atomic.Int64
+            b.SetBytes(perOp)
+            b.ResetTimer()
+            go func() {
+                defer wg.Done()
+                for {
+                    for _, f := range in {
+                        for sent.Load()-got.Load()-lost.Load() >= window {
+                            select {
+                            case <-stop:
+                                return
+                            case <-time.After(50 * time.Microsecond):
+                            }
+                        }
+                        select {
+                        case src[0].In <- f:
+                            sent.Add(int64(len(f) - hdr))
+                        case <-stop:
+                            return
+                        }
+                    }
+                }
+            }()
+            want := int64(b.N) * perOp
+            deadline := time.Now().Add(time.Minute)
+            last, idle := got.Load(), time.Now()
+            for last < want {
+                if time.Now().After(deadline) { b.Fatalf("%d of %d bytes delivered", last, want) }
+                time.Sleep(100 * time.Microsecond)
+                if c := got.Load(); c != last {
+                    last, idle = c, time.Now()
+                } else if time.Since(idle) > 20*time.Millisecond {
+                    lost.Store(sent.Load() - c)
+                    idle = time.Now()
+                }
+            }
+            b.StopTimer()
+            close(stop)
+            wg.Wait()
+            b.ReportMetric(float64(got.Load())/float64(sent.Load())*100, "%delivered")
+        })
+    }
+}
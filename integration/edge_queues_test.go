@@ -0,0 +1,149 @@
+package integration
+
+import (
+    "context"
+    "fmt"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+    "n2n-go/pkg/edge"
+    "n2n-go/pkg/tap"
+    "n2n-go/pkg/transport"
+    "n2n-go/pkg/wire"
+)
+
+var (
+    queueMacA   = wire.Mac{0x02, 0, 0, 0, 0x44, 0x0a}
+    queueMacB   = wire.Mac{0x02, 0, 0, 0, 0x44, 0x0b}
+    pairOptions = edge.Options{Cipher: "aes", Key: "secret", Compression: "none"}
+)
+
+// queuePair connects two edges with n device queues each directly: each
+// uses the other as its supernode, so the packets skip the supernode and
+// only the edge workers are measured. o holds the cipher and the other
+// options both edges share.
+func queuePair(tb testing.TB, n, portA, portB int, o edge.Options) ([]*tap.Memory, []*tap.Memory) {
+    tb.Helper()
+    run := func(port, peer int, mac wire.Mac) []*tap.Memory {
+        var mems []*tap.Memory
+        var devs []edge.Device
+        for i := 0; i < n; i++ {
+            m := tap.NewMemory(fmt.Sprintf("q%d.%d", port, i), 1024)
+            mems = append(mems, m)
+            devs = append(devs, m)
+        }
+        conn, err := transport.ListenUDP("127.0.0.1", port)
+        if err != nil { tb.Fatal(err) }
+        o := o
+        o.Devices, o.Transport, o.MAC, o.Bind, o.Port, o.Supernode, o.Community = devs, conn, mac, "127.0.0.1", port, fmt.Sprintf("127.0.0.1:%d", peer), "queues"
+        e, err := edge.New(o)
+        if err != nil { tb.Fatal(err) }
+        ctx, cancel := context.WithCancel(context.Background())
+        done := make(chan error, 1)
+        go func() { done <- e.Run(ctx) }()
+        tb.Cleanup(func() {
+            cancel()
+            <-done
+        })
+        return mems
+    }
+    return run(portA, portB, queueMacA), run(portB, portA, queueMacB)
+}
+
+func TestEdgeMultiQueue(t *testing.T) {
+    a, b := queuePair(t, 4, 7850, 7851, pairOptions)
+    // every queue of a sends, the frames come out of the queues of b
+    for i, q := range a {
+        q.In <- ethFrame(queueMacB, queueMacA, 0x88b5, []byte{byte(i)})
+    }
+    seen := map[byte]bool{}
+    deadline := time.After(2 * time.Second)
+    for len(seen) < len(a) {
+        for _, q := range b {
+            select {
+            case f := <-q.Out:
+                seen[f[14]] = true
+            case <-deadline:
+                t.Fatalf("frames from queues %v only", seen)
+            default:
+            }
+        }
+        time.Sleep(time.Millisecond)
+    }
+}
+
+// BenchmarkEdgeQueues measures the encrypted 1400 byte frames per second
+// one edge gets through to another; run it with -cpu 1,2,4,8 to see the
+// workers scale with cores.
+func BenchmarkEdgeQueues(b *testing.B) {
+    for i, n := range []int{1, 2, 4, 8} {
+        b.Run(fmt.Sprintf("queues=%d", n), func(b *testing.B) {
+            src, dst := queuePair(b, n, 7860+2*i, 7861+2*i, pairOptions)
+            frame := ethFrame(queueMacB, queueMacA, 0x88b5, make([]byte, 1400-14))
+            var got atomic.Int64
+            stop := make(chan struct{})
+            var drained sync.WaitGroup
+            for _, q := range dst {
+                drained.Add(1)
+                go func(q *tap.Memory) {
+                    defer drained.Done()
+                    for {
+                        select {
+                        case <-q.Out:
+                            got.Add(1)
+                        case <-stop:
+                            return
+                        }
+                    }
+                }(q)
+            }
+            // an op is a frame delivered to the other edge. The senders keep
+            // a window of frames in flight so that the socket buffer does
+            // not overflow; frames lost anyway are written off when nothing
+            // arrives for a while.
+            const window = 64
+            var sent, lost atomic.Int64
+            b.SetBytes(int64(len(frame)))
+            b.ResetTimer()
+            for _, q := range src {
+                drained.Add(1)
+                go func(q *tap.Memory) {
+                    defer drained.Done()
+                    for {
+                        if sent.Load()-got.Load()-lost.Load() >= window {
+                            select {
+                            case <-stop:
+                                return
+                            case <-time.After(50 * time.Microsecond):
+                            }
+                            continue
+                        }
+                        select {
+                        case q.In <- frame:
+                            sent.Add(1)
+                        case <-stop:
+                            return
+                        }
+                    }
+                }(q)
+            }
+            deadline := time.Now().Add(time.Minute)
+            last, idle := got.Load(), time.Now()
+            for last < int64(b.N) {
+                if time.Now().After(deadline) { b.Fatalf("%d of %d frames delivered", last, b.N) }
+                time.Sleep(100 * time.Microsecond)
+                if c := got.Load(); c != last {
+                    last, idle = c, time.Now()
+                } else if time.Since(idle) > 20*time.Millisecond {
+                    lost.Store(sent.Load() - c)
+                    idle = time.Now()
+                }
+            }
+            b.StopTimer()
+            close(stop)
+            drained.Wait()
+            b.ReportMetric(float64(got.Load())/float64(sent.Load())*100, "%delivered")
+        })
+    }
+}
@@ -0,0 +1,95 @@
+package integration
+
+import (
+    "context"
+    "encoding/binary"
+    "net"
+    "net/http"
+    "testing"
+    "time"
+    "n2n-go/pkg/edge"
+    "n2n-go/pkg/sn"
+    "n2n-go/pkg/tap"
+    "n2n-go/pkg/transport"
+    "n2n-go/pkg/wire"
+)
+
+// natpmpGateway answers NAT-PMP UDP mapping requests and passes on the
+// lifetime of each, 0 being a delete.
+func natpmpGateway(t *testing.T) (string, chan uint32) {
+    t.Helper()
+    c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+    if err != nil { t.Fatal(err) }
+    t.Cleanup(func() { c.Close() })
+    reqs := make(chan uint32, 8)
+    go func() {
+        b := make([]byte, 64)
+        for {
+            n, from, err := c.ReadFromUDP(b)
+            if err != nil { return }
+            if n < 12 || b[1] != 2 { continue }
+            resp := make([]byte, 16)
+            resp[1] = 130
+            copy(resp[8:12], b[4:8])
+            copy(resp[12:16], b[8:12])
+            c.WriteToUDP(resp, from)
+            reqs <- binary.BigEndian.Uint32(b[8:12])
+        }
+    }()
+    return c.LocalAddr().String(), reqs
+}
+
+func TestEdgeShutdownLifecycle(t *testing.T) {
+    stop := make(chan struct{})
+    snDone := make(chan error, 1)
+    go func() { snDone <- sn.RunOptions(sn.Options{Bind: "127.0.0.1", Port: 8788, MgmtPort: 5788, Stop: stop}) }()
+    defer func() {
+        close(stop)
+        <-snDone
+    }()
+    time.Sleep(100 * time.Millisecond)
+    sub := subscriber(t, "127.0.0.1:5788", "s 1 subscribe peer")
+    gw, reqs := natpmpGateway(t)
+
+    mac := wire.Mac{0x02, 0, 0, 0, 0x38, 1}
+    udp, err := transport.ListenUDP("127.0.0.1", 7888)
+    if err != nil { t.Fatal(err) }
+    e, err := edge.New(edge.Options{Device: tap.NewMemory("mem7888", 16), Transport: udp, PortmapGateways: []string{gw}, Bind: "127.0.0.1", Port: 7888, Supernode: "127.0.0.1:8788", Community: "community", Cipher: "null", Compression: "none", MAC: mac, HTTPAddr: "127.0.0.1:5789"})
+    if err != nil { t.Fatal(err) }
+    done := make(chan error, 1)
+    go func() { done <- e.Run(context.Background()) }()
+    defer func() {
+        select {
+        case <-done:
+        case <-time.After(3 * time.Second):
+            t.Fatal("edge still running")
+        }
+    }()
+
+    select {
+    case l := <-reqs:
+        if l == 0 { t.Fatal("mapping requested with lifetime 0") }
+    case <-time.After(2 * time.Second):
+        t.Fatal("no NAT-PMP mapping request")
+    }
+    if ev := nextEvent(sub, 2*time.Second); ev == nil || ev["event"] != "register" || ev["macaddr"] != "02:00:00:00:38:01" { t.Fatalf("want register event, got %v", ev) }
+    if code, v := httpDo(t, "GET", "http://127.0.0.1:5789/portmap", "", ""); code != http.StatusOK || v.([]any)[0].(map[string]any)["method"] != "natpmp" { t.Fatalf("portmap %d %v", code, v) }
+
+    // the stop request itself is answered before the listeners close
+    if code, v := httpDo(t, "POST", "http://127.0.0.1:5789/stop", "", ""); code != http.StatusOK || v.([]any)[0].(map[string]any)["keep_running"] != false { t.Fatalf("stop %d %v", code, v) }
+    if ev := nextEvent(sub, 2*time.Second); ev == nil || ev["event"] != "unregister" || ev["macaddr"] != "02:00:00:00:38:01" { t.Fatalf("want unregister event, got %v", ev) }
+    select {
+    case l := <-reqs:
+        if l != 0 { t.Fatalf("unmap lifetime %d", l) }
+    case <-time.After(2 * time.Second):
+        t.Fatal("mapping not removed through NAT-PMP")
+    }
+    select {
+    case err := <-done:
+        if err != nil { t.Fatal(err) }
+        done <- nil
+    case <-time.After(3 * time.Second):
+        t.Fatal("edge did not stop")
+    }
+    if _, err := http.Get("http://127.0.0.1:5789/portmap"); err == nil { t.Fatal("management still served after shutdown") }
+}
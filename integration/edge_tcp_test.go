@@ -0,0 +1,77 @@
+package integration
+
+import (
+    "encoding/json"
+    "fmt"
+    "net"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+    "n2n-go/pkg/edge"
+    "n2n-go/pkg/sn"
+    "n2n-go/pkg/wire"
+)
+
+func TestEdgeTCP(t *testing.T) {
+    lp, mp := 8790, 5790
+    stateFile := filepath.Join(t.TempDir(), "sn.state")
+    run := func() (chan struct{}, chan error) {
+        stop := make(chan struct{})
+        done := make(chan error, 1)
+        go func() { done <- sn.RunOptions(sn.Options{Bind: "127.0.0.1", Port: lp, MgmtPort: mp, TCP: true, StateFile: stateFile, Stop: stop}) }()
+        time.Sleep(100 * time.Millisecond)
+        return stop, done
+    }
+    stop, done := run()
+    defer func() {
+        close(stop)
+        <-done
+    }()
+
+    o := edge.Options{Supernode: fmt.Sprintf("127.0.0.1:%d", lp), Community: "tcp", Cipher: "aes", Key: "secret", Compression: "none"}
+    macA := wire.Mac{0x02, 0, 0, 0, 0x48, 0x0a}
+    macB := wire.Mac{0x02, 0, 0, 0, 0x48, 0x0b}
+    to := o
+    to.TCP, to.MAC = true, macA
+    _, devA := memEdge(t, to, 7880)
+    o.MAC = macB
+    _, devB := memEdge(t, o, 7881)
+
+    mc, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: mp})
+    if err != nil { t.Fatal(err) }
+    defer mc.Close()
+    protos := map[any]any{}
+    for _, r := range mgmtRows(t, mc, "r 1 edges") { protos[r["macaddr"]] = r["proto"] }
+    if protos["02:00:00:00:48:0a"] != "TCP" || protos["02:00:00:00:48:0b"] != "UDP" { t.Fatalf("edges %v", protos) }
+
+    // the supernode relays between the TCP and the UDP edge
+    ping := pingFrame(8, macB, macA, [4]byte{10, 0, 0, 1}, [4]byte{10, 0, 0, 2}, 1)
+    devA.In <- ping
+    expectFrame(t, devB, ping)
+    pong := pingFrame(0, macA, macB, [4]byte{10, 0, 0, 2}, [4]byte{10, 0, 0, 1}, 1)
+    devB.In <- pong
+    expectFrame(t, devA, pong)
+
+    // a restarted supernode: the edge connects again and registers
+    close(stop)
+    <-done
+    // the TCP edge keeps its lease but is not restored as a peer
+    var st struct {
+        Leases []struct{ Mac string } `json:"leases"`
+        Peers  []struct{ Mac string } `json:"peers"`
+    }
+    b, err := os.ReadFile(stateFile)
+    if err != nil { t.Fatal(err) }
+    if err := json.Unmarshal(b, &st); err != nil { t.Fatal(err) }
+    if len(st.Leases) != 2 || len(st.Peers) != 1 || st.Peers[0].Mac != "02:00:00:00:48:0b" { t.Fatalf("state %s", b) }
+    stop, done = run()
+    deadline := time.Now().Add(5 * time.Second)
+    for {
+        if rows := mgmtRows(t, mc, "r 2 edges"); len(rows) == 2 { break }
+        if time.Now().After(deadline) { t.Fatalf("edges did not register again: %v", mgmtRows(t, mc, "r 3 edges")) }
+        time.Sleep(50 * time.Millisecond)
+    }
+    devA.In <- ping
+    expectFrame(t, devB, ping)
+}
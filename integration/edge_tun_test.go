@@ -0,0 +1,98 @@
+package integration
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "testing"
+    "time"
+    "n2n-go/pkg/edge"
+    "n2n-go/pkg/sn"
+    "n2n-go/pkg/tap"
+    "n2n-go/pkg/wire"
+)
+
+func devAddr(e *edge.Edge) [4]byte {
+    var a [4]byte
+    binary.BigEndian.PutUint32(a[:], e.Status().DevAddr.NetAddr)
+    return a
+}
+
+func expectNothing(t *testing.T, dev *tap.Memory) {
+    t.Helper()
+    select {
+    case f := <-dev.Out:
+        t.Fatalf("unexpected frame on %s: %x", dev.Name, f)
+    case <-time.After(200 * time.Millisecond):
+    }
+}
+
+func TestEdgeTunMode(t *testing.T) {
+    lp := 8780
+    stop := make(chan struct{})
+    done := make(chan error, 1)
+    go func() { done <- sn.RunOptions(sn.Options{Bind: "127.0.0.1", Port: lp, MgmtPort: 5780, Stop: stop}) }()
+    defer func() {
+        close(stop)
+        <-done
+    }()
+    time.Sleep(100 * time.Millisecond)
+    base := edge.Options{Supernode: fmt.Sprintf("127.0.0.1:%d", lp), Cipher: "aes", Key: "secret", Compression: "none"}
+
+    t.Run("tun-to-tun", func(t *testing.T) {
+        o := base
+        o.Community, o.TUN = "tun", true
+        a, devA := memEdge(t, o, 7840)
+        b, devB := memEdge(t, o, 7841)
+        ipA, ipB := devAddr(a), devAddr(b)
+        if ipA == ipB || ipA[0] != 10 { t.Fatalf("leases %v %v", ipA, ipB) }
+        if a.Status().MAC[0] != 0x02 { t.Fatalf("mac %v", a.Status().MAC) }
+
+        // the supernode resolves the lease, nothing is broadcast
+        ping := pingFrame(8, wire.Mac{}, wire.Mac{}, ipA, ipB, 1)[14:]
+        devA.In <- ping
+        expectFrame(t, devB, ping)
+        // b learned a from the request
+        pong := pingFrame(0, wire.Mac{}, wire.Mac{}, ipB, ipA, 1)[14:]
+        devB.In <- pong
+        expectFrame(t, devA, pong)
+        if st := b.Status(); st.SuperBcastRx != 0 || st.SuperRx != 1 { t.Fatalf("b received %+v", st) }
+    })
+
+    t.Run("tun-to-tap", func(t *testing.T) {
+        o := base
+        o.Community = "mixed"
+        to := o
+        to.TUN = true
+        a, devA := memEdge(t, to, 7842)
+        macC := wire.Mac{0x02, 0, 0, 0, 0x43, 0x0c}
+        o.MAC = macC
+        _, devC := memEdge(t, o, 7843)
+        ipA := devAddr(a)
+        macA := a.Status().MAC
+
+        // c is a plain TAP host with a static address the supernode does
+        // not know: a falls back to ARP
+        ipC := [4]byte{10, 0, 0, 200}
+        ping := pingFrame(8, macC, macA, ipA, ipC, 1)
+        devA.In <- ping[14:]
+        select {
+        case f := <-devC.Out:
+            want := arpFrame(1, wire.Mac{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, macA, ipA, ipC)
+            if !bytes.Equal(f, want) { t.Fatalf("arp request\ngot  %x\nwant %x", f, want) }
+        case <-time.After(2 * time.Second):
+            t.Fatal("no arp request")
+        }
+        devC.In <- arpFrame(2, macA, macC, ipC, ipA)
+        expectFrame(t, devC, ping)
+
+        // c resolves a with ARP and gets the reply from the edge
+        devC.In <- arpFrame(1, wire.Mac{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, macC, ipC, ipA)
+        expectFrame(t, devC, arpFrame(2, macC, macA, ipA, ipC))
+        pong := pingFrame(0, macA, macC, ipC, ipA, 1)
+        devC.In <- pong
+        expectFrame(t, devA, pong[14:])
+        // ARP is answered by the edge and never reaches the TUN device
+        expectNothing(t, devA)
+    })
+}
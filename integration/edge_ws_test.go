@@ -0,0 +1,136 @@
+package integration
+
+import (
+    "bufio"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/pem"
+    "fmt"
+    "io"
+    "math/big"
+    "net"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+    "n2n-go/pkg/edge"
+    "n2n-go/pkg/sn"
+    "n2n-go/pkg/transport"
+    "n2n-go/pkg/wire"
+)
+
+// httpOnly stands in for a network that blocks UDP and lets only HTTP out:
+// it passes the TCP connections that start with a GET request on to to.
+func httpOnly(t *testing.T, to string) string {
+    t.Helper()
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil { t.Fatal(err) }
+    t.Cleanup(func() { ln.Close() })
+    go func() {
+        for {
+            c, err := ln.Accept()
+            if err != nil { return }
+            go func() {
+                defer c.Close()
+                r := bufio.NewReader(c)
+                if b, err := r.Peek(4); err != nil || string(b) != "GET " { return }
+                up, err := net.Dial("tcp", to)
+                if err != nil { return }
+                defer up.Close()
+                go func() {
+                    io.Copy(up, r)
+                    up.(*net.TCPConn).CloseWrite()
+                }()
+                io.Copy(c, up)
+            }()
+        }
+    }()
+    return ln.Addr().String()
+}
+
+// selfSigned writes a certificate for 127.0.0.1 and its key to dir.
+func selfSigned(t *testing.T, dir string) (cert, key string) {
+    t.Helper()
+    k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil { t.Fatal(err) }
+    tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "n2n supernode"}, NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour),
+        KeyUsage: x509.KeyUsageDigitalSignature, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}, IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)}}
+    der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &k.PublicKey, k)
+    if err != nil { t.Fatal(err) }
+    kb, err := x509.MarshalECPrivateKey(k)
+    if err != nil { t.Fatal(err) }
+    cert, key = filepath.Join(dir, "sn.crt"), filepath.Join(dir, "sn.key")
+    if err := os.WriteFile(cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil { t.Fatal(err) }
+    if err := os.WriteFile(key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb}), 0600); err != nil { t.Fatal(err) }
+    return cert, key
+}
+
+// wsPair starts a supernode with o and two edges of community: A over
+// WebSocket to url, B over UDP. It checks that frames cross both ways.
+func wsPair(t *testing.T, o sn.Options, community, url, ca string, port int) {
+    t.Helper()
+    stop := make(chan struct{})
+    done := make(chan error, 1)
+    o.Bind, o.Stop = "127.0.0.1", stop
+    go func() { done <- sn.RunOptions(o) }()
+    t.Cleanup(func() {
+        close(stop)
+        <-done
+    })
+    time.Sleep(100 * time.Millisecond)
+
+    eo := edge.Options{Supernode: fmt.Sprintf("127.0.0.1:%d", o.Port), Community: community, Cipher: "chacha", Key: "secret", Compression: "none"}
+    macA := wire.Mac{0x02, 0, 0, 0, 0x49, byte(port)}
+    macB := wire.Mac{0x02, 0, 0, 0, 0x49, byte(port + 1)}
+    wo := eo
+    wo.WebSocket, wo.WebSocketCA, wo.MAC = url, ca, macA
+    _, devA := memEdge(t, wo, port)
+    eo.MAC = macB
+    _, devB := memEdge(t, eo, port+1)
+
+    mc, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: o.MgmtPort})
+    if err != nil { t.Fatal(err) }
+    defer mc.Close()
+    protos := map[any]any{}
+    for _, r := range mgmtRows(t, mc, "r 1 edges") { protos[r["macaddr"]] = r["proto"] }
+    if protos[macString(macA)] != "WS" || protos[macString(macB)] != "UDP" { t.Fatalf("edges %v", protos) }
+
+    ping := pingFrame(8, macB, macA, [4]byte{10, 0, 0, 1}, [4]byte{10, 0, 0, 2}, 1)
+    devA.In <- ping
+    expectFrame(t, devB, ping)
+    pong := pingFrame(0, macA, macB, [4]byte{10, 0, 0, 2}, [4]byte{10, 0, 0, 1}, 1)
+    devB.In <- pong
+    expectFrame(t, devA, pong)
+}
+
+func macString(m wire.Mac) string {
+    return fmt.Sprintf("%02x:%02x:%02x:%02x:%02x:%02x", m[0], m[1], m[2], m[3], m[4], m[5])
+}
+
+func TestEdgeWebSocket(t *testing.T) {
+    // edge A reaches the supernode only through the stand-in
+    fw := httpOnly(t, "127.0.0.1:8791")
+    wsPair(t, sn.Options{Port: 8792, MgmtPort: 5792, WebSocket: "127.0.0.1:8791"}, "ws", "ws://"+fw+"/n2n", "", 7882)
+}
+
+func TestEdgeWebSocketTLS(t *testing.T) {
+    cert, key := selfSigned(t, t.TempDir())
+    // without the certificate the server is not trusted
+    c, err := transport.NewWSClient("wss://127.0.0.1:8793/", nil)
+    if err != nil { t.Fatal(err) }
+    defer c.Close()
+    stop := make(chan struct{})
+    done := make(chan error, 1)
+    go func() { done <- sn.RunOptions(sn.Options{Bind: "127.0.0.1", Port: 8796, MgmtPort: 0, WebSocket: "127.0.0.1:8793", WebSocketCert: cert, WebSocketKey: key, Stop: stop}) }()
+    time.Sleep(100 * time.Millisecond)
+    _, err = c.WriteTo([]byte("x"), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8796})
+    close(stop)
+    <-done
+    if err == nil || !strings.Contains(err.Error(), "certificate") { t.Fatalf("untrusted server: %v", err) }
+
+    wsPair(t, sn.Options{Port: 8794, MgmtPort: 5794, WebSocket: "127.0.0.1:8795", WebSocketCert: cert, WebSocketKey: key}, "wss", "wss://127.0.0.1:8795/", cert, 7884)
+}
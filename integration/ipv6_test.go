@@ -0,0 +1,86 @@
+package integration
+
+import (
+    "net"
+    "testing"
+    "time"
+    "n2n-go/pkg/edge"
+    "n2n-go/pkg/sn"
+    "n2n-go/pkg/wire"
+)
+
+// query sends a QUERY_PEER for target over c and returns the answer.
+func query(t *testing.T, c *net.UDPConn, community string, target wire.Mac) wire.PeerInfo {
+    t.Helper()
+    qc := wire.Common{TTL: 2, PC: wire.MsgQueryPeer, Flags: 0}
+    copy(qc.Community[:], community)
+    b := make([]byte, 256)
+    c.Write(b[:wire.EncodeQueryPeer(qc, wire.QueryPeer{SrcMac: wire.Mac{0x02, 0, 0, 0, 0x50, 0xff}, TargetMac: target}, b)])
+    c.SetReadDeadline(time.Now().Add(time.Second))
+    n, err := c.Read(b)
+    if err != nil { t.Fatal(err) }
+    i := 0
+    wire.DecodeCommon(b[:n], &i)
+    pi, ok := wire.DecodePeerInfo(b[:n], &i)
+    if !ok { t.Fatalf("peer info %x", b[:n]) }
+    return pi
+}
+
+func TestIPv6Underlay(t *testing.T) {
+    if l, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback}); err != nil {
+        t.Skip("no IPv6 loopback:", err)
+    } else {
+        l.Close()
+    }
+    // a wildcard bind serves IPv4 and IPv6 edges on one socket
+    stop := make(chan struct{})
+    done := make(chan error, 1)
+    go func() { done <- sn.RunOptions(sn.Options{Bind: "::", Port: 8798, MgmtPort: 5798, Stop: stop}) }()
+    defer func() {
+        close(stop)
+        <-done
+    }()
+    time.Sleep(100 * time.Millisecond)
+
+    o := edge.Options{Community: "v6", Cipher: "aes", Key: "secret", Compression: "none", SecureHeader: true}
+    macA := wire.Mac{0x02, 0, 0, 0, 0x50, 0x0a}
+    macB := wire.Mac{0x02, 0, 0, 0, 0x50, 0x0b}
+    oa := o
+    oa.Bind, oa.Supernode, oa.MAC = "::1", "[::1]:8798", macA
+    _, devA := memEdge(t, oa, 7886)
+    ob := o
+    ob.Bind, ob.Supernode, ob.MAC = "127.0.0.1", "127.0.0.1:8798", macB
+    _, devB := memEdge(t, ob, 7887)
+
+    ping := pingFrame(8, macB, macA, [4]byte{10, 0, 0, 1}, [4]byte{10, 0, 0, 2}, 1)
+    devA.In <- ping
+    expectFrame(t, devB, ping)
+    pong := pingFrame(0, macA, macB, [4]byte{10, 0, 0, 2}, [4]byte{10, 0, 0, 1}, 1)
+    devB.In <- pong
+    expectFrame(t, devA, pong)
+
+    // the replies carry IPv6 addresses as such
+    c, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv6loopback, Port: 8798})
+    if err != nil { t.Fatal(err) }
+    defer c.Close()
+    rc := wire.Common{TTL: 2, PC: wire.MsgRegisterSuper, Flags: 0}
+    copy(rc.Community[:], "v6")
+    b := make([]byte, 256)
+    c.Write(b[:wire.EncodeRegisterSuper(rc, wire.RegisterSuper{EdgeMac: wire.Mac{0x02, 0, 0, 0, 0x50, 0xff}}, b)])
+    c.SetReadDeadline(time.Now().Add(time.Second))
+    n, err := c.Read(b)
+    if err != nil { t.Fatal(err) }
+    i := 0
+    wire.DecodeCommon(b[:n], &i)
+    ack, ok := wire.DecodeRegisterSuperAck(b[:n], &i)
+    if !ok || ack.Sock.Family != 10 || ack.Sock.UDPAddr().String() != c.LocalAddr().String() { t.Fatalf("ack sock %+v for %s", ack.Sock, c.LocalAddr()) }
+    if pi := query(t, c, "v6", macA); pi.PreferredSock.Family != 10 || pi.PreferredSock.UDPAddr().String() != "[::1]:7886" { t.Fatalf("peer info %+v", pi.PreferredSock) }
+    if pi := query(t, c, "v6", macB); pi.PreferredSock.Family != 2 || pi.PreferredSock.UDPAddr().String() != "127.0.0.1:7887" { t.Fatalf("peer info %+v", pi.PreferredSock) }
+
+    mc, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5798})
+    if err != nil { t.Fatal(err) }
+    defer mc.Close()
+    addrs := map[any]any{}
+    for _, r := range mgmtRows(t, mc, "r 1 edges") { addrs[r["macaddr"]] = r["sockaddr"] }
+    if addrs[macString(macA)] != "[::1]:7886" || addrs[macString(macB)] != "127.0.0.1:7887" { t.Fatalf("edges %v", addrs) }
+}
@@ -0,0 +1,116 @@
+package integration
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+    "n2n-go/pkg/management"
+)
+
+type syncBuffer struct {
+    mu sync.Mutex
+    b  bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.b.Write(p)
+}
+
+func (s *syncBuffer) lines() []map[string]any {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    var out []map[string]any
+    for _, l := range strings.Split(strings.TrimSpace(s.b.String()), "\n") {
+        m := map[string]any{}
+        if json.Unmarshal([]byte(l), &m) == nil { out = append(out, m) }
+    }
+    return out
+}
+
+func TestMgmtRoles(t *testing.T) {
+    spec, err := management.HashPassword("admin")
+    if err != nil { t.Fatal(err) }
+    audit := &syncBuffer{}
+    s := &management.Server{Password: spec, ReadPassword: "monitor", Audit: audit}
+    // the commands run on the server goroutines
+    var mu sync.Mutex
+    value := "a"
+    get := func() string {
+        mu.Lock()
+        defer mu.Unlock()
+        return value
+    }
+    s.Register(management.Command{Name: "x.get", Method: "GET", Path: "/x", Func: func([]string) ([]map[string]any, error) {
+        return []map[string]any{{"value": get()}}, nil
+    }})
+    s.Register(management.Command{Name: "x.set", Write: true, Params: []string{"value"}, Method: "PUT", Path: "/x", Func: func(p []string) ([]map[string]any, error) {
+        mu.Lock()
+        value = p[0]
+        mu.Unlock()
+        return nil, nil
+    }})
+    c, err := management.Dial(startMgmt(t, s))
+    if err != nil { t.Fatal(err) }
+    defer c.Close()
+    // every read-only request is first checked against the scrypt hash,
+    // which takes seconds under the race detector
+    c.Timeout = 10 * time.Second
+    remote := func(err error) string {
+        var re *management.RemoteError
+        if !errors.As(err, &re) { return "" }
+        return re.Msg
+    }
+
+    if _, err := c.Call("x.get"); remote(err) != "unauth" { t.Fatalf("no password: %v", err) }
+    c.Password = "wrong"
+    if _, err := c.Call("x.get"); remote(err) != "badauth" { t.Fatalf("wrong password: %v", err) }
+    c.Password = "monitor"
+    if rows, err := c.Call("x.get"); err != nil || rows[0]["value"] != "a" { t.Fatalf("read-only read: %v %v", rows, err) }
+    if _, err := c.Write("x.set", "b"); remote(err) != "forbidden" { t.Fatalf("read-only write: %v", err) }
+    if _, err := c.Request("w", "stop"); remote(err) != "forbidden" { t.Fatalf("read-only stop: %v", err) }
+    c.Password = "admin"
+    if _, err := c.Write("x.set", "b"); err != nil || get() != "b" { t.Fatalf("read-write write: %v %q", err, get()) }
+
+    lines := audit.lines()
+    if len(lines) != 3 { t.Fatalf("audit %v", lines) }
+    for i, want := range [][3]string{{"x.set", "ro", "forbidden"}, {"stop", "ro", "forbidden"}, {"x.set", "rw", "ok"}} {
+        l := lines[i]
+        if l["method"] != want[0] || l["role"] != want[1] || l["result"] != want[2] || l["proto"] != "udp" { t.Fatalf("audit line %d: %v", i, l) }
+    }
+
+    srv := httptest.NewServer(s.HTTPHandler())
+    defer srv.Close()
+    if code, _ := httpDo(t, "GET", srv.URL+"/x", "monitor", ""); code != http.StatusOK { t.Fatalf("http read-only read got %d", code) }
+    if code, _ := httpDo(t, "PUT", srv.URL+"/x", "monitor", `{"value":"c"}`); code != http.StatusForbidden { t.Fatalf("http read-only write got %d", code) }
+    if code, _ := httpDo(t, "PUT", srv.URL+"/x", "admin", `{"value":"c"}`); code != http.StatusOK || get() != "c" { t.Fatalf("http write got %d %q", code, get()) }
+    if l := audit.lines(); len(l) != 5 || l[4]["proto"] != "http" || l[4]["result"] != "ok" { t.Fatalf("http audit %v", l) }
+}
+
+func TestMgmtHTTPNeedsPasswordOffLoopback(t *testing.T) {
+    if _, err := (&management.Server{}).ListenHTTP("0.0.0.0:0"); err == nil { t.Fatal("served a wildcard address without a password") }
+    l, err := (&management.Server{}).ListenHTTP("127.0.0.1:0")
+    if err != nil { t.Fatal(err) }
+    l.Close()
+    l, err = (&management.Server{Password: "pw"}).ListenHTTP("0.0.0.0:0")
+    if err != nil { t.Fatal(err) }
+    l.Close()
+}
+
+// TestMgmtPearsonSpecRefused checks that the pearson64 specs of earlier
+// releases match no password; "aa" matched the all-zero spec there.
+func TestMgmtPearsonSpecRefused(t *testing.T) {
+    s := &management.Server{Password: "pearson64:0000000000000000"}
+    srv := httptest.NewServer(s.HTTPHandler())
+    defer srv.Close()
+    for _, pw := range []string{"aa", "pearson64:0000000000000000"} {
+        if code, _ := httpDo(t, "GET", srv.URL+"/verbose", pw, ""); code != http.StatusUnauthorized { t.Fatalf("%q got %d", pw, code) }
+    }
+}
@@ -0,0 +1,93 @@
+package integration
+
+import (
+    "errors"
+    "net"
+    "strings"
+    "testing"
+    "time"
+    "n2n-go/pkg/management"
+    "n2n-go/pkg/sn"
+)
+
+func TestMgmtClient(t *testing.T) {
+    go sn.RunOptions(sn.Options{Bind: "127.0.0.1", Port: 8771, MgmtPort: 5772, MgmtPassword: "pw"})
+    time.Sleep(100 * time.Millisecond)
+
+    c, err := management.Dial("127.0.0.1:5772")
+    if err != nil { t.Fatal(err) }
+    defer c.Close()
+    var re *management.RemoteError
+    if _, err := c.Call("pool.list"); !errors.As(err, &re) || re.Msg != "unauth" { t.Fatalf("expected unauth, got %v", err) }
+
+    c.Password = "pw"
+    // pool.set is a write command and is not sent again as one
+    if _, err := c.Call("pool.set", "community", "10.7.0.0", "24", "60"); !errors.As(err, &re) || re.Msg != "badtype" { t.Fatalf("expected badtype, got %v", err) }
+    if rows, err := c.Call("pool.list"); err != nil || len(rows) != 0 { t.Fatalf("pool.list after badtype %v %v", rows, err) }
+    if _, err := c.Write("pool.set", "community", "10.7.0.0", "24", "60"); err != nil { t.Fatal(err) }
+    // help tells which commands are writes
+    help, err := c.Call("help")
+    if err != nil { t.Fatal(err) }
+    writes := map[any]any{}
+    for _, r := range help { writes[r["cmd"]] = r["write"] }
+    if writes["pool.set"] != true || writes["pool.list"] != false || writes["stop"] != true { t.Fatalf("help %v", help) }
+    rows, err := c.Call("pool.list")
+    if err != nil || len(rows) != 1 || rows[0]["community"] != "community" { t.Fatalf("pool.list %v %v", rows, err) }
+    if _, ok := rows[0]["_tag"]; ok { t.Fatal("framing fields not stripped") }
+    if _, err := c.Write("pool.set", "community", "bogus", "24", "60"); !errors.As(err, &re) { t.Fatalf("expected remote error, got %v", err) }
+}
+
+// TestMgmtClientRetry drops the first request and answers the second one
+// after a stale reply, as happens when datagrams are lost or delayed.
+func TestMgmtClientRetry(t *testing.T) {
+    srv, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+    if err != nil { t.Fatal(err) }
+    defer srv.Close()
+    go func() {
+        buf := make([]byte, 2048)
+        var first string
+        for i := 0; ; i++ {
+            n, addr, err := srv.ReadFromUDP(buf)
+            if err != nil { return }
+            tag := strings.Fields(string(buf[:n]))[1]
+            if i == 0 {
+                first = tag
+                continue
+            }
+            srv.WriteToUDP([]byte(`{"_tag":"`+first+`","_type":"row","stale":true}`), addr)
+            srv.WriteToUDP([]byte(`{"_tag":"`+tag+`","_type":"begin","cmd":"x"}`), addr)
+            srv.WriteToUDP([]byte(`{"_tag":"`+tag+`","_type":"row","n":1}`), addr)
+            srv.WriteToUDP([]byte(`{"_tag":"`+tag+`","_type":"end"}`), addr)
+        }
+    }()
+    c, err := management.Dial(srv.LocalAddr().String())
+    if err != nil { t.Fatal(err) }
+    defer c.Close()
+    c.Timeout = 100 * time.Millisecond
+    rows, err := c.Call("x")
+    if err != nil || len(rows) != 1 || rows[0]["n"] != float64(1) { t.Fatalf("rows %v %v", rows, err) }
+
+    // a write may have taken effect when its reply is lost, so it is sent once
+    silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+    if err != nil { t.Fatal(err) }
+    defer silent.Close()
+    wc, err := management.Dial(silent.LocalAddr().String())
+    if err != nil { t.Fatal(err) }
+    defer wc.Close()
+    wc.Timeout = 100 * time.Millisecond
+    if _, err := wc.Write("x.set", "a"); err != management.ErrTimeout { t.Fatalf("expected timeout, got %v", err) }
+    buf := make([]byte, 2048)
+    for i := 0; ; i++ {
+        silent.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+        n, _, err := silent.ReadFromUDP(buf)
+        if err != nil {
+            if i != 1 { t.Fatalf("write sent %d times", i) }
+            break
+        }
+        if !strings.HasPrefix(string(buf[:n]), "w ") { t.Fatalf("request %q", buf[:n]) }
+    }
+
+    c.Retries = 0
+    srv.Close()
+    if _, err := c.Call("x"); err == nil { t.Fatal("expected error without a server") }
+}
@@ -0,0 +1,121 @@
+package integration
+
+import (
+    "encoding/json"
+    "net"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+    "n2n-go/pkg/edge"
+    "n2n-go/pkg/sn"
+    "n2n-go/pkg/wire"
+)
+
+// mgmtRows sends one management request and collects the rows up to "end".
+func mgmtRows(t *testing.T, c *net.UDPConn, req string) []map[string]any {
+    t.Helper()
+    c.Write([]byte(req))
+    var rows []map[string]any
+    buf := make([]byte, 2048)
+    for {
+        c.SetReadDeadline(time.Now().Add(time.Second))
+        n, _, err := c.ReadFrom(buf)
+        if err != nil { t.Fatal(req, err) }
+        m := map[string]any{}
+        if err := json.Unmarshal(buf[:n], &m); err != nil { t.Fatal(err) }
+        switch m["_type"] {
+        case "end":
+            return rows
+        case "error":
+            t.Fatal(req, m["error"])
+        case "row":
+            rows = append(rows, m)
+        }
+    }
+}
+
+func TestMgmtCompatCommands(t *testing.T) {
+    dir := t.TempDir()
+    cf := filepath.Join(dir, "community.list")
+    os.WriteFile(cf, []byte("community 10.1.2.0/24\n"), 0644)
+    bind := "127.0.0.1"
+    lp := 8769
+    mp := 5769
+    go sn.RunOptions(sn.Options{Bind: bind, Port: lp, MgmtPort: mp, CommunityFile: cf})
+    time.Sleep(100 * time.Millisecond)
+
+    e, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP(bind), Port: lp})
+    if err != nil { t.Fatal(err) }
+    defer e.Close()
+    rc := wire.Common{TTL: 2, PC: wire.MsgRegisterSuper, Flags: 0}
+    copy(rc.Community[:], []byte("community"))
+    r := wire.RegisterSuper{EdgeMac: wire.Mac{0x02, 0, 0, 0, 0, 0x01}}
+    copy(r.DevDesc[:], []byte("edge1"))
+    b := make([]byte, 256)
+    e.Write(b[:wire.EncodeRegisterSuper(rc, r, b)])
+    e.SetReadDeadline(time.Now().Add(time.Second))
+    if _, err := e.Read(b); err != nil { t.Fatal(err) }
+
+    // a community missing from the list is rejected
+    copy(rc.Community[:], []byte("other\x00\x00\x00\x00"))
+    e.Write(b[:wire.EncodeRegisterSuper(rc, r, b)])
+    e.SetReadDeadline(time.Now().Add(time.Second))
+    n, err := e.Read(b)
+    if err != nil { t.Fatal(err) }
+    i := 0
+    if c, ok := wire.DecodeCommon(b[:n], &i); !ok || c.PC != wire.MsgRegisterSuperNak { t.Fatal("expected nak") }
+
+    c, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP(bind), Port: mp})
+    if err != nil { t.Fatal(err) }
+    defer c.Close()
+    rows := mgmtRows(t, c, "r 1 edges")
+    if len(rows) != 1 || rows[0]["macaddr"] != "02:00:00:00:00:01" || rows[0]["community"] != "community" || rows[0]["ip4addr"] != "10.1.2.10" || rows[0]["desc"] != "edge1" { t.Fatalf("edges %v", rows) }
+    rows = mgmtRows(t, c, "r 2 communities")
+    if len(rows) != 1 || rows[0]["ip4addr"] != "10.1.2.0/24" { t.Fatalf("communities %v", rows) }
+    rows = mgmtRows(t, c, "r 3 packetstats")
+    if len(rows) != 4 || rows[2]["type"] != "reg_super" || rows[2]["nak"] != float64(1) { t.Fatalf("packetstats %v", rows) }
+    rows = mgmtRows(t, c, "r 4 timestamps")
+    if len(rows) != 1 || rows[0]["last_reg_super"] == float64(0) { t.Fatalf("timestamps %v", rows) }
+    os.WriteFile(cf, []byte("community\nother\n"), 0644)
+    rows = mgmtRows(t, c, "w 5 reload_communities")
+    if len(rows) != 1 || rows[0]["ok"] != true { t.Fatalf("reload %v", rows) }
+    if len(mgmtRows(t, c, "r 6 communities")) != 2 { t.Fatal("reload not applied") }
+}
+
+func TestEdgeMgmtCompatCommands(t *testing.T) {
+    stop := make(chan struct{})
+    done := make(chan error, 1)
+    go func() { done <- sn.RunOptions(sn.Options{Bind: "127.0.0.1", Port: 8789, MgmtPort: 5787, Stop: stop}) }()
+    defer func() {
+        close(stop)
+        <-done
+    }()
+    time.Sleep(100 * time.Millisecond)
+    o := edge.Options{Supernode: "127.0.0.1:8789", Community: "compat", Cipher: "null", Compression: "none"}
+    macA, macB := wire.Mac{0x02, 0, 0, 0, 0x31, 0x0a}, wire.Mac{0x02, 0, 0, 0, 0x31, 0x0b}
+    oa := o
+    oa.MAC, oa.MgmtPort = macA, 5785
+    _, devA := memEdge(t, oa, 7889)
+    ob := o
+    ob.MAC = macB
+    _, devB := memEdge(t, ob, 7890)
+    ping := pingFrame(8, macA, macB, [4]byte{10, 0, 0, 2}, [4]byte{10, 0, 0, 1}, 1)
+    devB.In <- ping
+    expectFrame(t, devA, ping)
+
+    c, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5785})
+    if err != nil { t.Fatal(err) }
+    defer c.Close()
+    // only what the edge knows is reported
+    rows := mgmtRows(t, c, "r 1 supernodes")
+    if len(rows) != 1 || rows[0]["sockaddr"] != "127.0.0.1:8789" || rows[0]["last_seen"] == float64(0) { t.Fatalf("supernodes %v", rows) }
+    for _, f := range []string{"version", "macaddr", "uptime", "selection"} {
+        if _, ok := rows[0][f]; ok { t.Fatalf("supernodes row has %s: %v", f, rows[0]) }
+    }
+    rows = mgmtRows(t, c, "r 2 edges")
+    if len(rows) != 1 || rows[0]["macaddr"] != macString(macB) { t.Fatalf("edges %v", rows) }
+    for _, f := range []string{"ip4addr", "desc"} {
+        if _, ok := rows[0][f]; ok { t.Fatalf("edges row has %s: %v", f, rows[0]) }
+    }
+}
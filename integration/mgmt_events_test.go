@@ -0,0 +1,122 @@
+package integration
+
+import (
+    "encoding/json"
+    "net"
+    "testing"
+    "time"
+    "n2n-go/pkg/management"
+)
+
+func startMgmt(t *testing.T, s *management.Server) string {
+    t.Helper()
+    conn, err := s.Listen("127.0.0.1", 0)
+    if err != nil { t.Fatal(err) }
+    stop := make(chan struct{})
+    go s.Handle(conn, stop)
+    t.Cleanup(func() { conn.Close() })
+    return conn.LocalAddr().String()
+}
+
+func subscriber(t *testing.T, addr, req string) *net.UDPConn {
+    t.Helper()
+    ua, _ := net.ResolveUDPAddr("udp", addr)
+    c, err := net.DialUDP("udp", nil, ua)
+    if err != nil { t.Fatal(err) }
+    t.Cleanup(func() { c.Close() })
+    mgmtRows(t, c, req)
+    return c
+}
+
+// nextEvent returns the next event datagram or nil after the timeout.
+func nextEvent(c *net.UDPConn, d time.Duration) map[string]any {
+    buf := make([]byte, 2048)
+    for {
+        c.SetReadDeadline(time.Now().Add(d))
+        n, err := c.Read(buf)
+        if err != nil { return nil }
+        m := map[string]any{}
+        if json.Unmarshal(buf[:n], &m) == nil && m["_type"] == "event" { return m }
+    }
+}
+
+func TestMgmtEventSubscribers(t *testing.T) {
+    s := &management.Server{Events: make(chan management.MgmtEvent, 16), SubscriptionTTL: 300 * time.Millisecond, ReplaySize: 2}
+    addr := startMgmt(t, s)
+    a := subscriber(t, addr, "s 1 subscribe lease")
+    b := subscriber(t, addr, "s 2 subscribe lease")
+
+    s.Publish("lease", map[string]any{"event": "expired"})
+    for _, c := range []*net.UDPConn{a, b} {
+        ev := nextEvent(c, time.Second)
+        if ev == nil || ev["event"] != "expired" || ev["_topic"] != "lease" || ev["_seq"] != float64(1) || ev["_ts"] == nil { t.Fatalf("event %v", ev) }
+    }
+
+    if rows := mgmtRows(t, b, "s 3 unsubscribe lease"); len(rows) != 1 || rows[0]["unsubscribed"] != float64(1) { t.Fatalf("unsubscribe %v", rows) }
+    s.Publish("lease", map[string]any{"event": "expired"})
+    if ev := nextEvent(a, time.Second); ev == nil || ev["_seq"] != float64(2) { t.Fatalf("event %v", ev) }
+    if ev := nextEvent(b, 100*time.Millisecond); ev != nil { t.Fatalf("unsubscribed client got %v", ev) }
+
+    // a late subscriber catches up from the replay buffer, which keeps the
+    // last ReplaySize events
+    s.Publish("lease", map[string]any{"event": "expired"})
+    nextEvent(a, time.Second)
+    c := subscriber(t, addr, "s 4 subscribe lease 0")
+    for _, want := range []float64{2, 3} {
+        if ev := nextEvent(c, time.Second); ev == nil || ev["_seq"] != want { t.Fatalf("replay want %v got %v", want, ev) }
+    }
+
+    // subscriptions expire unless renewed, also without events
+    time.Sleep(400 * time.Millisecond)
+    if rows := mgmtRows(t, a, "r 5 subscriptions"); len(rows) != 0 { t.Fatalf("expired subscriptions listed %v", rows) }
+    s.Publish("lease", map[string]any{"event": "expired"})
+    if ev := nextEvent(a, 200*time.Millisecond); ev != nil { t.Fatalf("expired subscription got %v", ev) }
+}
+
+// TestMgmtEventTime checks that _ts is when the event was published, not
+// when the dispatcher got to it.
+func TestMgmtEventTime(t *testing.T) {
+    s := &management.Server{Events: make(chan management.MgmtEvent, 16)}
+    before := time.Now().UnixMilli()
+    s.Publish("peer", map[string]any{"event": "up"})
+    time.Sleep(300 * time.Millisecond)
+    // the dispatcher starts with the listener
+    c := subscriber(t, startMgmt(t, s), "s 1 subscribe peer 0")
+    ev := nextEvent(c, time.Second)
+    if ev == nil { t.Fatal("no event replayed") }
+    if ts := int64(ev["_ts"].(float64)); ts < before || ts > before+100 { t.Fatalf("_ts %d, published at %d", ts, before) }
+}
+
+func TestMgmtPublishNonBlocking(t *testing.T) {
+    s := &management.Server{Events: make(chan management.MgmtEvent, 1)}
+    done := make(chan struct{})
+    go func() {
+        for i := 0; i < 100; i++ { s.Publish("peer", map[string]any{"event": "up"}) }
+        close(done)
+    }()
+    select {
+    case <-done:
+    case <-time.After(time.Second):
+        t.Fatal("Publish blocked on a full channel")
+    }
+}
+
+func TestMgmtClientSubscribe(t *testing.T) {
+    s := &management.Server{Events: make(chan management.MgmtEvent, 16), SubscriptionTTL: 3 * time.Second}
+    addr := startMgmt(t, s)
+    s.Publish("peer", map[string]any{"event": "up"})
+    time.Sleep(50 * time.Millisecond)
+    c, err := management.Dial(addr)
+    if err != nil { t.Fatal(err) }
+    defer c.Close()
+    go func() {
+        time.Sleep(100 * time.Millisecond)
+        s.Publish("peer", map[string]any{"event": "down"})
+    }()
+    var got []string
+    err = c.Subscribe("peer", 0, func(ev map[string]any) bool {
+        got = append(got, ev["event"].(string))
+        return len(got) < 2
+    })
+    if err != nil || len(got) != 2 || got[0] != "up" || got[1] != "down" { t.Fatalf("events %v %v", got, err) }
+}
@@ -0,0 +1,101 @@
+package integration
+
+import (
+    "encoding/json"
+    "fmt"
+    "net"
+    "net/http"
+    "strings"
+    "testing"
+    "time"
+    "n2n-go/pkg/sn"
+    "n2n-go/pkg/wire"
+)
+
+func httpDo(t *testing.T, method, url, pass, body string) (int, any) {
+    t.Helper()
+    req, _ := http.NewRequest(method, url, strings.NewReader(body))
+    if body != "" { req.Header.Set("Content-Type", "application/json") }
+    if body == "" && method != "GET" { req.Header.Set("X-N2N-Request", "1") }
+    if pass != "" { req.Header.Set("Authorization", "Bearer "+pass) }
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil { t.Fatal(method, url, err) }
+    defer resp.Body.Close()
+    var v any
+    json.NewDecoder(resp.Body).Decode(&v)
+    return resp.StatusCode, v
+}
+
+func TestMgmtHTTP(t *testing.T) {
+    base := "http://127.0.0.1:5771"
+    done := make(chan error, 1)
+    go func() { done <- sn.RunOptions(sn.Options{Bind: "127.0.0.1", Port: 8770, MgmtPort: 5770, HTTPAddr: "127.0.0.1:5771", MgmtPassword: "s3cret", MgmtReadPassword: "r3ad"}) }()
+    time.Sleep(100 * time.Millisecond)
+
+    if code, _ := httpDo(t, "GET", base+"/pools", "", ""); code != http.StatusUnauthorized { t.Fatalf("unauthenticated got %d", code) }
+    if code, _ := httpDo(t, "GET", base+"/pools", "wrong", ""); code != http.StatusUnauthorized { t.Fatalf("bad password got %d", code) }
+
+    code, _ := httpDo(t, "PUT", base+"/pools/community", "s3cret", `{"netaddr":"10.9.0.0","bitlen":24,"lifetime":120}`)
+    if code != http.StatusOK { t.Fatalf("pool set got %d", code) }
+    code, v := httpDo(t, "GET", base+"/pools", "s3cret", "")
+    rows, _ := v.([]any)
+    if code != http.StatusOK || len(rows) != 1 { t.Fatalf("pools %d %v", code, v) }
+    if p := rows[0].(map[string]any); p["community"] != "community" || p["bitlen"] != float64(24) { t.Fatalf("pool %v", p) }
+
+    if code, _ := httpDo(t, "PUT", base+"/pools/community", "s3cret", `{"netaddr":"bogus","bitlen":24,"lifetime":120}`); code != http.StatusBadRequest { t.Fatalf("bad netaddr got %d", code) }
+    if code, _ := httpDo(t, "PUT", base+"/pools/community", "s3cret", `{"netaddr":"10.9.0.0"}`); code != http.StatusBadRequest { t.Fatalf("missing params got %d", code) }
+
+    if code, _ := httpDo(t, "PUT", base+"/leases/02:00:00:00:00:09", "s3cret", `{"community":"community","ip":"10.9.0.9"}`); code != http.StatusOK { t.Fatalf("lease reserve got %d", code) }
+    _, v = httpDo(t, "GET", base+"/leases", "s3cret", "")
+    if rows, _ := v.([]any); len(rows) != 1 { t.Fatalf("leases %v", v) }
+    if code, _ := httpDo(t, "DELETE", base+"/leases/02:00:00:00:00:09", "s3cret", ""); code != http.StatusOK { t.Fatalf("lease release got %d", code) }
+    _, v = httpDo(t, "GET", base+"/leases", "s3cret", "")
+    if rows, _ := v.([]any); len(rows) != 0 { t.Fatalf("leases after release %v", v) }
+
+    code, v = httpDo(t, "PUT", base+"/verbose", "s3cret", `{"level":2}`)
+    if rows, _ := v.([]any); code != http.StatusOK || len(rows) != 1 || rows[0].(map[string]any)["traceLevel"] != float64(2) { t.Fatalf("verbose %d %v", code, v) }
+
+    // /peers is the same list as /edges
+    c, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8770})
+    if err != nil { t.Fatal(err) }
+    defer c.Close()
+    rc := wire.Common{TTL: 2, PC: wire.MsgRegisterSuper, Flags: 0}
+    copy(rc.Community[:], "community")
+    b := make([]byte, 256)
+    c.Write(b[:wire.EncodeRegisterSuper(rc, wire.RegisterSuper{EdgeMac: wire.Mac{0x02, 0, 0, 0, 0x71, 1}}, b)])
+    c.SetReadDeadline(time.Now().Add(time.Second))
+    if _, err := c.Read(b); err != nil { t.Fatal(err) }
+    _, edges := httpDo(t, "GET", base+"/edges", "r3ad", "")
+    code, peers := httpDo(t, "GET", base+"/peers", "r3ad", "")
+    if rows, _ := peers.([]any); code != http.StatusOK || len(rows) != 1 || rows[0].(map[string]any)["macaddr"] != "02:00:00:00:71:01" || fmt.Sprint(peers) != fmt.Sprint(edges) { t.Fatalf("peers %d %v, edges %v", code, peers, edges) }
+
+    code, v = httpDo(t, "GET", base+"/openapi.json", "s3cret", "")
+    spec, _ := v.(map[string]any)
+    paths, _ := spec["paths"].(map[string]any)
+    if code != http.StatusOK || spec["openapi"] != "3.0.3" || paths["/pools/{community}"] == nil || paths["/leases/{mac}"] == nil { t.Fatalf("openapi %d %v", code, v) }
+    if p, _ := paths["/peers"].(map[string]any); p["get"] == nil { t.Fatalf("openapi /peers %v", paths["/peers"]) }
+    if p, _ := paths["/stop"].(map[string]any); p["post"] == nil { t.Fatalf("openapi /stop %v", paths["/stop"]) }
+
+    // a form post of another site carries neither a JSON body nor the header
+    req, _ := http.NewRequest("POST", base+"/stop", strings.NewReader("a=b"))
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    req.Header.Set("Authorization", "Bearer s3cret")
+    if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusUnsupportedMediaType { t.Fatalf("form stop %v %v", resp, err) }
+    // a name resolving to the supernode is not its address
+    req, _ = http.NewRequest("GET", base+"/pools", nil)
+    req.Host = "rebind.example:5771"
+    req.Header.Set("Authorization", "Bearer s3cret")
+    if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusForbidden { t.Fatalf("foreign host %v %v", resp, err) }
+    req.Host = "localhost:5771"
+    if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusOK { t.Fatalf("localhost %v %v", resp, err) }
+
+    // stopping needs the read-write password and ends the supernode
+    if code, _ := httpDo(t, "POST", base+"/stop", "r3ad", ""); code != http.StatusForbidden { t.Fatalf("read-only stop got %d", code) }
+    code, v = httpDo(t, "POST", base+"/stop", "s3cret", "")
+    if rows, _ := v.([]any); code != http.StatusOK || len(rows) != 1 || rows[0].(map[string]any)["keep_running"] != false { t.Fatalf("stop %d %v", code, v) }
+    select {
+    case <-done:
+    case <-time.After(3 * time.Second):
+        t.Fatal("supernode still running after POST /stop")
+    }
+}
@@ -0,0 +1,81 @@
+package integration
+
+import (
+    "errors"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+    "n2n-go/pkg/management"
+    "n2n-go/pkg/sn"
+)
+
+func TestMgmtUnixSocket(t *testing.T) {
+    dir := t.TempDir()
+    for _, network := range []string{"unixgram", "unix"} {
+        t.Run(network, func(t *testing.T) {
+            path := filepath.Join(dir, network+".sock")
+            s := &management.Server{Events: make(chan management.MgmtEvent, 16)}
+            s.Register(management.Command{Name: "x.set", Write: true, Func: func(p []string) ([]map[string]any, error) {
+                return []map[string]any{{"n": len(p)}}, nil
+            }})
+            us, err := s.ServeUnix(network+":"+path, 0640, "", make(chan struct{}))
+            if err != nil { t.Fatal(err) }
+            defer us.Close()
+            fi, err := os.Stat(path)
+            if err != nil { t.Fatal(err) }
+            if fi.Mode().Perm() != 0640 || fi.Mode()&os.ModeSocket == 0 { t.Fatalf("socket mode %v", fi.Mode()) }
+
+            c, err := management.Dial(network + ":" + path)
+            if err != nil { t.Fatal(err) }
+            defer c.Close()
+            rows, err := c.Write("x.set", "a", "b")
+            if err != nil || len(rows) != 1 || rows[0]["n"] != float64(2) { t.Fatalf("call %v %v", rows, err) }
+            if _, err := c.Call("nope"); err == nil { t.Fatal("expected error") }
+
+            go func() {
+                time.Sleep(100 * time.Millisecond)
+                s.Publish("peer", map[string]any{"event": "register"})
+            }()
+            var got map[string]any
+            err = c.Subscribe("peer", -1, func(ev map[string]any) bool {
+                got = ev
+                return false
+            })
+            if err != nil || got["event"] != "register" { t.Fatalf("event %v %v", got, err) }
+        })
+    }
+
+    // the HTTP socket is moved into place with its mode and removed on close
+    path := filepath.Join(dir, "http.sock")
+    l, err := (&management.Server{}).ListenHTTP("unix:" + path)
+    if err != nil { t.Fatal(err) }
+    fi, err := os.Stat(path)
+    if err != nil || fi.Mode().Perm() != 0600 || l.Addr().String() != path { t.Fatalf("http socket %v %v %v", fi, l.Addr(), err) }
+    l.Close()
+    // a file that is not a socket is not replaced
+    path = filepath.Join(dir, "data")
+    os.WriteFile(path, []byte("keep"), 0600)
+    if _, err := (&management.Server{}).ServeUnix("unix:"+path, 0600, "", make(chan struct{})); err == nil { t.Fatal("served over a regular file") }
+    if b, err := os.ReadFile(path); err != nil || string(b) != "keep" { t.Fatalf("file replaced: %q %v", b, err) }
+    os.Remove(path)
+    // no staging directory is left behind
+    if ents, _ := os.ReadDir(dir); len(ents) != 0 { t.Fatalf("left in %s: %v", dir, ents) }
+}
+
+func TestSupernodeMgmtUnixOnly(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "sn.sock")
+    go sn.RunOptions(sn.Options{Bind: "127.0.0.1", Port: 8774, MgmtPort: 0, MgmtSocket: "unix:" + path})
+    time.Sleep(100 * time.Millisecond)
+    fi, err := os.Stat(path)
+    if err != nil { t.Fatal(err) }
+    if fi.Mode().Perm() != 0600 { t.Fatalf("default socket mode %v", fi.Mode()) }
+    c, err := management.Dial("unix:" + path)
+    if err != nil { t.Fatal(err) }
+    defer c.Close()
+    if _, err := c.Write("pool.set", "community", "10.8.0.0", "24", "60"); err != nil { t.Fatal(err) }
+    rows, err := c.Call("pool.list")
+    if err != nil || len(rows) != 1 { t.Fatalf("pool.list %v %v", rows, err) }
+    var re *management.RemoteError
+    if _, err := c.Write("pool.set", "community"); !errors.As(err, &re) { t.Fatalf("expected remote error, got %v", err) }
+}
@@ -0,0 +1,155 @@
+package integration
+
+import (
+    "net"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+    "n2n-go/pkg/sn"
+    "n2n-go/pkg/wire"
+)
+
+func TestPeerLifecycleEvents(t *testing.T) {
+    dir := t.TempDir()
+    cf := filepath.Join(dir, "community.list")
+    os.WriteFile(cf, []byte("community\nother\n"), 0644)
+    lp, mp := 8773, 5774
+    go sn.RunOptions(sn.Options{Bind: "127.0.0.1", Port: lp, MgmtPort: mp, CommunityFile: cf})
+    time.Sleep(100 * time.Millisecond)
+    sub := subscriber(t, "127.0.0.1:5774", "s 1 subscribe peer")
+
+    mac := wire.Mac{0x02, 0, 0, 0, 0, 0x35}
+    register := func(e *net.UDPConn, comm, desc string) uint8 {
+        t.Helper()
+        rc := wire.Common{TTL: 2, PC: wire.MsgRegisterSuper, Flags: 0}
+        copy(rc.Community[:], comm)
+        r := wire.RegisterSuper{EdgeMac: mac}
+        copy(r.DevDesc[:], desc)
+        b := make([]byte, 256)
+        e.Write(b[:wire.EncodeRegisterSuper(rc, r, b)])
+        e.SetReadDeadline(time.Now().Add(time.Second))
+        n, err := e.Read(b)
+        if err != nil { t.Fatal(err) }
+        i := 0
+        c, _ := wire.DecodeCommon(b[:n], &i)
+        return c.PC
+    }
+    dial := func() *net.UDPConn {
+        e, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: lp})
+        if err != nil { t.Fatal(err) }
+        t.Cleanup(func() { e.Close() })
+        return e
+    }
+    expect := func(event string, check func(ev map[string]any)) {
+        t.Helper()
+        ev := nextEvent(sub, time.Second)
+        if ev == nil || ev["event"] != event { t.Fatalf("want %s event, got %v", event, ev) }
+        if ev["macaddr"] != "02:00:00:00:00:35" { t.Fatalf("event mac %v", ev) }
+        if check != nil { check(ev) }
+    }
+
+    e1 := dial()
+    register(e1, "community", "edge1")
+    expect("register", func(ev map[string]any) {
+        if ev["community"] != "community" || ev["desc"] != "edge1" || ev["sockaddr"] != e1.LocalAddr().String() || ev["ip4addr"] == "" { t.Fatalf("register %v", ev) }
+    })
+    // a periodic re-registration is silent
+    register(e1, "community", "edge1")
+    if ev := nextEvent(sub, 100*time.Millisecond); ev != nil { t.Fatalf("re-registration event %v", ev) }
+
+    e2 := dial()
+    register(e2, "community", "edge1")
+    expect("moved", func(ev map[string]any) {
+        if ev["sockaddr"] != e2.LocalAddr().String() || ev["prev_sockaddr"] != e1.LocalAddr().String() { t.Fatalf("moved %v", ev) }
+    })
+
+    // the newer registration of a MAC in use wins and is reported
+    e3 := dial()
+    if pc := register(e3, "other", "edge3"); pc != wire.MsgRegisterSuperAck { t.Fatalf("conflicting registration got pc %d", pc) }
+    expect("conflict", func(ev map[string]any) {
+        if ev["community"] != "other" || ev["prev_community"] != "community" || ev["prev_sockaddr"] != e2.LocalAddr().String() || ev["rejected"] != false { t.Fatalf("conflict %v", ev) }
+    })
+    if pc := register(e2, "community", "edge1"); pc != wire.MsgRegisterSuperAck { t.Fatalf("registration back got pc %d", pc) }
+    expect("conflict", func(ev map[string]any) {
+        if ev["community"] != "community" || ev["prev_community"] != "other" || ev["prev_desc"] != "edge3" { t.Fatalf("conflict %v", ev) }
+    })
+    if pc := register(e3, "denied", "edge3"); pc != wire.MsgRegisterSuperNak { t.Fatalf("denied registration got pc %d", pc) }
+    expect("rejected", func(ev map[string]any) {
+        if ev["community"] != "denied" || ev["sockaddr"] != e3.LocalAddr().String() { t.Fatalf("rejected %v", ev) }
+    })
+
+    uc := wire.Common{TTL: 2, PC: wire.MsgUnregisterSuper, Flags: 0}
+    copy(uc.Community[:], "community")
+    b := make([]byte, 256)
+    e2.Write(b[:wire.EncodeUnregisterSuper(uc, wire.UnregisterSuper{EdgeMac: mac}, b)])
+    expect("unregister", func(ev map[string]any) {
+        if ev["community"] != "community" || ev["desc"] != "edge1" { t.Fatalf("unregister %v", ev) }
+    })
+}
+
+func TestPeerConflictRejected(t *testing.T) {
+    go sn.RunOptions(sn.Options{Bind: "127.0.0.1", Port: 8799, MgmtPort: 5799, RejectConflicts: true})
+    time.Sleep(100 * time.Millisecond)
+    sub := subscriber(t, "127.0.0.1:5799", "s 1 subscribe peer")
+    register := func(comm string) uint8 {
+        t.Helper()
+        e, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8799})
+        if err != nil { t.Fatal(err) }
+        defer e.Close()
+        rc := wire.Common{TTL: 2, PC: wire.MsgRegisterSuper, Flags: 0}
+        copy(rc.Community[:], comm)
+        b := make([]byte, 256)
+        e.Write(b[:wire.EncodeRegisterSuper(rc, wire.RegisterSuper{EdgeMac: wire.Mac{0x02, 0, 0, 0, 0x37, 1}}, b)])
+        e.SetReadDeadline(time.Now().Add(time.Second))
+        n, err := e.Read(b)
+        if err != nil { t.Fatal(err) }
+        i := 0
+        c, _ := wire.DecodeCommon(b[:n], &i)
+        return c.PC
+    }
+    if pc := register("community"); pc != wire.MsgRegisterSuperAck { t.Fatalf("registration got pc %d", pc) }
+    if ev := nextEvent(sub, time.Second); ev == nil || ev["event"] != "register" { t.Fatalf("want register event, got %v", ev) }
+    if pc := register("other"); pc != wire.MsgRegisterSuperNak { t.Fatalf("conflicting registration got pc %d", pc) }
+    if ev := nextEvent(sub, time.Second); ev == nil || ev["event"] != "conflict" || ev["rejected"] != true { t.Fatalf("want rejected conflict event, got %v", ev) }
+}
+
+func TestPeerKDFMismatch(t *testing.T) {
+    lp := 8797
+    stop := make(chan struct{})
+    done := make(chan error, 1)
+    go func() { done <- sn.RunOptions(sn.Options{Bind: "127.0.0.1", Port: lp, MgmtPort: 5797, Stop: stop}) }()
+    defer func() {
+        close(stop)
+        <-done
+    }()
+    time.Sleep(100 * time.Millisecond)
+    sub := subscriber(t, "127.0.0.1:5797", "s 1 subscribe peer")
+    register := func(last byte, kdf string) {
+        t.Helper()
+        e, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: lp})
+        if err != nil { t.Fatal(err) }
+        defer e.Close()
+        rc := wire.Common{TTL: 2, PC: wire.MsgRegisterSuper, Flags: 0}
+        copy(rc.Community[:], "community")
+        b := make([]byte, 256)
+        e.Write(b[:wire.EncodeRegisterSuper(rc, wire.RegisterSuper{EdgeMac: wire.Mac{0x02, 0, 0, 0, 0x36, last}, KDF: kdf}, b)])
+        e.SetReadDeadline(time.Now().Add(time.Second))
+        n, err := e.Read(b)
+        if err != nil { t.Fatal(err) }
+        i := 0
+        // a mismatch is reported, not refused
+        if c, _ := wire.DecodeCommon(b[:n], &i); c.PC != wire.MsgRegisterSuperAck { t.Fatalf("registration got pc %d", c.PC) }
+    }
+    register(1, "hkdf")
+    register(2, "hkdf")
+    register(3, "")
+    for i := 0; i < 3; i++ {
+        if ev := nextEvent(sub, time.Second); ev == nil || ev["event"] != "register" { t.Fatalf("want register event, got %v", ev) }
+    }
+    register(4, "argon2id:t=3,m=65536,p=4")
+    ev := nextEvent(sub, time.Second)
+    if ev == nil || ev["event"] != "register" { t.Fatalf("want register event, got %v", ev) }
+    ev = nextEvent(sub, time.Second)
+    if ev == nil || ev["event"] != "kdf_mismatch" || ev["macaddr"] != "02:00:00:00:36:04" || ev["kdf"] != "argon2id:t=3,m=65536,p=4" || ev["prev_kdf"] != "hkdf" { t.Fatalf("kdf mismatch %v", ev) }
+}
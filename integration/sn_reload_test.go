@@ -0,0 +1,70 @@
+package integration
+
+import (
+    "encoding/json"
+    "net"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+    "n2n-go/pkg/sn"
+    "n2n-go/pkg/wire"
+)
+
+func TestSupernodeReload(t *testing.T) {
+    dir := t.TempDir()
+    cf := filepath.Join(dir, "community.list")
+    os.WriteFile(cf, []byte("alpha\n"), 0644)
+    lp, mp := 8777, 5777
+    o := sn.Options{Bind: "127.0.0.1", Port: lp, MgmtPort: mp, CommunityFile: cf, DefaultPool: "10.33.0.0/24"}
+    stop := make(chan struct{})
+    reload := make(chan sn.Options)
+    done := make(chan error, 1)
+    run := o
+    run.Stop, run.Reload = stop, reload
+    go func() { done <- sn.RunOptions(run) }()
+    defer func() {
+        close(stop)
+        <-done
+    }()
+    time.Sleep(100 * time.Millisecond)
+
+    e, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: lp})
+    if err != nil { t.Fatal(err) }
+    defer e.Close()
+    register := func(comm string, last byte) (uint8, uint32) {
+        t.Helper()
+        rc := wire.Common{TTL: 2, PC: wire.MsgRegisterSuper, Flags: 0}
+        copy(rc.Community[:], comm)
+        b := make([]byte, 256)
+        e.Write(b[:wire.EncodeRegisterSuper(rc, wire.RegisterSuper{EdgeMac: wire.Mac{0x02, 0, 0, 0, 0x40, last}}, b)])
+        e.SetReadDeadline(time.Now().Add(time.Second))
+        n, err := e.Read(b)
+        if err != nil { t.Fatal(err) }
+        i := 0
+        c, _ := wire.DecodeCommon(b[:n], &i)
+        a, _ := wire.DecodeRegisterSuperAck(b[:n], &i)
+        return c.PC, a.DevAddr.NetAddr
+    }
+    if pc, ip := register("alpha", 1); pc != wire.MsgRegisterSuperAck || ip>>8 != 0x0a2100 { t.Fatalf("alpha pc %d ip %x", pc, ip) }
+    if pc, _ := register("beta", 2); pc != wire.MsgRegisterSuperNak { t.Fatalf("beta before reload pc %d", pc) }
+
+    os.WriteFile(cf, []byte("alpha\nbeta 10.44.0.0/24\n"), 0644)
+    o.MgmtPassword = "secret"
+    reload <- o
+    time.Sleep(100 * time.Millisecond)
+    if pc, ip := register("beta", 2); pc != wire.MsgRegisterSuperAck || ip>>8 != 0x0a2c00 { t.Fatalf("beta after reload pc %d ip %x", pc, ip) }
+
+    mc, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: mp})
+    if err != nil { t.Fatal(err) }
+    defer mc.Close()
+    mc.Write([]byte("r 1 edges"))
+    buf := make([]byte, 2048)
+    mc.SetReadDeadline(time.Now().Add(time.Second))
+    n, err := mc.Read(buf)
+    if err != nil { t.Fatal(err) }
+    var m map[string]any
+    json.Unmarshal(buf[:n], &m)
+    if m["error"] != "unauth" { t.Fatalf("password not reloaded: %v", m) }
+    if rows := mgmtRows(t, mc, "r 2:1:secret edges"); len(rows) != 2 { t.Fatalf("edges %v", rows) }
+}
@@ -0,0 +1,80 @@
+package integration
+
+import (
+    "net"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+    "n2n-go/pkg/sn"
+    "n2n-go/pkg/wire"
+)
+
+func TestSupernodeShutdownHandOff(t *testing.T) {
+    dir := t.TempDir()
+    stateFile := filepath.Join(dir, "sn.state")
+    lp, mp := 8775, 5775
+    stop := make(chan struct{})
+    done := make(chan error, 1)
+    go func() { done <- sn.RunOptions(sn.Options{Bind: "127.0.0.1", Port: lp, MgmtPort: mp, StateFile: stateFile, Successor: "127.0.0.1:8776", Stop: stop}) }()
+    time.Sleep(100 * time.Millisecond)
+
+    e, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: lp})
+    if err != nil { t.Fatal(err) }
+    defer e.Close()
+    mac := wire.Mac{0x02, 0, 0, 0, 0, 0x39}
+    register := func() uint32 {
+        t.Helper()
+        rc := wire.Common{TTL: 2, PC: wire.MsgRegisterSuper, Flags: 0}
+        copy(rc.Community[:], "community")
+        b := make([]byte, 256)
+        e.Write(b[:wire.EncodeRegisterSuper(rc, wire.RegisterSuper{EdgeMac: mac}, b)])
+        e.SetReadDeadline(time.Now().Add(time.Second))
+        n, err := e.Read(b)
+        if err != nil { t.Fatal(err) }
+        i := 0
+        c, _ := wire.DecodeCommon(b[:n], &i)
+        if c.PC != wire.MsgRegisterSuperAck { t.Fatalf("pc %d", c.PC) }
+        a, ok := wire.DecodeRegisterSuperAck(b[:n], &i)
+        if !ok { t.Fatal("ack decode") }
+        return a.DevAddr.NetAddr
+    }
+    ip := register()
+
+    close(stop)
+    b := make([]byte, 256)
+    e.SetReadDeadline(time.Now().Add(3 * time.Second))
+    n, err := e.Read(b)
+    if err != nil { t.Fatal("no re-register notice:", err) }
+    i := 0
+    c, _ := wire.DecodeCommon(b[:n], &i)
+    if c.PC != wire.MsgReRegisterSuper { t.Fatalf("pc %d", c.PC) }
+    rr, ok := wire.DecodeReRegisterSuper(b[:n], &i)
+    if !ok || rr.Sock.Port != 8776 || rr.Sock.AddrV4 != [4]byte{127, 0, 0, 1} { t.Fatalf("successor %+v", rr.Sock) }
+    select {
+    case <-done:
+    case <-time.After(5 * time.Second):
+        t.Fatal("supernode did not stop")
+    }
+    st, err := os.ReadFile(stateFile)
+    if err != nil { t.Fatal(err) }
+    if !strings.Contains(string(st), "02:00:00:00:00:39") { t.Fatalf("state %s", st) }
+
+    // a restart from the state keeps the lease and serves management until
+    // it is stopped there
+    go func() { done <- sn.RunOptions(sn.Options{Bind: "127.0.0.1", Port: lp, MgmtPort: mp, StateFile: stateFile}) }()
+    time.Sleep(100 * time.Millisecond)
+    mc, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: mp})
+    if err != nil { t.Fatal(err) }
+    defer mc.Close()
+    rows := mgmtRows(t, mc, "r 1 edges")
+    if len(rows) != 1 || rows[0]["macaddr"] != "02:00:00:00:00:39" { t.Fatalf("restored edges %v", rows) }
+    if got := register(); got != ip { t.Fatalf("lease %x after restart, want %x", got, ip) }
+    mgmtRows(t, mc, "w 2 stop")
+    select {
+    case <-done:
+    case <-time.After(5 * time.Second):
+        t.Fatal("supernode did not stop on management request")
+    }
+}
@@ -0,0 +1,111 @@
+package integration
+
+import (
+    "fmt"
+    "net"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+    "n2n-go/pkg/sn"
+    "n2n-go/pkg/transport"
+    "n2n-go/pkg/wire"
+)
+
+// startSupernode runs a supernode on 127.0.0.1:port with the given number
+// of workers until the test ends.
+func startSupernode(tb testing.TB, port, workers int) *net.UDPAddr {
+    tb.Helper()
+    stop := make(chan struct{})
+    done := make(chan error, 1)
+    go func() { done <- sn.RunOptions(sn.Options{Bind: "127.0.0.1", Port: port, Workers: workers, Stop: stop}) }()
+    tb.Cleanup(func() {
+        close(stop)
+        <-done
+    })
+    time.Sleep(100 * time.Millisecond)
+    return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+}
+
+func benchMac(i int) wire.Mac { return wire.Mac{0x02, 0, 0, 0x47, byte(i >> 8), byte(i)} }
+
+// registerEdges registers n edges of community with the supernode, each
+// on a socket of its own, and returns the sockets.
+func registerEdges(tb testing.TB, snAddr *net.UDPAddr, community string, n int) []*transport.UDPListener {
+    tb.Helper()
+    var edges []*transport.UDPListener
+    for i := 0; i < n; i++ {
+        l, err := transport.ListenUDP("127.0.0.1", 0)
+        if err != nil { tb.Fatal(err) }
+        tb.Cleanup(func() { l.Close() })
+        rc := wire.Common{TTL: 2, PC: wire.MsgRegisterSuper, Flags: 0}
+        copy(rc.Community[:], community)
+        buf := make([]byte, 256)
+        m := wire.EncodeRegisterSuper(rc, wire.RegisterSuper{EdgeMac: benchMac(i)}, buf)
+        l.WriteTo(buf[:m], snAddr)
+        l.SetReadDeadline(time.Now().Add(time.Second))
+        if _, _, err := l.Read(buf); err != nil { tb.Fatalf("edge %d: %v", i, err) }
+        edges = append(edges, l)
+    }
+    return edges
+}
+
+// benchPacket is a PACKET from edge i to edge j with a 1400 byte payload.
+func benchPacket(community string, i, j int) []byte {
+    pc := wire.Common{TTL: 2, PC: wire.MsgPacket, Flags: 0}
+    copy(pc.Community[:], community)
+    out := make([]byte, 2048)
+    m := wire.EncodePacket(pc, wire.Packet{SrcMac: benchMac(i), DstMac: benchMac(j)}, make([]byte, 1400), out)
+    return out[:m]
+}
+
+func TestSupernodeWorkers(t *testing.T) {
+    snAddr := startSupernode(t, 8782, 4)
+    edges := registerEdges(t, snAddr, "workers", 16)
+    // whichever socket an edge landed on, every other edge is reachable
+    for i := range edges {
+        j := (i + 5) % len(edges)
+        edges[i].WriteTo(benchPacket("workers", i, j), snAddr)
+        buf := make([]byte, 2048)
+        edges[j].SetReadDeadline(time.Now().Add(time.Second))
+        n, _, err := edges[j].Read(buf)
+        if err != nil { t.Fatalf("%d -> %d: %v", i, j, err) }
+        k := 0
+        wire.DecodeCommon(buf[:n], &k)
+        pkt, ok, _ := wire.DecodePacket(buf[:n], &k, make([]byte, 2048))
+        if !ok || pkt.SrcMac != benchMac(i) { t.Fatalf("%d -> %d: %x", i, j, buf[:n]) }
+    }
+}
+
+// BenchmarkSupernodeWorkers is a load generator: 16 pairs of edges relay
+// through the supernode at once. Run it with -cpu to see the workers
+// scale with the cores.
+func BenchmarkSupernodeWorkers(b *testing.B) {
+    const pairs = 16
+    for w, workers := range []int{1, 2, 4, 8} {
+        b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+            snAddr := startSupernode(b, 8783+w, workers)
+            edges := registerEdges(b, snAddr, "bench", 2*pairs)
+            got := make([]atomic.Int64, pairs)
+            stop := make(chan struct{})
+            var wgs []*sync.WaitGroup
+            b.SetBytes(int64(len(benchPacket("bench", 0, 1))))
+            b.ResetTimer()
+            for p := 0; p < pairs; p++ {
+                wgs = append(wgs, pumpUDP(edges[2*p], edges[2*p+1], snAddr, benchPacket("bench", 2*p, 2*p+1), true, &got[p], stop))
+            }
+            deadline := time.Now().Add(time.Minute)
+            for {
+                var sum int64
+                for p := range got { sum += got[p].Load() }
+                if sum >= int64(b.N) { break }
+                if time.Now().After(deadline) { b.Fatalf("%d of %d packets", sum, b.N) }
+                time.Sleep(100 * time.Microsecond)
+            }
+            b.StopTimer()
+            b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "pkts/s")
+            close(stop)
+            for _, wg := range wgs { wg.Wait() }
+        })
+    }
+}
@@ -0,0 +1,176 @@
+package integration
+
+import (
+    "bytes"
+    "fmt"
+    "net"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+    "n2n-go/pkg/transport"
+)
+
+func localAddr(l *transport.UDPListener) *net.UDPAddr {
+    a := l.Conn.LocalAddr().(*net.UDPAddr)
+    return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: a.Port}
+}
+
+// readAll reads batches from l until n datagrams arrived.
+func readAll(t *testing.T, l *transport.UDPListener, n int) []transport.Message {
+    t.Helper()
+    var got []transport.Message
+    in := transport.NewBatch(8, 2048)
+    l.SetReadDeadline(time.Now().Add(2 * time.Second))
+    for len(got) < n {
+        k, err := l.ReadBatch(in)
+        if err != nil { t.Fatalf("%d of %d datagrams: %v", len(got), n, err) }
+        for _, m := range in[:k] { got = append(got, transport.Message{Buf: append([]byte(nil), m.Buf[:m.N]...), N: m.N, Addr: m.Addr}) }
+    }
+    return got
+}
+
+func TestUDPBatch(t *testing.T) {
+    a, err := transport.ListenUDP("127.0.0.1", 0)
+    if err != nil { t.Fatal(err) }
+    defer a.Close()
+    // a wildcard bind is a dual stack IPv6 socket
+    b, err := transport.ListenUDP("0.0.0.0", 0)
+    if err != nil { t.Fatal(err) }
+    defer b.Close()
+
+    var out []transport.Message
+    for i := 0; i < 20; i++ {
+        p := bytes.Repeat([]byte{byte(i)}, 1+i*70)
+        out = append(out, transport.Message{Buf: p, N: len(p), Addr: localAddr(b)})
+    }
+    // an IPv6 destination the IPv4 socket cannot reach is skipped
+    out[5].Addr = &net.UDPAddr{IP: net.ParseIP("::1"), Port: localAddr(b).Port}
+    if n, err := a.WriteBatch(out); n != len(out)-1 || err == nil { t.Fatalf("write %d %v", n, err) }
+    got := readAll(t, b, 19)
+    for i, m := range got {
+        want := out[i]
+        if i >= 5 { want = out[i+1] }
+        if !bytes.Equal(m.Buf, want.Buf) { t.Fatalf("datagram %d: %d bytes", i, m.N) }
+        if m.Addr.Port != localAddr(a).Port || !m.Addr.IP.Equal(net.IPv4(127, 0, 0, 1)) { t.Fatalf("from %v", m.Addr) }
+    }
+
+    // and back, with the IPv4 address mapped for the IPv6 socket
+    back := []transport.Message{{Buf: []byte("pong"), N: 4, Addr: localAddr(a)}}
+    if _, err := b.WriteBatch(back); err != nil { t.Fatal(err) }
+    if got := readAll(t, a, 1); string(got[0].Buf) != "pong" { t.Fatalf("got %q", got[0].Buf) }
+
+    // an expired deadline is a timeout like for Read
+    a.SetReadDeadline(time.Now())
+    _, err = a.ReadBatch(transport.NewBatch(4, 64))
+    if ne, ok := err.(net.Error); !ok || !ne.Timeout() { t.Fatalf("err %v", err) }
+}
+
+// pumpUDP sends datagrams from src to dst until stop is closed, keeping a
+// window of them in flight, and counts those that arrive. With batch set
+// both sides move batches of transport.MaxBatch datagrams.
+func pumpUDP(src, dst *transport.UDPListener, to *net.UDPAddr, payload []byte, batch bool, got *atomic.Int64, stop chan struct{}) *sync.WaitGroup {
+    const window = 256
+    var sent, lost atomic.Int64
+    var wg sync.WaitGroup
+    wg.Add(2)
+    go func() {
+        defer wg.Done()
+        in := transport.NewBatch(transport.MaxBatch, 2048)
+        for {
+            select {
+            case <-stop:
+                return
+            default:
+            }
+            dst.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+            var n int
+            var err error
+            if batch {
+                n, err = dst.ReadBatch(in)
+            } else {
+                _, _, err = dst.Read(in[0].Buf)
+                n = 1
+            }
+            if err != nil {
+                // nothing arrives: the rest of the window was lost
+                lost.Store(sent.Load() - got.Load())
+                continue
+            }
+            got.Add(int64(n))
+        }
+    }()
+    go func() {
+        defer wg.Done()
+        out := make([]transport.Message, transport.MaxBatch)
+        for i := range out { out[i] = transport.Message{Buf: payload, N: len(payload), Addr: to} }
+        for {
+            select {
+            case <-stop:
+                return
+            default:
+            }
+            if sent.Load()-got.Load()-lost.Load() >= window-int64(len(out)) {
+                time.Sleep(20 * time.Microsecond)
+                continue
+            }
+            if batch {
+                n, _ := src.WriteBatch(out)
+                sent.Add(int64(n))
+            } else {
+                src.WriteTo(payload, to)
+                sent.Add(1)
+            }
+        }
+    }()
+    return &wg
+}
+
+func waitFor(b *testing.B, got *atomic.Int64) {
+    deadline := time.Now().Add(time.Minute)
+    for got.Load() < int64(b.N) {
+        if time.Now().After(deadline) { b.Fatalf("%d of %d datagrams", got.Load(), b.N) }
+        time.Sleep(100 * time.Microsecond)
+    }
+    b.StopTimer()
+    b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "pkts/s")
+}
+
+// BenchmarkUDPBatch compares one system call per datagram with
+// recvmmsg/sendmmsg batches for 1400 byte datagrams on loopback.
+func BenchmarkUDPBatch(b *testing.B) {
+    for _, batch := range []bool{false, true} {
+        b.Run(fmt.Sprintf("batch=%v", batch), func(b *testing.B) {
+            src, err := transport.ListenUDP("127.0.0.1", 0)
+            if err != nil { b.Fatal(err) }
+            defer src.Close()
+            dst, err := transport.ListenUDP("127.0.0.1", 0)
+            if err != nil { b.Fatal(err) }
+            defer dst.Close()
+            var got atomic.Int64
+            stop := make(chan struct{})
+            b.SetBytes(1400)
+            b.ResetTimer()
+            wg := pumpUDP(src, dst, localAddr(dst), make([]byte, 1400), batch, &got, stop)
+            waitFor(b, &got)
+            close(stop)
+            wg.Wait()
+        })
+    }
+}
+
+// BenchmarkSupernodeForward measures the PACKETs per second the supernode
+// relays between two registered edges on loopback.
+func BenchmarkSupernodeForward(b *testing.B) {
+    snAddr := startSupernode(b, 8781, 1)
+    edges := registerEdges(b, snAddr, "bench", 2)
+    pkt := benchPacket("bench", 0, 1)
+    var got atomic.Int64
+    stop := make(chan struct{})
+    b.SetBytes(int64(len(pkt)))
+    b.ResetTimer()
+    wg := pumpUDP(edges[0], edges[1], snAddr, pkt, true, &got, stop)
+    waitFor(b, &got)
+    close(stop)
+    wg.Wait()
+}
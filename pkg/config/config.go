@@ -0,0 +1,168 @@
+// Package config reads edge and supernode configuration files. A file is
+// either in the C n2n form, one option per line written as on the command
+// line ("-c=mynetwork", "-l supernode:7654", "--management-password=..."),
+// with "#" comments, or a JSON object mapping option names to values:
+//
+//	{"c": "mynetwork", "l": "supernode:7654", "H": true, "v": 1}
+//
+// Both forms use the flag names of the daemon, so every command line
+// option can be set in a file.
+package config
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/json"
+    "flag"
+    "fmt"
+    "os"
+    "strings"
+)
+
+// Setting is one option read from a file.
+type Setting struct {
+    Name  string
+    Value string
+    Line  int
+}
+
+// File is a parsed configuration file.
+type File struct {
+    Path     string
+    Settings []Setting
+}
+
+// Read parses the file at path, detecting its form from the first
+// non-blank character.
+func Read(path string) (*File, error) {
+    b, err := os.ReadFile(path)
+    if err != nil { return nil, err }
+    f := &File{Path: path}
+    if t := bytes.TrimSpace(b); len(t) > 0 && t[0] == '{' {
+        err = f.parseJSON(b)
+    } else {
+        err = f.parseLines(b)
+    }
+    if err != nil { return nil, err }
+    return f, nil
+}
+
+func (f *File) parseLines(b []byte) error {
+    sc := bufio.NewScanner(bytes.NewReader(b))
+    ln := 0
+    for sc.Scan() {
+        ln++
+        line := strings.TrimSpace(sc.Text())
+        if line == "" || strings.HasPrefix(line, "#") { continue }
+        if !strings.HasPrefix(line, "-") { return fmt.Errorf("%s:%d: expected -option[=value], got %q", f.Path, ln, line) }
+        opt := strings.TrimLeft(line, "-")
+        name, value, ok := strings.Cut(opt, "=")
+        if !ok {
+            if i := strings.IndexAny(opt, " \t"); i >= 0 {
+                name, value = opt[:i], opt[i+1:]
+            } else {
+                // a bare option is a boolean switch
+                value = "true"
+            }
+        }
+        name = strings.TrimSpace(name)
+        if name == "" { return fmt.Errorf("%s:%d: empty option name", f.Path, ln) }
+        f.Settings = append(f.Settings, Setting{Name: name, Value: unquote(strings.TrimSpace(value)), Line: ln})
+    }
+    return sc.Err()
+}
+
+func unquote(s string) string {
+    if len(s) >= 2 && (s[0] == '"' && s[len(s)-1] == '"' || s[0] == '\'' && s[len(s)-1] == '\'') { return s[1 : len(s)-1] }
+    return s
+}
+
+// parseJSON reads a flat object. Arrays repeat an option; null skips it.
+func (f *File) parseJSON(b []byte) error {
+    dec := json.NewDecoder(bytes.NewReader(b))
+    dec.UseNumber()
+    line := func() int { return 1 + bytes.Count(b[:dec.InputOffset()], []byte("\n")) }
+    if _, err := dec.Token(); err != nil { return fmt.Errorf("%s:%d: %v", f.Path, line(), err) }
+    for dec.More() {
+        tok, err := dec.Token()
+        if err != nil { return fmt.Errorf("%s:%d: %v", f.Path, line(), err) }
+        name := strings.TrimLeft(tok.(string), "-")
+        ln := line()
+        var v any
+        if err := dec.Decode(&v); err != nil { return fmt.Errorf("%s:%d: %v", f.Path, ln, err) }
+        vals, ok := []any{v}, true
+        if a, isArray := v.([]any); isArray { vals = a }
+        for _, x := range vals {
+            var s string
+            switch x := x.(type) {
+            case nil:
+                continue
+            case string:
+                s = x
+            case json.Number:
+                s = x.String()
+            case bool:
+                s = fmt.Sprint(x)
+            default:
+                ok = false
+            }
+            if !ok { return fmt.Errorf("%s:%d: option %q must be a string, number, boolean or array of them", f.Path, ln, name) }
+            f.Settings = append(f.Settings, Setting{Name: name, Value: s, Line: ln})
+        }
+    }
+    if _, err := dec.Token(); err != nil { return fmt.Errorf("%s:%d: %v", f.Path, line(), err) }
+    return nil
+}
+
+// Lookup returns the last value given for name.
+func (f *File) Lookup(name string) (string, bool) {
+    for i := len(f.Settings) - 1; i >= 0; i-- {
+        if f.Settings[i].Name == name { return f.Settings[i].Value, true }
+    }
+    return "", false
+}
+
+// Apply sets the options of the file on fs, skipping those in keep (the
+// ones given on the command line). Unknown options and invalid values are
+// reported with their line.
+func (f *File) Apply(fs *flag.FlagSet, keep map[string]bool) error {
+    for _, s := range f.Settings {
+        fl := fs.Lookup(s.Name)
+        if fl == nil { return fmt.Errorf("%s:%d: unknown option -%s", f.Path, s.Line, s.Name) }
+        if keep[s.Name] { continue }
+        if err := fs.Set(s.Name, s.Value); err != nil { return fmt.Errorf("%s:%d: invalid value %q for -%s: %v", f.Path, s.Line, s.Value, s.Name, err) }
+    }
+    return nil
+}
+
+// Parse parses args into fs like fs.Parse, then applies the configuration
+// file named by the -config flag or, as with C n2n, by a first argument
+// that is not an option. Options on the command line override the file.
+// It returns the file path, empty when there is none, and the names of
+// the options set on the command line.
+func Parse(fs *flag.FlagSet, args []string) (string, map[string]bool, error) {
+    path := ""
+    if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+        path, args = args[0], args[1:]
+    }
+    if err := fs.Parse(args); err != nil { return "", nil, err }
+    set := map[string]bool{}
+    fs.Visit(func(fl *flag.Flag) { set[fl.Name] = true })
+    if fl := fs.Lookup("config"); fl != nil && set["config"] { path = fl.Value.String() }
+    if path == "" { return "", set, nil }
+    f, err := Read(path)
+    if err != nil { return "", nil, err }
+    if err := f.Apply(fs, set); err != nil { return "", nil, err }
+    return path, set, nil
+}
+
+// Choice defines a string flag that only accepts one of choices.
+func Choice(fs *flag.FlagSet, p *string, name, value, usage string, choices ...string) {
+    *p = value
+    fs.Func(name, fmt.Sprintf("%s (default %q)", usage, value), func(s string) error {
+        for _, c := range choices {
+            if s == c { *p = s; return nil }
+        }
+        return fmt.Errorf("must be one of %s", strings.Join(choices, ", "))
+    })
+}
@@ -0,0 +1,70 @@
+package config
+
+import (
+    "flag"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+type testOpts struct {
+    community string
+    sn        string
+    port      int
+    secure    bool
+    cipher    string
+}
+
+func testFlags(o *testOpts) *flag.FlagSet {
+    fs := flag.NewFlagSet("test", flag.ContinueOnError)
+    fs.SetOutput(new(strings.Builder))
+    fs.StringVar(&o.community, "c", "community", "")
+    fs.StringVar(&o.sn, "l", "", "")
+    fs.IntVar(&o.port, "p", 7655, "")
+    fs.BoolVar(&o.secure, "H", false, "")
+    Choice(fs, &o.cipher, "A", "null", "", "aes", "chacha", "null")
+    fs.String("config", "", "")
+    return fs
+}
+
+func writeConf(t *testing.T, body string) string {
+    p := filepath.Join(t.TempDir(), "edge.conf")
+    if err := os.WriteFile(p, []byte(body), 0600); err != nil { t.Fatal(err) }
+    return p
+}
+
+func TestParseCStyle(t *testing.T) {
+    p := writeConf(t, "# edge\n-c=mynetwork\n-l sn.example.org:7654\n--p=7700\n-H\n-A=\"aes\"\n")
+    var o testOpts
+    path, set, err := Parse(testFlags(&o), []string{p, "-p", "7800"})
+    if err != nil { t.Fatal(err) }
+    if path != p || !set["p"] || set["c"] { t.Fatalf("path %q set %v", path, set) }
+    if o.community != "mynetwork" || o.sn != "sn.example.org:7654" || !o.secure || o.cipher != "aes" { t.Fatalf("%+v", o) }
+    if o.port != 7800 { t.Fatalf("command line did not override the file: %d", o.port) }
+}
+
+func TestParseJSON(t *testing.T) {
+    p := writeConf(t, "{\n  \"c\": \"mynetwork\",\n  \"p\": 7700,\n  \"H\": true,\n  \"l\": [\"a:1\", \"b:2\"]\n}\n")
+    var o testOpts
+    if _, _, err := Parse(testFlags(&o), []string{"-config", p}); err != nil { t.Fatal(err) }
+    if o.community != "mynetwork" || o.port != 7700 || !o.secure || o.sn != "b:2" { t.Fatalf("%+v", o) }
+    f, err := Read(p)
+    if err != nil { t.Fatal(err) }
+    if v, _ := f.Lookup("l"); v != "b:2" { t.Fatalf("lookup %q", v) }
+}
+
+func TestParseErrorsPointAtLine(t *testing.T) {
+    for _, c := range []struct{ body, want string }{
+        {"-c=x\n\n-p=seven\n", ":3: invalid value \"seven\" for -p"},
+        {"-c=x\n-bogus=1\n", ":2: unknown option -bogus"},
+        {"-c=x\nc=y\n", ":2: expected -option"},
+        {"# comment\n-A=des\n", ":2: invalid value \"des\" for -A: must be one of aes, chacha, null"},
+        {"{\n  \"c\": \"x\",\n  \"p\": {\"n\": 1}\n}\n", ":3: option \"p\" must be"},
+        {"{\n  \"c\": \"x\",\n  \"A\": \"des\"\n}\n", ":3: invalid value \"des\" for -A"},
+    } {
+        var o testOpts
+        _, _, err := Parse(testFlags(&o), []string{writeConf(t, c.body)})
+        if err == nil || !strings.Contains(err.Error(), c.want) { t.Errorf("%q: got %v, want %q", c.body, err, c.want) }
+    }
+}
@@ -3,13 +3,18 @@ package crypto
 import (
     "crypto/aes"
     "crypto/cipher"
+    "crypto/sha256"
+    "errors"
+    "io"
     "golang.org/x/crypto/chacha20poly1305"
+    "golang.org/x/crypto/hkdf"
 )
 
 type AEAD interface{
     Seal(dst, nonce, plaintext, ad []byte) []byte
     Open(dst, nonce, ciphertext, ad []byte) ([]byte, error)
     NonceSize() int
+    Overhead() int
 }
 
 type aesgcm struct{ aead cipher.AEAD }
@@ -17,12 +22,14 @@ type aesgcm struct{ aead cipher.AEAD }
 func (a *aesgcm) Seal(dst, nonce, plaintext, ad []byte) []byte { return a.aead.Seal(dst, nonce, plaintext, ad) }
 func (a *aesgcm) Open(dst, nonce, ciphertext, ad []byte) ([]byte, error) { return a.aead.Open(dst, nonce, ciphertext, ad) }
 func (a *aesgcm) NonceSize() int { return a.aead.NonceSize() }
+func (a *aesgcm) Overhead() int { return a.aead.Overhead() }
 
 type chachaaead struct{ aead cipher.AEAD }
 
 func (c *chachaaead) Seal(dst, nonce, plaintext, ad []byte) []byte { return c.aead.Seal(dst, nonce, plaintext, ad) }
 func (c *chachaaead) Open(dst, nonce, ciphertext, ad []byte) ([]byte, error) { return c.aead.Open(dst, nonce, ciphertext, ad) }
 func (c *chachaaead) NonceSize() int { return c.aead.NonceSize() }
+func (c *chachaaead) Overhead() int { return c.aead.Overhead() }
 
 func NewAESGCM(key []byte) (AEAD, error) {
     blk, err := aes.NewCipher(key)
@@ -38,3 +45,22 @@ func NewChaCha(key []byte) (AEAD, error) {
     return &chachaaead{aead: a}, nil
 }
 
+// New returns the AEAD selected by the edge -A option ("aes" or "chacha").
+func New(name string, key []byte) (AEAD, error) {
+    switch name {
+    case "aes":
+        return NewAESGCM(key)
+    case "chacha":
+        return NewChaCha(key)
+    }
+    return nil, errors.New("unknown cipher " + name)
+}
+
+// DeriveKey expands a community secret into a 32 byte AEAD key using
+// HKDF-SHA256 with the community name as salt.
+func DeriveKey(secret []byte, community string) []byte {
+    mk := make([]byte, 32)
+    rdr := hkdf.New(sha256.New, secret, []byte(community), nil)
+    io.ReadFull(rdr, mk)
+    return mk
+}
@@ -0,0 +1,64 @@
+package crypto
+
+import (
+    "bufio"
+    "crypto/ed25519"
+    crand "crypto/rand"
+    "encoding/base64"
+    "errors"
+    "fmt"
+    "net"
+    "os"
+    "strings"
+)
+
+// An edge identity is a long-term Ed25519 key. With identities the X25519
+// keys of a session handshake are signed, and a peer accepts them only
+// under the key its trust file lists for the sender MAC, so members of the
+// community can no longer sit in the middle of the exchange.
+
+// LoadIdentity reads the base64 Ed25519 seed in path. A missing file is
+// created with a new key, readable by the owner only.
+func LoadIdentity(path string) (ed25519.PrivateKey, error) {
+    b, err := os.ReadFile(path)
+    if errors.Is(err, os.ErrNotExist) {
+        seed := make([]byte, ed25519.SeedSize)
+        if _, err := crand.Read(seed); err != nil { return nil, err }
+        if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(seed)+"\n"), 0600); err != nil { return nil, err }
+        return ed25519.NewKeyFromSeed(seed), nil
+    }
+    if err != nil { return nil, err }
+    seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+    if err != nil || len(seed) != ed25519.SeedSize { return nil, fmt.Errorf("%s: not a base64 Ed25519 seed", path) }
+    return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// IdentityString is the form of an identity's public key in trust files.
+func IdentityString(id ed25519.PrivateKey) string {
+    return base64.StdEncoding.EncodeToString(id.Public().(ed25519.PublicKey))
+}
+
+// LoadTrust reads a trust file: one "<mac> <base64 public key>" line per
+// edge, # starts a comment.
+func LoadTrust(path string) (map[[6]byte]ed25519.PublicKey, error) {
+    f, err := os.Open(path)
+    if err != nil { return nil, err }
+    defer f.Close()
+    trust := map[[6]byte]ed25519.PublicKey{}
+    sc := bufio.NewScanner(f)
+    ln := 0
+    for sc.Scan() {
+        ln++
+        line := strings.TrimSpace(sc.Text())
+        if i := strings.IndexByte(line, '#'); i >= 0 { line = strings.TrimSpace(line[:i]) }
+        if line == "" { continue }
+        fs := strings.Fields(line)
+        if len(fs) != 2 { return nil, fmt.Errorf("%s:%d: want \"<mac> <public key>\"", path, ln) }
+        hw, err := net.ParseMAC(fs[0])
+        if err != nil || len(hw) != 6 { return nil, fmt.Errorf("%s:%d: bad mac %q", path, ln, fs[0]) }
+        pub, err := base64.StdEncoding.DecodeString(fs[1])
+        if err != nil || len(pub) != ed25519.PublicKeySize { return nil, fmt.Errorf("%s:%d: bad public key", path, ln) }
+        trust[[6]byte(hw)] = pub
+    }
+    return trust, sc.Err()
+}
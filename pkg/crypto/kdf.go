@@ -0,0 +1,99 @@
+package crypto
+
+import (
+    "crypto/sha256"
+    "errors"
+    "fmt"
+    "strconv"
+    "strings"
+    "golang.org/x/crypto/argon2"
+    "golang.org/x/crypto/scrypt"
+)
+
+// KDF turns a community secret into a 32 byte AEAD key. All edges of a
+// community must use the same KDF and parameters; String returns the
+// canonical spec accepted by ParseKDF so it can be compared and distributed.
+type KDF interface {
+    Derive(secret []byte, community string) ([]byte, error)
+    String() string
+}
+
+// HKDF is the default KDF, suitable for high entropy raw keys only.
+type HKDF struct{}
+
+func (HKDF) Derive(secret []byte, community string) ([]byte, error) { return DeriveKey(secret, community), nil }
+func (HKDF) String() string { return "hkdf" }
+
+// Scrypt derives keys from passphrases with scrypt.
+type Scrypt struct {
+    N, R, P int
+}
+
+func (s Scrypt) Derive(secret []byte, community string) ([]byte, error) {
+    return scrypt.Key(secret, kdfSalt(community), s.N, s.R, s.P, 32)
+}
+
+func (s Scrypt) String() string { return fmt.Sprintf("scrypt:n=%d,r=%d,p=%d", s.N, s.R, s.P) }
+
+// Argon2id derives keys from passphrases with Argon2id. Memory is in KiB.
+type Argon2id struct {
+    Time    uint32
+    Memory  uint32
+    Threads uint8
+}
+
+func (a Argon2id) Derive(secret []byte, community string) ([]byte, error) {
+    return argon2.IDKey(secret, kdfSalt(community), a.Time, a.Memory, a.Threads, 32), nil
+}
+
+func (a Argon2id) String() string { return fmt.Sprintf("argon2id:t=%d,m=%d,p=%d", a.Time, a.Memory, a.Threads) }
+
+// kdfSalt derives a deterministic salt from the community name so that every
+// edge of the community computes the same key.
+func kdfSalt(community string) []byte {
+    h := sha256.Sum256([]byte("n2n-go kdf salt\x00" + community))
+    return h[:16]
+}
+
+// ParseKDF parses a KDF spec: "hkdf", "scrypt[:n=N,r=R,p=P]" or
+// "argon2id[:t=T,m=KiB,p=P]". Omitted parameters take their defaults
+// (scrypt n=32768,r=8,p=1; argon2id t=3,m=65536,p=4).
+func ParseKDF(spec string) (KDF, error) {
+    name, args, _ := strings.Cut(strings.TrimSpace(spec), ":")
+    params := map[string]int{}
+    if args != "" {
+        for _, kv := range strings.Split(args, ",") {
+            k, v, ok := strings.Cut(kv, "=")
+            if !ok { return nil, fmt.Errorf("kdf %s: bad parameter %q", name, kv) }
+            n, err := strconv.Atoi(v)
+            if err != nil || n <= 0 { return nil, fmt.Errorf("kdf %s: bad value for %s", name, k) }
+            params[strings.ToLower(k)] = n
+        }
+    }
+    get := func(k string, def int) int {
+        if v, ok := params[k]; ok {
+            delete(params, k)
+            return v
+        }
+        return def
+    }
+    var kdf KDF
+    switch strings.ToLower(name) {
+    case "", "hkdf":
+        kdf = HKDF{}
+    case "scrypt":
+        s := Scrypt{N: get("n", 32768), R: get("r", 8), P: get("p", 1)}
+        if s.N < 2 || s.N&(s.N-1) != 0 { return nil, errors.New("kdf scrypt: n must be a power of two") }
+        if uint64(s.R)*uint64(s.P) >= 1<<30 { return nil, errors.New("kdf scrypt: r*p too large") }
+        kdf = s
+    case "argon2id":
+        t, m, p := get("t", 3), get("m", 65536), get("p", 4)
+        if p > 255 { return nil, errors.New("kdf argon2id: p must be at most 255") }
+        if m < 8*p { return nil, errors.New("kdf argon2id: m must be at least 8*p KiB") }
+        kdf = Argon2id{Time: uint32(t), Memory: uint32(m), Threads: uint8(p)}
+    default:
+        return nil, fmt.Errorf("unknown kdf %q", name)
+    }
+    for k := range params { return nil, fmt.Errorf("kdf %s: unknown parameter %s", name, k) }
+    return kdf, nil
+}
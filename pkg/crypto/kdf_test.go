@@ -0,0 +1,40 @@
+package crypto
+
+import (
+    "bytes"
+    "testing"
+)
+
+func TestParseKDF(t *testing.T) {
+    for spec, want := range map[string]string{
+        "": "hkdf",
+        "hkdf": "hkdf",
+        "scrypt": "scrypt:n=32768,r=8,p=1",
+        "scrypt:n=1024,r=4": "scrypt:n=1024,r=4,p=1",
+        "argon2id:t=1,m=64,p=2": "argon2id:t=1,m=64,p=2",
+    } {
+        k, err := ParseKDF(spec)
+        if err != nil || k.String() != want { t.Fatalf("%q: got %v %v", spec, k, err) }
+        if again, err := ParseKDF(k.String()); err != nil || again.String() != want { t.Fatalf("%q: not canonical", spec) }
+    }
+    for _, bad := range []string{"md5", "scrypt:n=1000", "argon2id:m=4,p=2", "scrypt:x=1", "argon2id:t"} {
+        if _, err := ParseKDF(bad); err == nil { t.Fatalf("%q accepted", bad) }
+    }
+}
+
+func TestKDFDeterministicPerCommunity(t *testing.T) {
+    for _, spec := range []string{"hkdf", "scrypt:n=1024,r=8,p=1", "argon2id:t=1,m=64,p=1"} {
+        k, _ := ParseKDF(spec)
+        a, _ := k.Derive([]byte("passphrase"), "community")
+        b, _ := k.Derive([]byte("passphrase"), "community")
+        c, _ := k.Derive([]byte("passphrase"), "other")
+        if len(a) != 32 || !bytes.Equal(a, b) || bytes.Equal(a, c) { t.Fatal(spec) }
+    }
+}
+
+func TestKeyRingKDFDirective(t *testing.T) {
+    p := writeRing(t, "kdf scrypt:n=1024,r=8,p=1\n1 passphrase\n")
+    r, err := LoadKeyRing(p, "aes", "community", nil)
+    if err != nil { t.Fatal(err) }
+    if r.KDF().String() != "scrypt:n=1024,r=8,p=1" { t.Fatal(r.KDF()) }
+}
@@ -0,0 +1,175 @@
+package crypto
+
+import (
+    "bufio"
+    "errors"
+    "fmt"
+    "os"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// KeyIDSize is the length of the key id prefixed to payloads sealed with a
+// key ring key.
+const KeyIDSize = 4
+
+// Key is one entry of a KeyRing. ID follows the RegisterSuper KeyTime
+// convention: by default it is the unix time at which the key becomes valid.
+type Key struct {
+    ID        uint32
+    NotBefore time.Time
+    NotAfter  time.Time
+    Transform *Transform
+}
+
+// Active reports whether the key may be used for encryption at now.
+func (k *Key) Active(now time.Time) bool {
+    if !k.NotBefore.IsZero() && now.Before(k.NotBefore) { return false }
+    if !k.NotAfter.IsZero() && !now.Before(k.NotAfter) { return false }
+    return true
+}
+
+// KeyRing holds the community keys an edge accepts. Encryption always uses
+// the newest active key while decryption uses whichever key the sender named,
+// so keys can be rotated without restarting every edge at once.
+type KeyRing struct {
+    mu        sync.RWMutex
+    path      string
+    cipher    string
+    community string
+    defKDF    KDF
+    kdf       KDF
+    keys      []*Key
+}
+
+// LoadKeyRing reads a key ring file. Each non-empty line not starting with
+// '#' has the form
+//
+//     <id> <secret> [<not_before> [<not_after>]]
+//
+// where times are unix seconds or RFC 3339 and "-" leaves a bound open. When
+// not_before is omitted the id is used as the key time. Secrets are derived
+// with kdf and the community name, like the -k option; a "kdf <spec>" line
+// in the file overrides kdf so the ring file pins the KDF for the community.
+func LoadKeyRing(path, cipher, community string, kdf KDF) (*KeyRing, error) {
+    if kdf == nil { kdf = HKDF{} }
+    r := &KeyRing{path: path, cipher: cipher, community: community, defKDF: kdf}
+    if err := r.Reload(); err != nil { return nil, err }
+    return r, nil
+}
+
+// Reload re-reads the key ring file. On error the previous keys are kept.
+func (r *KeyRing) Reload() error {
+    if err := CheckKeyFile(r.path); err != nil { return err }
+    f, err := os.Open(r.path)
+    if err != nil { return err }
+    defer f.Close()
+    kdf := r.defKDF
+    var lines []string
+    var lnos []int
+    sc := bufio.NewScanner(f)
+    ln := 0
+    for sc.Scan() {
+        ln++
+        line := strings.TrimSpace(sc.Text())
+        if line == "" || strings.HasPrefix(line, "#") { continue }
+        if spec, ok := strings.CutPrefix(line, "kdf "); ok {
+            if kdf, err = ParseKDF(spec); err != nil { return fmt.Errorf("%s:%d: %v", r.path, ln, err) }
+            continue
+        }
+        lines = append(lines, line)
+        lnos = append(lnos, ln)
+    }
+    if err := sc.Err(); err != nil { return err }
+    var keys []*Key
+    seen := map[uint32]bool{}
+    for i, line := range lines {
+        k, err := r.parseLine(line, kdf)
+        if err != nil { return fmt.Errorf("%s:%d: %v", r.path, lnos[i], err) }
+        if seen[k.ID] { return fmt.Errorf("%s:%d: duplicate key id %d", r.path, lnos[i], k.ID) }
+        seen[k.ID] = true
+        keys = append(keys, k)
+    }
+    if len(keys) == 0 { return errors.New(r.path + ": no keys") }
+    sort.Slice(keys, func(i, j int) bool {
+        if !keys[i].NotBefore.Equal(keys[j].NotBefore) { return keys[i].NotBefore.Before(keys[j].NotBefore) }
+        return keys[i].ID < keys[j].ID
+    })
+    r.mu.Lock()
+    r.keys = keys
+    r.kdf = kdf
+    r.mu.Unlock()
+    return nil
+}
+
+func (r *KeyRing) parseLine(line string, kdf KDF) (*Key, error) {
+    fs := strings.Fields(line)
+    if len(fs) < 2 || len(fs) > 4 { return nil, errors.New("expected <id> <secret> [<not_before> [<not_after>]]") }
+    id, err := strconv.ParseUint(fs[0], 10, 32)
+    if err != nil { return nil, fmt.Errorf("bad key id %q", fs[0]) }
+    k := &Key{ID: uint32(id), NotBefore: time.Unix(int64(id), 0)}
+    if len(fs) >= 3 {
+        if k.NotBefore, err = parseKeyTime(fs[2]); err != nil { return nil, err }
+    }
+    if len(fs) >= 4 {
+        if k.NotAfter, err = parseKeyTime(fs[3]); err != nil { return nil, err }
+    }
+    mk, err := kdf.Derive([]byte(fs[1]), r.community)
+    if err != nil { return nil, err }
+    t, err := NewTransformKey(r.cipher, mk)
+    Wipe(mk)
+    if err != nil { return nil, err }
+    k.Transform = t
+    return k, nil
+}
+
+func parseKeyTime(s string) (time.Time, error) {
+    if s == "-" { return time.Time{}, nil }
+    if n, err := strconv.ParseInt(s, 10, 64); err == nil { return time.Unix(n, 0), nil }
+    t, err := time.Parse(time.RFC3339, s)
+    if err != nil { return time.Time{}, fmt.Errorf("bad time %q", s) }
+    return t, nil
+}
+
+// KDF returns the key derivation function the ring was loaded with.
+func (r *KeyRing) KDF() KDF {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    return r.kdf
+}
+
+// Current returns the newest key that is active at now, or nil.
+func (r *KeyRing) Current(now time.Time) *Key {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    for i := len(r.keys) - 1; i >= 0; i-- {
+        if r.keys[i].Active(now) { return r.keys[i] }
+    }
+    return nil
+}
+
+// Lookup returns the key with the given id unless it is unknown or expired.
+// Keys that are not yet valid are accepted so that peers which switched to a
+// new key slightly earlier can still be decrypted.
+func (r *KeyRing) Lookup(id uint32, now time.Time) *Key {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    for _, k := range r.keys {
+        if k.ID != id { continue }
+        if !k.NotAfter.IsZero() && !now.Before(k.NotAfter) { return nil }
+        return k
+    }
+    return nil
+}
+
+// Keys returns a snapshot of the ring ordered from oldest to newest.
+func (r *KeyRing) Keys() []Key {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    out := make([]Key, 0, len(r.keys))
+    for _, k := range r.keys { out = append(out, *k) }
+    return out
+}
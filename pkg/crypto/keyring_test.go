@@ -0,0 +1,39 @@
+package crypto
+
+import (
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func writeRing(t *testing.T, body string) string {
+    p := filepath.Join(t.TempDir(), "keys")
+    if err := os.WriteFile(p, []byte(body), 0600); err != nil { t.Fatal(err) }
+    return p
+}
+
+func TestKeyRingRotation(t *testing.T) {
+    p := writeRing(t, "# old and new key\n1000 oldsecret 1000 3000\n2000 newsecret\n")
+    r, err := LoadKeyRing(p, "aes", "community", nil)
+    if err != nil { t.Fatal(err) }
+    if k := r.Current(time.Unix(1500, 0)); k == nil || k.ID != 1000 { t.Fatal("current before rotation") }
+    if k := r.Current(time.Unix(2500, 0)); k == nil || k.ID != 2000 { t.Fatal("current after rotation") }
+    if r.Lookup(1000, time.Unix(2500, 0)) == nil { t.Fatal("old key rejected inside window") }
+    if r.Lookup(1000, time.Unix(3000, 0)) != nil { t.Fatal("old key accepted after expiry") }
+    if r.Lookup(2000, time.Unix(1500, 0)) == nil { t.Fatal("early key rejected") }
+    ct, _ := r.Lookup(2000, time.Unix(2500, 0)).Transform.Seal(nil, []byte("frame"), nil)
+    if _, err := r.Lookup(1000, time.Unix(2500, 0)).Transform.Open(nil, ct, nil); err == nil { t.Fatal("keys not distinct") }
+}
+
+func TestKeyRingReloadKeepsOldOnError(t *testing.T) {
+    p := writeRing(t, "1 secret\n")
+    r, err := LoadKeyRing(p, "chacha", "community", nil)
+    if err != nil { t.Fatal(err) }
+    if err := os.WriteFile(p, []byte("x secret\n"), 0600); err != nil { t.Fatal(err) }
+    if err := r.Reload(); err == nil { t.Fatal("bad id accepted") }
+    if len(r.Keys()) != 1 { t.Fatal("keys lost") }
+    if err := os.WriteFile(p, []byte("1 secret\n2 other\n"), 0600); err != nil { t.Fatal(err) }
+    if err := r.Reload(); err != nil { t.Fatal(err) }
+    if k := r.Current(time.Unix(10, 0)); k == nil || k.ID != 2 { t.Fatal("reload not applied") }
+}
@@ -0,0 +1,72 @@
+package crypto
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "os"
+    "path/filepath"
+    "runtime"
+)
+
+// CredentialName is the systemd credential (LoadCredential=) holding the
+// community secret.
+const CredentialName = "n2n-key"
+
+// KeyEnv is the environment variable holding the community secret.
+const KeyEnv = "N2N_KEY"
+
+// ReadKeyFile reads a secret from path, stripping one trailing newline. On
+// unix systems files that group or others can access are refused.
+func ReadKeyFile(path string) ([]byte, error) {
+    if err := CheckKeyFile(path); err != nil { return nil, err }
+    b, err := os.ReadFile(path)
+    if err != nil { return nil, err }
+    b = bytes.TrimSuffix(b, []byte("\n"))
+    b = bytes.TrimSuffix(b, []byte("\r"))
+    if len(b) == 0 { return nil, errors.New(path + ": empty key file") }
+    return b, nil
+}
+
+// CheckKeyFile verifies that a file holding key material is not accessible
+// by group or others.
+func CheckKeyFile(path string) error {
+    fi, err := os.Stat(path)
+    if err != nil { return err }
+    if runtime.GOOS != "windows" && fi.Mode().Perm()&0077 != 0 {
+        return fmt.Errorf("%s: key file mode %04o is accessible by group or others, use chmod 600", path, fi.Mode().Perm())
+    }
+    return nil
+}
+
+// LookupSecret resolves the community secret from, in order, a key file,
+// the -k value, the N2N_KEY environment variable and the systemd credential
+// directory. It returns the secret, a description of its source for logging,
+// and nil, "", nil when no secret is configured. N2N_KEY is removed from the
+// environment once read so child processes do not inherit it.
+func LookupSecret(flagValue, file string) ([]byte, string, error) {
+    if file != "" {
+        b, err := ReadKeyFile(file)
+        if err != nil { return nil, "", err }
+        return b, "file " + file, nil
+    }
+    if flagValue != "" { return []byte(flagValue), "command line", nil }
+    if v, ok := os.LookupEnv(KeyEnv); ok && v != "" {
+        os.Unsetenv(KeyEnv)
+        return []byte(v), "environment " + KeyEnv, nil
+    }
+    if dir := os.Getenv("CREDENTIALS_DIRECTORY"); dir != "" {
+        p := filepath.Join(dir, CredentialName)
+        if _, err := os.Stat(p); err == nil {
+            b, err := ReadKeyFile(p)
+            if err != nil { return nil, "", err }
+            return b, "credential " + CredentialName, nil
+        }
+    }
+    return nil, "", nil
+}
+
+// Wipe overwrites key material that is no longer needed.
+func Wipe(b []byte) {
+    for i := range b { b[i] = 0 }
+}
@@ -0,0 +1,29 @@
+package crypto
+
+import (
+    "os"
+    "path/filepath"
+    "runtime"
+    "testing"
+)
+
+func TestReadKeyFilePermissions(t *testing.T) {
+    p := filepath.Join(t.TempDir(), "key")
+    if err := os.WriteFile(p, []byte("secret\n"), 0600); err != nil { t.Fatal(err) }
+    b, err := ReadKeyFile(p)
+    if err != nil || string(b) != "secret" { t.Fatal("read", err) }
+    if runtime.GOOS == "windows" { return }
+    if err := os.Chmod(p, 0644); err != nil { t.Fatal(err) }
+    if _, err := ReadKeyFile(p); err == nil { t.Fatal("world readable key accepted") }
+}
+
+func TestLookupSecretOrder(t *testing.T) {
+    dir := t.TempDir()
+    if err := os.WriteFile(filepath.Join(dir, CredentialName), []byte("cred"), 0400); err != nil { t.Fatal(err) }
+    t.Setenv("CREDENTIALS_DIRECTORY", dir)
+    if b, _, _ := LookupSecret("", ""); string(b) != "cred" { t.Fatal("credential") }
+    t.Setenv(KeyEnv, "env")
+    if b, _, _ := LookupSecret("", ""); string(b) != "env" { t.Fatal("env") }
+    if _, ok := os.LookupEnv(KeyEnv); ok { t.Fatal("env not cleared") }
+    if b, _, _ := LookupSecret("flag", ""); string(b) != "flag" { t.Fatal("flag") }
+}
@@ -0,0 +1,246 @@
+package crypto
+
+import (
+    "bytes"
+    "crypto/ed25519"
+    crand "crypto/rand"
+    "crypto/sha256"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "sync"
+    "time"
+    "golang.org/x/crypto/curve25519"
+    "golang.org/x/crypto/hkdf"
+)
+
+// SessionKeyFlag marks a payload key id as a per-peer session key. The low
+// 31 bits carry the session epoch; community and key ring ids stay below it.
+const SessionKeyFlag = 0x80000000
+
+// handshakeRetry limits how often a handshake is started towards one peer.
+const handshakeRetry = 5 * time.Second
+
+// maxSessionPeers bounds the peers Sessions keeps state for, as any
+// community member can make us create some.
+const maxSessionPeers = 4096
+
+// epochBase is where epochs count seconds from. Epochs taken from the clock
+// keep growing across restarts, so a peer can refuse every handshake that
+// is not newer than the session it has, replays included.
+var epochBase = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+const (
+    kindInit = 'I'
+    kindResp = 'R'
+)
+
+type sessionKey struct {
+    epoch   uint32
+    t       *Transform
+    created time.Time
+}
+
+type peerSession struct {
+    priv    [32]byte
+    pub     [32]byte
+    // epoch is the newest handshake seen with the peer
+    epoch   uint32
+    pending bool
+    sentAt  time.Time
+    cur     *sessionKey
+    prev    *sessionKey
+}
+
+// Sessions keeps per-peer keys negotiated with an X25519 exchange. Each pair
+// of edges derives its own key so that other community members cannot read
+// unicast traffic between them; the previous key is retained after a rekey
+// until the next one replaces it. The exchange is only as trustworthy as
+// the keys that authenticate it: without SetIdentity any holder of the
+// community key can answer in a peer's place.
+type Sessions struct {
+    mu        sync.Mutex
+    cipher    string
+    community string
+    rekey     time.Duration
+    peers     map[[6]byte]*peerSession
+    id        ed25519.PrivateKey
+    trust     map[[6]byte]ed25519.PublicKey
+}
+
+func NewSessions(cipher, community string, rekey time.Duration) *Sessions {
+    return &Sessions{cipher: cipher, community: community, rekey: rekey, peers: map[[6]byte]*peerSession{}}
+}
+
+// SetIdentity signs our handshake messages with id and, when trust is not
+// nil, accepts only handshakes signed by the key trust lists for the peer.
+func (s *Sessions) SetIdentity(id ed25519.PrivateKey, trust map[[6]byte]ed25519.PublicKey) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.id, s.trust = id, trust
+}
+
+// transcript is what a handshake message signs: who sends what to whom in
+// which handshake, and for a response the initiator key it answers.
+func (s *Sessions) transcript(kind byte, epoch uint32, src, dst [6]byte, pub, initPub []byte) []byte {
+    m := append([]byte("n2n-go kx"), s.community...)
+    m = append(m, 0, kind)
+    m = binary.BigEndian.AppendUint32(m, epoch)
+    m = append(m, src[:]...)
+    m = append(m, dst[:]...)
+    m = append(m, pub...)
+    return append(m, initPub...)
+}
+
+// message is the payload of a handshake message: pub, signed when we have
+// an identity.
+func (s *Sessions) message(kind byte, epoch uint32, src, dst [6]byte, pub, initPub []byte) []byte {
+    msg := append([]byte(nil), pub...)
+    if s.id == nil { return msg }
+    return append(msg, ed25519.Sign(s.id, s.transcript(kind, epoch, src, dst, pub, initPub))...)
+}
+
+// verify checks a handshake message from peer and returns its public key.
+func (s *Sessions) verify(kind byte, epoch uint32, peer, local [6]byte, msg, initPub []byte) ([]byte, error) {
+    if len(msg) != 32 && len(msg) != 32+ed25519.SignatureSize { return nil, errors.New("bad public key length") }
+    pub := msg[:32]
+    if s.trust == nil { return pub, nil }
+    key := s.trust[peer]
+    if key == nil { return nil, fmt.Errorf("peer %x not in the trust file", peer) }
+    if len(msg) != 32+ed25519.SignatureSize || !ed25519.Verify(key, s.transcript(kind, epoch, peer, local, pub, initPub), msg[32:]) { return nil, fmt.Errorf("peer %x: bad handshake signature", peer) }
+    return pub, nil
+}
+
+// peer returns the state of mac, creating it unless the table is full
+// after dropping stale peers; then it returns nil.
+func (s *Sessions) peer(mac [6]byte, now time.Time) *peerSession {
+    ps := s.peers[mac]
+    if ps != nil { return ps }
+    if len(s.peers) >= maxSessionPeers { s.prune(now) }
+    if len(s.peers) >= maxSessionPeers { return nil }
+    ps = &peerSession{}
+    s.peers[mac] = ps
+    return ps
+}
+
+// prune drops the peers whose handshake went unanswered and those whose key
+// was not renewed for two rekey intervals: traffic would have renewed it.
+func (s *Sessions) prune(now time.Time) {
+    for mac, ps := range s.peers {
+        if ps.cur == nil && now.Sub(ps.sentAt) < handshakeRetry { continue }
+        if ps.cur != nil && now.Sub(ps.cur.created) < 2*s.rekey { continue }
+        delete(s.peers, mac)
+    }
+}
+
+// Initiate starts a handshake from local to peer when there is no usable
+// key or the current one is due for rekeying, and returns the message to
+// send. It returns ok=false when no handshake should be sent, e.g. because
+// one is already in flight.
+func (s *Sessions) Initiate(local, peer [6]byte, now time.Time) (msg []byte, epoch uint32, ok bool) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    ps := s.peer(peer, now)
+    if ps == nil { return nil, 0, false }
+    if ps.cur != nil && now.Sub(ps.cur.created) < s.rekey { return nil, 0, false }
+    if ps.pending && now.Sub(ps.sentAt) < handshakeRetry { return nil, 0, false }
+    if err := newKeyPair(&ps.priv, &ps.pub); err != nil { return nil, 0, false }
+    ps.epoch = max(ps.epoch+1, clockEpoch(now)) &^ SessionKeyFlag
+    if ps.epoch == 0 { ps.epoch = 1 }
+    ps.pending = true
+    ps.sentAt = now
+    return s.message(kindInit, ps.epoch, local, peer, ps.pub[:], nil), ps.epoch, true
+}
+
+func clockEpoch(now time.Time) uint32 {
+    if !now.After(epochBase) { return 0 }
+    return uint32(now.Sub(epochBase) / time.Second)
+}
+
+// HandleInit answers a handshake started by peer, installs the resulting
+// key and returns the response. local is our own MAC; when both sides
+// initiate at the same time the edge with the lower MAC keeps the
+// initiator role and the other init is ignored (ok=false). An epoch not
+// newer than the current session is refused, so a replayed init cannot
+// replace the key.
+func (s *Sessions) HandleInit(local, peer [6]byte, epoch uint32, msg []byte, now time.Time) (resp []byte, ok bool, err error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    epoch &^= SessionKeyFlag
+    peerPub, err := s.verify(kindInit, epoch, peer, local, msg, nil)
+    if err != nil { return nil, false, err }
+    ps := s.peer(peer, now)
+    if ps == nil { return nil, false, errors.New("too many peers") }
+    if ps.cur != nil && epoch <= ps.cur.epoch { return nil, false, fmt.Errorf("stale handshake epoch %d, have %d", epoch, ps.cur.epoch) }
+    if ps.pending && now.Sub(ps.sentAt) < handshakeRetry && bytes.Compare(local[:], peer[:]) < 0 { return nil, false, nil }
+    var priv, pub [32]byte
+    if err := newKeyPair(&priv, &pub); err != nil { return nil, false, err }
+    k, err := s.derive(priv[:], peerPub, peerPub, pub[:])
+    if err != nil { return nil, false, err }
+    ps.pending = false
+    ps.epoch = epoch
+    s.install(ps, k, now)
+    return s.message(kindResp, epoch, local, peer, pub[:], peerPub), true, nil
+}
+
+// HandleResp completes a handshake local initiated.
+func (s *Sessions) HandleResp(local, peer [6]byte, epoch uint32, msg []byte, now time.Time) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    ps := s.peers[peer]
+    if ps == nil || !ps.pending || ps.epoch != epoch&^SessionKeyFlag { return errors.New("unexpected handshake response") }
+    peerPub, err := s.verify(kindResp, ps.epoch, peer, local, msg, ps.pub[:])
+    if err != nil { return err }
+    k, err := s.derive(ps.priv[:], peerPub, ps.pub[:], peerPub)
+    if err != nil { return err }
+    ps.pending = false
+    ps.priv = [32]byte{}
+    s.install(ps, k, now)
+    return nil
+}
+
+func (s *Sessions) install(ps *peerSession, t *Transform, now time.Time) {
+    ps.prev = ps.cur
+    ps.cur = &sessionKey{epoch: ps.epoch, t: t, created: now}
+}
+
+func (s *Sessions) derive(priv, peerPub, initPub, respPub []byte) (*Transform, error) {
+    shared, err := curve25519.X25519(priv, peerPub)
+    if err != nil { return nil, err }
+    info := append([]byte("n2n-go session"), initPub...)
+    info = append(info, respPub...)
+    mk := make([]byte, 32)
+    if _, err := io.ReadFull(hkdf.New(sha256.New, shared, []byte(s.community), info), mk); err != nil { return nil, err }
+    return NewTransformKey(s.cipher, mk)
+}
+
+// Current returns the key id and transform to seal frames for peer, or nil
+// when no session has been established yet.
+func (s *Sessions) Current(peer [6]byte) (uint32, *Transform) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    ps := s.peers[peer]
+    if ps == nil || ps.cur == nil { return 0, nil }
+    return SessionKeyFlag | ps.cur.epoch, ps.cur.t
+}
+
+// Lookup returns the session transform for a key id received from peer.
+func (s *Sessions) Lookup(peer [6]byte, id uint32) *Transform {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    ps := s.peers[peer]
+    if ps == nil { return nil }
+    epoch := id &^ SessionKeyFlag
+    if ps.cur != nil && ps.cur.epoch == epoch { return ps.cur.t }
+    if ps.prev != nil && ps.prev.epoch == epoch { return ps.prev.t }
+    return nil
+}
+
+func newKeyPair(priv, pub *[32]byte) error {
+    if _, err := crand.Read(priv[:]); err != nil { return err }
+    p, err := curve25519.X25519(priv[:], curve25519.Basepoint)
+    if err != nil { return err }
+    copy(pub[:], p)
+    return nil
+}
@@ -0,0 +1,126 @@
+package crypto
+
+import (
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func TestSessionHandshake(t *testing.T) {
+    macA := [6]byte{0, 0, 0, 0, 0, 1}
+    macB := [6]byte{0, 0, 0, 0, 0, 2}
+    a := NewSessions("chacha", "community", time.Minute)
+    b := NewSessions("chacha", "community", time.Minute)
+    now := time.Unix(1000, 0)
+    msgA, epoch, ok := a.Initiate(macA, macB, now)
+    if !ok { t.Fatal("initiate") }
+    if _, _, again := a.Initiate(macA, macB, now); again { t.Fatal("duplicate initiate") }
+    msgB, ok, err := b.HandleInit(macB, macA, epoch, msgA, now)
+    if err != nil || !ok { t.Fatal("handle init", err) }
+    if err := a.HandleResp(macA, macB, epoch, msgB, now); err != nil { t.Fatal(err) }
+    idA, sa := a.Current(macB)
+    idB, sb := b.Current(macA)
+    if sa == nil || sb == nil || idA != idB || idA&SessionKeyFlag == 0 { t.Fatal("keys not installed") }
+    ct, _ := sa.Seal(nil, []byte("frame"), nil)
+    pt, err := b.Lookup(macA, idA).Open(nil, ct, nil)
+    if err != nil || string(pt) != "frame" { t.Fatal("session keys differ") }
+    other := NewSessions("chacha", "community", time.Minute)
+    if _, _, ok := other.Initiate(macB, macA, now); !ok { t.Fatal("third party") }
+    if other.Lookup(macA, idA) != nil { t.Fatal("third party has key") }
+}
+
+func TestSessionRekeyKeepsPrevious(t *testing.T) {
+    macA := [6]byte{0, 0, 0, 0, 0, 1}
+    macB := [6]byte{0, 0, 0, 0, 0, 2}
+    a := NewSessions("aes", "community", time.Minute)
+    b := NewSessions("aes", "community", time.Minute)
+    now := time.Unix(1000, 0)
+    handshake := func() {
+        msg, epoch, ok := a.Initiate(macA, macB, now)
+        if !ok { t.Fatal("initiate") }
+        resp, ok, err := b.HandleInit(macB, macA, epoch, msg, now)
+        if err != nil || !ok { t.Fatal("init", err) }
+        if err := a.HandleResp(macA, macB, epoch, resp, now); err != nil { t.Fatal(err) }
+    }
+    handshake()
+    oldID, _ := a.Current(macB)
+    now = now.Add(2 * time.Minute)
+    handshake()
+    newID, _ := a.Current(macB)
+    if newID == oldID { t.Fatal("no rekey") }
+    if b.Lookup(macA, oldID) == nil || b.Lookup(macA, newID) == nil { t.Fatal("previous key dropped") }
+}
+
+func TestSessionRejectsReplay(t *testing.T) {
+    macA := [6]byte{0, 0, 0, 0, 0, 1}
+    macB := [6]byte{0, 0, 0, 0, 0, 2}
+    a := NewSessions("chacha", "community", time.Minute)
+    b := NewSessions("chacha", "community", time.Minute)
+    now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+    msg, epoch, _ := a.Initiate(macA, macB, now)
+    resp, _, err := b.HandleInit(macB, macA, epoch, msg, now)
+    if err != nil { t.Fatal(err) }
+    if err := a.HandleResp(macA, macB, epoch, resp, now); err != nil { t.Fatal(err) }
+    id, _ := b.Current(macA)
+    if _, ok, err := b.HandleInit(macB, macA, epoch, msg, now.Add(time.Minute)); ok || err == nil { t.Fatal("replayed init accepted") }
+    if cur, _ := b.Current(macA); cur != id { t.Fatal("replay replaced the key") }
+    // a restarted peer starts again from the clock, above the old epoch
+    a2 := NewSessions("chacha", "community", time.Minute)
+    msg, epoch2, _ := a2.Initiate(macA, macB, now.Add(time.Minute))
+    if epoch2 <= epoch { t.Fatalf("epoch %d after %d", epoch2, epoch) }
+    if _, ok, err := b.HandleInit(macB, macA, epoch2, msg, now.Add(time.Minute)); !ok || err != nil { t.Fatal("restarted peer", err) }
+}
+
+func TestSessionIdentity(t *testing.T) {
+    macA := [6]byte{0, 0, 0, 0, 0, 1}
+    macB := [6]byte{0, 0, 0, 0, 0, 2}
+    dir := t.TempDir()
+    idA, err := LoadIdentity(filepath.Join(dir, "a"))
+    if err != nil { t.Fatal(err) }
+    again, err := LoadIdentity(filepath.Join(dir, "a"))
+    if err != nil || !idA.Equal(again) { t.Fatal("identity not kept", err) }
+    idB, _ := LoadIdentity(filepath.Join(dir, "b"))
+    idM, _ := LoadIdentity(filepath.Join(dir, "m"))
+    tf := filepath.Join(dir, "trust")
+    os.WriteFile(tf, []byte("# edges\n00:00:00:00:00:01 "+IdentityString(idA)+"\n00:00:00:00:00:02 "+IdentityString(idB)+"\n"), 0644)
+    trust, err := LoadTrust(tf)
+    if err != nil || len(trust) != 2 { t.Fatal("trust", err) }
+    now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+    a := NewSessions("aes", "community", time.Minute)
+    a.SetIdentity(idA, trust)
+    b := NewSessions("aes", "community", time.Minute)
+    b.SetIdentity(idB, trust)
+    msg, epoch, _ := a.Initiate(macA, macB, now)
+    resp, ok, err := b.HandleInit(macB, macA, epoch, msg, now)
+    if err != nil || !ok { t.Fatal("signed init", err) }
+    if err := a.HandleResp(macA, macB, epoch, resp, now); err != nil { t.Fatal(err) }
+
+    // a member with the community key but another identity cannot stand
+    // in for A, neither signed nor unsigned
+    m := NewSessions("aes", "community", time.Minute)
+    m.SetIdentity(idM, nil)
+    msg, epoch, _ = m.Initiate(macA, macB, now.Add(time.Hour))
+    if _, _, err := b.HandleInit(macB, macA, epoch, msg, now.Add(time.Hour)); err == nil { t.Fatal("forged init accepted") }
+    if _, _, err := b.HandleInit(macB, macA, epoch, msg[:32], now.Add(time.Hour)); err == nil { t.Fatal("unsigned init accepted") }
+    // nor answer in B's place
+    msg, epoch, _ = a.Initiate(macA, macB, now.Add(time.Hour))
+    resp, _, _ = m.HandleInit(macB, macA, epoch, msg, now.Add(time.Hour))
+    if err := a.HandleResp(macA, macB, epoch, resp, now.Add(time.Hour)); err == nil { t.Fatal("forged response accepted") }
+    if _, _, err := b.HandleInit(macB, [6]byte{0, 0, 0, 0, 0, 3}, epoch, msg, now.Add(time.Hour)); err == nil { t.Fatal("unknown peer accepted") }
+}
+
+func TestSessionPeerLimit(t *testing.T) {
+    local := [6]byte{0, 0, 0, 0, 0, 1}
+    s := NewSessions("aes", "community", time.Minute)
+    now := time.Unix(1000, 0)
+    peer := func(i int) [6]byte { return [6]byte{2, 0, 0, byte(i >> 16), byte(i >> 8), byte(i)} }
+    for i := 0; i < maxSessionPeers; i++ {
+        if _, _, ok := s.Initiate(local, peer(i), now); !ok { t.Fatal("initiate", i) }
+    }
+    if _, _, ok := s.Initiate(local, peer(maxSessionPeers), now); ok { t.Fatal("table grew past the limit") }
+    // unanswered handshakes are dropped once they could be retried
+    now = now.Add(handshakeRetry)
+    if _, _, ok := s.Initiate(local, peer(maxSessionPeers), now); !ok { t.Fatal("stale peers not pruned") }
+    if len(s.peers) != 1 { t.Fatalf("%d peers left", len(s.peers)) }
+}
@@ -0,0 +1,122 @@
+package crypto
+
+import (
+    crand "crypto/rand"
+    "encoding/binary"
+    "errors"
+    "io"
+    "math"
+    "sync"
+    "sync/atomic"
+)
+
+// saltSize is the random prefix of every nonce and the last 4 nonce bytes
+// hold a big endian message counter. All edges of a community seal under
+// one key, so the salt has to be wide enough that no two senders (or two
+// starts of one) ever draw the same: with 8 bytes a collision is unlikely
+// even across billions of salts, where 4 bytes collide after ~65000.
+const saltSize = 8
+
+// maxCount is the last counter value used with a salt; the next message
+// draws a fresh salt.
+const maxCount = math.MaxUint32
+
+var errShortPayload = errors.New("payload shorter than transform overhead")
+
+// nonceRand is where nonce salts are drawn from.
+var nonceRand io.Reader = crand.Reader
+
+// Transform seals and opens payloads in caller provided buffers. Nonces are
+// built from a random salt and a counter, so a sender never repeats a nonce
+// under one key and only needs a random read every 2^32 frames. The sealed
+// format is nonce || ciphertext || tag.
+type Transform struct {
+    aead AEAD
+    mu   sync.Mutex
+    blk  atomic.Pointer[nonceBlock]
+}
+
+// nonceBlock is a salt and the count of nonces taken with it. The count is
+// 64 bits wide so that it never wraps back to values already handed out.
+type nonceBlock struct {
+    salt [saltSize]byte
+    ctr  atomic.Uint64
+}
+
+func newNonceBlock() (*nonceBlock, error) {
+    b := &nonceBlock{}
+    if _, err := io.ReadFull(nonceRand, b.salt[:]); err != nil { return nil, err }
+    return b, nil
+}
+
+func NewTransform(a AEAD) (*Transform, error) {
+    if a.NonceSize() < saltSize+4 { return nil, errors.New("nonce too short for counter mode") }
+    t := &Transform{aead: a}
+    b, err := newNonceBlock()
+    if err != nil { return nil, err }
+    t.blk.Store(b)
+    return t, nil
+}
+
+// nonce fills n with the next unused nonce. It fails when a new salt is
+// due and no randomness is available: there is no safe nonce left then.
+func (t *Transform) nonce(n []byte) error {
+    for {
+        b := t.blk.Load()
+        if c := b.ctr.Add(1); c <= maxCount {
+            copy(n, b.salt[:])
+            for i := saltSize; i < len(n)-4; i++ { n[i] = 0 }
+            binary.BigEndian.PutUint32(n[len(n)-4:], uint32(c))
+            return nil
+        }
+        t.mu.Lock()
+        if t.blk.Load() == b {
+            nb, err := newNonceBlock()
+            if err != nil {
+                t.mu.Unlock()
+                return err
+            }
+            t.blk.Store(nb)
+        }
+        t.mu.Unlock()
+    }
+}
+
+// NewTransformKey is a shorthand for New followed by NewTransform.
+func NewTransformKey(cipher string, key []byte) (*Transform, error) {
+    a, err := New(cipher, key)
+    if err != nil { return nil, err }
+    return NewTransform(a)
+}
+
+func (t *Transform) NonceSize() int { return t.aead.NonceSize() }
+
+// Overhead is the number of bytes Seal adds to a plaintext.
+func (t *Transform) Overhead() int { return t.aead.NonceSize() + t.aead.Overhead() }
+
+// Seal appends nonce || ciphertext to dst and returns the updated slice.
+// To encrypt in place, store the plaintext at dst[len(dst)+NonceSize():]
+// and make sure cap(dst) leaves room for Overhead() more bytes; no memory
+// is allocated in that case. It fails only when no fresh nonce can be
+// drawn.
+func (t *Transform) Seal(dst, plaintext, ad []byte) ([]byte, error) {
+    ns := t.aead.NonceSize()
+    n := len(dst)
+    if need := n + ns + len(plaintext) + t.aead.Overhead(); cap(dst) < need {
+        grown := make([]byte, n, need)
+        copy(grown, dst)
+        dst = grown
+    }
+    dst = dst[:n+ns]
+    nonce := dst[n : n+ns]
+    if err := t.nonce(nonce); err != nil { return nil, err }
+    return t.aead.Seal(dst, nonce, plaintext, ad), nil
+}
+
+// Open decrypts a payload produced by Seal and appends the plaintext to dst.
+// Passing sealed[NonceSize():NonceSize()] as dst decrypts in place.
+func (t *Transform) Open(dst, sealed, ad []byte) ([]byte, error) {
+    ns := t.aead.NonceSize()
+    if len(sealed) < ns+t.aead.Overhead() { return nil, errShortPayload }
+    return t.aead.Open(dst, sealed[:ns], sealed[ns:], ad)
+}
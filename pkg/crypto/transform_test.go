@@ -0,0 +1,105 @@
+package crypto
+
+import (
+    "bytes"
+    crand "crypto/rand"
+    "errors"
+    "testing"
+    "testing/iotest"
+)
+
+func newTestTransform(t testing.TB, cipher string) *Transform {
+    tr, err := NewTransformKey(cipher, DeriveKey([]byte("secret"), "community"))
+    if err != nil { t.Fatal(err) }
+    return tr
+}
+
+func TestTransformInPlace(t *testing.T) {
+    for _, c := range []string{"aes", "chacha"} {
+        tr := newTestTransform(t, c)
+        ad := []byte("header")
+        msg := []byte("ethernet frame payload")
+        buf := make([]byte, 4+tr.Overhead()+len(msg))
+        copy(buf, "kid!")
+        ns := tr.NonceSize()
+        copy(buf[4+ns:], msg)
+        sealed, err := tr.Seal(buf[:4], buf[4+ns:4+ns+len(msg)], ad)
+        if err != nil { t.Fatal(c, err) }
+        if len(sealed) != len(buf) || &sealed[0] != &buf[0] { t.Fatal(c, "not sealed in place") }
+        body := sealed[4:]
+        pt, err := tr.Open(body[ns:ns], body, ad)
+        if err != nil || !bytes.Equal(pt, msg) { t.Fatal(c, "open", err) }
+        if _, err := tr.Open(nil, body[:ns], ad); err == nil { t.Fatal(c, "short payload accepted") }
+    }
+}
+
+func TestTransformCounterNonces(t *testing.T) {
+    tr := newTestTransform(t, "chacha")
+    a, _ := tr.Seal(nil, []byte("x"), nil)
+    b, _ := tr.Seal(nil, []byte("x"), nil)
+    ns := tr.NonceSize()
+    if bytes.Equal(a[:ns], b[:ns]) { t.Fatal("nonce reused") }
+    if !bytes.Equal(a[:saltSize], b[:saltSize]) { t.Fatal("salt changed") }
+
+    // a used up counter moves on to a fresh salt instead of wrapping
+    tr.blk.Load().ctr.Store(maxCount - 1)
+    c, _ := tr.Seal(nil, []byte("x"), nil)
+    d, _ := tr.Seal(nil, []byte("x"), nil)
+    if !bytes.Equal(c[:saltSize], a[:saltSize]) || bytes.Equal(d[:saltSize], a[:saltSize]) { t.Fatal("salt not renewed") }
+    if !bytes.Equal(d[saltSize:ns], []byte{0, 0, 0, 1}) { t.Fatalf("counter %x", d[saltSize:ns]) }
+    if _, err := tr.Open(nil, d, nil); err != nil { t.Fatal(err) }
+
+    // without randomness for the next salt sealing fails instead of
+    // reusing a nonce
+    tr.blk.Load().ctr.Store(maxCount)
+    nonceRand = iotest.ErrReader(errors.New("no entropy"))
+    defer func() { nonceRand = crand.Reader }()
+    if _, err := tr.Seal(nil, []byte("x"), nil); err == nil { t.Fatal("sealed without a fresh salt") }
+    nonceRand = crand.Reader
+    if e, err := tr.Seal(nil, []byte("x"), nil); err != nil || bytes.Equal(e[:saltSize], d[:saltSize]) { t.Fatal("salt not renewed after failure", err) }
+}
+
+func TestTransformSealAllocs(t *testing.T) {
+    tr := newTestTransform(t, "aes")
+    buf := make([]byte, 2048)
+    ad := make([]byte, 48)
+    ns := tr.NonceSize()
+    allocs := testing.AllocsPerRun(100, func() {
+        sealed, _ := tr.Seal(buf[:0], buf[ns:ns+1400], ad)
+        if _, err := tr.Open(sealed[ns:ns], sealed, ad); err != nil { t.Fatal(err) }
+    })
+    if allocs != 0 { t.Fatalf("allocs=%v", allocs) }
+}
+
+func benchmarkSeal(b *testing.B, cipher string) {
+    tr := newTestTransform(b, cipher)
+    buf := make([]byte, 2048)
+    ad := make([]byte, 48)
+    ns := tr.NonceSize()
+    b.SetBytes(1400)
+    b.ReportAllocs()
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        tr.Seal(buf[:0], buf[ns:ns+1400], ad)
+    }
+}
+
+func benchmarkOpen(b *testing.B, cipher string) {
+    tr := newTestTransform(b, cipher)
+    ad := make([]byte, 48)
+    sealed, _ := tr.Seal(nil, make([]byte, 1400), ad)
+    work := make([]byte, len(sealed))
+    ns := tr.NonceSize()
+    b.SetBytes(1400)
+    b.ReportAllocs()
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        copy(work, sealed)
+        if _, err := tr.Open(work[ns:ns], work, ad); err != nil { b.Fatal(err) }
+    }
+}
+
+func BenchmarkSealAES(b *testing.B)    { benchmarkSeal(b, "aes") }
+func BenchmarkSealChaCha(b *testing.B) { benchmarkSeal(b, "chacha") }
+func BenchmarkOpenAES(b *testing.B)    { benchmarkOpen(b, "aes") }
+func BenchmarkOpenChaCha(b *testing.B) { benchmarkOpen(b, "chacha") }
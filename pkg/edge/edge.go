@@ -0,0 +1,565 @@
+// Package edge implements an n2n edge: it registers with a supernode and
+// moves ethernet frames between a TAP device and the supernode, encrypted
+// with the community key, a key ring or per-peer session keys.
+package edge
+
+import (
+    "context"
+    "crypto/ed25519"
+    "crypto/tls"
+    "crypto/x509"
+    "fmt"
+    "io"
+    "math/rand"
+    "net"
+    "net/netip"
+    "os"
+    "sync"
+    "sync/atomic"
+    "time"
+    "n2n-go/pkg/compress"
+    "n2n-go/pkg/crypto"
+    "n2n-go/pkg/logx"
+    "n2n-go/pkg/management"
+    "n2n-go/pkg/portmap"
+    "n2n-go/pkg/tap"
+    "n2n-go/pkg/transport"
+    "n2n-go/pkg/wire"
+)
+
+// Device is the virtual interface frames are read from and written to;
+// *tap.Device and *tap.Memory implement it.
+type Device = tap.Interface
+
+// Transport carries the n2n packets to and from the supernode.
+type Transport = transport.Transport
+
+// BatchTransport is a Transport that also moves several datagrams per
+// call; the edge then receives in batches and sends the segments of an
+// offloaded frame together.
+type BatchTransport = transport.BatchTransport
+
+// Options configures an edge created with New. The fields follow the edge
+// command line options.
+type Options struct {
+    // Device is used instead of opening the TAP device Dev; Devices are
+    // the queues of a multi-queue device and replace Device.
+    Device  Device
+    Devices []Device
+    Dev     string
+    // TUN opens Dev as a TUN device; the device then carries IP packets
+    // instead of ethernet frames.
+    TUN bool
+    // Queues opens Dev with that many queues (Linux IFF_MULTI_QUEUE). Each
+    // queue is read by its own goroutine and as many goroutines receive
+    // from the socket; 0 means 1.
+    Queues int
+    // Offload exchanges frames with the device behind a virtio-net header
+    // (Linux IFF_VNET_HDR, TAP mode only): TCP super-frames read from it
+    // are segmented before encryption and received segments are merged
+    // before they are written.
+    Offload bool
+    // MAC is the address registered with the supernode; it defaults to the
+    // hardware address of Dev, or a random address in TUN mode.
+    MAC wire.Mac
+    // Transport is used instead of a UDP socket bound to Bind:Port; Run
+    // only attempts the port mapping for that socket unless
+    // PortmapGateways names the NAT-PMP gateways (host or host:port).
+    Transport Transport
+    PortmapGateways []string
+    // TCP reaches the supernode over a TCP connection instead (C n2n
+    // -S2), for networks that block UDP; it reconnects when the
+    // connection drops.
+    TCP       bool
+    // WebSocket is the ws:// or wss:// URL of the supernode's WebSocket
+    // listener, for networks that only let HTTP(S) out; Supernode then
+    // only names the supernode. WebSocketCA is a PEM file with the
+    // certificates a wss:// server is verified against instead of the
+    // system roots, e.g. its own self-signed one.
+    WebSocket   string
+    WebSocketCA string
+    Bind      string
+    Port      int
+    Supernode string
+    Community string
+    // Key is the community secret; KeyFile, $N2N_KEY and the n2n-key
+    // systemd credential are the alternatives, in LookupSecret order.
+    Key     string
+    KeyFile string
+    // KeyRing is a key ring file; it overrides Key.
+    KeyRing string
+    KDF     string
+    // Cipher is aes, chacha or null; Compression is none or zstd.
+    Cipher      string
+    Compression string
+    SecureHeader bool
+    // PeerKeys negotiates session keys renewed every Rekey. Identity is
+    // the Ed25519 key file the exchange is signed with; with PeerTrust
+    // only peers listed there are accepted.
+    PeerKeys  bool
+    Rekey     time.Duration
+    Identity  string
+    PeerTrust string
+    // MgmtPort is the UDP management port on 127.0.0.1; 0 disables it.
+    MgmtPort        int
+    MgmtSocket      string
+    MgmtSocketMode  os.FileMode
+    MgmtSocketOwner string
+    HTTPAddr         string
+    MgmtPassword     string
+    MgmtReadPassword string
+    MgmtAudit        string
+    Verbose          int
+}
+
+// Edge is a running or runnable edge.
+type Edge struct {
+    opts     Options
+    devs     []Device
+    conn     Transport
+    pm       *portmap.Client
+    mgmt     *management.Server
+    audit    *os.File
+    unixSock io.Closer
+    kdf      crypto.KDF
+    ring     *crypto.KeyRing
+    // tr is the community key; it is swapped when Reload re-reads it
+    tr       atomic.Pointer[crypto.Transform]
+    sessions *crypto.Sessions
+    encrypt  bool
+    // payloads carry a key id when a key ring or session keys are in use
+    withKeyID bool
+    codec    compress.Codec
+    // sn is the supernode in use; a RE_REGISTER_SUPER may move it
+    sn       atomic.Pointer[net.UDPAddr]
+    // addr is the virtual address leased by the supernode
+    addr     atomic.Pointer[wire.IPSubnet]
+    l3       l3
+    // regMu guards reg, lastReg and regBuf; any receive worker registers
+    regMu    sync.Mutex
+    regc     wire.Common
+    reg      wire.RegisterSuper
+    lastReg  time.Time
+    regBuf   []byte
+    // reregister asks the packet loop to register right away
+    reregister atomic.Bool
+    lastSrc  atomic.Pointer[wire.Mac]
+    stats    stats
+    traceLevel  atomic.Int32
+    keepRunning bool
+    // mu serializes Reload and the keyring.reload command
+    mu       sync.Mutex
+}
+
+const regInterval = 20 * time.Second
+
+// newWSClient is the WebSocket transport to url, trusting the certificates
+// in the PEM file ca when one is given.
+func newWSClient(url, ca string) (*transport.TCPClient, error) {
+    var tlsConf *tls.Config
+    if ca != "" {
+        pem, err := os.ReadFile(ca)
+        if err != nil { return nil, err }
+        pool := x509.NewCertPool()
+        if !pool.AppendCertsFromPEM(pem) { return nil, fmt.Errorf("%s: no certificates", ca) }
+        tlsConf = &tls.Config{RootCAs: pool}
+    }
+    return transport.NewWSClient(url, tlsConf)
+}
+
+// New sets up an edge: it opens the device and the socket unless given,
+// and loads the keys. Nothing is sent before Run.
+func New(o Options) (*Edge, error) {
+    e := &Edge{opts: o, devs: o.Devices, conn: o.Transport, regBuf: make([]byte, 256), pm: &portmap.Client{Gateways: o.PortmapGateways}, keepRunning: true}
+    e.traceLevel.Store(int32(o.Verbose))
+    e.stats.start = time.Now()
+    e.stats.peers = map[wire.Mac]*peer{}
+    e.l3.macs = map[netip.Addr]wire.Mac{}
+    e.l3.pending = map[netip.Addr]*pending{}
+    raddr, err := net.ResolveUDPAddr("udp", o.Supernode)
+    if err != nil { return nil, fmt.Errorf("resolve supernode: %w", err) }
+    e.sn.Store(raddr)
+    e.kdf, err = crypto.ParseKDF(o.KDF)
+    if err != nil { return nil, fmt.Errorf("kdf: %w", err) }
+    if o.KeyRing != "" {
+        e.ring, err = crypto.LoadKeyRing(o.KeyRing, o.Cipher, o.Community, e.kdf)
+        if err != nil { return nil, fmt.Errorf("key ring: %w", err) }
+        logx.Printf(1, "key ring loaded keys=%d kdf=%s", len(e.ring.Keys()), e.ring.KDF())
+    } else {
+        t, err := e.loadKey(o.Key)
+        if err != nil { return nil, fmt.Errorf("key: %w", err) }
+        e.tr.Store(t)
+    }
+    e.opts.Key = ""
+    e.encrypt = e.tr.Load() != nil || e.ring != nil
+    if o.PeerKeys {
+        if !e.encrypt { return nil, fmt.Errorf("-peer-keys requires -k or -keyring with -A aes|chacha") }
+        e.sessions = crypto.NewSessions(o.Cipher, o.Community, o.Rekey)
+        if o.Identity != "" {
+            id, err := crypto.LoadIdentity(o.Identity)
+            if err != nil { return nil, fmt.Errorf("identity: %w", err) }
+            var trust map[[6]byte]ed25519.PublicKey
+            if o.PeerTrust != "" {
+                if trust, err = crypto.LoadTrust(o.PeerTrust); err != nil { return nil, fmt.Errorf("peer trust: %w", err) }
+            }
+            e.sessions.SetIdentity(id, trust)
+            logx.Printf(0, "identity %s", crypto.IdentityString(id))
+        } else if o.PeerTrust != "" {
+            return nil, fmt.Errorf("-peer-trust requires -identity")
+        }
+        if o.PeerTrust == "" { logx.Printf(0, "warning: session keys are authenticated by the community key only; any community member can intercept them (use -identity and -peer-trust)") }
+    }
+    e.withKeyID = e.ring != nil || e.sessions != nil
+    e.codec = compress.Null{}
+    if o.Compression == "zstd" {
+        if z, err := compress.NewZstd(); err == nil { e.codec = z }
+    }
+
+    if o.Offload && o.TUN { return nil, fmt.Errorf("offload needs TAP mode") }
+    if o.TCP && o.WebSocket != "" { return nil, fmt.Errorf("TCP and WebSocket transports exclude each other") }
+    if e.conn == nil && o.TCP {
+        e.conn = transport.NewTCPClient()
+        logx.Printf(1, "tcp transport to sn=%s", o.Supernode)
+    }
+    if e.conn == nil && o.WebSocket != "" {
+        ws, err := newWSClient(o.WebSocket, o.WebSocketCA)
+        if err != nil { return nil, fmt.Errorf("websocket: %w", err) }
+        e.conn = ws
+        logx.Printf(1, "websocket transport url=%s sn=%s", o.WebSocket, o.Supernode)
+    }
+    if len(e.devs) == 0 && o.Device != nil { e.devs = []Device{o.Device} }
+    if len(e.devs) == 0 {
+        kind := "tap"
+        if o.TUN { kind = "tun" }
+        qs, err := tap.OpenConfig(tap.Config{Name: o.Dev, MTU: 1500, Queues: o.Queues, TUN: o.TUN, Offload: o.Offload})
+        if err != nil { return nil, fmt.Errorf("%s open: %w", kind, err) }
+        logx.Printf(1, "%s opened name=%s queues=%d offload=%v", kind, o.Dev, len(qs), o.Offload)
+        for _, d := range qs { e.devs = append(e.devs, d) }
+        if o.MAC == (wire.Mac{}) && !o.TUN {
+            if ifi, err := net.InterfaceByName(qs[0].Name); err == nil && len(ifi.HardwareAddr) == 6 { copy(e.opts.MAC[:], ifi.HardwareAddr) }
+        }
+    }
+    if o.TUN && e.opts.MAC == (wire.Mac{}) {
+        // a locally administered unicast address
+        e.opts.MAC = wire.Mac{0x02}
+        for i := 1; i < 6; i++ { e.opts.MAC[i] = byte(rand.Intn(256)) }
+    }
+    if tc, ok := e.conn.(*transport.TCPClient); ok {
+        // a new connection is a new address to the supernode; after a
+        // lost one try again soon, like for a supernode going away
+        tc.Connected = func() { e.reregister.Store(true) }
+        tc.Lost = func() { e.setLastReg(time.Now().Add(2*time.Second - regInterval)) }
+    }
+    if e.conn == nil {
+        udp, err := transport.ListenUDP(o.Bind, o.Port)
+        if err != nil {
+            if o.Device == nil && o.Devices == nil { e.closeDevs() }
+            return nil, fmt.Errorf("udp open: %w", err)
+        }
+        logx.Printf(1, "udp opened bind=%s lport=%d", o.Bind, o.Port)
+        e.conn = udp
+    }
+
+    e.regc = wire.Common{TTL: 2, PC: wire.MsgRegisterSuper, Flags: 0}
+    copy(e.regc.Community[:], []byte(o.Community))
+    e.reg.Sock = wire.SockFrom(&net.UDPAddr{IP: net.ParseIP(o.Bind), Port: o.Port})
+    e.reg.DevAddr.Bitlen = 24
+    e.reg.EdgeMac = e.opts.MAC
+    e.reg.KeyTime = uint32(time.Now().Unix())
+
+    e.mgmt = &management.Server{Password: o.MgmtPassword, ReadPassword: o.MgmtReadPassword, KeepRunning: &e.keepRunning, TraceLevel: &e.traceLevel}
+    e.registerCommands()
+    return e, nil
+}
+
+// Management returns the management server so that embedders can register
+// their own commands before Run.
+func (e *Edge) Management() *management.Server { return e.mgmt }
+
+// loadKey derives the community key from the key file, key, $N2N_KEY or
+// the systemd credential; it returns nil when no key is configured.
+func (e *Edge) loadKey(key string) (*crypto.Transform, error) {
+    secret, src, err := crypto.LookupSecret(key, e.opts.KeyFile)
+    if err != nil || secret == nil { return nil, err }
+    defer crypto.Wipe(secret)
+    logx.Printf(1, "community key from %s kdf=%s", src, e.kdf)
+    if e.opts.Cipher != "aes" && e.opts.Cipher != "chacha" { return nil, nil }
+    mk, err := e.kdf.Derive(secret, e.opts.Community)
+    if err != nil { return nil, err }
+    defer crypto.Wipe(mk)
+    return crypto.NewTransformKey(e.opts.Cipher, mk)
+}
+
+// serveManagement starts the management listeners; stopCh is closed by a
+// stop request.
+func (e *Edge) serveManagement(stopCh chan struct{}) error {
+    o := e.opts
+    if o.MgmtAudit != "" {
+        f, err := management.OpenAudit(o.MgmtAudit)
+        if err != nil { return fmt.Errorf("management audit: %w", err) }
+        e.audit = f
+        e.mgmt.Audit = f
+    }
+    if o.MgmtPort != 0 {
+        mgmtConn, err := e.mgmt.Listen("127.0.0.1", o.MgmtPort)
+        if err != nil { return fmt.Errorf("management port: %w", err) }
+        go e.mgmt.Handle(mgmtConn, stopCh)
+    }
+    if o.MgmtSocket != "" {
+        mode := o.MgmtSocketMode
+        if mode == 0 { mode = 0600 }
+        us, err := e.mgmt.ServeUnix(o.MgmtSocket, mode, o.MgmtSocketOwner, stopCh)
+        if err != nil { return fmt.Errorf("management socket: %w", err) }
+        e.unixSock = us
+    }
+    if o.HTTPAddr != "" {
+        hl, err := e.mgmt.ListenHTTP(o.HTTPAddr)
+        if err != nil { return fmt.Errorf("management http: %w", err) }
+        go e.mgmt.ServeHTTP(hl, stopCh)
+    }
+    return nil
+}
+
+// Run registers with the supernode and forwards traffic until ctx is done
+// or a management stop request arrives. On the way out it unregisters,
+// removes the port mapping and closes the device, the socket and the
+// management listeners.
+func (e *Edge) Run(ctx context.Context) error {
+    logx.Printf(1, "edge start dev=%s bind=%s lport=%d sn=%s", e.opts.Dev, e.opts.Bind, e.opts.Port, e.opts.Supernode)
+    stopCh := make(chan struct{})
+    defer e.close()
+    if err := e.serveManagement(stopCh); err != nil { return err }
+    if len(e.opts.PortmapGateways) > 0 || e.opts.Transport == nil && !e.opts.TCP && e.opts.WebSocket == "" { e.pm.TryMap(e.opts.Port) }
+    e.register()
+    for _, d := range e.devs { go e.tapLoop(d) }
+
+    quit := make(chan struct{})
+    var quitOnce sync.Once
+    shutdown := func(why string) {
+        quitOnce.Do(func() {
+            logx.Printf(0, "edge stopping (%s)", why)
+            close(quit)
+            e.conn.SetReadDeadline(time.Now())
+        })
+    }
+    go func() {
+        select {
+        case <-ctx.Done():
+            shutdown(context.Cause(ctx).Error())
+        case <-stopCh:
+            shutdown("management stop")
+        case <-quit:
+        }
+    }()
+    var wg sync.WaitGroup
+    for i := 1; i < e.workers(); i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            e.packetLoop(quit, e.devs[i%len(e.devs)])
+        }(i)
+    }
+    e.packetLoop(quit, e.devs[0])
+    shutdown("socket closed")
+    wg.Wait()
+
+    // tell the supernode right away instead of letting the lease expire
+    mac := e.reg.EdgeMac
+    if mac == (wire.Mac{}) { mac = e.srcMac() }
+    uc := wire.Common{TTL: 2, PC: wire.MsgUnregisterSuper, Flags: 0}
+    copy(uc.Community[:], []byte(e.opts.Community))
+    b := make([]byte, 256)
+    ul := wire.EncodeUnregisterSuper(uc, wire.UnregisterSuper{Cookie: rand.Uint32(), EdgeMac: mac}, b)
+    e.conn.WriteTo(b[:ul], e.sn.Load())
+    logx.Printf(1, "unregister sent mac=%s", macString(mac))
+    if e.pm.Status().Enabled { e.pm.Unmap(e.opts.Port) }
+    e.mgmt.Shutdown(time.Second)
+    logx.Printf(0, "edge stopped")
+    return nil
+}
+
+// workers is the number of goroutines receiving from the socket.
+func (e *Edge) workers() int {
+    if e.opts.Queues > len(e.devs) { return e.opts.Queues }
+    return len(e.devs)
+}
+
+func (e *Edge) closeDevs() {
+    for _, d := range e.devs { d.Close() }
+}
+
+func (e *Edge) close() {
+    e.closeDevs()
+    e.conn.Close()
+    if e.unixSock != nil { e.unixSock.Close() }
+    if e.audit != nil { e.audit.Close() }
+}
+
+// register sends a REGISTER_SUPER to the supernode in use.
+func (e *Edge) register() {
+    e.regMu.Lock()
+    defer e.regMu.Unlock()
+    e.registerLocked()
+}
+
+// registerDue registers when the last registration is older than
+// regInterval.
+func (e *Edge) registerDue() {
+    e.regMu.Lock()
+    defer e.regMu.Unlock()
+    if time.Since(e.lastReg) >= regInterval { e.registerLocked() }
+}
+
+// setLastReg moves the time the next registerDue counts from.
+func (e *Edge) setLastReg(t time.Time) {
+    e.regMu.Lock()
+    e.lastReg = t
+    e.regMu.Unlock()
+}
+
+func (e *Edge) registerLocked() {
+    b := e.regBuf
+    e.reg.Cookie = uint32(rand.Uint32())
+    if e.ring != nil {
+        if k := e.ring.Current(time.Now()); k != nil { e.reg.KeyTime = k.ID }
+        e.reg.KDF = e.ring.KDF().String()
+    } else if e.encrypt {
+        e.reg.KDF = e.kdf.String()
+    }
+    rl := wire.EncodeRegisterSuper(e.regc, e.reg, b)
+    e.conn.WriteTo(b[:rl], e.sn.Load())
+    e.lastReg = time.Now()
+    logx.Printf(1, "register sent cookie=%d community=%s", e.reg.Cookie, e.opts.Community)
+}
+
+// Reload applies the options of o that can change at runtime: Verbose,
+// Supernode, Key and the management passwords. It then re-reads the key
+// ring, or the key file.
+func (e *Edge) Reload(o Options) {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    if o.Verbose != e.opts.Verbose {
+        e.mgmt.SetVerbose(o.Verbose)
+        e.opts.Verbose = o.Verbose
+    }
+    e.mgmt.SetPasswords(o.MgmtPassword, o.MgmtReadPassword)
+    if o.Supernode != e.opts.Supernode {
+        a, err := net.ResolveUDPAddr("udp", o.Supernode)
+        if err != nil {
+            logx.Printf(0, "reload: resolve supernode: %v", err)
+        } else {
+            e.opts.Supernode = o.Supernode
+            e.sn.Store(a)
+            e.reregister.Store(true)
+            logx.Printf(0, "supernode changed to %s", a)
+        }
+    }
+    if e.ring != nil {
+        if err := e.ring.Reload(); err != nil {
+            logx.Printf(0, "key ring reload failed: %v", err)
+            return
+        }
+        logx.Printf(1, "key ring reloaded keys=%d", len(e.ring.Keys()))
+        return
+    }
+    if e.tr.Load() == nil || e.opts.KeyFile == "" && o.Key == "" { return }
+    t, err := e.loadKey(o.Key)
+    if err != nil || t == nil {
+        logx.Printf(0, "key reload failed: %v", err)
+        return
+    }
+    e.tr.Store(t)
+    logx.Printf(1, "community key reloaded")
+}
+
+// Status is a snapshot of the edge state.
+type Status struct {
+    Supernode  string
+    Community  string
+    MAC        wire.Mac
+    // DevAddr is the virtual address leased by the supernode.
+    DevAddr    wire.IPSubnet
+    Start      time.Time
+    // LastSuper is the time of the last REGISTER_SUPER_ACK, zero before.
+    LastSuper  time.Time
+    TransopTx  uint64
+    TransopRx  uint64
+    SuperTx    uint64
+    SuperRx    uint64
+    SuperBcastTx uint64
+    SuperBcastRx uint64
+}
+
+// Status returns the current state of the edge.
+func (e *Edge) Status() Status {
+    st := &e.stats
+    s := Status{Supernode: e.sn.Load().String(), Community: e.opts.Community, MAC: e.reg.EdgeMac, Start: st.start,
+        TransopTx: st.transopTx.Load(), TransopRx: st.transopRx.Load(), SuperTx: st.superTx.Load(), SuperRx: st.superRx.Load(), SuperBcastTx: st.superBcastTx.Load(), SuperBcastRx: st.superBcastRx.Load()}
+    if s.MAC == (wire.Mac{}) { s.MAC = e.srcMac() }
+    if a := e.addr.Load(); a != nil { s.DevAddr = *a }
+    if t := st.lastSuper.Load(); t != 0 { s.LastSuper = time.Unix(t, 0) }
+    return s
+}
+
+// Peer is an edge frames were received from.
+type Peer struct {
+    MAC      wire.Mac
+    Sockaddr string
+    LastSeen time.Time
+}
+
+// Peers returns the edges frames were received from.
+func (e *Edge) Peers() []Peer {
+    st := &e.stats
+    st.mu.Lock()
+    defer st.mu.Unlock()
+    out := make([]Peer, 0, len(st.peers))
+    for mac, p := range st.peers { out = append(out, Peer{MAC: mac, Sockaddr: p.sock, LastSeen: p.lastSeen}) }
+    return out
+}
+
+func (e *Edge) srcMac() wire.Mac {
+    if m := e.lastSrc.Load(); m != nil { return *m }
+    return e.opts.MAC
+}
+
+// isLocal reports whether mac is ours: the registered MAC or the source of
+// the frames from the device.
+func (e *Edge) isLocal(mac wire.Mac) bool { return mac == e.reg.EdgeMac || mac == e.srcMac() }
+
+// stats holds the state reported by the C n2n compatible management
+// commands; it is updated from both the TAP and the UDP goroutine.
+type stats struct {
+    transopTx    atomic.Uint64
+    transopRx    atomic.Uint64
+    superTx      atomic.Uint64
+    superRx      atomic.Uint64
+    superBcastTx atomic.Uint64
+    superBcastRx atomic.Uint64
+    lastSuper    atomic.Int64
+    start        time.Time
+    mu           sync.Mutex
+    peers        map[wire.Mac]*peer
+}
+
+type peer struct {
+    sock     string
+    lastSeen time.Time
+}
+
+func (st *stats) seen(mac wire.Mac, sock wire.Sock) {
+    if mac[0]&1 != 0 { return }
+    st.mu.Lock()
+    p := st.peers[mac]
+    if p == nil {
+        p = &peer{}
+        st.peers[mac] = p
+    }
+    p.sock = sock.UDPAddr().String()
+    p.lastSeen = time.Now()
+    st.mu.Unlock()
+}
+
+func macString(m wire.Mac) string {
+    return fmt.Sprintf("%02x:%02x:%02x:%02x:%02x:%02x", m[0], m[1], m[2], m[3], m[4], m[5])
+}
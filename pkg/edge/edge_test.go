@@ -0,0 +1,146 @@
+package edge
+
+import (
+    "context"
+    "net"
+    "strings"
+    "testing"
+    "time"
+    "n2n-go/pkg/tap"
+    "n2n-go/pkg/wire"
+)
+
+// testReceiver is the receiver a packetLoop on the first device uses.
+func testReceiver(e *Edge) *receiver {
+    return &receiver{dev: e.devs[0], snd: e.newSender(e.devs[0]), pbuf: make([]byte, 4096), dbuf: make([]byte, 4096), rad: make([]byte, 64)}
+}
+
+// supernode is the address the test edges register with.
+var supernode = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 7654}
+
+func TestNewChecksOptions(t *testing.T) {
+    for _, c := range []struct {
+        o    Options
+        want string
+    }{
+        {Options{Supernode: "127.0.0.1:notaport"}, "resolve supernode"},
+        {Options{KDF: "md5"}, "kdf"},
+        {Options{Offload: true, TUN: true}, "TAP mode"},
+        {Options{TCP: true, WebSocket: "ws://127.0.0.1:1/"}, "exclude each other"},
+        {Options{PeerKeys: true, Cipher: "null"}, "-peer-keys"},
+        {Options{PeerKeys: true, Cipher: "aes", Key: "secret", PeerTrust: "trust"}, "-identity"},
+    } {
+        if c.o.Supernode == "" { c.o.Supernode = "127.0.0.1:7654" }
+        c.o.Device, c.o.Transport = tap.NewMemory("test", 1), &recorder{}
+        _, err := New(c.o)
+        if err == nil || !strings.Contains(err.Error(), c.want) { t.Errorf("%+v: got %v, want %q", c.o, err, c.want) }
+    }
+}
+
+func TestRegisterAndAck(t *testing.T) {
+    e, rec := testEdge(t, Options{Cipher: "aes", Key: "secret"})
+    e.register()
+    pkts := rec.packets()
+    if len(pkts) != 1 { t.Fatalf("%d packets", len(pkts)) }
+    i := 0
+    c, ok := wire.DecodeCommon(pkts[0], &i)
+    if !ok || c.PC != wire.MsgRegisterSuper || !strings.HasPrefix(string(c.Community[:]), "community\x00") { t.Fatalf("common %+v", c) }
+    reg, ok := wire.DecodeRegisterSuper(pkts[0], &i)
+    if !ok || reg.EdgeMac != testMac || reg.KDF == "" { t.Fatalf("register %+v", reg) }
+
+    // the ack leases the address and is answered with a query for ourselves
+    ac := wire.Common{TTL: 2, PC: wire.MsgRegisterSuperAck}
+    copy(ac.Community[:], "community")
+    b := make([]byte, 256)
+    n := wire.EncodeRegisterSuperAck(ac, wire.RegisterSuperAck{Cookie: reg.Cookie, SrcMac: testMac, DevAddr: wire.IPSubnet{NetAddr: 0x0a000005, Bitlen: 24}, Lifetime: 120}, b)
+    e.handle(testReceiver(e), b[:n], supernode)
+    st := e.Status()
+    if st.LastSuper.IsZero() || st.DevAddr.NetAddr != 0x0a000005 || st.DevAddr.Bitlen != 24 { t.Fatalf("status %+v", st) }
+    pkts = rec.packets()
+    i = 0
+    if c, _ := wire.DecodeCommon(pkts[len(pkts)-1], &i); len(pkts) != 2 || c.PC != wire.MsgQueryPeer { t.Fatalf("%d packets, last %+v", len(pkts), c) }
+}
+
+func TestPacketRoundTrip(t *testing.T) {
+    peer := wire.Mac{0x02, 0, 0, 0, 0, 2}
+    for _, cipher := range []string{"null", "aes", "chacha"} {
+        a, rec := testEdge(t, Options{Cipher: cipher, Key: "secret"})
+        b, _ := testEdge(t, Options{Cipher: cipher, Key: "secret", MAC: peer})
+        f := frame(peer, 200)
+        for i := 14; i < len(f); i++ { f[i] = byte(i) }
+        a.send(a.newSender(a.devs[0]), f)
+        pkts := rec.packets()
+        if len(pkts) != 1 { t.Fatalf("%s: %d packets", cipher, len(pkts)) }
+        b.handle(testReceiver(b), pkts[0], supernode)
+        select {
+        case got := <-b.devs[0].(*tap.Memory).Out:
+            if string(got) != string(f) { t.Fatalf("%s: frame changed", cipher) }
+        default:
+            t.Fatalf("%s: frame not delivered", cipher)
+        }
+        if ps := b.Peers(); len(ps) != 1 || ps[0].MAC != testMac { t.Fatalf("%s: peers %+v", cipher, ps) }
+        sa, sb := a.Status(), b.Status()
+        if sa.SuperTx != 1 || sb.SuperRx != 1 { t.Fatalf("%s: tx %d rx %d", cipher, sa.SuperTx, sb.SuperRx) }
+        if cipher != "null" && (sa.TransopTx != 1 || sb.TransopRx != 1) { t.Fatalf("%s: transop tx %d rx %d", cipher, sa.TransopTx, sb.TransopRx) }
+
+        // an edge with another key drops it
+        if cipher == "null" { continue }
+        c, _ := testEdge(t, Options{Cipher: cipher, Key: "other", MAC: peer})
+        c.handle(testReceiver(c), pkts[0], supernode)
+        select {
+        case <-c.devs[0].(*tap.Memory).Out:
+            t.Fatalf("%s: frame delivered under another key", cipher)
+        default:
+        }
+        if len(c.Peers()) != 0 { t.Fatalf("%s: peer learned from a packet that did not open", cipher) }
+    }
+}
+
+func TestReRegisterOnlyFromSupernode(t *testing.T) {
+    e, rec := testEdge(t, Options{Cipher: "null"})
+    rc := wire.Common{TTL: 2, PC: wire.MsgReRegisterSuper}
+    copy(rc.Community[:], "community")
+    b := make([]byte, 64)
+    n := wire.EncodeReRegisterSuper(rc, wire.ReRegisterSuper{Sock: wire.SockFrom(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 7655})}, b)
+    e.handle(testReceiver(e), b[:n], &net.UDPAddr{IP: net.IPv4(127, 0, 0, 9), Port: 7654})
+    if st := e.Status(); st.Supernode != "127.0.0.1:7654" || len(rec.packets()) != 0 { t.Fatalf("moved by a stranger: %s", st.Supernode) }
+    e.handle(testReceiver(e), b[:n], supernode)
+    if st := e.Status(); st.Supernode != "127.0.0.2:7655" || len(rec.packets()) != 1 { t.Fatalf("not handed over: %s", st.Supernode) }
+}
+
+func TestMgmtCommands(t *testing.T) {
+    e, _ := testEdge(t, Options{Cipher: "null"})
+    e.stats.seen(wire.Mac{0x02, 0, 0, 0, 0, 2}, wire.SockFrom(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4000}))
+    e.stats.seen(wire.Mac{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, wire.Sock{})
+    cmds := map[string]func([]string) ([]map[string]any, error){}
+    for _, c := range e.Management().Commands() { cmds[c.Name] = c.Func }
+    rows, err := cmds["edges"](nil)
+    if err != nil || len(rows) != 1 || rows[0]["macaddr"] != "02:00:00:00:00:02" || rows[0]["sockaddr"] != "127.0.0.1:4000" { t.Fatalf("edges %v %v", rows, err) }
+    rows, _ = cmds["packetstats"](nil)
+    var types []string
+    for _, r := range rows { types = append(types, r["type"].(string)) }
+    if strings.Join(types, " ") != "transop super super_broadcast" { t.Fatalf("packetstats types %v", types) }
+    if _, err := cmds["keyring.reload"](nil); err == nil { t.Fatal("keyring.reload without a key ring") }
+}
+
+func TestRunStopsOnCancel(t *testing.T) {
+    e, rec := testEdge(t, Options{Cipher: "null"})
+    ctx, cancel := context.WithCancel(context.Background())
+    done := make(chan error, 1)
+    go func() { done <- e.Run(ctx) }()
+    time.Sleep(50 * time.Millisecond)
+    cancel()
+    select {
+    case err := <-done:
+        if err != nil { t.Fatal(err) }
+    case <-time.After(3 * time.Second):
+        t.Fatal("Run did not return")
+    }
+    pkts := rec.packets()
+    if len(pkts) < 2 { t.Fatalf("%d packets", len(pkts)) }
+    i := 0
+    if c, _ := wire.DecodeCommon(pkts[0], &i); c.PC != wire.MsgRegisterSuper { t.Fatalf("first packet %d", c.PC) }
+    i = 0
+    if c, _ := wire.DecodeCommon(pkts[len(pkts)-1], &i); c.PC != wire.MsgUnregisterSuper { t.Fatalf("last packet %d", c.PC) }
+    if _, err := e.devs[0].Write(make([]byte, 14)); err == nil { t.Fatal("device left open") }
+}
@@ -0,0 +1,85 @@
+package edge
+
+import (
+    "fmt"
+    "net"
+    "time"
+    "n2n-go/pkg/management"
+    "n2n-go/pkg/tap"
+)
+
+// registerCommands installs the edge management commands.
+func (e *Edge) registerCommands() {
+    mgmt, st, ring := e.mgmt, &e.stats, e.ring
+    mgmt.Register(management.Command{Name: "portmap.status", Help: "port mapping state", Method: "GET", Path: "/portmap", Func: func(p []string) ([]map[string]any, error) {
+        ps := e.pm.Status()
+        return []map[string]any{{"enabled": ps.Enabled, "method": ps.Method, "last_ok": ps.LastOK.Unix(), "last_err": ps.LastErr}}, nil
+    }})
+    mgmt.Register(management.Command{Name: "portmap.refresh", Help: "retry the port mapping", Write: true, Method: "POST", Path: "/portmap/refresh", Func: func(p []string) ([]map[string]any, error) {
+        ok := e.pm.TryMap(e.opts.Port)
+        ps := e.pm.Status()
+        return []map[string]any{{"ok": ok, "enabled": ps.Enabled, "last_err": ps.LastErr}}, nil
+    }})
+    mgmt.Register(management.Command{Name: "tap.configure", Help: "configure the tap address", Write: true, Params: []string{"name", "ip", "mask", "metric"}, Method: "PUT", Path: "/tap", Func: func(p []string) ([]map[string]any, error) {
+        var name, ip, mask string
+        var metric int
+        if len(p) >= 1 { name = p[0] }
+        if len(p) >= 3 { ip = p[1]; mask = p[2] }
+        if len(p) >= 4 && p[3] != "" {
+            if _, err := fmt.Sscanf(p[3], "%d", &metric); err != nil { return nil, management.BadRequest("bad metric") }
+        }
+        if ip != "" && net.ParseIP(ip) == nil { return nil, management.BadRequest("bad ip") }
+        tap.ConfigureIPv4(name, ip, mask, metric)
+        return []map[string]any{{"ok": true}}, nil
+    }})
+    mgmt.Register(management.Command{Name: "keyring.list", Help: "list key ring keys", Method: "GET", Path: "/keyring", Func: func(p []string) ([]map[string]any, error) {
+        var rows []map[string]any
+        if ring == nil { return rows, nil }
+        now := time.Now()
+        cur := ring.Current(now)
+        for _, k := range ring.Keys() {
+            row := map[string]any{"id": k.ID, "not_before": k.NotBefore.Unix(), "not_after": int64(0), "active": k.Active(now), "current": cur != nil && cur.ID == k.ID}
+            if !k.NotAfter.IsZero() { row["not_after"] = k.NotAfter.Unix() }
+            rows = append(rows, row)
+        }
+        return rows, nil
+    }})
+    mgmt.Register(management.Command{Name: "keyring.reload", Help: "reload the key ring file", Write: true, Method: "POST", Path: "/keyring/reload", Func: func(p []string) ([]map[string]any, error) {
+        if ring == nil { return nil, management.BadRequest("no key ring") }
+        // the same lock as a SIGHUP reload, which also re-reads the ring
+        e.mu.Lock()
+        defer e.mu.Unlock()
+        if err := ring.Reload(); err != nil { return nil, err }
+        return []map[string]any{{"ok": true, "keys": len(ring.Keys())}}, nil
+    }})
+
+    // C n2n compatible commands, field names follow n2n 3.x edge_management.c;
+    // fields the edge does not learn, like the address and description of
+    // a peer or the version of the supernode, are left out, and so are the
+    // peer-to-peer ones: all traffic goes through the supernode
+    edges := func(p []string) ([]map[string]any, error) {
+        var rows []map[string]any
+        for _, p := range e.Peers() {
+            rows = append(rows, map[string]any{"mode": "pSp", "purgeable": 1, "local": 0, "macaddr": macString(p.MAC), "sockaddr": p.Sockaddr, "last_seen": p.LastSeen.Unix()})
+        }
+        return rows, nil
+    }
+    mgmt.Register(management.Command{Name: "edges", Help: "list known peers", Method: "GET", Path: "/edges", Func: edges})
+    mgmt.Register(management.Command{Name: "peers", Help: "list known peers (same as edges)", Method: "GET", Path: "/peers", Func: edges})
+    mgmt.Register(management.Command{Name: "supernodes", Help: "list supernodes", Method: "GET", Path: "/supernodes", Func: func(p []string) ([]map[string]any, error) {
+        return []map[string]any{{"purgeable": 0, "current": 1, "sockaddr": e.sn.Load().String(), "last_seen": st.lastSuper.Load()}}, nil
+    }})
+    mgmt.Register(management.Command{Name: "communities", Help: "show the community", Method: "GET", Path: "/communities", Func: func(p []string) ([]map[string]any, error) {
+        return []map[string]any{{"community": e.opts.Community}}, nil
+    }})
+    mgmt.Register(management.Command{Name: "packetstats", Help: "traffic counters", Method: "GET", Path: "/packetstats", Func: func(p []string) ([]map[string]any, error) {
+        return []map[string]any{
+            {"type": "transop", "tx_pkt": st.transopTx.Load(), "rx_pkt": st.transopRx.Load()},
+            {"type": "super", "tx_pkt": st.superTx.Load(), "rx_pkt": st.superRx.Load()},
+            {"type": "super_broadcast", "tx_pkt": st.superBcastTx.Load(), "rx_pkt": st.superBcastRx.Load()},
+        }, nil
+    }})
+    mgmt.Register(management.Command{Name: "timestamps", Help: "start and last activity times", Method: "GET", Path: "/timestamps", Func: func(p []string) ([]map[string]any, error) {
+        return []map[string]any{{"start_time": st.start.Unix(), "last_super": st.lastSuper.Load()}}, nil
+    }})
+}
@@ -0,0 +1,71 @@
+package edge
+
+import (
+    "sync"
+    "time"
+    "n2n-go/pkg/logx"
+    "n2n-go/pkg/tap"
+)
+
+// groFlush is how long a merged frame waits for the next segment.
+const groFlush = 200 * time.Microsecond
+
+// offloadLoop is tapLoop for a device with a virtio-net header: TCP
+// super-frames are cut into segments before they are encrypted. A
+// BatchTransport sends the segments of a frame together.
+func (e *Edge) offloadLoop(dev Device, s *sender) {
+    buf := make([]byte, tap.MaxOffloadFrame)
+    // a segment is at most as large as the frame it is cut from
+    seg := make([]byte, tap.MaxOffloadFrame)
+    _, s.hold = e.conn.(BatchTransport)
+    emit := func(f []byte) {
+        e.noteSrc(f)
+        e.send(s, f)
+    }
+    for {
+        n, err := dev.Read(buf)
+        if err != nil { return }
+        h, ok := tap.DecodeVnetHdr(buf[:n])
+        if !ok { continue }
+        if err := tap.Segment(h, buf[tap.VnetHdrLen:n], seg, emit); err != nil { logx.Printf(2, "offload frame dropped: %v", err) }
+        if s.hold { e.flush(s) }
+    }
+}
+
+// gro merges the TCP segments a receive worker writes to its device queue.
+// The timer writes a merged frame out when no segment continues it.
+type gro struct {
+    mu    sync.Mutex
+    c     *tap.Coalescer
+    t     *time.Timer
+    armed bool
+}
+
+func newGRO(dev Device) *gro {
+    g := &gro{c: tap.NewCoalescer(dev)}
+    g.t = time.AfterFunc(time.Hour, g.flush)
+    g.t.Stop()
+    return g
+}
+
+func (g *gro) write(frame []byte) {
+    g.mu.Lock()
+    if err := g.c.Write(frame); err != nil { logx.Printf(2, "gro frame dropped: %v", err) }
+    if g.c.Pending() && !g.armed {
+        g.armed = true
+        g.t.Reset(groFlush)
+    }
+    g.mu.Unlock()
+}
+
+func (g *gro) flush() {
+    g.mu.Lock()
+    g.armed = false
+    if err := g.c.Flush(); err != nil { logx.Printf(2, "gro flush failed: %v", err) }
+    g.mu.Unlock()
+}
+
+func (g *gro) stop() {
+    g.t.Stop()
+    g.flush()
+}
@@ -0,0 +1,441 @@
+package edge
+
+import (
+    "encoding/binary"
+    "net"
+    "time"
+    "n2n-go/pkg/crypto"
+    "n2n-go/pkg/logx"
+    "n2n-go/pkg/transport"
+    "n2n-go/pkg/wire"
+)
+
+// communityKey returns the transform shared by the whole community and its
+// key id (0 for the -k key).
+func (e *Edge) communityKey() (*crypto.Transform, uint32) {
+    if e.ring == nil { return e.tr.Load(), 0 }
+    k := e.ring.Current(time.Now())
+    if k == nil { return nil, 0 }
+    return k.Transform, k.ID
+}
+
+func (e *Edge) lookupKey(src wire.Mac, kid uint32) *crypto.Transform {
+    if kid&crypto.SessionKeyFlag != 0 {
+        if e.sessions == nil { return nil }
+        return e.sessions.Lookup(src, kid)
+    }
+    if e.ring != nil {
+        if k := e.ring.Lookup(kid, time.Now()); k != nil { return k.Transform }
+        return nil
+    }
+    if kid == 0 { return e.tr.Load() }
+    return nil
+}
+
+func (e *Edge) sendKeyExchange(src, dst wire.Mac, kind uint8, epoch uint32, pub []byte) {
+    kt, kid := e.communityKey()
+    if kt == nil { return }
+    kc := wire.Common{TTL: 2, PC: wire.MsgKeyExchange, Flags: 0}
+    copy(kc.Community[:], []byte(e.opts.Community))
+    kx := wire.KeyExchange{SrcMac: src, DstMac: dst, Kind: kind, Epoch: epoch}
+    out := make([]byte, 256)
+    hl := wire.EncodeKeyExchange(kc, kx, out)
+    ad := append([]byte(nil), out[:hl]...)
+    sealed := make([]byte, crypto.KeyIDSize, crypto.KeyIDSize+kt.Overhead()+len(pub))
+    binary.BigEndian.PutUint32(sealed, kid)
+    sealed, err := kt.Seal(sealed, pub, ad)
+    if err != nil {
+        logx.Printf(0, "key exchange not sent: %v", err)
+        return
+    }
+    kx.Payload = sealed
+    l := wire.EncodeKeyExchange(kc, kx, out)
+    e.conn.WriteTo(out[:l], e.sn.Load())
+    logx.Printf(1, "key exchange kind=%d epoch=%d sent dst=%02x:%02x:%02x:%02x:%02x:%02x", kind, epoch, dst[0], dst[1], dst[2], dst[3], dst[4], dst[5])
+}
+
+// sender holds the buffers for sending frames; each goroutine that sends
+// uses its own.
+type sender struct {
+    // dev receives the frames for the device
+    dev Device
+    out []byte
+    ad  []byte
+    pc  wire.Common
+    // while hold is set packets collect in batch until flush
+    hold  bool
+    batch []transport.Message
+    held  int
+}
+
+func (e *Edge) newSender(dev Device) *sender {
+    s := &sender{dev: dev, out: make([]byte, 4096), ad: make([]byte, 64), pc: wire.Common{TTL: 2, PC: wire.MsgPacket, Flags: 0}}
+    copy(s.pc.Community[:], []byte(e.opts.Community))
+    return s
+}
+
+// slot returns the buffer for the next held packet, sending the batch
+// first when it is full.
+func (e *Edge) slot(s *sender) []byte {
+    if s.held == transport.MaxBatch { e.flush(s) }
+    if s.held == len(s.batch) { s.batch = append(s.batch, transport.Message{Buf: make([]byte, len(s.out))}) }
+    return s.batch[s.held].Buf
+}
+
+// flush sends the held packets.
+func (e *Edge) flush(s *sender) {
+    if s.held == 0 { return }
+    if n, err := e.conn.(BatchTransport).WriteBatch(s.batch[:s.held]); n < s.held { logx.Printf(2, "%d of %d packets not sent: %v", s.held-n, s.held, err) }
+    s.held = 0
+}
+
+// tapLoop sends the frames read from a device queue to the supernode until
+// the device is closed. In TUN mode the device yields IP packets, which are
+// read behind room for the ethernet header.
+func (e *Edge) tapLoop(dev Device) {
+    s := e.newSender(dev)
+    if e.opts.Offload {
+        e.offloadLoop(dev, s)
+        return
+    }
+    tapBuf := make([]byte, 2048)
+    for {
+        if e.opts.TUN {
+            n, err := dev.Read(tapBuf[ethHeaderLen:])
+            if err != nil { return }
+            if frame := e.tunFrame(tapBuf[:ethHeaderLen+n]); frame != nil { e.send(s, frame) }
+            continue
+        }
+        n, err := dev.Read(tapBuf)
+        if err != nil {
+            return
+        }
+        e.noteSrc(tapBuf[:n])
+        e.send(s, tapBuf[:n])
+    }
+}
+
+// noteSrc remembers the source MAC of a frame from the device.
+func (e *Edge) noteSrc(frame []byte) {
+    if len(frame) < 14 { return }
+    var src wire.Mac
+    copy(src[:], frame[6:12])
+    if src != e.srcMac() { e.lastSrc.Store(&src) }
+}
+
+// send encrypts and compresses an ethernet frame and sends it to the
+// supernode. All buffers are reused: frames are compressed and sealed in
+// place directly behind the packet header.
+func (e *Edge) send(s *sender, payload []byte) {
+    cipher, secure, st := e.opts.Cipher, e.opts.SecureHeader, &e.stats
+    out, ad, pc := s.out, s.ad, s.pc
+    if s.hold { out = e.slot(s) }
+    n := len(payload)
+    pkt := wire.Packet{}
+    if n >= 14 {
+        copy(pkt.DstMac[:], payload[0:6])
+        copy(pkt.SrcMac[:], payload[6:12])
+    }
+    pkt.Sock = e.reg.Sock
+    pkt.Transform = wire.TransformNull
+    pkt.Compression = wire.CompressionNone
+    if e.encrypt {
+        if cipher == "aes" { pkt.Transform = wire.TransformAES }
+        if cipher == "chacha" { pkt.Transform = wire.TransformChaCha20 }
+    }
+    if e.opts.Compression == "zstd" { pkt.Compression = wire.CompressionZstd }
+    et, kid := e.communityKey()
+    if e.encrypt && et == nil {
+        logx.Printf(1, "no active key, frame dropped")
+        return
+    }
+    if e.sessions != nil && pkt.DstMac[0]&1 == 0 && e.isLocal(pkt.SrcMac) {
+        if id, sk := e.sessions.Current(pkt.DstMac); sk != nil {
+            et = sk
+            kid = id
+        }
+        if msg, epoch, ok := e.sessions.Initiate(pkt.SrcMac, pkt.DstMac, time.Now()); ok {
+            e.sendKeyExchange(pkt.SrcMac, pkt.DstMac, wire.KeyExchangeInit, epoch, msg)
+        }
+    }
+    // in secure header mode the codes travel inside the ciphertext
+    wpkt := pkt
+    if et != nil && secure {
+        wpkt.Compression = wire.CompressionNone
+        wpkt.Transform = wire.TransformNull
+    }
+    m := wire.EncodePacket(pc, wpkt, nil, out)
+    if et == nil {
+        cdata, _ := e.codec.Compress(out[m:m], payload)
+        if !inPlace(cdata, out, m) {
+            logx.Printf(1, "frame of %d bytes does not fit, dropped", n)
+            return
+        }
+        m += len(cdata)
+    } else {
+        if e.withKeyID {
+            binary.BigEndian.PutUint32(out[m:], kid)
+            m += crypto.KeyIDSize
+        }
+        pt := m + et.NonceSize()
+        if secure {
+            out[pt] = pkt.Compression
+            out[pt+1] = pkt.Transform
+            pt += 2
+        }
+        cdata, _ := e.codec.Compress(out[pt:pt], payload)
+        // Seal reads the plaintext from out and must not grow it either
+        if !inPlace(cdata, out, pt) || pt+len(cdata)+et.Overhead() > len(out) {
+            logx.Printf(1, "frame of %d bytes does not fit, dropped", n)
+            return
+        }
+        ai := packetAD(ad, pc, &wpkt)
+        sealed, err := et.Seal(out[m:m], out[m+et.NonceSize():pt+len(cdata)], ad[:ai])
+        if err != nil {
+            logx.Printf(0, "frame not sent: %v", err)
+            return
+        }
+        m += len(sealed)
+    }
+    if s.hold {
+        s.batch[s.held].N, s.batch[s.held].Addr = m, e.sn.Load()
+        s.held++
+    } else {
+        e.conn.WriteTo(out[:m], e.sn.Load())
+    }
+    if et != nil { st.transopTx.Add(1) }
+    if pkt.DstMac[0]&1 != 0 { st.superBcastTx.Add(1) } else { st.superTx.Add(1) }
+    if logx.Level() >= 2 {
+        logx.Printf(2, "packet out src=%02x:%02x:%02x:%02x:%02x:%02x dst=%02x:%02x:%02x:%02x:%02x:%02x bytes=%d", pkt.SrcMac[0], pkt.SrcMac[1], pkt.SrcMac[2], pkt.SrcMac[3], pkt.SrcMac[4], pkt.SrcMac[5], pkt.DstMac[0], pkt.DstMac[1], pkt.DstMac[2], pkt.DstMac[3], pkt.DstMac[4], pkt.DstMac[5], n)
+    }
+}
+
+// inPlace reports whether a codec wrote b to buf[off:off] without moving it
+// to a new array.
+func inPlace(b, buf []byte, off int) bool { return len(b) == 0 || off < len(buf) && &b[0] == &buf[off] }
+
+// receiver holds the buffers of a packetLoop.
+type receiver struct {
+    dev Device
+    // snd sends the frames answered from here, ARP replies and resolved
+    // TUN packets
+    snd  *sender
+    g    *gro
+    pbuf []byte
+    dbuf []byte
+    rad  []byte
+}
+
+// packetLoop handles the packets from the supernode and keeps the
+// registration alive until quit is closed or the socket fails. Several
+// may run at once; frames go to dev. A BatchTransport is read a batch of
+// datagrams at a time.
+func (e *Edge) packetLoop(quit chan struct{}, dev Device) {
+    r := &receiver{dev: dev, snd: e.newSender(dev), pbuf: make([]byte, 4096), dbuf: make([]byte, 4096), rad: make([]byte, 64)}
+    if e.opts.Offload {
+        r.g = newGRO(dev)
+        defer r.g.stop()
+    }
+    bt, batched := e.conn.(BatchTransport)
+    in := transport.NewBatch(1, 2048)
+    if batched { in = transport.NewBatch(transport.MaxBatch, 2048) }
+    for {
+        select {
+        case <-quit:
+            return
+        default:
+        }
+        if e.reregister.Swap(false) { e.register() }
+        e.conn.SetReadDeadline(time.Now().Add(time.Second))
+        cnt := 1
+        var err error
+        if batched {
+            cnt, err = bt.ReadBatch(in)
+        } else {
+            in[0].N, in[0].Addr, err = e.conn.Read(in[0].Buf)
+        }
+        if err != nil {
+            if ne, ok := err.(net.Error); ok && ne.Timeout() {
+                e.registerDue()
+                continue
+            }
+            return
+        }
+        for k := 0; k < cnt; k++ { e.handle(r, in[k].Buf[:in[k].N], in[k].Addr) }
+        // the socket is drained: like the kernel at the end of a poll,
+        // hand the merged frame over now
+        if r.g != nil && batched && cnt < len(in) { r.g.flush() }
+    }
+}
+
+// handle processes one datagram from the transport.
+func (e *Edge) handle(r *receiver, p []byte, from *net.UDPAddr) {
+    secure, st := e.opts.SecureHeader, &e.stats
+    i := 0
+    c, ok := wire.DecodeCommon(p, &i)
+    if !ok {
+        return
+    }
+    if c.PC == wire.MsgRegisterSuperNak {
+        logx.Printf(0, "register rejected by supernode (community %s not allowed?)", e.opts.Community)
+        return
+    }
+    if c.PC == wire.MsgReRegisterSuper {
+        // only the supernode in use may send us elsewhere
+        if cur := e.sn.Load(); !from.IP.Equal(cur.IP) || from.Port != cur.Port { return }
+        rr, rok := wire.DecodeReRegisterSuper(p, &i)
+        if !rok { return }
+        if rr.Sock.Port != 0 {
+            next := rr.Sock.UDPAddr()
+            if next.IP.IsUnspecified() { next.IP = from.IP }
+            e.sn.Store(next)
+            logx.Printf(0, "supernode %s hands over to %s", from, next)
+            e.register()
+        } else {
+            logx.Printf(0, "supernode %s is going away, registering again", from)
+            e.register()
+            // retry soon: a restarting supernode is back within seconds
+            e.setLastReg(time.Now().Add(2*time.Second - regInterval))
+        }
+        return
+    }
+    if c.PC == wire.MsgRegisterSuperAck {
+        ack, aok := wire.DecodeRegisterSuperAck(p, &i)
+        if !aok {
+            return
+        }
+        if old := e.addr.Load(); ack.DevAddr.NetAddr != 0 && (old == nil || *old != ack.DevAddr) {
+            e.addr.Store(&ack.DevAddr)
+            logx.Printf(0, "virtual address %s/%d", ip4(ack.DevAddr.NetAddr), ack.DevAddr.Bitlen)
+        }
+        now := time.Now()
+        e.setLastReg(now)
+        st.lastSuper.Store(now.Unix())
+        logx.Printf(1, "register ack received")
+        qc := wire.Common{TTL: 2, PC: wire.MsgQueryPeer, Flags: 0}
+        copy(qc.Community[:], []byte(e.opts.Community))
+        src := e.srcMac()
+        q := wire.QueryPeer{}
+        q.AFlags = 0
+        copy(q.SrcMac[:], src[:])
+        q.Sock = e.reg.Sock
+        out := make([]byte, 128)
+        l := wire.EncodeQueryPeer(qc, q, out)
+        e.conn.WriteTo(out[:l], e.sn.Load())
+        logx.Printf(1, "query peer sent src=%02x:%02x:%02x:%02x:%02x:%02x", src[0], src[1], src[2], src[3], src[4], src[5])
+        return
+    }
+    if c.PC == wire.MsgPeerInfo {
+        pi, pok := wire.DecodePeerInfo(p, &i)
+        if !pok {
+            return
+        }
+        logx.Printf(1, "peer info received")
+        if e.opts.TUN { e.resolved(pi, r.snd) }
+        return
+    }
+    if c.PC == wire.MsgKeyExchange {
+        e.handleKeyExchange(c, p, i)
+        return
+    }
+    if c.PC == wire.MsgPacket {
+        pkt, ok, _ := wire.DecodePacket(p, &i, r.pbuf)
+        if !ok { return }
+        if !e.encrypt && (pkt.Transform == wire.TransformAES || pkt.Transform == wire.TransformChaCha20) { return }
+        data := pkt.Payload
+        dt := e.tr.Load()
+        if e.withKeyID {
+            if len(data) < crypto.KeyIDSize { return }
+            kid := binary.BigEndian.Uint32(data[:crypto.KeyIDSize])
+            dt = e.lookupKey(pkt.SrcMac, kid)
+            if dt == nil {
+                logx.Printf(2, "packet with unknown key id=%d dropped", kid)
+                return
+            }
+            data = data[crypto.KeyIDSize:]
+        }
+        if dt != nil {
+            if len(data) < dt.Overhead() { return }
+            ai := packetAD(r.rad, c, &pkt)
+            ns := dt.NonceSize()
+            dec, err := dt.Open(data[ns:ns], data, r.rad[:ai])
+            if err != nil { return }
+            data = dec
+            if secure {
+                if len(data) < 2 { return }
+                pkt.Compression = data[0]
+                pkt.Transform = data[1]
+                data = data[2:]
+            }
+        }
+        dec, _ := e.codec.Decompress(r.dbuf[:0], data)
+        if len(dec) > 0 && e.opts.TUN {
+            e.tunDeliver(dec, r.snd)
+        } else if len(dec) > 0 && r.g != nil {
+            r.g.write(dec)
+        } else if len(dec) > 0 {
+            r.dev.Write(dec)
+        }
+        if dt != nil { st.transopRx.Add(1) }
+        if pkt.DstMac[0]&1 != 0 { st.superBcastRx.Add(1) } else { st.superRx.Add(1) }
+        st.seen(pkt.SrcMac, pkt.Sock)
+        if logx.Level() >= 2 { logx.Printf(2, "packet in bytes=%d", len(dec)) }
+        return
+    }
+}
+
+// handleKeyExchange answers or completes a session key negotiation; p is
+// the packet and i the offset behind its common header.
+func (e *Edge) handleKeyExchange(c wire.Common, p []byte, i int) {
+    if e.sessions == nil { return }
+    kx, kok := wire.DecodeKeyExchange(p, &i)
+    if !kok || len(kx.Payload) < crypto.KeyIDSize { return }
+    // sessions are kept for our own addresses only
+    if !e.isLocal(kx.DstMac) {
+        logx.Printf(2, "key exchange for %s dropped", macString(kx.DstMac))
+        return
+    }
+    kid := binary.BigEndian.Uint32(kx.Payload[:crypto.KeyIDSize])
+    if kid&crypto.SessionKeyFlag != 0 { return }
+    kt := e.lookupKey(kx.SrcMac, kid)
+    if kt == nil { return }
+    hdr := make([]byte, 64)
+    hl := wire.EncodeKeyExchange(c, wire.KeyExchange{SrcMac: kx.SrcMac, DstMac: kx.DstMac, Kind: kx.Kind, Epoch: kx.Epoch}, hdr)
+    msg, err := kt.Open(nil, kx.Payload[crypto.KeyIDSize:], hdr[:hl])
+    if err != nil {
+        logx.Printf(1, "key exchange authentication failed")
+        return
+    }
+    now := time.Now()
+    switch kx.Kind {
+    case wire.KeyExchangeInit:
+        resp, ok, err := e.sessions.HandleInit(kx.DstMac, kx.SrcMac, kx.Epoch, msg, now)
+        if err != nil { logx.Printf(1, "key exchange: %v", err) }
+        if err != nil || !ok { return }
+        e.sendKeyExchange(kx.DstMac, kx.SrcMac, wire.KeyExchangeResp, kx.Epoch, resp)
+    case wire.KeyExchangeResp:
+        if err := e.sessions.HandleResp(kx.DstMac, kx.SrcMac, kx.Epoch, msg, now); err != nil {
+            logx.Printf(1, "key exchange: %v", err)
+            return
+        }
+        logx.Printf(1, "session key established epoch=%d", kx.Epoch)
+    }
+}
+
+// packetAD writes the associated data authenticated with a PACKET payload
+// into ad: the common header, both MACs, the socket and the compression and
+// transform codes as sent on the wire.
+func packetAD(ad []byte, c wire.Common, pkt *wire.Packet) int {
+    ai := 0
+    ai += wire.EncodeCommon(c, ad[ai:])
+    copy(ad[ai:ai+6], pkt.SrcMac[:])
+    ai += 6
+    copy(ad[ai:ai+6], pkt.DstMac[:])
+    ai += 6
+    ai += wire.EncodeSock(pkt.Sock, ad[ai:])
+    ad[ai] = pkt.Compression
+    ai++
+    ad[ai] = pkt.Transform
+    ai++
+    return ai
+}
@@ -0,0 +1,79 @@
+package edge
+
+import (
+    "net"
+    "os"
+    "sync"
+    "testing"
+    "time"
+    "n2n-go/pkg/tap"
+    "n2n-go/pkg/wire"
+)
+
+// recorder is a Transport that keeps the packets written to it.
+type recorder struct {
+    mu   sync.Mutex
+    sent [][]byte
+}
+
+func (r *recorder) Read(b []byte) (int, *net.UDPAddr, error) { return 0, nil, os.ErrDeadlineExceeded }
+func (r *recorder) SetReadDeadline(time.Time) error { return nil }
+func (r *recorder) Close() error { return nil }
+
+func (r *recorder) WriteTo(b []byte, addr *net.UDPAddr) (int, error) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    r.sent = append(r.sent, append([]byte(nil), b...))
+    return len(b), nil
+}
+
+func (r *recorder) packets() [][]byte {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return append([][]byte(nil), r.sent...)
+}
+
+var testMac = wire.Mac{0x02, 0, 0, 0, 0, 1}
+
+// testEdge sets up an edge on a memory device that sends to a recorder.
+func testEdge(t *testing.T, o Options) (*Edge, *recorder) {
+    t.Helper()
+    rec := &recorder{}
+    o.Device, o.Transport = tap.NewMemory("test", 4), rec
+    o.Supernode, o.Community = "127.0.0.1:7654", "community"
+    if o.MAC == (wire.Mac{}) { o.MAC = testMac }
+    if o.Compression == "" { o.Compression = "none" }
+    e, err := New(o)
+    if err != nil { t.Fatal(err) }
+    return e, rec
+}
+
+// frame is an ethernet frame of n bytes from testMac to dst.
+func frame(dst wire.Mac, n int) []byte {
+    f := make([]byte, n)
+    copy(f, dst[:])
+    copy(f[6:], testMac[:])
+    return f
+}
+
+// movingCodec returns its output in a new array, as a codec does when the
+// result does not fit the buffer it is given.
+type movingCodec struct{}
+
+func (movingCodec) Compress(dst, src []byte) ([]byte, error) { return append([]byte(nil), src...), nil }
+func (movingCodec) Decompress(dst, src []byte) ([]byte, error) { return append(dst[:0], src...), nil }
+
+func TestSendDropsFramesOutsideTheBuffer(t *testing.T) {
+    for _, cipher := range []string{"null", "aes"} {
+        e, rec := testEdge(t, Options{Cipher: cipher, Key: "secret"})
+        s := e.newSender(e.devs[0])
+        peer := wire.Mac{0x02, 0, 0, 0, 0, 2}
+        e.send(s, frame(peer, 100))
+        if n := len(rec.packets()); n != 1 { t.Fatalf("%s: %d packets", cipher, n) }
+        // sealing would have to grow the buffer
+        e.send(s, frame(peer, len(s.out)-20))
+        e.codec = movingCodec{}
+        e.send(s, frame(peer, 100))
+        if n := len(rec.packets()); n != 1 { t.Fatalf("%s: frame sent from a stale buffer (%d packets)", cipher, n) }
+    }
+}
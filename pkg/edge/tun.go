@@ -0,0 +1,244 @@
+package edge
+
+import (
+    "encoding/binary"
+    "net/netip"
+    "sync"
+    "time"
+    "n2n-go/pkg/logx"
+    "n2n-go/pkg/wire"
+)
+
+// In TUN mode the device carries IP packets. The edge puts an ethernet
+// header in front of each packet so that the wire format stays the same
+// as for TAP edges, and C n2n peers see an ordinary host: it answers ARP
+// requests for its own address and learns the MACs of the addresses it
+// receives packets from. Unknown IPv4 destinations are resolved with a
+// query to the supernode, which knows the address leases, and only with
+// an ARP broadcast when the supernode does not know them either.
+
+const ethHeaderLen = 14
+
+const (
+    etherIPv4 = 0x0800
+    etherARP  = 0x0806
+    etherIPv6 = 0x86dd
+)
+
+var broadcastMac = wire.Mac{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+const (
+    // maxPending frames per address wait for it to resolve, like the
+    // kernel ARP queue
+    maxPending = 3
+    // resolveTimeout is when a query is repeated and waiting frames dropped
+    resolveTimeout = 3 * time.Second
+)
+
+// l3 maps virtual addresses to edge MACs; mu guards it.
+type l3 struct {
+    mu      sync.Mutex
+    macs    map[netip.Addr]wire.Mac
+    pending map[netip.Addr]*pending
+}
+
+type pending struct {
+    frames [][]byte
+    since  time.Time
+    // arp is set once the supernode did not know the address
+    arp bool
+}
+
+func ip4(v uint32) netip.Addr {
+    var b [4]byte
+    binary.BigEndian.PutUint32(b[:], v)
+    return netip.AddrFrom4(b)
+}
+
+// ownAddr returns the virtual address leased by the supernode.
+func (e *Edge) ownAddr() (netip.Addr, wire.IPSubnet) {
+    a := e.addr.Load()
+    if a == nil || a.NetAddr == 0 { return netip.Addr{}, wire.IPSubnet{} }
+    return ip4(a.NetAddr), *a
+}
+
+// tunFrame fills in the ethernet header in front of the IP packet read from
+// the TUN device. It returns nil when the packet is dropped or waits for
+// its destination to resolve.
+func (e *Edge) tunFrame(frame []byte) []byte {
+    p := frame[ethHeaderLen:]
+    if len(p) < 1 { return nil }
+    var typ uint16
+    var dst netip.Addr
+    switch p[0] >> 4 {
+    case 4:
+        if len(p) < 20 { return nil }
+        typ, dst = etherIPv4, netip.AddrFrom4([4]byte(p[16:20]))
+    case 6:
+        if len(p) < 40 { return nil }
+        typ, dst = etherIPv6, netip.AddrFrom16([16]byte(p[24:40]))
+    default:
+        return nil
+    }
+    self := e.opts.MAC
+    copy(frame[6:12], self[:])
+    binary.BigEndian.PutUint16(frame[12:14], typ)
+    mac, ok := e.resolve(dst, frame)
+    if !ok { return nil }
+    copy(frame[0:6], mac[:])
+    return frame
+}
+
+// resolve returns the MAC for dst. When it is unknown the frame is queued
+// and the address looked up; unknown IPv6 destinations are broadcast
+// until a reply teaches their MAC.
+func (e *Edge) resolve(dst netip.Addr, frame []byte) (wire.Mac, bool) {
+    switch {
+    case dst.Is4() && dst.IsMulticast():
+        b := dst.As4()
+        return wire.Mac{0x01, 0x00, 0x5e, b[1] & 0x7f, b[2], b[3]}, true
+    case dst.Is4() && e.isBroadcast(dst):
+        return broadcastMac, true
+    case dst.Is6() && dst.IsMulticast():
+        b := dst.As16()
+        return wire.Mac{0x33, 0x33, b[12], b[13], b[14], b[15]}, true
+    }
+    l := &e.l3
+    l.mu.Lock()
+    if mac, ok := l.macs[dst]; ok {
+        l.mu.Unlock()
+        return mac, true
+    }
+    if dst.Is6() {
+        l.mu.Unlock()
+        return broadcastMac, true
+    }
+    now := time.Now()
+    p := l.pending[dst]
+    query := p == nil || now.Sub(p.since) >= resolveTimeout
+    if query {
+        p = &pending{since: now}
+        l.pending[dst] = p
+    }
+    if len(p.frames) < maxPending { p.frames = append(p.frames, append([]byte(nil), frame...)) }
+    l.mu.Unlock()
+    if query { e.queryAddr(dst) }
+    return wire.Mac{}, false
+}
+
+func (e *Edge) isBroadcast(a netip.Addr) bool {
+    if a == netip.AddrFrom4([4]byte{255, 255, 255, 255}) { return true }
+    _, sub := e.ownAddr()
+    if sub.NetAddr == 0 || sub.Bitlen == 0 || sub.Bitlen >= 31 { return false }
+    host := uint32(1)<<(32-sub.Bitlen) - 1
+    return a == ip4(sub.NetAddr|host)
+}
+
+// queryAddr asks the supernode which edge holds the lease of a.
+func (e *Edge) queryAddr(a netip.Addr) {
+    qc := wire.Common{TTL: 2, PC: wire.MsgQueryPeer, Flags: 0}
+    copy(qc.Community[:], []byte(e.opts.Community))
+    b := a.As4()
+    q := wire.QueryPeer{SrcMac: e.opts.MAC, Sock: e.reg.Sock, TargetIP: binary.BigEndian.Uint32(b[:])}
+    out := make([]byte, 128)
+    l := wire.EncodeQueryPeer(qc, q, out)
+    e.conn.WriteTo(out[:l], e.sn.Load())
+    logx.Printf(1, "query peer sent ip=%s", a)
+}
+
+// learn records that a is at mac and sends the frames waiting for it.
+func (e *Edge) learn(a netip.Addr, mac wire.Mac, s *sender) {
+    if !a.IsValid() || a.IsUnspecified() || a.IsMulticast() || mac[0]&1 != 0 || mac == e.opts.MAC { return }
+    l := &e.l3
+    l.mu.Lock()
+    old, known := l.macs[a]
+    l.macs[a] = mac
+    p := l.pending[a]
+    delete(l.pending, a)
+    l.mu.Unlock()
+    if !known || old != mac { logx.Printf(1, "address %s is at %s", a, macString(mac)) }
+    if p == nil { return }
+    for _, f := range p.frames {
+        copy(f[0:6], mac[:])
+        e.send(s, f)
+    }
+}
+
+// resolved handles the supernode's answer to queryAddr.
+func (e *Edge) resolved(pi wire.PeerInfo, s *sender) {
+    if pi.DevAddr.NetAddr == 0 { return }
+    a := ip4(pi.DevAddr.NetAddr)
+    if pi.Mac != (wire.Mac{}) {
+        e.learn(a, pi.Mac, s)
+        return
+    }
+    // not leased by the supernode, maybe a host with a static address
+    l := &e.l3
+    l.mu.Lock()
+    p := l.pending[a]
+    ask := p != nil && !p.arp
+    if ask { p.arp = true }
+    l.mu.Unlock()
+    if ask { e.sendARP(1, broadcastMac, wire.Mac{}, a, s) }
+}
+
+// tunDeliver writes the IP packet of a frame received in TUN mode to the
+// device and answers ARP requests for the own address.
+func (e *Edge) tunDeliver(frame []byte, s *sender) {
+    if len(frame) < ethHeaderLen { return }
+    var dst, src wire.Mac
+    copy(dst[:], frame[0:6])
+    copy(src[:], frame[6:12])
+    if dst[0]&1 == 0 && dst != e.opts.MAC { return }
+    p := frame[ethHeaderLen:]
+    switch binary.BigEndian.Uint16(frame[12:14]) {
+    case etherIPv4:
+        if len(p) < 20 { return }
+        e.learn(netip.AddrFrom4([4]byte(p[12:16])), src, s)
+        s.dev.Write(p)
+    case etherIPv6:
+        if len(p) < 40 { return }
+        e.learn(netip.AddrFrom16([16]byte(p[8:24])), src, s)
+        s.dev.Write(p)
+    case etherARP:
+        e.handleARP(p, s)
+    }
+}
+
+func (e *Edge) handleARP(p []byte, s *sender) {
+    if len(p) < 28 || binary.BigEndian.Uint16(p[0:2]) != 1 || binary.BigEndian.Uint16(p[2:4]) != etherIPv4 || p[4] != 6 || p[5] != 4 { return }
+    var sha wire.Mac
+    copy(sha[:], p[8:14])
+    spa := netip.AddrFrom4([4]byte(p[14:18]))
+    tpa := netip.AddrFrom4([4]byte(p[24:28]))
+    e.learn(spa, sha, s)
+    if own, _ := e.ownAddr(); binary.BigEndian.Uint16(p[6:8]) == 1 && own.IsValid() && tpa == own {
+        e.sendARP(2, sha, sha, spa, s)
+    }
+}
+
+// sendARP sends an ARP request (op 1) or reply (op 2) for the own address
+// to dst; tha and tpa are the target hardware and protocol address.
+func (e *Edge) sendARP(op uint16, dst, tha wire.Mac, tpa netip.Addr, s *sender) {
+    self := e.opts.MAC
+    own, _ := e.ownAddr()
+    f := make([]byte, ethHeaderLen+28)
+    copy(f[0:6], dst[:])
+    copy(f[6:12], self[:])
+    binary.BigEndian.PutUint16(f[12:14], etherARP)
+    p := f[ethHeaderLen:]
+    binary.BigEndian.PutUint16(p[0:2], 1)
+    binary.BigEndian.PutUint16(p[2:4], etherIPv4)
+    p[4], p[5] = 6, 4
+    binary.BigEndian.PutUint16(p[6:8], op)
+    copy(p[8:14], self[:])
+    if own.IsValid() {
+        b := own.As4()
+        copy(p[14:18], b[:])
+    }
+    copy(p[18:24], tha[:])
+    b := tpa.As4()
+    copy(p[24:28], b[:])
+    e.send(s, f)
+    logx.Printf(1, "arp op=%d sent for %s", op, tpa)
+}
@@ -3,22 +3,27 @@ package logx
 import (
     "fmt"
     "os"
+    "sync/atomic"
 )
 
-var Level int
+// level is changed by management requests while packets are logged.
+var level atomic.Int32
 
-func SetLevel(l int) { Level = l }
+func SetLevel(l int) { level.Store(int32(l)) }
+
+// Level returns the current trace level.
+func Level() int { return int(level.Load()) }
 
 func InitFromEnv() {
     v := os.Getenv("N2N_TRACE")
     if v == "" { return }
     var x int
     fmt.Sscanf(v, "%d", &x)
-    Level = x
+    SetLevel(x)
 }
 
 func Printf(l int, format string, v ...any) {
-    if Level >= l {
+    if Level() >= l {
         fmt.Printf(format+"\n", v...)
     }
 }
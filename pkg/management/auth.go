@@ -1,18 +1,127 @@
 package management
 
-func pearson64(b []byte) uint64 {
-    var t [256]uint8
-    for i := 0; i < 256; i++ { t[i] = uint8(i) }
-    var h0, h1, h2, h3, h4, h5, h6, h7 uint8
-    for _, c := range b {
-        h0 = t[h0^c]
-        h1 = t[h1^c]
-        h2 = t[h2^c]
-        h3 = t[h3^c]
-        h4 = t[h4^c]
-        h5 = t[h5^c]
-        h6 = t[h6^c]
-        h7 = t[h7^c]
+import (
+    crand "crypto/rand"
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/hex"
+    "encoding/json"
+    "os"
+    "strings"
+    "time"
+    "golang.org/x/crypto/scrypt"
+    "n2n-go/pkg/logx"
+)
+
+// Roles granted by the management credentials.
+const (
+    RoleNone = iota
+    RoleRead
+    RoleWrite
+)
+
+func roleName(r int) string {
+    switch r {
+    case RoleRead:
+        return "ro"
+    case RoleWrite:
+        return "rw"
+    }
+    return "none"
+}
+
+// scrypt parameters of HashPassword.
+const (
+    pwScryptN = 1 << 15
+    pwScryptR = 8
+    pwScryptP = 1
+)
+
+// HashPassword returns a credential spec for password that can be used as
+// Server.Password or Server.ReadPassword without storing the password.
+func HashPassword(password string) (string, error) {
+    salt := make([]byte, 16)
+    if _, err := crand.Read(salt); err != nil { return "", err }
+    k, err := scrypt.Key([]byte(password), salt, pwScryptN, pwScryptR, pwScryptP, 32)
+    if err != nil { return "", err }
+    return "scrypt:" + hex.EncodeToString(salt) + ":" + hex.EncodeToString(k), nil
+}
+
+// match reports whether auth satisfies the credential spec. A spec is the
+// plain password or a scrypt spec from HashPassword. "pearson64:<hex>"
+// specs of earlier releases did not use the hash of C n2n and accepted
+// colliding passwords; they match nothing. Successful scrypt checks are cached so that every
+// request does not pay for the key derivation.
+func (s *Server) match(spec, auth string) bool {
+    kind, rest, _ := strings.Cut(spec, ":")
+    switch kind {
+    case "pearson64":
+        logx.Printf(1, "mgmt pearson64 password specs are not supported; use n2nctl hash-password")
+        return false
+    case "scrypt":
+        saltHex, keyHex, _ := strings.Cut(rest, ":")
+        salt, err1 := hex.DecodeString(saltHex)
+        want, err2 := hex.DecodeString(keyHex)
+        if err1 != nil || err2 != nil || len(want) == 0 { return false }
+        ck := sha256.Sum256([]byte(spec + "\x00" + auth))
+        s.mu.Lock()
+        ok := s.authCache[ck]
+        s.mu.Unlock()
+        if ok { return true }
+        got, err := scrypt.Key([]byte(auth), salt, pwScryptN, pwScryptR, pwScryptP, len(want))
+        if err != nil || subtle.ConstantTimeCompare(got, want) != 1 { return false }
+        s.mu.Lock()
+        if s.authCache == nil || len(s.authCache) >= 64 { s.authCache = map[[32]byte]bool{} }
+        s.authCache[ck] = true
+        s.mu.Unlock()
+        return true
     }
-    return uint64(h0) | uint64(h1)<<8 | uint64(h2)<<16 | uint64(h3)<<24 | uint64(h4)<<32 | uint64(h5)<<40 | uint64(h6)<<48 | uint64(h7)<<56
+    // compare digests so that the length of the password does not leak
+    a, b := sha256.Sum256([]byte(auth)), sha256.Sum256([]byte(spec))
+    return subtle.ConstantTimeCompare(a[:], b[:]) == 1
+}
+
+// role returns the role granted to auth. Without any credential configured
+// everybody may write; with only ReadPassword set no one may.
+func (s *Server) role(auth string) int {
+    rw, ro := s.passwords()
+    if rw == "" && ro == "" { return RoleWrite }
+    if auth == "" { return RoleNone }
+    if rw != "" && s.match(rw, auth) { return RoleWrite }
+    if ro != "" && s.match(ro, auth) { return RoleRead }
+    return RoleNone
+}
+
+// SetPasswords replaces Password and ReadPassword while serving.
+func (s *Server) SetPasswords(rw, ro string) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.Password, s.ReadPassword = rw, ro
+}
+
+func (s *Server) passwords() (string, string) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.Password, s.ReadPassword
+}
+
+// audit records a write request and its outcome in Audit, or in the log
+// when Audit is nil.
+func (s *Server) audit(proto, remote string, role int, method string, params []string, errMsg string) {
+    result := "ok"
+    if errMsg != "" { result = errMsg }
+    if s.Audit == nil {
+        logx.Printf(0, "mgmt audit %s %s role=%s %s %v result=%s", proto, remote, roleName(role), method, params, result)
+        return
+    }
+    if params == nil { params = []string{} }
+    b, _ := json.Marshal(map[string]any{"time": time.Now().Format(time.RFC3339), "proto": proto, "remote": remote, "role": roleName(role), "method": method, "params": params, "result": result})
+    s.mu.Lock()
+    s.Audit.Write(append(b, '\n'))
+    s.mu.Unlock()
+}
+
+// OpenAudit opens the audit log at path for appending.
+func OpenAudit(path string) (*os.File, error) {
+    return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
 }
@@ -0,0 +1,212 @@
+package management
+
+import (
+    "bufio"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "math/rand"
+    "net"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync/atomic"
+    "time"
+)
+
+// ErrTimeout is returned when a request stays unanswered after all retries.
+var ErrTimeout = errors.New("management request timed out")
+
+// RemoteError is an error reply sent by the server.
+type RemoteError struct {
+    Method string
+    Msg    string
+}
+
+func (e *RemoteError) Error() string { return e.Method + ": " + e.Msg }
+
+// Client speaks the UDP management protocol served by Server.Handle.
+type Client struct {
+    // Password is sent in the auth field of every request when set.
+    Password string
+    // Timeout bounds the wait for each reply datagram.
+    Timeout time.Duration
+    // Retries is how often a read request is re-sent after a timeout.
+    Retries int
+    conn    net.Conn
+    // r reads the replies of stream connections line by line.
+    r       *bufio.Reader
+    // local is the socket file bound for unix datagram replies.
+    local   string
+    tag     uint32
+}
+
+// Dial connects a client to a management socket: host:port for UDP, or a
+// unix socket spec as accepted by Server.ServeUnix ("unixgram:<path>",
+// "unix:<path>").
+func Dial(addr string) (*Client, error) {
+    c := &Client{Timeout: time.Second, Retries: 2, tag: uint32(rand.Intn(1 << 16))}
+    var err error
+    switch {
+    case strings.HasPrefix(addr, "unixgram:"):
+        // the server answers to our address, so the socket must be bound
+        c.local = filepath.Join(os.TempDir(), fmt.Sprintf("n2nctl-%d-%d.sock", os.Getpid(), rand.Int63()))
+        c.conn, err = net.DialUnix("unixgram", &net.UnixAddr{Name: c.local, Net: "unixgram"}, &net.UnixAddr{Name: strings.TrimPrefix(addr, "unixgram:"), Net: "unixgram"})
+        if err != nil { os.Remove(c.local) }
+    case strings.HasPrefix(addr, "unix:"):
+        c.conn, err = net.Dial("unix", strings.TrimPrefix(addr, "unix:"))
+        if err == nil { c.r = bufio.NewReader(c.conn) }
+    default:
+        c.conn, err = net.Dial("udp", addr)
+    }
+    if err != nil { return nil, err }
+    return c, nil
+}
+
+func (c *Client) Close() error {
+    err := c.conn.Close()
+    if c.local != "" { os.Remove(c.local) }
+    return err
+}
+
+// Call runs method as a read request. Commands that modify state answer
+// badtype; they must be sent with Write.
+func (c *Client) Call(method string, params ...string) ([]map[string]any, error) {
+    return c.Request("r", method, params...)
+}
+
+// Write runs method as a write request.
+func (c *Client) Write(method string, params ...string) ([]map[string]any, error) {
+    return c.Request("w", method, params...)
+}
+
+// Request sends a request of type mtype (r, w or s) and collects the rows up
+// to the end marker. When a reply datagram to a read request is lost the
+// request is sent again under a new tag; late replies carrying an older tag
+// are dropped. Other requests are sent once, as a lost reply does not tell
+// whether the command took effect.
+func (c *Client) Request(mtype, method string, params ...string) ([]map[string]any, error) {
+    retries := c.Retries
+    if mtype != "r" { retries = 0 }
+    for try := 0; try <= retries; try++ {
+        rows, err := c.roundTrip(mtype, method, params)
+        if err != ErrTimeout { return rows, err }
+    }
+    return nil, ErrTimeout
+}
+
+// send writes one request under a fresh tag and returns the tag.
+func (c *Client) send(mtype, method string, params []string) (string, error) {
+    tag := strconv.FormatUint(uint64(atomic.AddUint32(&c.tag, 1)), 10)
+    opts := tag
+    if c.Password != "" { opts += ":1:" + c.Password }
+    line := strings.Join(append([]string{mtype, opts, method}, params...), " ")
+    if c.r != nil { line += "\n" }
+    _, err := c.conn.Write([]byte(line))
+    return tag, err
+}
+
+func (c *Client) roundTrip(mtype, method string, params []string) ([]map[string]any, error) {
+    tag, err := c.send(mtype, method, params)
+    if err != nil { return nil, err }
+    var rows []map[string]any
+    for {
+        m, err := c.read(c.Timeout)
+        if err != nil { return nil, err }
+        if m["_tag"] != tag || m["_type"] == "event" { continue }
+        typ := m["_type"]
+        delete(m, "_tag")
+        delete(m, "_type")
+        switch typ {
+        case "begin":
+        case "end":
+            return rows, nil
+        case "error":
+            return nil, &RemoteError{Method: method, Msg: fmt.Sprint(m["error"])}
+        default:
+            rows = append(rows, m)
+        }
+    }
+}
+
+// Subscribe subscribes to topic and passes every event to fn until fn
+// returns false or reading fails. Waiting for events never times out. When
+// since is not negative, buffered events with a higher sequence number are
+// replayed first. The subscription is renewed before the server expires it,
+// and each renewal asks for a replay after the last event seen so that lost
+// datagrams are recovered; duplicates are filtered by sequence number.
+func (c *Client) Subscribe(topic string, since int64, fn func(map[string]any) bool) error {
+    last := since
+    acked := false
+    tries := 0
+    var tag string
+    var renew time.Time
+    for {
+        if !time.Now().Before(renew) {
+            if !acked {
+                if tries > c.Retries { return ErrTimeout }
+                tries++
+            }
+            params := []string{topic}
+            if last >= 0 { params = append(params, strconv.FormatInt(last, 10)) }
+            var err error
+            if tag, err = c.send("s", "subscribe", params); err != nil { return err }
+            renew = time.Now().Add(c.Timeout)
+        }
+        wait := time.Until(renew)
+        if wait <= 0 { continue }
+        m, err := c.read(wait)
+        if err == ErrTimeout { continue }
+        if err != nil { return err }
+        switch m["_type"] {
+        case "subscribed":
+            if m["_tag"] != tag { break }
+            acked = true
+            ttl, _ := m["ttl"].(float64)
+            if ttl < 3 { ttl = 3 }
+            renew = time.Now().Add(time.Duration(ttl/3*1000) * time.Millisecond)
+        case "error":
+            if m["_tag"] == tag { return &RemoteError{Method: "subscribe", Msg: fmt.Sprint(m["error"])} }
+        case "event":
+            seq, _ := m["_seq"].(float64)
+            if int64(seq) <= last { continue }
+            last = int64(seq)
+            delete(m, "_tag")
+            delete(m, "_type")
+            if !fn(m) { return nil }
+        }
+    }
+}
+
+// Unsubscribe cancels the subscriptions of this client to the given topics,
+// or to all topics. It does not wait for the reply so it may be called while
+// Subscribe is reading.
+func (c *Client) Unsubscribe(topics ...string) error {
+    _, err := c.send("s", "unsubscribe", topics)
+    return err
+}
+
+// read returns the next JSON reply; a zero timeout waits indefinitely.
+func (c *Client) read(timeout time.Duration) (map[string]any, error) {
+    buf := make([]byte, 65535)
+    for {
+        var dl time.Time
+        if timeout > 0 { dl = time.Now().Add(timeout) }
+        c.conn.SetReadDeadline(dl)
+        var b []byte
+        var err error
+        if c.r != nil {
+            b, err = c.r.ReadBytes('\n')
+        } else {
+            var n int
+            n, err = c.conn.Read(buf)
+            b = buf[:n]
+        }
+        if errors.Is(err, os.ErrDeadlineExceeded) { return nil, ErrTimeout }
+        if err != nil { return nil, err }
+        m := map[string]any{}
+        if json.Unmarshal(b, &m) != nil { continue }
+        return m, nil
+    }
+}
@@ -0,0 +1,175 @@
+package management
+
+import (
+    "encoding/json"
+    "sort"
+    "time"
+    "n2n-go/pkg/logx"
+)
+
+type subscriber struct {
+    from    string
+    send    func([]byte)
+    tag     string
+    expires time.Time
+}
+
+// topic holds the subscribers of one event topic and its recent events.
+// Sequence numbers are per topic so that subscribers can detect gaps.
+type topic struct {
+    seq    uint64
+    subs   map[string]*subscriber
+    replay []map[string]any
+}
+
+// Publish queues an event for the subscribers of topic. It never blocks: when
+// the Events channel is full the event is dropped and counted, so a slow
+// management client cannot stall the caller.
+func (s *Server) Publish(topic string, row map[string]any) {
+    if s.Events == nil { return }
+    select {
+    case s.Events <- MgmtEvent{Topic: topic, Row: row, Time: time.Now()}:
+    default:
+        n := s.dropped.Add(1)
+        logx.Printf(2, "mgmt event dropped topic=%s total=%d", topic, n)
+    }
+}
+
+func (s *Server) ttl() time.Duration {
+    if s.SubscriptionTTL > 0 { return s.SubscriptionTTL }
+    return 60 * time.Second
+}
+
+func (s *Server) replaySize() int {
+    if s.ReplaySize > 0 { return s.ReplaySize }
+    return 128
+}
+
+// topicLocked returns the state of name, creating it. s.mu must be held.
+func (s *Server) topicLocked(name string) *topic {
+    if s.topics == nil { s.topics = map[string]*topic{} }
+    t := s.topics[name]
+    if t == nil {
+        t = &topic{subs: map[string]*subscriber{}}
+        s.topics[name] = t
+    }
+    return t
+}
+
+// pruneLocked drops the subscriptions that expired before now. s.mu must be
+// held.
+func (s *Server) pruneLocked(now time.Time) {
+    for name, t := range s.topics {
+        for key, sub := range t.subs {
+            if now.After(sub.expires) {
+                delete(t.subs, key)
+                logx.Printf(2, "mgmt subscription expired %s %s", name, key)
+            }
+        }
+    }
+}
+
+// subscribe adds or renews the subscription of client from and returns the
+// last sequence number of the topic and the subscription lifetime.
+func (s *Server) subscribe(name, tag, from string, send func([]byte)) (uint64, time.Duration) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    now := time.Now()
+    s.pruneLocked(now)
+    t := s.topicLocked(name)
+    ttl := s.ttl()
+    t.subs[from] = &subscriber{from: from, send: send, tag: tag, expires: now.Add(ttl)}
+    return t.seq, ttl
+}
+
+// unsubscribe removes client from from the given topics, or from all topics
+// when none are given, and returns how many subscriptions were removed.
+func (s *Server) unsubscribe(names []string, from string) int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if len(names) == 0 {
+        for name := range s.topics { names = append(names, name) }
+    }
+    n := 0
+    for _, name := range names {
+        if t := s.topics[name]; t != nil && t.subs[from] != nil {
+            delete(t.subs, from)
+            n++
+        }
+    }
+    return n
+}
+
+// replay encodes the buffered events of name newer than since for tag.
+func (s *Server) replay(name, tag string, since uint64) [][]byte {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    var out [][]byte
+    for _, ev := range s.topicLocked(name).replay {
+        if ev["_seq"].(uint64) > since { out = append(out, encodeEvent(ev, tag)) }
+    }
+    return out
+}
+
+func (s *Server) subscriptions() []replyRow {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.pruneLocked(time.Now())
+    var rows []replyRow
+    for name, t := range s.topics {
+        for _, sub := range t.subs {
+            rows = append(rows, replyRow{"topic": name, "sockaddr": sub.from, "seq": t.seq, "expires": sub.expires.Unix()})
+        }
+    }
+    sort.Slice(rows, func(i, j int) bool {
+        if rows[i]["topic"] != rows[j]["topic"] { return rows[i]["topic"].(string) < rows[j]["topic"].(string) }
+        return rows[i]["sockaddr"].(string) < rows[j]["sockaddr"].(string)
+    })
+    return rows
+}
+
+// startDispatch starts the event dispatcher once for all listeners.
+func (s *Server) startDispatch() {
+    if s.Events == nil { return }
+    s.dispatchOnce.Do(func() { go s.dispatch() })
+}
+
+// dispatch numbers published events, keeps them for replay and sends them
+// to every live subscriber of their topic.
+func (s *Server) dispatch() {
+    done := s.doneCh()
+    for {
+        var ev MgmtEvent
+        select {
+        case ev = <-s.Events:
+        case <-done:
+            return
+        }
+        now := time.Now()
+        at := ev.Time
+        if at.IsZero() { at = now }
+        m := map[string]any{"_topic": ev.Topic, "_ts": at.UnixMilli()}
+        for k, v := range ev.Row { m[k] = v }
+        s.mu.Lock()
+        t := s.topicLocked(ev.Topic)
+        t.seq++
+        m["_seq"] = t.seq
+        t.replay = append(t.replay, m)
+        if over := len(t.replay) - s.replaySize(); over > 0 { t.replay = append(t.replay[:0], t.replay[over:]...) }
+        s.pruneLocked(now)
+        var to []subscriber
+        for _, sub := range t.subs { to = append(to, *sub) }
+        s.mu.Unlock()
+        for _, sub := range to { sub.send(encodeEvent(m, sub.tag)) }
+        logx.Printf(2, "mgmt event topic=%s seq=%d subscribers=%d", ev.Topic, m["_seq"], len(to))
+    }
+}
+
+func encodeEvent(ev map[string]any, tag string) []byte {
+    m := make(map[string]any, len(ev)+2)
+    for k, v := range ev { m[k] = v }
+    m["_tag"] = tag
+    m["_type"] = "event"
+    b, _ := json.Marshal(m)
+    return append(b, '\n')
+}
@@ -0,0 +1,260 @@
+package management
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "mime"
+    "net"
+    "net/http"
+    "strconv"
+    "strings"
+    "n2n-go/pkg/logx"
+)
+
+// ErrBadRequest marks command errors caused by invalid parameters; over
+// HTTP they are reported as 400, other errors as 500.
+var ErrBadRequest = errors.New("badreq")
+
+// BadRequest wraps msg so that it is reported as a client error.
+func BadRequest(msg string) error { return fmt.Errorf("%w: %s", ErrBadRequest, msg) }
+
+// ListenHTTP opens the listener for ServeHTTP. addr is host:port or
+// unix:<path> for a unix stream socket. A TCP address other than loopback
+// is refused unless a password is set.
+func (s *Server) ListenHTTP(addr string) (net.Listener, error) {
+    if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+        l, err := listenUnix("unix", path, 0600, -1, -1)
+        if err != nil { return nil, err }
+        return unixListener{Listener: l.(net.Listener), path: path}, nil
+    }
+    l, err := net.Listen("tcp", addr)
+    if err != nil { return nil, err }
+    if rw, ro := s.passwords(); rw == "" && ro == "" && !l.Addr().(*net.TCPAddr).IP.IsLoopback() {
+        l.Close()
+        return nil, fmt.Errorf("%s is not a loopback address; set a management password to serve it", addr)
+    }
+    return l, nil
+}
+
+// ServeHTTP serves the registered commands as REST resources on l, plus
+// GET/PUT /verbose, POST /stop and GET /openapi.json. When a password is
+// set, requests must carry it as a bearer token or as the basic auth
+// password; write resources need the read-write Password. POST /stop
+// closes keepAlive like the stop request of Handle.
+//
+// Requests must name the address they arrive on in their Host header, and
+// writes must be sent as application/json or carry an X-N2N-Request
+// header, so that web pages cannot drive the API through the browser of
+// the operator.
+func (s *Server) ServeHTTP(l net.Listener, keepAlive chan struct{}) error {
+    logx.Printf(1, "mgmt http listening %s", l.Addr())
+    s.mu.Lock()
+    s.httpStop = keepAlive
+    s.mu.Unlock()
+    hs := &http.Server{Handler: s.HTTPHandler()}
+    s.mu.Lock()
+    s.servers = append(s.servers, hs)
+    s.mu.Unlock()
+    if s.closing.Load() { hs.Close() }
+    return hs.Serve(l)
+}
+
+// HTTPHandler returns the REST handler used by ServeHTTP.
+func (s *Server) HTTPHandler() http.Handler {
+    mux := http.NewServeMux()
+    for _, c := range s.httpCommands() {
+        c := c
+        mux.HandleFunc(c.Method+" "+c.Path, func(w http.ResponseWriter, r *http.Request) { s.serveCommand(w, r, c) })
+    }
+    mux.HandleFunc("GET /openapi.json", func(w http.ResponseWriter, r *http.Request) {
+        writeJSON(w, http.StatusOK, s.OpenAPI())
+    })
+    return s.authHTTP(mux)
+}
+
+// httpCommands returns the registered commands with a REST binding plus the
+// built-in verbose and stop resources.
+func (s *Server) httpCommands() []Command {
+    var out []Command
+    for _, c := range s.Commands() {
+        if c.Path != "" { out = append(out, c) }
+    }
+    out = append(out, Command{Name: "verbose", Help: "get the trace level", Method: "GET", Path: "/verbose", Func: func([]string) ([]map[string]any, error) {
+        return []map[string]any{{"traceLevel": s.verbose()}}, nil
+    }})
+    out = append(out, Command{Name: "verbose.set", Help: "set the trace level", Write: true, Params: []string{"level"}, Method: "PUT", Path: "/verbose", Func: func(p []string) ([]map[string]any, error) {
+        v, err := strconv.Atoi(p[0])
+        if err != nil { return nil, BadRequest("level must be an integer") }
+        s.SetVerbose(v)
+        return []map[string]any{{"traceLevel": s.verbose()}}, nil
+    }})
+    out = append(out, Command{Name: "stop", Help: "stop the daemon", Write: true, Method: "POST", Path: "/stop", Func: func([]string) ([]map[string]any, error) {
+        s.mu.Lock()
+        keepAlive := s.httpStop
+        s.mu.Unlock()
+        if keepAlive == nil { return nil, errors.New("stop is not available") }
+        if s.KeepRunning != nil { *s.KeepRunning = false }
+        // the response still goes out: Shutdown waits for running handlers
+        s.stopOnce.Do(func() { close(keepAlive) })
+        logx.Printf(1, "mgmt stop")
+        return []map[string]any{{"keep_running": s.safeBool(s.KeepRunning)}}, nil
+    }})
+    return out
+}
+
+type roleKey struct{}
+
+// hostAllowed reports whether the Host header of a request names the local
+// address it arrived on: its IP, or localhost on loopback. A site that
+// resolves its own name to this address (DNS rebinding) is refused. Unix
+// sockets cannot be reached by browsers and are not checked.
+func hostAllowed(host string, local net.Addr) bool {
+    ta, ok := local.(*net.TCPAddr)
+    if !ok { return true }
+    if h, _, err := net.SplitHostPort(host); err == nil { host = h }
+    host = strings.Trim(host, "[]")
+    if strings.EqualFold(host, "localhost") { return ta.IP.IsLoopback() }
+    ip := net.ParseIP(host)
+    return ip != nil && ip.Equal(ta.IP)
+}
+
+// writeAllowed reports whether a write request carries what a form or a
+// plain cross-site fetch cannot send without a CORS preflight, which this
+// API never grants: a JSON content type or an X-N2N-Request header.
+func writeAllowed(r *http.Request) bool {
+    if r.Header.Get("X-N2N-Request") != "" { return true }
+    mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+    return err == nil && mt == "application/json"
+}
+
+func (s *Server) authHTTP(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        local, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+        if !hostAllowed(r.Host, local) {
+            writeJSON(w, http.StatusForbidden, map[string]any{"error": "badhost"})
+            return
+        }
+        // the password may have been removed by a reload after ListenHTTP
+        if ta, ok := local.(*net.TCPAddr); ok && !ta.IP.IsLoopback() {
+            if rw, ro := s.passwords(); rw == "" && ro == "" {
+                writeJSON(w, http.StatusForbidden, map[string]any{"error": "no password set for a non-loopback address"})
+                return
+            }
+        }
+        pass := ""
+        if tok, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+            pass = tok
+        } else if _, p, ok := r.BasicAuth(); ok {
+            pass = p
+        }
+        role := s.role(pass)
+        if role == RoleNone {
+            if r.Method != http.MethodGet { s.audit("http", r.RemoteAddr, role, r.Method+" "+r.URL.Path, nil, "unauth") }
+            w.Header().Set("WWW-Authenticate", `Bearer realm="n2n"`)
+            writeJSON(w, http.StatusUnauthorized, map[string]any{"error": "unauth"})
+            return
+        }
+        next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), roleKey{}, role)))
+    })
+}
+
+func (s *Server) serveCommand(w http.ResponseWriter, r *http.Request, c Command) {
+    role, _ := r.Context().Value(roleKey{}).(int)
+    if c.Write && role != RoleWrite {
+        s.audit("http", r.RemoteAddr, role, c.Name, nil, "forbidden")
+        writeJSON(w, http.StatusForbidden, map[string]any{"error": "forbidden"})
+        return
+    }
+    if c.Write && !writeAllowed(r) {
+        s.audit("http", r.RemoteAddr, role, c.Name, nil, "nocsrf")
+        writeJSON(w, http.StatusUnsupportedMediaType, map[string]any{"error": "write requests need Content-Type: application/json or an X-N2N-Request header"})
+        return
+    }
+    body := map[string]any{}
+    if r.ContentLength != 0 && r.Method != http.MethodGet {
+        if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&body); err != nil {
+            writeJSON(w, http.StatusBadRequest, map[string]any{"error": "invalid JSON body"})
+            return
+        }
+    }
+    params := make([]string, len(c.Params))
+    for i, name := range c.Params {
+        if v := r.PathValue(name); v != "" {
+            params[i] = v
+        } else if v, ok := body[name]; ok {
+            params[i] = fmt.Sprint(v)
+        } else if r.URL.Query().Has(name) {
+            params[i] = r.URL.Query().Get(name)
+        } else {
+            writeJSON(w, http.StatusBadRequest, map[string]any{"error": "missing parameter " + name})
+            return
+        }
+    }
+    rows, err := c.Func(params)
+    if c.Write {
+        msg := ""
+        if err != nil { msg = err.Error() }
+        s.audit("http", r.RemoteAddr, role, c.Name, params, msg)
+    }
+    if err != nil {
+        code := http.StatusInternalServerError
+        if errors.Is(err, ErrBadRequest) { code = http.StatusBadRequest }
+        writeJSON(w, code, map[string]any{"error": err.Error()})
+        return
+    }
+    if rows == nil { rows = []map[string]any{} }
+    writeJSON(w, http.StatusOK, rows)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(code)
+    json.NewEncoder(w).Encode(v)
+}
+
+// OpenAPI describes the REST resources generated from the registry.
+func (s *Server) OpenAPI() map[string]any {
+    paths := map[string]any{}
+    for _, c := range s.httpCommands() {
+        item, _ := paths[c.Path].(map[string]any)
+        if item == nil {
+            item = map[string]any{}
+            paths[c.Path] = item
+        }
+        op := map[string]any{
+            "operationId": c.Name,
+            "summary":     c.Help,
+            "responses": map[string]any{
+                "200": map[string]any{"description": "result rows", "content": map[string]any{"application/json": map[string]any{"schema": map[string]any{"type": "array", "items": map[string]any{"type": "object"}}}}},
+                "400": map[string]any{"description": "invalid parameters"},
+                "401": map[string]any{"description": "authentication required"},
+                "403": map[string]any{"description": "read-only credential"},
+            },
+        }
+        var pathParams []any
+        bodyProps := map[string]any{}
+        var required []string
+        for _, p := range c.Params {
+            if strings.Contains(c.Path, "{"+p+"}") {
+                pathParams = append(pathParams, map[string]any{"name": p, "in": "path", "required": true, "schema": map[string]any{"type": "string"}})
+                continue
+            }
+            bodyProps[p] = map[string]any{"type": "string"}
+            required = append(required, p)
+        }
+        if len(pathParams) > 0 { op["parameters"] = pathParams }
+        if len(bodyProps) > 0 {
+            op["requestBody"] = map[string]any{"required": true, "content": map[string]any{"application/json": map[string]any{"schema": map[string]any{"type": "object", "properties": bodyProps, "required": required}}}}
+        }
+        item[strings.ToLower(c.Method)] = op
+    }
+    return map[string]any{
+        "openapi": "3.0.3",
+        "info":    map[string]any{"title": "n2n-go management", "version": "1"},
+        "components": map[string]any{"securitySchemes": map[string]any{"bearer": map[string]any{"type": "http", "scheme": "bearer"}}},
+        "security": []any{map[string]any{"bearer": []any{}}},
+        "paths":   paths,
+    }
+}
@@ -1,20 +1,110 @@
 package management
 
 import (
+    "context"
     "encoding/json"
     "fmt"
+    "io"
     "net"
+    "sort"
     "strings"
+    "strconv"
+    "sync"
+    "sync/atomic"
+    "time"
+    "net/http"
     "n2n-go/pkg/logx"
 )
 
 type Server struct {
+    // Password grants read-write access and ReadPassword read-only access;
+    // either may be a hash spec, see HashPassword. With neither set the
+    // server is open.
     Password string
+    ReadPassword string
+    // Audit receives one JSON line per write request; nil logs them.
+    Audit io.Writer
     KeepRunning *bool
-    TraceLevel *int
-    subscribers map[string]*net.UDPAddr
+    // TraceLevel is read by the logging of the daemon while requests
+    // change it.
+    TraceLevel *atomic.Int32
+    // Events carries published events to the subscribers; see Publish.
     Events chan MgmtEvent
+    // SubscriptionTTL is how long a subscription lasts unless it is renewed
+    // by repeating the subscribe request (default 60s).
+    SubscriptionTTL time.Duration
+    // ReplaySize bounds the events kept per topic for late subscribers
+    // (default 128).
+    ReplaySize int
+    topics   map[string]*topic
+    dropped  atomic.Uint64
+    authCache map[[32]byte]bool
+    dispatchOnce sync.Once
+    stopOnce sync.Once
+    // inflight is read-held by every request being served; Shutdown takes
+    // it to wait for them once closing is set.
+    inflight sync.RWMutex
+    closing  atomic.Bool
+    done     chan struct{}
+    conns    map[io.Closer]bool
+    servers  []*http.Server
+    // httpStop is the keepAlive channel POST /stop closes
+    httpStop chan struct{}
+    // HandleFunc is consulted for methods that are not registered.
     HandleFunc func(method string, params []string) []map[string]any
+    mu       sync.Mutex
+    commands map[string]*Command
+}
+
+// Command is a management method served over UDP and, when Path is set,
+// as a REST resource by ServeHTTP.
+type Command struct {
+    Name   string
+    Help   string
+    // Write commands need the "w" request type (PUT/POST/DELETE over HTTP).
+    Write  bool
+    // Params names the positional parameters; over HTTP they are taken from
+    // path wildcards, then the JSON body, then the query string.
+    Params []string
+    Method string
+    Path   string
+    Func   func(params []string) ([]map[string]any, error)
+}
+
+// Register adds or replaces a command.
+func (s *Server) Register(c Command) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.commands == nil { s.commands = map[string]*Command{} }
+    s.commands[c.Name] = &c
+}
+
+// Commands returns the registered commands sorted by name.
+func (s *Server) Commands() []Command {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    out := make([]Command, 0, len(s.commands))
+    for _, c := range s.commands { out = append(out, *c) }
+    sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+    return out
+}
+
+func (s *Server) command(name string) *Command {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.commands[name]
+}
+
+// SetVerbose changes the trace level of the daemon.
+func (s *Server) SetVerbose(v int) {
+    if s.TraceLevel != nil { s.TraceLevel.Store(int32(v)) }
+    logx.Printf(1, "mgmt verbose %d", v)
+    logx.SetLevel(v)
+}
+
+func (s *Server) verbose() int {
+    if s.TraceLevel == nil { return 0 }
+    return int(s.TraceLevel.Load())
 }
 
 type replyRow map[string]any
@@ -39,122 +129,218 @@ func genJSONErr(tag, msg string) []byte {
     return append(b, '\n')
 }
 
-func (s *Server) Handle(conn *net.UDPConn, keepAlive chan struct{}) {
+// Handle serves management requests received on conn, a UDP or unix
+// datagram socket, until conn is closed or a stop request closes keepAlive.
+func (s *Server) Handle(conn net.PacketConn, keepAlive chan struct{}) {
     buf := make([]byte, 2048)
-    if s.subscribers == nil { s.subscribers = make(map[string]*net.UDPAddr) }
-    if s.Events != nil {
-        go func() {
-            for ev := range s.Events {
-                if addr, ok := s.subscribers[ev.Topic]; ok {
-                    m := map[string]any{"_type": "event"}
-                    for k, v := range ev.Row { m[k] = v }
-                    b, _ := json.Marshal(m)
-                    conn.WriteToUDP(append(b, '\n'), addr)
-                    logx.Printf(2, "mgmt event topic=%s", ev.Topic)
-                }
-            }
-        }()
-    }
+    s.startDispatch()
+    defer s.track(conn)()
     for {
-        n, addr, err := conn.ReadFromUDP(buf)
+        n, addr, err := conn.ReadFrom(buf)
         if err != nil {
             return
         }
-        line := strings.TrimSpace(string(buf[:n]))
-        logx.Printf(2, "mgmt recv %s", line)
-        parts := strings.Fields(line)
-        if len(parts) < 3 { conn.WriteToUDP(genJSONErr("mgmt", "badreq"), addr); continue }
-        mtype := parts[0]
-        opts := parts[1]
-        method := parts[2]
-        params := parts[3:]
-        tag := "mgmt"
-        // options: tag[:flags[:auth]]
-        optFields := strings.Split(opts, ":")
-        if len(optFields) >= 1 && optFields[0] != "" { tag = optFields[0] }
-        var flags string
-        var auth string
-        if len(optFields) >= 2 { flags = optFields[1] }
-        if len(optFields) >= 3 { auth = optFields[2] }
-        if s.Password != "" {
-            if flags == "1" && auth != "" {
-                if pearson64([]byte(auth)) != pearson64([]byte(s.Password)) { conn.WriteToUDP(genJSONErr(tag, "badauth"), addr); continue }
-            } else if strings.HasPrefix(line, "auth ") {
-                // backward compatibility: auth <user> <pass> <rest>
-                if len(parts) < 5 { conn.WriteToUDP(genJSONErr(tag, "badauth"), addr); continue }
-                if pearson64([]byte(parts[2])) != pearson64([]byte(s.Password)) { conn.WriteToUDP(genJSONErr(tag, "badauth"), addr); continue }
-                // re-parse after auth prefix
-                mtype = parts[3]
-                if len(parts) < 6 { conn.WriteToUDP(genJSONErr(tag, "badreq"), addr); continue }
-                opts = parts[4]
-                method = parts[5]
-                params = parts[6:]
-                optFields = strings.Split(opts, ":")
-                if len(optFields) >= 1 && optFields[0] != "" { tag = optFields[0] }
-            } else {
-                conn.WriteToUDP(genJSONErr(tag, "unauth"), addr); continue
-            }
+        // an unbound unix datagram peer cannot be answered
+        if addr == nil || addr.String() == "" { continue }
+        if s.handle(string(buf[:n]), addr.Network(), addr.String(), func(b []byte) { conn.WriteTo(b, addr) }, keepAlive) { return }
+    }
+}
+
+// handle serves one request line. from identifies the client, send writes
+// a reply to it. It reports whether the server was stopped.
+func (s *Server) handle(line, proto, from string, send func([]byte), keepAlive chan struct{}) bool {
+    line = strings.TrimSpace(line)
+    logx.Printf(2, "mgmt recv %s", line)
+    parts := strings.Fields(line)
+    if len(parts) < 3 { send(genJSONErr("mgmt", "badreq")); return false }
+    mtype := parts[0]
+    opts := parts[1]
+    method := parts[2]
+    params := parts[3:]
+    tag := "mgmt"
+    // options: tag[:flags[:auth]]
+    optFields := strings.Split(opts, ":")
+    if len(optFields) >= 1 && optFields[0] != "" { tag = optFields[0] }
+    var flags string
+    var auth string
+    if len(optFields) >= 2 { flags = optFields[1] }
+    if len(optFields) >= 3 { auth = optFields[2] }
+    s.inflight.RLock()
+    defer s.inflight.RUnlock()
+    if s.closing.Load() { send(genJSONErr(tag, "shutdown")); return true }
+    role := RoleWrite
+    if rw, ro := s.passwords(); rw != "" || ro != "" {
+        if flags == "1" && auth != "" {
+            // C n2n clients send the password itself in the auth field
+            role = s.role(auth)
+        } else if strings.HasPrefix(line, "auth ") {
+            // backward compatibility: auth <user> <pass> <rest>
+            if len(parts) < 6 { send(genJSONErr(tag, "badreq")); return false }
+            role = s.role(parts[2])
+            // re-parse after auth prefix
+            mtype = parts[3]
+            opts = parts[4]
+            method = parts[5]
+            params = parts[6:]
+            optFields = strings.Split(opts, ":")
+            if len(optFields) >= 1 && optFields[0] != "" { tag = optFields[0] }
+        } else {
+            if mtype == "w" { s.audit(proto, from, RoleNone, method, params, "unauth") }
+            send(genJSONErr(tag, "unauth")); return false
+        }
+        if role == RoleNone {
+            if mtype == "w" { s.audit(proto, from, RoleNone, method, params, "badauth") }
+            send(genJSONErr(tag, "badauth")); return false
+        }
+    }
+    if mtype == "w" && role != RoleWrite {
+        s.audit(proto, from, role, method, params, "forbidden")
+        send(genJSONErr(tag, "forbidden")); return false
+    }
+    errMsg := ""
+    fail := func(msg string) {
+        errMsg = msg
+        send(genJSONErr(tag, msg))
+    }
+    var replay [][]byte
+    // begin
+    send(genJSONRow(tag, replyRow{"_type": "begin", "cmd": method}))
+    switch method {
+    case "help":
+        send(genJSONRow(tag, replyRow{"cmd": "help", "help": "show commands"}))
+        send(genJSONRow(tag, replyRow{"cmd": "stop", "help": "stop the daemon (w)", "write": true}))
+        send(genJSONRow(tag, replyRow{"cmd": "verbose", "help": "get or set the trace level: verbose [<n>]"}))
+        send(genJSONRow(tag, replyRow{"cmd": "subscribe", "help": "receive events of a topic, replaying those after <seq> (s): subscribe <topic> [<seq>]"}))
+        send(genJSONRow(tag, replyRow{"cmd": "unsubscribe", "help": "stop receiving events of the given topics or of all topics (s)"}))
+        send(genJSONRow(tag, replyRow{"cmd": "subscriptions", "help": "list event subscribers"}))
+        for _, c := range s.Commands() {
+            send(genJSONRow(tag, replyRow{"cmd": c.Name, "help": c.Help, "write": c.Write}))
+        }
+    case "stop":
+        if mtype == "w" {
+            if s.KeepRunning != nil { *s.KeepRunning = false }
+            send(genJSONRow(tag, replyRow{"keep_running": s.safeBool(s.KeepRunning)}))
+            s.audit(proto, from, role, method, params, "")
+            send(genJSONRow(tag, replyRow{"_type": "end"}))
+            s.stopOnce.Do(func() { close(keepAlive) })
+            logx.Printf(1, "mgmt stop")
+            return true
+        } else {
+            fail("badtype")
+        }
+    case "verbose":
+        if len(params) >= 1 {
+            if mtype != "w" { fail("badtype"); break }
+            var v int
+            fmt.Sscanf(params[0], "%d", &v)
+            s.SetVerbose(v)
         }
-        // begin
-        conn.WriteToUDP(genJSONRow(tag, replyRow{"_type": "begin", "cmd": method}), addr)
-        switch method {
-        case "help":
-            conn.WriteToUDP(genJSONRow(tag, replyRow{"cmd": "help", "help": "stop|verbose <n>|subscribe <topic>"}), addr)
-        case "stop":
-            if mtype == "w" {
-                if s.KeepRunning != nil { *s.KeepRunning = false }
-                conn.WriteToUDP(genJSONRow(tag, replyRow{"keep_running": s.safeBool(s.KeepRunning)}), addr)
-                conn.WriteToUDP(genJSONRow(tag, replyRow{"_type": "end"}), addr)
-                close(keepAlive)
-                logx.Printf(1, "mgmt stop")
-                return
-            } else {
-                conn.WriteToUDP(genJSONErr(tag, "badtype"), addr)
-            }
-        case "verbose":
-            if len(params) >= 1 {
-                var v int
-                fmt.Sscanf(params[0], "%d", &v)
-                if s.TraceLevel != nil { *s.TraceLevel = v }
-            }
-            logx.Printf(1, "mgmt verbose %d", s.safeInt(s.TraceLevel))
-            logx.SetLevel(s.safeInt(s.TraceLevel))
-            conn.WriteToUDP(genJSONRow(tag, replyRow{"traceLevel": s.safeInt(s.TraceLevel)}), addr)
-        case "subscribe":
-            if mtype != "s" { conn.WriteToUDP(genJSONErr(tag, "badtype"), addr); break }
-            topic := "debug"
-            if len(params) >= 1 { topic = params[0] }
-            s.subscribers[topic] = addr
-            conn.WriteToUDP(genJSONRow(tag, replyRow{"_type": "subscribed", "topic": topic}), addr)
-            logx.Printf(1, "mgmt subscribe %s", topic)
-        default:
-            if s.HandleFunc != nil {
-                rows := s.HandleFunc(method, params)
-                for _, r := range rows { conn.WriteToUDP(genJSONRow(tag, replyRow(r)), addr) }
-                logx.Printf(2, "mgmt call %s", method)
-            } else {
-                conn.WriteToUDP(genJSONErr(tag, "unimplemented"), addr)
-            }
+        send(genJSONRow(tag, replyRow{"traceLevel": s.verbose()}))
+    case "subscribe":
+        if mtype != "s" { fail("badtype"); break }
+        topic := "debug"
+        if len(params) >= 1 { topic = params[0] }
+        since := int64(-1)
+        if len(params) >= 2 {
+            n, err := strconv.ParseUint(params[1], 10, 63)
+            if err != nil { fail("badreq"); break }
+            since = int64(n)
+        }
+        seq, ttl := s.subscribe(topic, tag, from, send)
+        send(genJSONRow(tag, replyRow{"_type": "subscribed", "topic": topic, "seq": seq, "ttl": int(ttl.Seconds())}))
+        if since >= 0 { replay = s.replay(topic, tag, uint64(since)) }
+        logx.Printf(2, "mgmt subscribe %s %s", topic, from)
+    case "unsubscribe":
+        if mtype != "s" { fail("badtype"); break }
+        n := s.unsubscribe(params, from)
+        send(genJSONRow(tag, replyRow{"unsubscribed": n}))
+        logx.Printf(2, "mgmt unsubscribe %v %s", params, from)
+    case "subscriptions":
+        for _, r := range s.subscriptions() { send(genJSONRow(tag, r)) }
+    default:
+        if c := s.command(method); c != nil {
+            if c.Write && mtype != "w" { fail("badtype"); break }
+            rows, err := c.Func(params)
+            if err != nil { fail(err.Error()); break }
+            for _, r := range rows { send(genJSONRow(tag, replyRow(r))) }
+            logx.Printf(2, "mgmt call %s", method)
+        } else if s.HandleFunc != nil {
+            rows := s.HandleFunc(method, params)
+            for _, r := range rows { send(genJSONRow(tag, replyRow(r))) }
+            logx.Printf(2, "mgmt call %s", method)
+        } else {
+            fail("unimplemented")
         }
-        // end
-        conn.WriteToUDP(genJSONRow(tag, replyRow{"_type": "end"}), addr)
     }
+    if mtype == "w" { s.audit(proto, from, role, method, params, errMsg) }
+    // end
+    send(genJSONRow(tag, replyRow{"_type": "end"}))
+    for _, b := range replay { send(b) }
+    return false
 }
 
-func (s *Server) safeBool(p *bool) bool {
-    if p == nil {
-        return false
+// track registers c to be closed by Shutdown; the returned func forgets it.
+func (s *Server) track(c io.Closer) func() {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.conns == nil { s.conns = map[io.Closer]bool{} }
+    s.conns[c] = true
+    return func() {
+        s.mu.Lock()
+        delete(s.conns, c)
+        s.mu.Unlock()
     }
-    return *p
 }
 
-func (s *Server) safeInt(p *int) int {
+// doneCh is closed by Shutdown.
+func (s *Server) doneCh() chan struct{} {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.done == nil { s.done = make(chan struct{}) }
+    return s.done
+}
+
+// Shutdown stops serving management requests: new requests are refused
+// with "shutdown", requests in progress get up to timeout to finish, then
+// every listener and connection is closed and the event dispatcher stops.
+// Events published afterwards are dropped.
+func (s *Server) Shutdown(timeout time.Duration) {
+    if s.closing.Swap(true) { return }
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+    s.mu.Lock()
+    servers := s.servers
+    s.mu.Unlock()
+    for _, hs := range servers { hs.Shutdown(ctx) }
+    drained := make(chan struct{})
+    go func() {
+        s.inflight.Lock()
+        s.inflight.Unlock()
+        close(drained)
+    }()
+    select {
+    case <-drained:
+    case <-ctx.Done():
+        logx.Printf(0, "mgmt shutdown: requests still in progress")
+    }
+    s.mu.Lock()
+    for c := range s.conns { c.Close() }
+    s.conns = nil
+    s.mu.Unlock()
+    close(s.doneCh())
+    logx.Printf(1, "mgmt shutdown")
+}
+
+func (s *Server) safeBool(p *bool) bool {
     if p == nil {
-        return 0
+        return false
     }
     return *p
 }
+
 type MgmtEvent struct {
     Topic string
     Row map[string]any
+    // Time is when the event happened; it is sent as _ts.
+    Time time.Time
 }
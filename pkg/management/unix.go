@@ -0,0 +1,157 @@
+package management
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "net"
+    "os"
+    "os/user"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// unixSpec splits a socket spec "unixgram:<path>", "unix:<path>" or a bare
+// path (datagram) into network and path.
+func unixSpec(spec string) (network, path string) {
+    if p, ok := strings.CutPrefix(spec, "unixgram:"); ok { return "unixgram", p }
+    if p, ok := strings.CutPrefix(spec, "unix:"); ok { return "unix", p }
+    return "unixgram", spec
+}
+
+// lookupOwner resolves "user[:group]" (names or numeric ids) to uid and gid;
+// -1 leaves the id unchanged.
+func lookupOwner(owner string) (uid, gid int, err error) {
+    uid, gid = -1, -1
+    if owner == "" { return uid, gid, nil }
+    un, gn, _ := strings.Cut(owner, ":")
+    if un != "" {
+        if uid, err = strconv.Atoi(un); err != nil {
+            u, err := user.Lookup(un)
+            if err != nil { return -1, -1, err }
+            if uid, err = strconv.Atoi(u.Uid); err != nil { return -1, -1, err }
+        }
+    }
+    if gn != "" {
+        if gid, err = strconv.Atoi(gn); err != nil {
+            g, err := user.LookupGroup(gn)
+            if err != nil { return -1, -1, err }
+            if gid, err = strconv.Atoi(g.Gid); err != nil { return -1, -1, err }
+        }
+    }
+    return uid, gid, nil
+}
+
+type unixSocket struct {
+    io.Closer
+    path string
+}
+
+func (u unixSocket) Close() error {
+    err := u.Closer.Close()
+    os.Remove(u.path)
+    return err
+}
+
+// unixListener is a stream listener moved into place by listenUnix.
+type unixListener struct {
+    net.Listener
+    path string
+}
+
+func (u unixListener) Addr() net.Addr { return &net.UnixAddr{Name: u.path, Net: "unix"} }
+
+func (u unixListener) Close() error {
+    err := u.Listener.Close()
+    os.Remove(u.path)
+    return err
+}
+
+// listenUnix creates the socket in a new 0700 directory next to path, sets
+// mode and the owner (-1 keeps an id) there and then renames it to path, so
+// the socket is never reachable with the permissions of the umask. The
+// result is a net.PacketConn for unixgram and a net.Listener for unix.
+func listenUnix(network, path string, mode os.FileMode, uid, gid int) (io.Closer, error) {
+    dir, err := os.MkdirTemp(filepath.Dir(path), ".mgmt-")
+    if err != nil { return nil, err }
+    defer os.RemoveAll(dir)
+    tmp := filepath.Join(dir, "sock")
+    var c io.Closer
+    if network == "unixgram" {
+        pc, err := net.ListenPacket(network, tmp)
+        if err != nil { return nil, err }
+        c = pc
+    } else {
+        l, err := net.Listen(network, tmp)
+        if err != nil { return nil, err }
+        // the socket is removed under its final path by the caller
+        l.(*net.UnixListener).SetUnlinkOnClose(false)
+        c = l
+    }
+    err = os.Chmod(tmp, mode)
+    if err == nil && (uid != -1 || gid != -1) { err = os.Chown(tmp, uid, gid) }
+    // the rename replaces a stale socket but must not take anything else
+    if fi, lerr := os.Lstat(path); err == nil && lerr == nil && fi.Mode()&os.ModeSocket == 0 { err = fmt.Errorf("%s exists and is not a socket", path) }
+    if err == nil { err = os.Rename(tmp, path) }
+    if err != nil {
+        c.Close()
+        return nil, err
+    }
+    return c, nil
+}
+
+// ServeUnix serves the management protocol on a unix socket described by
+// spec (see unixSpec) until the returned closer is called. The socket file
+// is created with mode and, when owner is set, chowned to "user[:group]",
+// so access can be limited by file permissions instead of a password.
+// Datagram clients must bind their own socket to receive replies; stream
+// clients send one request per line.
+func (s *Server) ServeUnix(spec string, mode os.FileMode, owner string, keepAlive chan struct{}) (io.Closer, error) {
+    network, path := unixSpec(spec)
+    if path == "" { return nil, fmt.Errorf("empty management socket path") }
+    uid, gid, err := lookupOwner(owner)
+    if err != nil { return nil, err }
+    c, err := listenUnix(network, path, mode, uid, gid)
+    if err != nil { return nil, err }
+    if pc, ok := c.(net.PacketConn); ok {
+        go s.Handle(pc, keepAlive)
+    } else {
+        // Shutdown closes the listener, which then removes the socket
+        go s.serveStream(unixListener{Listener: c.(net.Listener), path: path}, keepAlive)
+    }
+    return unixSocket{Closer: c, path: path}, nil
+}
+
+func (s *Server) serveStream(l net.Listener, keepAlive chan struct{}) {
+    s.startDispatch()
+    defer s.track(l)()
+    for {
+        c, err := l.Accept()
+        if err != nil { return }
+        go s.handleStream(c, keepAlive)
+    }
+}
+
+// handleStream serves the requests of one stream client. Replies and events
+// share the connection, so writes are serialized and bounded by a deadline
+// to keep a stalled client from blocking the event dispatcher.
+func (s *Server) handleStream(c net.Conn, keepAlive chan struct{}) {
+    defer c.Close()
+    defer s.track(c)()
+    from := fmt.Sprintf("unix:%p", c)
+    var mu sync.Mutex
+    send := func(b []byte) {
+        mu.Lock()
+        defer mu.Unlock()
+        c.SetWriteDeadline(time.Now().Add(time.Second))
+        c.Write(b)
+    }
+    defer s.unsubscribe(nil, from)
+    sc := bufio.NewScanner(c)
+    for sc.Scan() {
+        if s.handle(sc.Text(), "unix", from, send, keepAlive) { return }
+    }
+}
@@ -10,37 +10,76 @@ import (
 
 type Status struct {
     Enabled bool
+    // Method is how the mapping was made: "natpmp" or "igd".
+    Method string
     LastOK time.Time
     LastErr string
 }
 
 type Client struct {
+    // Gateways are the NAT-PMP gateways tried, as host or host:port; nil
+    // tries the usual home router addresses.
+    Gateways []string
     st Status
+    // gw is the NAT-PMP gateway holding the mapping.
+    gw string
 }
 
 func New() *Client { return &Client{st: Status{}} }
 
 func (c *Client) TryMap(port int) bool {
-    gateways := []string{"192.168.0.1", "192.168.1.1", "10.0.0.1"}
+    gateways := c.Gateways
+    if gateways == nil { gateways = []string{"192.168.0.1", "192.168.1.1", "10.0.0.1"} }
     for _, gw := range gateways {
-        if natpmpMap(gw, port) || igdMap(port) {
-            c.st.Enabled = true
-            c.st.LastOK = time.Now()
-            c.st.LastErr = ""
-            logx.Printf(1, "portmap enabled via %s", gw)
+        if natpmpMap(gw, port, 3600) {
+            c.mapped("natpmp", gw)
             return true
         }
     }
+    if igdMap(port) {
+        c.mapped("igd", "")
+        return true
+    }
     c.st.Enabled = false
+    c.st.Method = ""
     c.st.LastErr = "no-gateway"
     logx.Printf(1, "portmap failed: %s", c.st.LastErr)
     return false
 }
 
+func (c *Client) mapped(method, gw string) {
+    c.gw = gw
+    c.st.Enabled = true
+    c.st.Method = method
+    c.st.LastOK = time.Now()
+    c.st.LastErr = ""
+    logx.Printf(1, "portmap enabled via %s %s", method, gw)
+}
+
 func (c *Client) Status() Status { return c.st }
 
-func natpmpMap(gateway string, port int) bool {
-    addr := &net.UDPAddr{IP: net.ParseIP(gateway), Port: 5351}
+// Unmap removes the mapping created by TryMap with the method that made
+// it, so the port is not left open on the gateway after the edge exits.
+func (c *Client) Unmap(port int) bool {
+    if !c.st.Enabled { return false }
+    var ok bool
+    switch c.st.Method {
+    case "natpmp":
+        ok = natpmpMap(c.gw, port, 0)
+    case "igd":
+        ok = igdUnmap(port)
+    }
+    logx.Printf(1, "portmap removed via %s %s ok=%v", c.st.Method, c.gw, ok)
+    c.st.Enabled = false
+    c.st.Method = ""
+    return ok
+}
+
+// natpmpMap requests a UDP mapping for lifetime seconds; 0 deletes it.
+func natpmpMap(gateway string, port int, lifetime uint32) bool {
+    if _, _, err := net.SplitHostPort(gateway); err != nil { gateway = net.JoinHostPort(gateway, "5351") }
+    addr, err := net.ResolveUDPAddr("udp", gateway)
+    if err != nil { return false }
     conn, err := net.DialUDP("udp", nil, addr)
     if err != nil { return false }
     defer conn.Close()
@@ -49,8 +88,8 @@ func natpmpMap(gateway string, port int) bool {
     req[1] = 2
     binary.BigEndian.PutUint16(req[2:], 0)
     binary.BigEndian.PutUint16(req[4:], uint16(port))
-    binary.BigEndian.PutUint16(req[6:], uint16(port))
-    binary.BigEndian.PutUint32(req[8:], uint32(3600))
+    if lifetime != 0 { binary.BigEndian.PutUint16(req[6:], uint16(port)) }
+    binary.BigEndian.PutUint32(req[8:], lifetime)
     conn.SetDeadline(time.Now().Add(500 * time.Millisecond))
     if _, err = conn.Write(req); err != nil { return false }
     resp := make([]byte, 16)
@@ -63,6 +102,13 @@ func natpmpMap(gateway string, port int) bool {
     return true
 }
 
+// igdUnmap removes a mapping made by igdMap.
+func igdUnmap(port int) bool {
+    // the SOAP DeletePortMapping request is omitted like AddPortMapping
+    logx.Printf(2, "igd unmap port=%d not supported", port)
+    return false
+}
+
 func igdMap(port int) bool {
     conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4zero, Port: 0})
     if err != nil { return false }
@@ -0,0 +1,108 @@
+package sn
+
+import (
+    "fmt"
+    "net"
+    "strconv"
+    "time"
+    "n2n-go/pkg/management"
+)
+
+// registerCommands installs the supernode management commands. Every
+// command runs with s.mu held.
+func (s *state) registerCommands(mgmt *management.Server) {
+    locked := func(f func(p []string) ([]map[string]any, error)) func(p []string) ([]map[string]any, error) {
+        return func(p []string) ([]map[string]any, error) {
+            s.mu.Lock()
+            defer s.mu.Unlock()
+            return f(p)
+        }
+    }
+    mgmt.Register(management.Command{Name: "pool.list", Help: "list address pools", Method: "GET", Path: "/pools", Func: locked(func(p []string) ([]map[string]any, error) {
+        var rows []map[string]any
+        for k, p := range s.pools {
+            rows = append(rows, map[string]any{"community": k, "netaddr": p.NetAddr, "bitlen": p.Bitlen, "lifetime": int(p.lifetime.Seconds())})
+        }
+        return rows, nil
+    })})
+    mgmt.Register(management.Command{Name: "pool.set", Help: "set the address pool of a community", Write: true, Params: []string{"community", "netaddr", "bitlen", "lifetime"}, Method: "PUT", Path: "/pools/{community}", Func: locked(func(p []string) ([]map[string]any, error) {
+        if len(p) < 4 { return nil, management.BadRequest("pool.set <community> <netaddr> <bitlen> <lifetime>") }
+        ip := parseIPv4(p[1])
+        if ip == 0 { return nil, management.BadRequest("bad netaddr") }
+        bl, err := strconv.Atoi(p[2])
+        if err != nil || bl < 1 || bl > 30 { return nil, management.BadRequest("bad bitlen") }
+        lt, err := strconv.Atoi(p[3])
+        if err != nil || lt <= 0 { return nil, management.BadRequest("bad lifetime") }
+        s.pools[p[0]] = &addrPool{NetAddr: ip, Bitlen: uint8(bl), next: 10, lifetime: time.Duration(lt) * time.Second}
+        return []map[string]any{{"ok": true}}, nil
+    })})
+    mgmt.Register(management.Command{Name: "lease.list", Help: "list address leases", Method: "GET", Path: "/leases", Func: locked(func(p []string) ([]map[string]any, error) {
+        var rows []map[string]any
+        for mac, ai := range s.alloc {
+            rows = append(rows, map[string]any{"mac": mac, "ip": ai.ip, "expires": ai.expires.Unix(), "community": ai.community})
+        }
+        return rows, nil
+    })})
+    mgmt.Register(management.Command{Name: "lease.reserve", Help: "reserve an address for a MAC", Write: true, Params: []string{"mac", "community", "ip"}, Method: "PUT", Path: "/leases/{mac}", Func: locked(func(p []string) ([]map[string]any, error) {
+        if len(p) < 3 { return nil, management.BadRequest("lease.reserve <mac> <community> <ip>") }
+        if _, err := net.ParseMAC(p[0]); err != nil { return nil, management.BadRequest("bad mac") }
+        ip := parseIPv4(p[2])
+        if ip == 0 { return nil, management.BadRequest("bad ip") }
+        s.alloc[parseMAC(p[0])] = allocInfo{ip: ip, expires: time.Now().Add(60 * time.Second), community: p[1]}
+        return []map[string]any{{"ok": true}}, nil
+    })})
+    mgmt.Register(management.Command{Name: "lease.release", Help: "release the lease of a MAC", Write: true, Params: []string{"mac"}, Method: "DELETE", Path: "/leases/{mac}", Func: locked(func(p []string) ([]map[string]any, error) {
+        if len(p) < 1 { return nil, management.BadRequest("lease.release <mac>") }
+        if _, err := net.ParseMAC(p[0]); err != nil { return nil, management.BadRequest("bad mac") }
+        delete(s.alloc, parseMAC(p[0]))
+        return []map[string]any{{"ok": true}}, nil
+    })})
+
+    // C n2n compatible commands, field names follow n2n 3.x sn_management.c
+    edges := locked(func(p []string) ([]map[string]any, error) {
+        var rows []map[string]any
+        for mac, p := range s.peers {
+            ai := s.alloc[mac]
+            rows = append(rows, map[string]any{"community": p.community, "ip4addr": ipString(ai.ip), "purgeable": 1, "macaddr": macString(mac), "sockaddr": p.addr.String(), "proto": proto(p), "desc": p.desc, "last_seen": p.lastSeen.Unix()})
+        }
+        return rows, nil
+    })
+    mgmt.Register(management.Command{Name: "edges", Help: "list registered edges", Method: "GET", Path: "/edges", Func: edges})
+    mgmt.Register(management.Command{Name: "peers", Help: "list registered edges (same as edges)", Method: "GET", Path: "/peers", Func: edges})
+    mgmt.Register(management.Command{Name: "communities", Help: "list communities", Method: "GET", Path: "/communities", Func: locked(func(p []string) ([]map[string]any, error) {
+        var rows []map[string]any
+        seen := map[string]bool{}
+        for comm := range s.communities { seen[comm] = true }
+        for comm := range s.pools { seen[comm] = true }
+        for _, p := range s.peers { seen[p.community] = true }
+        for comm := range seen {
+            row := map[string]any{"community": comm, "purgeable": 1, "is_federation": 0, "ip4addr": ""}
+            if s.communities != nil { row["purgeable"] = 0 }
+            if p := s.pools[comm]; p != nil { row["ip4addr"] = fmt.Sprintf("%s/%d", ipString(p.NetAddr), p.Bitlen) }
+            rows = append(rows, row)
+        }
+        return rows, nil
+    })})
+    mgmt.Register(management.Command{Name: "packetstats", Help: "traffic counters", Method: "GET", Path: "/packetstats", Func: locked(func(p []string) ([]map[string]any, error) {
+        st := s.stats
+        return []map[string]any{
+            {"type": "forward", "tx_pkt": st.forward},
+            {"type": "broadcast", "tx_pkt": st.broadcast},
+            {"type": "reg_super", "rx_pkt": st.regSuper, "nak": st.regSuperNak},
+            {"type": "errors", "tx_pkt": st.errors},
+        }, nil
+    })})
+    mgmt.Register(management.Command{Name: "timestamps", Help: "start and last activity times", Method: "GET", Path: "/timestamps", Func: locked(func(p []string) ([]map[string]any, error) {
+        return []map[string]any{{"start_time": s.stats.start.Unix(), "last_fwd": unixOrZero(s.stats.lastFwd), "last_reg_super": unixOrZero(s.stats.lastRegSuper)}}, nil
+    })})
+    mgmt.Register(management.Command{Name: "reload_communities", Help: "reload the community file", Write: true, Method: "POST", Path: "/communities/reload", Func: locked(func(p []string) ([]map[string]any, error) {
+        if s.communityFile == "" { return nil, management.BadRequest("no community file provided (-c command line option)") }
+        if err := s.loadCommunitiesLocked(s.communityFile); err != nil { return nil, err }
+        return []map[string]any{{"ok": true, "communities": len(s.communities)}}, nil
+    })})
+}
+
+func proto(p *peer) string {
+    if p.stream != nil { return p.stream.Proto() }
+    return "UDP"
+}
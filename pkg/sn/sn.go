@@ -1,10 +1,15 @@
 package sn
 
 import (
+    "bufio"
     "bytes"
+    "crypto/tls"
     "fmt"
     "net"
     "os"
+    "strings"
+    "sync"
+    "sync/atomic"
     "time"
     "n2n-go/pkg/management"
     "n2n-go/pkg/transport"
@@ -12,6 +17,63 @@ import (
     "n2n-go/pkg/logx"
 )
 
+// Options configures a supernode started with RunOptions.
+type Options struct {
+    Bind          string
+    Port          int
+    // MgmtPort is the UDP management port on 127.0.0.1; 0 disables it.
+    MgmtPort      int
+    // MgmtSocket serves management on a unix socket, "unixgram:<path>" or
+    // "unix:<path>", created with MgmtSocketMode and MgmtSocketOwner.
+    MgmtSocket      string
+    MgmtSocketMode  os.FileMode
+    MgmtSocketOwner string
+    // CommunityFile restricts registrations to the listed communities, one
+    // per line with an optional "net/bitlen" address pool (C n2n -c).
+    CommunityFile string
+    // DefaultPool is the "net/bitlen" pool of communities without one
+    // (default 10.0.0.0/24).
+    DefaultPool   string
+    // RejectConflicts refuses with a NAK the registration of a MAC held by
+    // an edge of another community or with another device name. By default
+    // the newer registration replaces the older one; the conflict event is
+    // published either way.
+    RejectConflicts bool
+    // HTTPAddr enables the REST management API on host:port or unix:<path>.
+    HTTPAddr      string
+    MgmtPassword  string
+    // MgmtReadPassword grants read-only management access.
+    MgmtReadPassword string
+    // MgmtAudit is the file write requests are logged to.
+    MgmtAudit     string
+    // StateFile keeps the pools, leases and registered edges across
+    // restarts: it is read on start and written on shutdown.
+    StateFile     string
+    // Successor is the host:port of the supernode edges are redirected to
+    // on shutdown; without it they are only told to register again.
+    Successor     string
+    // Workers is the number of sockets bound to Port with SO_REUSEPORT,
+    // each served by its own goroutine (default 1). The kernel spreads
+    // the edges across them, so relaying scales with the cores.
+    Workers       int
+    // TCP also accepts edges connecting over TCP on Port (C n2n -S2) and
+    // relays between them and the UDP edges.
+    TCP           bool
+    // WebSocket is the host:port edges can connect to over WebSocket, for
+    // networks that only let HTTP out; it serves wss:// with the PEM files
+    // WebSocketCert and WebSocketKey.
+    WebSocket     string
+    WebSocketCert string
+    WebSocketKey  string
+    Verbose       int
+    // Stop shuts the supernode down like the management stop request.
+    Stop          <-chan struct{}
+    // Reload applies the options that can change at runtime: the community
+    // file (re-read), DefaultPool, Successor, the management passwords and
+    // Verbose. Changes to the others are logged and need a restart.
+    Reload        <-chan Options
+}
+
 type addrPool struct {
     NetAddr uint32
     Bitlen  uint8
@@ -25,214 +87,696 @@ type allocInfo struct {
     community string
 }
 
+type peer struct {
+    addr      *net.UDPAddr
+    community string
+    desc      string
+    // kdf is the key derivation the edge registered with, "" if unknown
+    kdf       string
+    lastSeen  time.Time
+    // stream is the server of edges connected over TCP or WebSocket,
+    // nil for UDP ones
+    stream    *transport.TCPServer
+}
+
+type stats struct {
+    forward      uint64
+    broadcast    uint64
+    regSuper     uint64
+    regSuperNak  uint64
+    errors       uint64
+    start        time.Time
+    lastFwd      time.Time
+    lastRegSuper time.Time
+}
+
+// state is shared between the packet workers, the lease sweeper and the
+// management handlers; mu guards all of it.
 type state struct {
-    peers map[[6]byte]*net.UDPAddr
+    mu    sync.RWMutex
+    peers map[[6]byte]*peer
     alloc map[[6]byte]allocInfo
     pools map[string]*addrPool
+    // communities lists the allowed communities; nil accepts any.
+    communities map[string]bool
+    communityFile string
+    defaultPool addrPool
+    successor   *net.UDPAddr
+    rejectConflicts bool
+    // streams accept the edges connecting over TCP and WebSocket
+    streams     []*transport.TCPServer
+    stats       stats
 }
 
 func Run(bind string, lport int, mport int) error {
+    return RunOptions(Options{Bind: bind, Port: lport, MgmtPort: mport})
+}
+
+func RunOptions(o Options) error {
+    bind, lport, mport := o.Bind, o.Port, o.MgmtPort
     keepRunning := true
-    traceLevel := 0
-    if tv := os.Getenv("N2N_SN_TRACE"); tv != "" { var x int; fmt.Sscanf(tv, "%d", &x); traceLevel = x }
+    // traceLevel is set by management requests while the workers log
+    var traceLevel atomic.Int32
+    if tv := os.Getenv("N2N_SN_TRACE"); tv != "" { var x int; fmt.Sscanf(tv, "%d", &x); traceLevel.Store(int32(x)) }
     logx.InitFromEnv()
-    s := &state{peers: map[[6]byte]*net.UDPAddr{}, alloc: map[[6]byte]allocInfo{}, pools: map[string]*addrPool{}}
+    if o.Verbose != 0 {
+        traceLevel.Store(int32(o.Verbose))
+        logx.SetLevel(o.Verbose)
+    }
+    s := &state{peers: map[[6]byte]*peer{}, alloc: map[[6]byte]allocInfo{}, pools: map[string]*addrPool{}, communityFile: o.CommunityFile}
+    s.stats.start = time.Now()
     logf := func(l int, format string, v ...any) {
-        if traceLevel >= l { fmt.Printf(format+"\n", v...) }
+        if int(traceLevel.Load()) >= l { fmt.Printf(format+"\n", v...) }
+    }
+    if err := s.setOptions(o); err != nil {
+        fmt.Println("invalid options", err)
+        os.Exit(2)
+    }
+    if o.StateFile != "" {
+        n, err := s.load(o.StateFile)
+        if err != nil {
+            fmt.Println("failed to load state file", err)
+            os.Exit(2)
+        }
+        logf(1, "state restored from %s: %d edges", o.StateFile, n)
+    }
+    if o.CommunityFile != "" {
+        if err := s.loadCommunities(o.CommunityFile); err != nil {
+            fmt.Println("failed to load community file", err)
+            os.Exit(2)
+        }
     }
 
-    mainUDP, err := transport.ListenUDP(bind, lport)
+    conns, err := transport.ListenUDPReuse(bind, lport, o.Workers)
     if err != nil {
         fmt.Println("failed to open main socket", err)
         os.Exit(2)
     }
-    mgmt := &management.Server{KeepRunning: &keepRunning, TraceLevel: &traceLevel, Events: make(chan management.MgmtEvent, 16)}
-    mgmtConn, err := mgmt.Listen("127.0.0.1", mport)
-    if err != nil {
-        fmt.Println("failed to open management socket", err)
-        os.Exit(2)
+    if o.TCP {
+        ts, err := transport.ListenTCP(bind, lport)
+        if err != nil {
+            fmt.Println("failed to open tcp socket", err)
+            os.Exit(2)
+        }
+        s.streams = append(s.streams, ts)
     }
-    stopCh := make(chan struct{})
-    mgmt.HandleFunc = func(method string, params []string) []map[string]any {
-        var rows []map[string]any
-        switch method {
-        case "pool.list":
-            for k, p := range s.pools {
-                rows = append(rows, map[string]any{"community": k, "netaddr": p.NetAddr, "bitlen": p.Bitlen, "lifetime": int(p.lifetime.Seconds())})
-            }
-        case "pool.set":
-            if len(params) >= 4 {
-                comm := params[0]
-                ip := parseIPv4(params[1])
-                var bl int
-                fmt.Sscanf(params[2], "%d", &bl)
-                var lt int
-                fmt.Sscanf(params[3], "%d", &lt)
-                s.pools[comm] = &addrPool{NetAddr: ip, Bitlen: uint8(bl), next: 10, lifetime: time.Duration(lt) * time.Second}
-                rows = append(rows, map[string]any{"ok": true})
-            } else {
-                rows = append(rows, map[string]any{"ok": false})
-            }
-        case "lease.list":
-            for mac, ai := range s.alloc {
-                rows = append(rows, map[string]any{"mac": mac, "ip": ai.ip, "expires": ai.expires.Unix(), "community": ai.community})
-            }
-        case "lease.reserve":
-            if len(params) >= 3 {
-                mac := parseMAC(params[0])
-                comm := params[1]
-                ip := parseIPv4(params[2])
-                s.alloc[mac] = allocInfo{ip: ip, expires: time.Now().Add(60 * time.Second), community: comm}
-                rows = append(rows, map[string]any{"ok": true})
-            } else {
-                rows = append(rows, map[string]any{"ok": false})
-            }
-        case "lease.release":
-            if len(params) >= 1 {
-                mac := parseMAC(params[0])
-                delete(s.alloc, mac)
-                rows = append(rows, map[string]any{"ok": true})
-            } else {
-                rows = append(rows, map[string]any{"ok": false})
+    if o.WebSocket != "" {
+        var tlsConf *tls.Config
+        if o.WebSocketCert != "" {
+            cert, err := tls.LoadX509KeyPair(o.WebSocketCert, o.WebSocketKey)
+            if err != nil {
+                fmt.Println("failed to load websocket certificate", err)
+                os.Exit(2)
             }
+            tlsConf = &tls.Config{Certificates: []tls.Certificate{cert}}
         }
-        return rows
+        ws, err := transport.ListenWS(o.WebSocket, tlsConf)
+        if err != nil {
+            fmt.Println("failed to open websocket listener", err)
+            os.Exit(2)
+        }
+        s.streams = append(s.streams, ws)
+    }
+    mgmt := &management.Server{Password: o.MgmtPassword, ReadPassword: o.MgmtReadPassword, KeepRunning: &keepRunning, TraceLevel: &traceLevel, Events: make(chan management.MgmtEvent, 256)}
+    if o.MgmtAudit != "" {
+        f, err := management.OpenAudit(o.MgmtAudit)
+        if err != nil {
+            fmt.Println("failed to open management audit log", err)
+            os.Exit(2)
+        }
+        defer f.Close()
+        mgmt.Audit = f
+    }
+    stopCh := make(chan struct{})
+    s.registerCommands(mgmt)
+    if mport != 0 {
+        mgmtConn, err := mgmt.Listen("127.0.0.1", mport)
+        if err != nil {
+            fmt.Println("failed to open management socket", err)
+            os.Exit(2)
+        }
+        go mgmt.Handle(mgmtConn, stopCh)
+        logf(1, "management listening 127.0.0.1:%d", mport)
+    }
+    if o.MgmtSocket != "" {
+        mode := o.MgmtSocketMode
+        if mode == 0 { mode = 0600 }
+        us, err := mgmt.ServeUnix(o.MgmtSocket, mode, o.MgmtSocketOwner, stopCh)
+        if err != nil {
+            fmt.Println("failed to open management unix socket", err)
+            os.Exit(2)
+        }
+        defer us.Close()
+        logf(1, "management listening %s", o.MgmtSocket)
+    }
+    if o.HTTPAddr != "" {
+        hl, err := mgmt.ListenHTTP(o.HTTPAddr)
+        if err != nil {
+            fmt.Println("failed to open management http listener", err)
+            os.Exit(2)
+        }
+        go mgmt.ServeHTTP(hl, stopCh)
     }
-    go mgmt.Handle(mgmtConn, stopCh)
-    logf(1, "management listening 127.0.0.1:%d", mport)
 
-    buf := make([]byte, 2048)
+    // quit is closed by a stop request or Options.Stop; the packet loop and
+    // the sweeper return and the shutdown sequence after the loop runs.
+    quit := make(chan struct{})
+    var quitOnce sync.Once
+    stop := func() { quitOnce.Do(func() { close(quit) }) }
+    go func() {
+        select {
+        case <-stopCh:
+        case <-o.Stop:
+        case <-quit:
+        }
+        stop()
+    }()
+    var wg sync.WaitGroup
+    if o.Reload != nil {
+        wg.Add(1)
+        go func(cur Options) {
+            defer wg.Done()
+            for {
+                select {
+                case <-quit:
+                    return
+                case n := <-cur.Reload:
+                    s.reload(mgmt, cur, n)
+                    n.Reload = cur.Reload
+                    cur = n
+                }
+            }
+        }(o)
+    }
     // sweeper for expired leases
+    wg.Add(1)
     go func() {
-        for keepRunning {
-            time.Sleep(5 * time.Second)
+        defer wg.Done()
+        t := time.NewTicker(5 * time.Second)
+        defer t.Stop()
+        for {
+            select {
+            case <-quit:
+                return
+            case <-t.C:
+            }
             now := time.Now()
+            s.mu.Lock()
             for mac, ai := range s.alloc {
                 if now.After(ai.expires) {
+                    if p := s.peers[mac]; p != nil { mgmt.Publish("peer", s.peerEvent("expired", mac, p.community, p.desc, p.addr)) }
                     delete(s.alloc, mac)
                     delete(s.peers, mac)
-                    if mgmt.Events != nil { mgmt.Events <- management.MgmtEvent{Topic: "lease", Row: map[string]any{"event": "expired", "mac": mac, "ip": ai.ip}} }
+                    mgmt.Publish("lease", map[string]any{"event": "expired", "mac": mac, "ip": ai.ip})
                 }
             }
+            s.mu.Unlock()
         }
     }()
-    for keepRunning {
-        mainUDP.Conn.SetReadDeadline(time.Now().Add(time.Second))
-        n, addr, err := mainUDP.Read(buf)
-        if err != nil {
-            if _, ok := err.(net.Error); ok {
-                select {
-                case <-stopCh:
-                    keepRunning = false
-                default:
+    var workers sync.WaitGroup
+    for _, c := range conns {
+        workers.Add(1)
+        go func(c *transport.UDPListener) {
+            defer workers.Done()
+            s.serve(s.newWorker(c, mgmt, logf), quit)
+            // a failed socket takes the supernode down
+            stop()
+        }(c)
+    }
+    var streams sync.WaitGroup
+    for _, ts := range s.streams {
+        streams.Add(1)
+        go func(ts *transport.TCPServer) {
+            defer streams.Done()
+            ts.Serve(func(from *net.UDPAddr) func(b []byte) {
+                w := s.newWorker(conns[0], mgmt, logf)
+                return func(b []byte) {
+                    w.handle(b, from, ts)
+                    w.flush()
                 }
-                continue
-            }
-            break
-        }
-        logf(1, "recv %d bytes from %s:%d", n, addr.IP.String(), addr.Port)
-        i := 0
-        c, ok := wire.DecodeCommon(buf[:n], &i)
-        if !ok { logf(1, "bad common header ver=%d len=%d", int(buf[0]), n); continue }
-        logf(1, "pc=%d flags=%d ttl=%d community=%s", int(c.PC), int(c.Flags), int(c.TTL), string(bytes.TrimRight(c.Community[:], "\x00")))
-        typ := c.PC
-        if typ == 0 { typ = uint8(c.Flags & 0x1f) }
-        if typ == wire.MsgRegisterSuper {
-            r, rok := wire.DecodeRegisterSuper(buf[:n], &i)
-            if !rok { logf(1, "register decode failed flags=%d", c.Flags); continue }
-            if r.EdgeMac != (wire.Mac{}) { s.peers[r.EdgeMac] = addr; if mgmt.Events != nil { mgmt.Events <- management.MgmtEvent{Topic: "peer", Row: map[string]any{"event": "up"}} } }
-            comm := string(bytes.TrimRight(c.Community[:], "\x00"))
-            pool := s.pools[comm]
-            if pool == nil { pool = &addrPool{NetAddr: 0x0a000000, Bitlen: 24, next: 10, lifetime: 60 * time.Second}; s.pools[comm] = pool }
-            ai := s.alloc[r.EdgeMac]
-            if ai.ip == 0 {
-                ip := pool.NetAddr | (pool.next & 0xff)
-                pool.next++
-                ai = allocInfo{ip: ip, expires: time.Now().Add(pool.lifetime), community: comm}
-                s.alloc[r.EdgeMac] = ai
-            } else {
-                ai.expires = time.Now().Add(pool.lifetime)
-                s.alloc[r.EdgeMac] = ai
-            }
-            ipstr := fmt.Sprintf("%d.%d.%d.%d", (ai.ip>>24)&0xff, (ai.ip>>16)&0xff, (ai.ip>>8)&0xff, ai.ip&0xff)
-            logf(1, "register mac=%02x:%02x:%02x:%02x:%02x:%02x community=%s ip=%s", r.EdgeMac[0], r.EdgeMac[1], r.EdgeMac[2], r.EdgeMac[3], r.EdgeMac[4], r.EdgeMac[5], comm, ipstr)
-            ackc := wire.Common{TTL: 2, PC: wire.MsgRegisterSuperAck, Flags: 0}
-            copy(ackc.Community[:], c.Community[:])
-            a := wire.RegisterSuperAck{Cookie: r.Cookie, Lifetime: 60}
-            copy(a.SrcMac[:], r.EdgeMac[:])
-            a.DevAddr.NetAddr = ai.ip
-            a.DevAddr.Bitlen = pool.Bitlen
-            a.Sock.Family = 2
-            a.Sock.Type = 2
-            a.Sock.Port = uint16(mainUDP.Conn.LocalAddr().(*net.UDPAddr).Port)
-            b := make([]byte, 256)
-            l := wire.EncodeRegisterSuperAck(ackc, a, b)
-            mainUDP.WriteTo(b[:l], addr)
-            continue
-        }
-        if typ == wire.MsgUnregisterSuper {
-            u, uok := wire.DecodeUnregisterSuper(buf[:n], &i)
-            if !uok { continue }
-            delete(s.peers, u.EdgeMac)
-            delete(s.alloc, u.EdgeMac)
-            if mgmt.Events != nil { mgmt.Events <- management.MgmtEvent{Topic: "peer", Row: map[string]any{"event": "down"}} }
-            logf(1, "unregister mac=%02x:%02x:%02x:%02x:%02x:%02x", u.EdgeMac[0], u.EdgeMac[1], u.EdgeMac[2], u.EdgeMac[3], u.EdgeMac[4], u.EdgeMac[5])
-            continue
-        }
-        if typ == wire.MsgQueryPeer {
-            q, qok := wire.DecodeQueryPeer(buf[:n], &i)
-            if !qok { continue }
-            rc := wire.Common{TTL: 2, PC: wire.MsgPeerInfo, Flags: 0}
-            copy(rc.Community[:], c.Community[:])
-            pi := wire.PeerInfo{}
-            pi.AFlags = 0
-            copy(pi.SrcMac[:], q.SrcMac[:])
-            copy(pi.Mac[:], q.TargetMac[:])
-            pi.Sock.Family = 2
-            pi.Sock.Type = 2
-            pi.Sock.Port = uint16(mainUDP.Conn.LocalAddr().(*net.UDPAddr).Port)
-            pi.PreferredSock = pi.Sock
-            if peerAddr, ok := s.peers[q.TargetMac]; ok {
-                pi.PreferredSock.Family = 2
-                pi.PreferredSock.Type = 2
-                pi.PreferredSock.Port = uint16(peerAddr.Port)
-                copy(pi.PreferredSock.AddrV4[:], peerAddr.IP.To4())
-                logf(1, "query src=%02x:%02x:%02x:%02x:%02x:%02x target found=%02x:%02x:%02x:%02x:%02x:%02x", q.SrcMac[0], q.SrcMac[1], q.SrcMac[2], q.SrcMac[3], q.SrcMac[4], q.SrcMac[5], q.TargetMac[0], q.TargetMac[1], q.TargetMac[2], q.TargetMac[3], q.TargetMac[4], q.TargetMac[5])
-            } else {
-                logf(1, "query src=%02x:%02x:%02x:%02x:%02x:%02x target missing=%02x:%02x:%02x:%02x:%02x:%02x", q.SrcMac[0], q.SrcMac[1], q.SrcMac[2], q.SrcMac[3], q.SrcMac[4], q.SrcMac[5], q.TargetMac[0], q.TargetMac[1], q.TargetMac[2], q.TargetMac[3], q.TargetMac[4], q.TargetMac[5])
+            })
+        }(ts)
+    }
+    workers.Wait()
+    logf(1, "supernode stopping")
+    stop()
+    wg.Wait()
+    n := s.notifyShutdown(conns[0])
+    logf(1, "asked %d edges to re-register", n)
+    if o.StateFile != "" {
+        if err := s.save(o.StateFile); err != nil {
+            fmt.Println("failed to save state file", err)
+        } else {
+            logf(1, "state saved to %s", o.StateFile)
+        }
+    }
+    mgmt.Shutdown(2 * time.Second)
+    for _, c := range conns { c.Close() }
+    // the TCP edges get their notices before the connections close
+    for _, ts := range s.streams { ts.Close() }
+    streams.Wait()
+    logf(1, "supernode stopped")
+    return nil
+}
+
+// worker handles the packets of one socket or TCP/WebSocket connection. Replies go
+// back the way the request came; packets relayed to UDP edges leave
+// through conn together on flush, and so do the counters.
+type worker struct {
+    s    *state
+    conn *transport.UDPListener
+    port uint16
+    mgmt *management.Server
+    logf func(int, string, ...any)
+    fwd  []transport.Message
+    forwards, bcasts uint64
+}
+
+func (s *state) newWorker(conn *transport.UDPListener, mgmt *management.Server, logf func(int, string, ...any)) *worker {
+    return &worker{s: s, conn: conn, port: uint16(conn.Conn.LocalAddr().(*net.UDPAddr).Port), mgmt: mgmt, logf: logf}
+}
+
+// serve handles the datagrams arriving on conn until quit is closed or the
+// socket fails. Each socket of a supernode has its own.
+func (s *state) serve(w *worker, quit chan struct{}) {
+    in := transport.NewBatch(transport.MaxBatch, 2048)
+    for {
+        select {
+        case <-quit:
+            return
+        default:
+        }
+        w.conn.Conn.SetReadDeadline(time.Now().Add(time.Second))
+        cnt, err := w.conn.ReadBatch(in)
+        if err != nil {
+            if ne, ok := err.(net.Error); ok && ne.Timeout() { continue }
+            return
+        }
+        for k := 0; k < cnt; k++ { w.handle(in[k].Buf[:in[k].N], in[k].Addr, nil) }
+        w.flush()
+    }
+}
+
+func (w *worker) reply(b []byte, addr *net.UDPAddr, via *transport.TCPServer) {
+    if via != nil {
+        via.WriteTo(b, addr)
+        return
+    }
+    w.conn.WriteTo(b, addr)
+}
+
+// relay sends a received packet on to an edge. For UDP edges b must stay
+// untouched until flush.
+func (w *worker) relay(b []byte, to *peer) {
+    if to.stream != nil {
+        to.stream.WriteTo(b, to.addr)
+        return
+    }
+    w.fwd = append(w.fwd, transport.Message{Buf: b, N: len(b), Addr: to.addr})
+}
+
+func (w *worker) flush() {
+    if len(w.fwd) > 0 {
+        if n, err := w.conn.WriteBatch(w.fwd); n < len(w.fwd) { w.logf(2, "%d of %d forwards not sent: %v", len(w.fwd)-n, len(w.fwd), err) }
+        clear(w.fwd)
+        w.fwd = w.fwd[:0]
+    }
+    if w.forwards+w.bcasts > 0 {
+        w.s.mu.Lock()
+        w.s.stats.forward += w.forwards
+        w.s.stats.broadcast += w.bcasts
+        w.s.stats.lastFwd = time.Now()
+        w.s.mu.Unlock()
+        w.forwards, w.bcasts = 0, 0
+    }
+}
+
+// handle processes one packet from addr, which came through the TCP or
+// WebSocket server via, or over UDP when via is nil.
+func (w *worker) handle(buf []byte, addr *net.UDPAddr, via *transport.TCPServer) {
+    s, mgmt, logf := w.s, w.mgmt, w.logf
+    n := len(buf)
+    if n == 0 { return }
+    logf(1, "recv %d bytes from %s:%d", n, addr.IP.String(), addr.Port)
+    i := 0
+    c, ok := wire.DecodeCommon(buf[:n], &i)
+    if !ok {
+        logf(1, "bad common header ver=%d len=%d", int(buf[0]), n)
+        s.mu.Lock()
+        s.stats.errors++
+        s.mu.Unlock()
+        return
+    }
+    logf(1, "pc=%d flags=%d ttl=%d community=%s", int(c.PC), int(c.Flags), int(c.TTL), string(bytes.TrimRight(c.Community[:], "\x00")))
+    typ := c.PC
+    if typ == 0 { typ = uint8(c.Flags & 0x1f) }
+    if typ == wire.MsgRegisterSuper {
+        r, rok := wire.DecodeRegisterSuper(buf[:n], &i)
+        if !rok { logf(1, "register decode failed flags=%d", c.Flags); return }
+        comm := string(bytes.TrimRight(c.Community[:], "\x00"))
+        desc := string(bytes.TrimRight(r.DevDesc[:], "\x00"))
+        nak := func() {
+            nc := wire.Common{TTL: 2, PC: wire.MsgRegisterSuperNak, Flags: 0}
+            copy(nc.Community[:], c.Community[:])
+            b := make([]byte, 64)
+            l := wire.EncodeRegisterSuperNak(nc, wire.RegisterSuperNak{Cookie: r.Cookie}, b)
+            w.reply(b[:l], addr, via)
+        }
+        s.mu.Lock()
+        s.stats.regSuper++
+        s.stats.lastRegSuper = time.Now()
+        if s.communities != nil && !s.communities[comm] {
+            s.stats.regSuperNak++
+            mgmt.Publish("peer", s.peerEvent("rejected", r.EdgeMac, comm, desc, addr))
+            s.mu.Unlock()
+            logf(1, "register rejected community=%s not allowed", comm)
+            nak()
+            return
+        }
+        old := s.peers[r.EdgeMac]
+        conflict := false
+        // the MAC is held by an edge of another community or by another
+        // named device
+        if old != nil && (old.community != comm || old.desc != "" && desc != "" && old.desc != desc) {
+            ev := s.peerEvent("conflict", r.EdgeMac, comm, desc, addr)
+            ev["prev_community"] = old.community
+            ev["prev_sockaddr"] = old.addr.String()
+            ev["prev_desc"] = old.desc
+            ev["rejected"] = s.rejectConflicts
+            mgmt.Publish("peer", ev)
+            if s.rejectConflicts {
+                s.stats.regSuperNak++
+                s.mu.Unlock()
+                logf(1, "register rejected mac=%s in use by %s", macString(r.EdgeMac), old.addr)
+                nak()
+                return
             }
-            out := make([]byte, 256)
-            l := wire.EncodePeerInfo(rc, pi, out)
-            mainUDP.WriteTo(out[:l], addr)
-            continue
-        }
-        if typ == wire.MsgPacket {
-            j := i
-            if n-j < 12 { continue }
-            var src [6]byte
-            var dst [6]byte
-            copy(src[:], buf[j:j+6])
-            copy(dst[:], buf[j+6:j+12])
-            if peerAddr, ok := s.peers[dst]; ok {
-                mainUDP.WriteTo(buf[:n], peerAddr)
-                logf(2, "forward mac=%02x:%02x:%02x:%02x:%02x:%02x -> %02x:%02x:%02x:%02x:%02x:%02x bytes=%d", src[0], src[1], src[2], src[3], src[4], src[5], dst[0], dst[1], dst[2], dst[3], dst[4], dst[5], n-(j+12))
-            } else {
-                mainUDP.WriteTo(buf[:n], addr)
-                logf(2, "echo mac=%02x:%02x:%02x:%02x:%02x:%02x bytes=%d", src[0], src[1], src[2], src[3], src[4], src[5], n-(j+12))
+            logf(1, "register mac=%s replaces %s community=%s", macString(r.EdgeMac), old.addr, old.community)
+            conflict = true
+        }
+        pool := s.pools[comm]
+        if pool == nil { p := s.defaultPool; pool = &p; s.pools[comm] = pool }
+        ai := s.alloc[r.EdgeMac]
+        if ai.ip == 0 {
+            ip := pool.NetAddr | (pool.next & 0xff)
+            pool.next++
+            ai = allocInfo{ip: ip, expires: time.Now().Add(pool.lifetime), community: comm}
+            s.alloc[r.EdgeMac] = ai
+        } else {
+            ai.expires = time.Now().Add(pool.lifetime)
+            s.alloc[r.EdgeMac] = ai
+        }
+        if r.EdgeMac != (wire.Mac{}) {
+            s.peers[r.EdgeMac] = &peer{addr: addr, community: comm, desc: desc, kdf: r.KDF, lastSeen: time.Now(), stream: via}
+            switch {
+            case old == nil:
+                mgmt.Publish("peer", s.peerEvent("register", r.EdgeMac, comm, desc, addr))
+            case conflict:
+                // reported above
+            case old.addr.String() != addr.String():
+                ev := s.peerEvent("moved", r.EdgeMac, comm, desc, addr)
+                ev["prev_sockaddr"] = old.addr.String()
+                mgmt.Publish("peer", ev)
             }
-            continue
+            if r.KDF != "" && (old == nil || old.kdf != r.KDF) { w.checkKDF(r.EdgeMac, comm, desc, r.KDF, addr) }
         }
-        logf(1, "unhandled pc=%d (derived=%d)", int(c.PC), int(typ))
+        bitlen := pool.Bitlen
+        s.mu.Unlock()
+        ipstr := ipString(ai.ip)
+        logf(1, "register mac=%02x:%02x:%02x:%02x:%02x:%02x community=%s ip=%s", r.EdgeMac[0], r.EdgeMac[1], r.EdgeMac[2], r.EdgeMac[3], r.EdgeMac[4], r.EdgeMac[5], comm, ipstr)
+        ackc := wire.Common{TTL: 2, PC: wire.MsgRegisterSuperAck, Flags: 0}
+        copy(ackc.Community[:], c.Community[:])
+        a := wire.RegisterSuperAck{Cookie: r.Cookie, Lifetime: 60}
+        copy(a.SrcMac[:], r.EdgeMac[:])
+        a.DevAddr.NetAddr = ai.ip
+        a.DevAddr.Bitlen = bitlen
+        // the address the edge registered from, as in C n2n
+        a.Sock = wire.SockFrom(addr)
+        b := make([]byte, 256)
+        l := wire.EncodeRegisterSuperAck(ackc, a, b)
+        w.reply(b[:l], addr, via)
+        return
+    }
+    if typ == wire.MsgUnregisterSuper {
+        u, uok := wire.DecodeUnregisterSuper(buf[:n], &i)
+        if !uok { return }
+        s.mu.Lock()
+        if p := s.peers[u.EdgeMac]; p != nil { mgmt.Publish("peer", s.peerEvent("unregister", u.EdgeMac, p.community, p.desc, p.addr)) }
+        delete(s.peers, u.EdgeMac)
+        delete(s.alloc, u.EdgeMac)
+        s.mu.Unlock()
+        logf(1, "unregister mac=%02x:%02x:%02x:%02x:%02x:%02x", u.EdgeMac[0], u.EdgeMac[1], u.EdgeMac[2], u.EdgeMac[3], u.EdgeMac[4], u.EdgeMac[5])
+        return
+    }
+    if typ == wire.MsgQueryPeer {
+        q, qok := wire.DecodeQueryPeer(buf[:n], &i)
+        if !qok { return }
+        rc := wire.Common{TTL: 2, PC: wire.MsgPeerInfo, Flags: 0}
+        copy(rc.Community[:], c.Community[:])
+        pi := wire.PeerInfo{}
+        pi.AFlags = 0
+        copy(pi.SrcMac[:], q.SrcMac[:])
+        copy(pi.Mac[:], q.TargetMac[:])
+        pi.Sock = wire.Sock{Family: 2, Type: 2, Port: w.port}
+        if addr.IP.To4() == nil { pi.Sock.Family = 10 }
+        pi.PreferredSock = pi.Sock
+        if q.TargetIP != 0 && q.TargetMac == (wire.Mac{}) {
+            // a TUN edge resolving a virtual address
+            mac, bitlen := s.leaseHolder(string(bytes.TrimRight(c.Community[:], "\x00")), q.TargetIP)
+            pi.Mac = mac
+            pi.DevAddr = wire.IPSubnet{NetAddr: q.TargetIP, Bitlen: bitlen}
+            logf(1, "query src=%s ip=%s holder=%s", macString(q.SrcMac), ipString(q.TargetIP), macString(mac))
+        }
+        if to := s.lookup(pi.Mac); pi.Mac != (wire.Mac{}) && to != nil {
+            pi.PreferredSock = wire.SockFrom(to.addr)
+            logf(1, "query src=%02x:%02x:%02x:%02x:%02x:%02x target found=%02x:%02x:%02x:%02x:%02x:%02x", q.SrcMac[0], q.SrcMac[1], q.SrcMac[2], q.SrcMac[3], q.SrcMac[4], q.SrcMac[5], q.TargetMac[0], q.TargetMac[1], q.TargetMac[2], q.TargetMac[3], q.TargetMac[4], q.TargetMac[5])
+        } else {
+            logf(1, "query src=%02x:%02x:%02x:%02x:%02x:%02x target missing=%02x:%02x:%02x:%02x:%02x:%02x", q.SrcMac[0], q.SrcMac[1], q.SrcMac[2], q.SrcMac[3], q.SrcMac[4], q.SrcMac[5], q.TargetMac[0], q.TargetMac[1], q.TargetMac[2], q.TargetMac[3], q.TargetMac[4], q.TargetMac[5])
+        }
+        out := make([]byte, 256)
+        l := wire.EncodePeerInfo(rc, pi, out)
+        w.reply(out[:l], addr, via)
+        return
+    }
+    if typ == wire.MsgPacket || typ == wire.MsgKeyExchange {
+        j := i
+        if n-j < 12 { return }
+        var src [6]byte
+        var dst [6]byte
+        copy(src[:], buf[j:j+6])
+        copy(dst[:], buf[j+6:j+12])
+        if typ == wire.MsgPacket && dst[0]&1 != 0 {
+            comm := string(bytes.TrimRight(c.Community[:], "\x00"))
+            targets := s.members(comm, src)
+            for _, t := range targets { w.relay(buf[:n], t) }
+            w.bcasts += uint64(len(targets))
+            logf(2, "broadcast mac=%02x:%02x:%02x:%02x:%02x:%02x peers=%d bytes=%d", src[0], src[1], src[2], src[3], src[4], src[5], len(targets), n-(j+12))
+        } else if to := s.lookup(dst); to != nil {
+            w.relay(buf[:n], to)
+            w.forwards++
+            logf(2, "forward mac=%02x:%02x:%02x:%02x:%02x:%02x -> %02x:%02x:%02x:%02x:%02x:%02x bytes=%d", src[0], src[1], src[2], src[3], src[4], src[5], dst[0], dst[1], dst[2], dst[3], dst[4], dst[5], n-(j+12))
+        } else if typ == wire.MsgPacket {
+            w.relay(buf[:n], &peer{addr: addr, stream: via})
+            logf(2, "echo mac=%02x:%02x:%02x:%02x:%02x:%02x bytes=%d", src[0], src[1], src[2], src[3], src[4], src[5], n-(j+12))
+        }
+        return
+    }
+    logf(1, "unhandled pc=%d (derived=%d)", int(c.PC), int(typ))
+}
+
+// notifyShutdown sends RE_REGISTER_SUPER to every registered edge, pointing
+// at successor when there is one, and returns how many were told.
+func (s *state) notifyShutdown(conn *transport.UDPListener) int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    rr := wire.ReRegisterSuper{}
+    if s.successor != nil {
+        rr.Sock = wire.SockFrom(s.successor)
+    }
+    b := make([]byte, 64)
+    for _, p := range s.peers {
+        c := wire.Common{TTL: 2, PC: wire.MsgReRegisterSuper, Flags: 0}
+        copy(c.Community[:], p.community)
+        l := wire.EncodeReRegisterSuper(c, rr, b)
+        if p.stream != nil {
+            p.stream.WriteTo(b[:l], p.addr)
+        } else {
+            conn.WriteTo(b[:l], p.addr)
+        }
+    }
+    return len(s.peers)
+}
+
+// peerEvent builds a "peer" topic event with the fields of the edges
+// command. s.mu must be held.
+func (s *state) peerEvent(event string, mac [6]byte, community, desc string, addr *net.UDPAddr) map[string]any {
+    ev := map[string]any{"event": event, "macaddr": macString(mac), "community": community, "ip4addr": "", "sockaddr": "", "desc": desc}
+    if ai, ok := s.alloc[mac]; ok && ai.ip != 0 { ev["ip4addr"] = ipString(ai.ip) }
+    if addr != nil { ev["sockaddr"] = addr.String() }
+    return ev
+}
+
+// checkKDF reports an edge whose key derivation differs from that of
+// another edge of its community: they derive different keys from the same
+// secret and cannot read each other's packets. Called with s.mu held.
+func (w *worker) checkKDF(mac [6]byte, community, desc, kdf string, addr *net.UDPAddr) {
+    s := w.s
+    for omac, p := range s.peers {
+        if omac == mac || p.community != community || p.kdf == "" || p.kdf == kdf { continue }
+        w.logf(0, "warning: community %s: edge %s uses kdf %s but %s uses %s", community, macString(mac), kdf, macString(omac), p.kdf)
+        ev := s.peerEvent("kdf_mismatch", mac, community, desc, addr)
+        ev["kdf"] = kdf
+        ev["prev_macaddr"] = macString(omac)
+        ev["prev_kdf"] = p.kdf
+        w.mgmt.Publish("peer", ev)
+        return
+    }
+}
+
+// lookup returns the registered edge mac or nil. Peers are replaced, never
+// changed, so the result may be used without the lock.
+func (s *state) lookup(mac [6]byte) *peer {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    return s.peers[mac]
+}
+
+// leaseHolder returns the MAC holding the lease of ip in community and the
+// pool prefix length; the MAC is zero when nobody holds it.
+func (s *state) leaseHolder(community string, ip uint32) (wire.Mac, uint8) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    var bitlen uint8
+    if p := s.pools[community]; p != nil { bitlen = p.Bitlen }
+    for mac, ai := range s.alloc {
+        if ai.ip == ip && ai.community == community && time.Now().Before(ai.expires) { return mac, bitlen }
+    }
+    return wire.Mac{}, bitlen
+}
+
+// members returns all edges of a community except src.
+func (s *state) members(community string, src [6]byte) []*peer {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    var out []*peer
+    for mac, p := range s.peers {
+        if mac != src && p.community == community { out = append(out, p) }
+    }
+    return out
+}
+
+// setOptions validates and applies the options that can change at runtime
+// other than the community file.
+func (s *state) setOptions(o Options) error {
+    pool := addrPool{NetAddr: 0x0a000000, Bitlen: 24, next: 10, lifetime: 60 * time.Second}
+    if o.DefaultPool != "" {
+        p, err := parsePool(o.DefaultPool)
+        if err != nil { return err }
+        pool = *p
+    }
+    var successor *net.UDPAddr
+    if o.Successor != "" {
+        a, err := net.ResolveUDPAddr("udp", o.Successor)
+        if err != nil { return fmt.Errorf("successor: %v", err) }
+        successor = a
+    }
+    s.mu.Lock()
+    s.defaultPool = pool
+    s.successor = successor
+    s.rejectConflicts = o.RejectConflicts
+    s.mu.Unlock()
+    return nil
+}
+
+// reload applies the runtime options of n, the options now in effect
+// being o.
+func (s *state) reload(mgmt *management.Server, o, n Options) {
+    if err := s.setOptions(n); err != nil {
+        logx.Printf(0, "reload failed: %v", err)
+        return
+    }
+    s.mu.Lock()
+    s.communityFile = n.CommunityFile
+    var err error
+    if n.CommunityFile != "" {
+        err = s.loadCommunitiesLocked(n.CommunityFile)
+    } else {
+        s.communities = nil
+    }
+    s.mu.Unlock()
+    if err != nil { logx.Printf(0, "reload communities failed: %v", err) }
+    mgmt.SetPasswords(n.MgmtPassword, n.MgmtReadPassword)
+    if n.Verbose != o.Verbose { mgmt.SetVerbose(n.Verbose) }
+    if n.Bind != o.Bind || n.Port != o.Port || n.MgmtPort != o.MgmtPort || n.MgmtSocket != o.MgmtSocket || n.MgmtSocketMode != o.MgmtSocketMode || n.MgmtSocketOwner != o.MgmtSocketOwner || n.HTTPAddr != o.HTTPAddr || n.MgmtAudit != o.MgmtAudit || n.StateFile != o.StateFile || n.Workers != o.Workers || n.TCP != o.TCP || n.WebSocket != o.WebSocket || n.WebSocketCert != o.WebSocketCert || n.WebSocketKey != o.WebSocketKey {
+        logx.Printf(0, "reload: listener, worker, audit and state file changes need a restart")
+    }
+    logx.Printf(0, "reloaded configuration")
+}
+
+func (s *state) loadCommunities(path string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.loadCommunitiesLocked(path)
+}
+
+// loadCommunitiesLocked reads a C n2n style community list: one community
+// per line, optionally followed by the address pool "net/bitlen".
+func (s *state) loadCommunitiesLocked(path string) error {
+    f, err := os.Open(path)
+    if err != nil { return err }
+    defer f.Close()
+    comms := map[string]bool{}
+    pools := map[string]*addrPool{}
+    sc := bufio.NewScanner(f)
+    ln := 0
+    for sc.Scan() {
+        ln++
+        fs := strings.Fields(sc.Text())
+        if len(fs) == 0 || strings.HasPrefix(fs[0], "#") { continue }
+        if len(fs[0]) > 20 { return fmt.Errorf("%s:%d: community name too long", path, ln) }
+        comms[fs[0]] = true
+        if len(fs) >= 2 {
+            p, err := parsePool(fs[1])
+            if err != nil { return fmt.Errorf("%s:%d: %v", path, ln, err) }
+            pools[fs[0]] = p
+        }
+    }
+    if err := sc.Err(); err != nil { return err }
+    s.communities = comms
+    for comm, p := range pools {
+        if cur := s.pools[comm]; cur != nil && cur.NetAddr == p.NetAddr && cur.Bitlen == p.Bitlen { continue }
+        s.pools[comm] = p
     }
     return nil
 }
 
+// parsePool parses an IPv4 "net/bitlen" address pool.
+func parsePool(spec string) (*addrPool, error) {
+    _, ipnet, err := net.ParseCIDR(spec)
+    if err != nil || ipnet.IP.To4() == nil { return nil, fmt.Errorf("bad network %q", spec) }
+    bl, _ := ipnet.Mask.Size()
+    return &addrPool{NetAddr: parseIPv4(ipnet.IP.String()), Bitlen: uint8(bl), next: 10, lifetime: 60 * time.Second}, nil
+}
+
 func parseIPv4(s string) uint32 {
     ip := net.ParseIP(s).To4()
     if ip == nil { return 0 }
     return uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])
 }
 
+func ipString(ip uint32) string {
+    return fmt.Sprintf("%d.%d.%d.%d", (ip>>24)&0xff, (ip>>16)&0xff, (ip>>8)&0xff, ip&0xff)
+}
+
+func macString(m [6]byte) string {
+    return fmt.Sprintf("%02x:%02x:%02x:%02x:%02x:%02x", m[0], m[1], m[2], m[3], m[4], m[5])
+}
+
+func unixOrZero(t time.Time) int64 {
+    if t.IsZero() { return 0 }
+    return t.Unix()
+}
+
 func parseMAC(s string) [6]byte {
     var m [6]byte
     var b0, b1, b2, b3, b4, b5 int
@@ -245,4 +789,3 @@ func parseMAC(s string) [6]byte {
     m[5] = byte(b5)
     return m
 }
-
@@ -0,0 +1,25 @@
+package sn
+
+import (
+    "testing"
+    "time"
+    "n2n-go/pkg/transport"
+)
+
+func TestServeReturnsOnClosedSocket(t *testing.T) {
+    c, err := transport.ListenUDP("127.0.0.1", 0)
+    if err != nil { t.Fatal(err) }
+    s := &state{peers: map[[6]byte]*peer{}}
+    w := s.newWorker(c, nil, func(int, string, ...any) {})
+    c.Close()
+    done := make(chan struct{})
+    go func() {
+        s.serve(w, make(chan struct{}))
+        close(done)
+    }()
+    select {
+    case <-done:
+    case <-time.After(2 * time.Second):
+        t.Fatal("serve kept reading a closed socket")
+    }
+}
@@ -0,0 +1,105 @@
+package sn
+
+import (
+    "encoding/json"
+    "net"
+    "os"
+    "path/filepath"
+    "time"
+)
+
+// stateFile is the JSON snapshot written on shutdown and read on start, so
+// a restarted or successor supernode keeps the leases and known edges.
+type stateFile struct {
+    Saved  int64         `json:"saved"`
+    Pools  []savedPool   `json:"pools"`
+    Leases []savedLease  `json:"leases"`
+    Peers  []savedPeer   `json:"peers"`
+}
+
+type savedPool struct {
+    Community string `json:"community"`
+    Net       string `json:"net"`
+    Bitlen    uint8  `json:"bitlen"`
+    Next      uint32 `json:"next"`
+    Lifetime  int64  `json:"lifetime"`
+}
+
+type savedLease struct {
+    Mac       string `json:"mac"`
+    IP        string `json:"ip"`
+    Community string `json:"community"`
+    Expires   int64  `json:"expires"`
+}
+
+type savedPeer struct {
+    Mac       string `json:"mac"`
+    Sockaddr  string `json:"sockaddr"`
+    Community string `json:"community"`
+    Desc      string `json:"desc"`
+    KDF       string `json:"kdf,omitempty"`
+    LastSeen  int64  `json:"last_seen"`
+}
+
+// save writes the state to path through a temporary file so that a crash
+// never leaves a truncated snapshot. Edges connected over TCP or WebSocket
+// keep their leases but are not saved as peers: their connection ends with
+// this supernode and they register again once they have reconnected.
+func (s *state) save(path string) error {
+    s.mu.Lock()
+    st := stateFile{Saved: time.Now().Unix()}
+    for comm, p := range s.pools {
+        st.Pools = append(st.Pools, savedPool{Community: comm, Net: ipString(p.NetAddr), Bitlen: p.Bitlen, Next: p.next, Lifetime: int64(p.lifetime / time.Second)})
+    }
+    for mac, ai := range s.alloc {
+        st.Leases = append(st.Leases, savedLease{Mac: macString(mac), IP: ipString(ai.ip), Community: ai.community, Expires: ai.expires.Unix()})
+    }
+    for mac, p := range s.peers {
+        if p.stream != nil { continue }
+        st.Peers = append(st.Peers, savedPeer{Mac: macString(mac), Sockaddr: p.addr.String(), Community: p.community, Desc: p.desc, KDF: p.kdf, LastSeen: p.lastSeen.Unix()})
+    }
+    s.mu.Unlock()
+    b, err := json.MarshalIndent(st, "", "  ")
+    if err != nil { return err }
+    tmp, err := os.CreateTemp(filepath.Dir(path), ".sn-state-*")
+    if err != nil { return err }
+    defer os.Remove(tmp.Name())
+    if _, err := tmp.Write(append(b, '\n')); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Close(); err != nil { return err }
+    return os.Rename(tmp.Name(), path)
+}
+
+// load restores a snapshot written by save. Expired leases are dropped and
+// so are peers without a lease; all peers are restored as UDP edges. A
+// missing file is not an error.
+func (s *state) load(path string) (int, error) {
+    b, err := os.ReadFile(path)
+    if os.IsNotExist(err) { return 0, nil }
+    if err != nil { return 0, err }
+    var st stateFile
+    if err := json.Unmarshal(b, &st); err != nil { return 0, err }
+    now := time.Now()
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for _, p := range st.Pools {
+        s.pools[p.Community] = &addrPool{NetAddr: parseIPv4(p.Net), Bitlen: p.Bitlen, next: p.Next, lifetime: time.Duration(p.Lifetime) * time.Second}
+    }
+    for _, l := range st.Leases {
+        exp := time.Unix(l.Expires, 0)
+        if now.After(exp) { continue }
+        s.alloc[parseMAC(l.Mac)] = allocInfo{ip: parseIPv4(l.IP), expires: exp, community: l.Community}
+    }
+    n := 0
+    for _, p := range st.Peers {
+        mac := parseMAC(p.Mac)
+        if _, ok := s.alloc[mac]; !ok { continue }
+        addr, err := net.ResolveUDPAddr("udp", p.Sockaddr)
+        if err != nil { continue }
+        s.peers[mac] = &peer{addr: addr, community: p.Community, desc: p.Desc, kdf: p.KDF, lastSeen: time.Unix(p.LastSeen, 0)}
+        n++
+    }
+    return n, nil
+}
@@ -0,0 +1,53 @@
+package tap
+
+import (
+    "os"
+    "sync"
+)
+
+// Memory is an in-memory TAP device for tests and embedding: frames sent
+// on In are read by the edge, frames the edge writes arrive on Out.
+type Memory struct {
+    Name string
+    In   chan []byte
+    Out  chan []byte
+    closed chan struct{}
+    once   sync.Once
+}
+
+// NewMemory returns a Memory device whose channels buffer queue frames.
+func NewMemory(name string, queue int) *Memory {
+    return &Memory{Name: name, In: make(chan []byte, queue), Out: make(chan []byte, queue), closed: make(chan struct{})}
+}
+
+// Read returns the next frame from In; a frame longer than b is truncated.
+func (m *Memory) Read(b []byte) (int, error) {
+    select {
+    case f := <-m.In:
+        return copy(b, f), nil
+    case <-m.closed:
+        return 0, os.ErrClosed
+    }
+}
+
+// Write queues a copy of b on Out. Like a real interface with a full
+// queue, it drops the frame when nobody reads Out.
+func (m *Memory) Write(b []byte) (int, error) {
+    select {
+    case <-m.closed:
+        return 0, os.ErrClosed
+    default:
+    }
+    f := append([]byte(nil), b...)
+    select {
+    case m.Out <- f:
+    default:
+    }
+    return len(b), nil
+}
+
+// Close makes pending and later reads and writes fail.
+func (m *Memory) Close() error {
+    m.once.Do(func() { close(m.closed) })
+    return nil
+}
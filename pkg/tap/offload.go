@@ -0,0 +1,283 @@
+package tap
+
+import (
+    "encoding/binary"
+    "errors"
+    "io"
+)
+
+// Devices opened with a virtio-net header (IFF_VNET_HDR) prefix every frame
+// with a VnetHdr. Reads may then return TCP super-frames of up to 64 KiB
+// that are cut into segments with Segment, and writes may carry frames
+// merged by a Coalescer, so that bulk transfers cost one read or write per
+// super-frame instead of one per segment.
+
+// VnetHdrLen is the size of the virtio-net header.
+const VnetHdrLen = 10
+
+// MaxOffloadFrame is the largest frame read from or written to a device
+// with a virtio-net header, header included.
+const MaxOffloadFrame = VnetHdrLen + 14 + 65535
+
+const (
+    VnetNeedsCsum = 1
+    VnetDataValid = 2
+)
+
+const (
+    GSONone  = 0
+    GSOTCPv4 = 1
+    GSOUDP   = 3
+    GSOTCPv6 = 4
+    GSOECN   = 0x80
+)
+
+// VnetHdr is struct virtio_net_hdr; its fields are little endian.
+type VnetHdr struct {
+    Flags      uint8
+    GSOType    uint8
+    HdrLen     uint16
+    GSOSize    uint16
+    CsumStart  uint16
+    CsumOffset uint16
+}
+
+var errBadFrame = errors.New("malformed offload frame")
+
+func DecodeVnetHdr(b []byte) (VnetHdr, bool) {
+    if len(b) < VnetHdrLen { return VnetHdr{}, false }
+    le := binary.LittleEndian
+    return VnetHdr{Flags: b[0], GSOType: b[1], HdrLen: le.Uint16(b[2:]), GSOSize: le.Uint16(b[4:]), CsumStart: le.Uint16(b[6:]), CsumOffset: le.Uint16(b[8:])}, true
+}
+
+func (h VnetHdr) Encode(b []byte) {
+    le := binary.LittleEndian
+    b[0], b[1] = h.Flags, h.GSOType
+    le.PutUint16(b[2:], h.HdrLen)
+    le.PutUint16(b[4:], h.GSOSize)
+    le.PutUint16(b[6:], h.CsumStart)
+    le.PutUint16(b[8:], h.CsumOffset)
+}
+
+// csumAdd adds b to the ones' complement sum s.
+func csumAdd(s uint32, b []byte) uint32 {
+    for len(b) >= 2 {
+        s += uint32(b[0])<<8 | uint32(b[1])
+        b = b[2:]
+    }
+    if len(b) == 1 { s += uint32(b[0]) << 8 }
+    return s
+}
+
+func csumFold(s uint32) uint16 {
+    for s > 0xffff { s = s>>16 + s&0xffff }
+    return uint16(s)
+}
+
+// pseudoSum is the ones' complement sum of the TCP/UDP pseudo header.
+func pseudoSum(ip []byte, v6 bool, proto uint8, l4len int) uint32 {
+    var s uint32
+    if v6 {
+        s = csumAdd(0, ip[8:40])
+    } else {
+        s = csumAdd(0, ip[12:20])
+    }
+    return s + uint32(proto) + uint32(l4len)
+}
+
+func ipv4Csum(ip []byte) {
+    ip[10], ip[11] = 0, 0
+    binary.BigEndian.PutUint16(ip[10:], ^csumFold(csumAdd(0, ip[:int(ip[0]&0xf)*4])))
+}
+
+// tcpFrame locates the IP and TCP headers of an untagged ethernet frame
+// and returns their offsets and the header length up to the TCP payload.
+func tcpFrame(f []byte) (ipOff, tcpOff, hdrLen int, v6 bool, ok bool) {
+    if len(f) < 14 { return }
+    ipOff = 14
+    switch binary.BigEndian.Uint16(f[12:14]) {
+    case 0x0800:
+        if len(f) < ipOff+20 || f[ipOff]>>4 != 4 || f[ipOff+9] != 6 { return }
+        tcpOff = ipOff + int(f[ipOff]&0xf)*4
+    case 0x86dd:
+        // extension headers are not supported
+        if len(f) < ipOff+40 || f[ipOff+6] != 6 { return }
+        tcpOff, v6 = ipOff+40, true
+    default:
+        return
+    }
+    if len(f) < tcpOff+20 { return }
+    hdrLen = tcpOff + int(f[tcpOff+12]>>4)*4
+    if hdrLen < tcpOff+20 || len(f) < hdrLen { return }
+    return ipOff, tcpOff, hdrLen, v6, true
+}
+
+// Segment hands the frames making up frame, read with header h, to emit.
+// A GSO super-frame is cut into TCP segments of h.GSOSize bytes with their
+// own lengths, sequence numbers and checksums; a frame only asking for
+// its checksum gets it filled in. buf holds each segment while emit runs.
+func Segment(h VnetHdr, frame []byte, buf []byte, emit func([]byte)) error {
+    gso := h.GSOType &^ GSOECN
+    if gso == GSONone {
+        if h.Flags&VnetNeedsCsum != 0 {
+            cs, co := int(h.CsumStart), int(h.CsumStart)+int(h.CsumOffset)
+            if cs >= len(frame) || co+2 > len(frame) { return errBadFrame }
+            binary.BigEndian.PutUint16(frame[co:], ^csumFold(csumAdd(0, frame[cs:])))
+        }
+        emit(frame)
+        return nil
+    }
+    if gso != GSOTCPv4 && gso != GSOTCPv6 || h.GSOSize == 0 { return errBadFrame }
+    ipOff, tcpOff, hdrLen, v6, ok := tcpFrame(frame)
+    if !ok { return errBadFrame }
+    mss := int(h.GSOSize)
+    payload := frame[hdrLen:]
+    if len(buf) < hdrLen+mss { return errBadFrame }
+    seq := binary.BigEndian.Uint32(frame[tcpOff+4:])
+    id := binary.BigEndian.Uint16(frame[ipOff+4:])
+    flags := frame[tcpOff+13]
+    for off := 0; off < len(payload); off += mss {
+        end := off + mss
+        if end > len(payload) { end = len(payload) }
+        n := copy(buf, frame[:hdrLen])
+        n += copy(buf[n:], payload[off:end])
+        seg := buf[:n]
+        ip, tcp := seg[ipOff:], seg[tcpOff:]
+        if v6 {
+            binary.BigEndian.PutUint16(ip[4:], uint16(n-ipOff-40))
+        } else {
+            binary.BigEndian.PutUint16(ip[2:], uint16(n-ipOff))
+            binary.BigEndian.PutUint16(ip[4:], id)
+            id++
+            ipv4Csum(ip)
+        }
+        binary.BigEndian.PutUint32(tcp[4:], seq+uint32(off))
+        f := flags
+        // CWR only on the first segment, FIN and PSH only on the last
+        if off > 0 { f &^= 0x80 }
+        if end < len(payload) { f &^= 0x09 }
+        tcp[13] = f
+        tcp[16], tcp[17] = 0, 0
+        s := pseudoSum(ip, v6, 6, len(tcp))
+        binary.BigEndian.PutUint16(tcp[16:], ^csumFold(csumAdd(s, tcp)))
+        emit(seg)
+    }
+    return nil
+}
+
+// Coalescer writes frames to a device opened with a virtio-net header and
+// merges consecutive TCP segments of one flow into a GSO super-frame. The
+// merged frame goes out when a frame that does not continue it arrives or
+// on Flush.
+type Coalescer struct {
+    w   io.Writer
+    buf []byte
+    // n is the length of the pending frame behind the header, segs the
+    // number of segments in it and mss the payload size of the first
+    n, segs, mss int
+    ipOff, tcpOff, hdrLen int
+    v6   bool
+    next uint32
+}
+
+// maxCoalesce keeps merged frames below the 64 KiB IP packet limit.
+const maxCoalesce = 65535 - 60
+
+func NewCoalescer(w io.Writer) *Coalescer {
+    return &Coalescer{w: w, buf: make([]byte, MaxOffloadFrame)}
+}
+
+// Pending reports whether a frame waits for Flush.
+func (c *Coalescer) Pending() bool { return c.segs > 0 }
+
+// Write adds frame; it is merged, held or written at once.
+func (c *Coalescer) Write(frame []byte) error {
+    ipOff, tcpOff, hdrLen, v6, ok := tcpFrame(frame)
+    plen := len(frame) - hdrLen
+    // only plain data segments are merged; PSH ends a run
+    var flags byte
+    if ok { flags = frame[tcpOff+13] }
+    ok = ok && plen > 0 && flags&^0x18 == 0 && flags&0x10 != 0 && len(frame) <= len(c.buf)-VnetHdrLen
+    if ok && !v6 {
+        ip := frame[ipOff:]
+        // no options, no fragments, a length that matches the frame
+        ok = ip[0]&0xf == 5 && binary.BigEndian.Uint16(ip[6:])&0x3fff == 0 && int(binary.BigEndian.Uint16(ip[2:])) == len(frame)-ipOff
+    }
+    if ok && v6 { ok = int(binary.BigEndian.Uint16(frame[ipOff+4:])) == len(frame)-ipOff-40 }
+    if !ok {
+        if err := c.Flush(); err != nil { return err }
+        return c.writePlain(frame)
+    }
+    if c.segs > 0 && c.continues(frame, ipOff, tcpOff, hdrLen, v6, plen) {
+        copy(c.buf[VnetHdrLen+c.n:], frame[hdrLen:])
+        c.n += plen
+        c.segs++
+        c.next += uint32(plen)
+        // a short segment or PSH ends the run
+        c.buf[VnetHdrLen+c.tcpOff+13] |= flags & 0x08
+        if plen < c.mss || flags&0x08 != 0 { return c.Flush() }
+        return nil
+    }
+    if err := c.Flush(); err != nil { return err }
+    copy(c.buf[VnetHdrLen:], frame)
+    c.n, c.segs, c.mss = len(frame), 1, plen
+    c.ipOff, c.tcpOff, c.hdrLen, c.v6 = ipOff, tcpOff, hdrLen, v6
+    c.next = binary.BigEndian.Uint32(frame[tcpOff+4:]) + uint32(plen)
+    if flags&0x08 != 0 { return c.Flush() }
+    return nil
+}
+
+// continues reports whether frame is the next segment of the pending one.
+func (c *Coalescer) continues(f []byte, ipOff, tcpOff, hdrLen int, v6 bool, plen int) bool {
+    p := c.buf[VnetHdrLen:]
+    if ipOff != c.ipOff || tcpOff != c.tcpOff || hdrLen != c.hdrLen || v6 != c.v6 || plen > c.mss || c.n+plen > maxCoalesce { return false }
+    if binary.BigEndian.Uint32(f[tcpOff+4:]) != c.next { return false }
+    // MACs and type
+    if string(f[:14]) != string(p[:14]) { return false }
+    if v6 {
+        // traffic class, flow label, hop limit and addresses
+        if string(f[ipOff:ipOff+4]) != string(p[ipOff:ipOff+4]) || f[ipOff+7] != p[ipOff+7] || string(f[ipOff+8:ipOff+40]) != string(p[ipOff+8:ipOff+40]) { return false }
+    } else {
+        // TOS, TTL, protocol and addresses
+        if f[ipOff+1] != p[ipOff+1] || f[ipOff+8] != p[ipOff+8] || string(f[ipOff+12:ipOff+20]) != string(p[ipOff+12:ipOff+20]) { return false }
+    }
+    // ports, ack, header length, window and options; flags were checked
+    t, pt := f[tcpOff:], p[tcpOff:]
+    return string(t[0:4]) == string(pt[0:4]) && string(t[8:13]) == string(pt[8:13]) && string(t[14:16]) == string(pt[14:16]) && string(t[20:hdrLen-tcpOff]) == string(pt[20:hdrLen-tcpOff])
+}
+
+// Flush writes the pending frame.
+func (c *Coalescer) Flush() error {
+    if c.segs == 0 { return nil }
+    segs := c.segs
+    c.segs = 0
+    f := c.buf[VnetHdrLen : VnetHdrLen+c.n]
+    if segs == 1 {
+        // unchanged, its checksums are still good
+        VnetHdr{}.Encode(c.buf)
+        _, err := c.w.Write(c.buf[:VnetHdrLen+c.n])
+        return err
+    }
+    ip, tcp := f[c.ipOff:], f[c.tcpOff:]
+    gso := uint8(GSOTCPv4)
+    if c.v6 {
+        gso = GSOTCPv6
+        binary.BigEndian.PutUint16(ip[4:], uint16(len(f)-c.ipOff-40))
+    } else {
+        binary.BigEndian.PutUint16(ip[2:], uint16(len(f)-c.ipOff))
+        ipv4Csum(ip)
+    }
+    // the device finishes the checksum from the pseudo header sum
+    binary.BigEndian.PutUint16(tcp[16:], csumFold(pseudoSum(ip, c.v6, 6, len(tcp))))
+    VnetHdr{Flags: VnetNeedsCsum, GSOType: gso, HdrLen: uint16(c.hdrLen), GSOSize: uint16(c.mss), CsumStart: uint16(c.tcpOff), CsumOffset: 16}.Encode(c.buf)
+    _, err := c.w.Write(c.buf[:VnetHdrLen+len(f)])
+    return err
+}
+
+func (c *Coalescer) writePlain(frame []byte) error {
+    b := c.buf[:VnetHdrLen+len(frame)]
+    VnetHdr{}.Encode(b)
+    copy(b[VnetHdrLen:], frame)
+    _, err := c.w.Write(b)
+    return err
+}
@@ -0,0 +1,129 @@
+package tap
+
+import (
+    "bytes"
+    "encoding/binary"
+    "testing"
+)
+
+// superFrame builds a TCP super-frame with a timestamp option and n bytes
+// of payload as the kernel hands it over, with the pseudo header sum in
+// the checksum field.
+func superFrame(v6 bool, n int, flags byte) []byte {
+    f := make([]byte, 14)
+    copy(f, []byte{2, 0, 0, 0, 0, 2, 2, 0, 0, 0, 0, 1})
+    var ip []byte
+    if v6 {
+        binary.BigEndian.PutUint16(f[12:], 0x86dd)
+        ip = make([]byte, 40)
+        ip[0], ip[6], ip[7] = 0x60, 6, 64
+        ip[8], ip[23], ip[24], ip[39] = 0xfd, 1, 0xfd, 2
+    } else {
+        binary.BigEndian.PutUint16(f[12:], 0x0800)
+        ip = make([]byte, 20)
+        ip[0], ip[8], ip[9] = 0x45, 64, 6
+        binary.BigEndian.PutUint16(ip[4:], 100)
+        copy(ip[12:], []byte{10, 0, 0, 1, 10, 0, 0, 2})
+    }
+    tcp := make([]byte, 32)
+    binary.BigEndian.PutUint16(tcp[0:], 40000)
+    binary.BigEndian.PutUint16(tcp[2:], 5201)
+    binary.BigEndian.PutUint32(tcp[4:], 1000)
+    binary.BigEndian.PutUint32(tcp[8:], 7)
+    tcp[12], tcp[13] = 8<<4, flags
+    binary.BigEndian.PutUint16(tcp[14:], 502)
+    copy(tcp[20:], []byte{1, 1, 8, 10, 0, 0, 0, 1, 0, 0, 0, 2})
+    f = append(f, ip...)
+    f = append(f, tcp...)
+    for i := 0; i < n; i++ { f = append(f, byte(i*7)) }
+    l4 := len(f) - 14 - len(ip)
+    if v6 {
+        binary.BigEndian.PutUint16(f[18:], uint16(l4))
+    } else {
+        binary.BigEndian.PutUint16(f[16:], uint16(len(f)-14))
+        ipv4Csum(f[14:])
+    }
+    binary.BigEndian.PutUint16(f[14+len(ip)+16:], csumFold(pseudoSum(f[14:], v6, 6, l4)))
+    return f
+}
+
+func checkSegment(t *testing.T, seg []byte, v6 bool) {
+    t.Helper()
+    ipOff, tcpOff, _, _, ok := tcpFrame(seg)
+    if !ok { t.Fatal("not a TCP frame") }
+    if !v6 && csumFold(csumAdd(0, seg[ipOff:tcpOff])) != 0xffff { t.Fatal("bad IPv4 header checksum") }
+    if csumFold(csumAdd(pseudoSum(seg[ipOff:], v6, 6, len(seg)-tcpOff), seg[tcpOff:])) != 0xffff { t.Fatal("bad TCP checksum") }
+}
+
+type frames [][]byte
+
+func (f *frames) Write(b []byte) (int, error) {
+    *f = append(*f, append([]byte(nil), b...))
+    return len(b), nil
+}
+
+func TestSegmentAndCoalesce(t *testing.T) {
+    for _, v6 := range []bool{false, true} {
+        f := superFrame(v6, 5000, 0x18)
+        _, tcpOff, hdrLen, _, _ := tcpFrame(f)
+        gso := uint8(GSOTCPv4)
+        if v6 { gso = GSOTCPv6 }
+        h := VnetHdr{Flags: VnetNeedsCsum, GSOType: gso, HdrLen: uint16(hdrLen), GSOSize: 1448, CsumStart: uint16(tcpOff), CsumOffset: 16}
+        var segs frames
+        buf := make([]byte, 2048)
+        if err := Segment(h, f, buf, func(s []byte) { segs.Write(s) }); err != nil { t.Fatal(err) }
+        if len(segs) != 4 { t.Fatalf("v6 %v: %d segments", v6, len(segs)) }
+        for i, s := range segs {
+            checkSegment(t, s, v6)
+            if seq := binary.BigEndian.Uint32(s[tcpOff+4:]); seq != 1000+uint32(i*1448) { t.Fatalf("segment %d seq %d", i, seq) }
+            if psh := s[tcpOff+13]&0x08 != 0; psh != (i == 3) { t.Fatalf("segment %d flags %x", i, s[tcpOff+13]) }
+        }
+        if got := len(segs[3]) - hdrLen; got != 5000-3*1448 { t.Fatalf("last segment %d bytes", got) }
+
+        // merged again they make one super-frame that segments the same way
+        var out frames
+        c := NewCoalescer(&out)
+        for _, s := range segs {
+            if err := c.Write(s); err != nil { t.Fatal(err) }
+        }
+        if c.Pending() || len(out) != 1 { t.Fatalf("v6 %v: %d writes, pending %v", v6, len(out), c.Pending()) }
+        mh, _ := DecodeVnetHdr(out[0])
+        if mh != h { t.Fatalf("header %+v, want %+v", mh, h) }
+        var again frames
+        Segment(mh, out[0][VnetHdrLen:], buf, func(s []byte) { again.Write(s) })
+        if len(again) != len(segs) { t.Fatalf("%d segments after coalescing", len(again)) }
+        for i := range segs {
+            if !bytes.Equal(again[i], segs[i]) { t.Fatalf("segment %d differs", i) }
+        }
+    }
+}
+
+func TestCoalescerKeepsOtherFrames(t *testing.T) {
+    var out frames
+    c := NewCoalescer(&out)
+    buf := make([]byte, 2048)
+    var segs frames
+    f := superFrame(false, 3000, 0x10)
+    Segment(VnetHdr{GSOType: GSOTCPv4, GSOSize: 1000}, f, buf, func(s []byte) { segs.Write(s) })
+    arp := make([]byte, 42)
+    binary.BigEndian.PutUint16(arp[12:], 0x0806)
+    c.Write(segs[0])
+    c.Write(segs[1])
+    // an unrelated frame goes out behind the merged ones
+    c.Write(arp)
+    // a gap in the sequence starts a new run
+    c.Write(segs[2])
+    c.Flush()
+    if len(out) != 3 { t.Fatalf("%d writes", len(out)) }
+    if h, _ := DecodeVnetHdr(out[0]); h.GSOType != GSOTCPv4 || len(out[0]) != VnetHdrLen+len(segs[0])+1000 { t.Fatalf("merged %+v len %d", h, len(out[0])) }
+    if h, _ := DecodeVnetHdr(out[1]); h != (VnetHdr{}) || !bytes.Equal(out[1][VnetHdrLen:], arp) { t.Fatal("arp frame") }
+    if !bytes.Equal(out[2][VnetHdrLen:], segs[2]) { t.Fatal("single segment changed") }
+}
+
+func TestSegmentChecksumOnly(t *testing.T) {
+    f := superFrame(false, 100, 0x18)
+    _, tcpOff, _, _, _ := tcpFrame(f)
+    var got []byte
+    if err := Segment(VnetHdr{Flags: VnetNeedsCsum, CsumStart: uint16(tcpOff), CsumOffset: 16}, f, nil, func(s []byte) { got = s }); err != nil { t.Fatal(err) }
+    checkSegment(t, got, false)
+}
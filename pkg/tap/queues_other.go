@@ -0,0 +1,25 @@
+//go:build !linux
+
+package tap
+
+import (
+    "errors"
+)
+
+// OpenQueues opens a TAP device, or a TUN device with tun set; only Linux
+// supports more than one queue.
+func OpenQueues(name string, mtu int, queues int, tun bool) ([]*Device, error) {
+    return OpenConfig(Config{Name: name, MTU: mtu, Queues: queues, TUN: tun})
+}
+
+// OpenConfig opens the device described by c; only Linux supports queues
+// and offloads.
+func OpenConfig(c Config) ([]*Device, error) {
+    if c.Queues > 1 { return nil, errors.New("multi-queue devices not supported on this platform") }
+    if c.Offload { return nil, errors.New("offload not supported on this platform") }
+    open := Open
+    if c.TUN { open = OpenTUN }
+    d, err := open(c.Name, c.MTU)
+    if err != nil { return nil, err }
+    return []*Device{d}, nil
+}
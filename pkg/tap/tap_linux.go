@@ -9,12 +9,65 @@ import (
 )
 
 const (
+    IFF_TUN  = 0x0001
     IFF_TAP  = 0x0002
+    IFF_MULTI_QUEUE = 0x0100
     IFF_NO_PI = 0x1000
+    IFF_VNET_HDR = 0x4000
     TUNSETIFF = 0x400454ca
+    TUNSETOFFLOAD = 0x400454d0
+    TUN_F_CSUM = 0x01
+    TUN_F_TSO4 = 0x02
+    TUN_F_TSO6 = 0x04
 )
 
 func Open(name string, mtu int) (*Device, error) {
+    return open(name, IFF_TAP)
+}
+
+// OpenTUN opens a TUN device, which carries IP packets without an
+// ethernet header.
+func OpenTUN(name string, mtu int) (*Device, error) {
+    return open(name, IFF_TUN)
+}
+
+// OpenQueues opens a TAP device, or a TUN device with tun set, with the
+// given number of queues.
+func OpenQueues(name string, mtu int, queues int, tun bool) ([]*Device, error) {
+    return OpenConfig(Config{Name: name, MTU: mtu, Queues: queues, TUN: tun})
+}
+
+// OpenConfig opens the device described by c. With more than one queue the
+// device is created with IFF_MULTI_QUEUE and the kernel spreads flows
+// across the returned Devices.
+func OpenConfig(c Config) ([]*Device, error) {
+    mode := uint16(IFF_TAP)
+    if c.TUN { mode = IFF_TUN }
+    if c.Queues > 1 { mode |= IFF_MULTI_QUEUE }
+    if c.Offload { mode |= IFF_VNET_HDR }
+    n := c.Queues
+    if n < 1 { n = 1 }
+    var ds []*Device
+    for i := 0; i < n; i++ {
+        d, err := open(c.Name, mode)
+        if err == nil && c.Offload {
+            // the header stays 10 bytes: no TUNSETVNETHDRSZ
+            _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, d.File.Fd(), uintptr(TUNSETOFFLOAD), uintptr(TUN_F_CSUM|TUN_F_TSO4|TUN_F_TSO6))
+            if errno != 0 {
+                d.Close()
+                err = errno
+            }
+        }
+        if err != nil {
+            for _, d := range ds { d.Close() }
+            return nil, err
+        }
+        ds = append(ds, d)
+    }
+    return ds, nil
+}
+
+func open(name string, mode uint16) (*Device, error) {
     f, err := os.OpenFile("/dev/net/tun", os.O_RDWR, 0)
     if err != nil {
         return nil, err
@@ -28,7 +81,7 @@ func Open(name string, mtu int) (*Device, error) {
         bs = bs[:15]
     }
     copy(ifr[:], bs)
-    *(*uint16)(unsafe.Pointer(&ifr[16])) = uint16(IFF_TAP | IFF_NO_PI)
+    *(*uint16)(unsafe.Pointer(&ifr[16])) = mode | IFF_NO_PI
     _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), uintptr(TUNSETIFF), uintptr(unsafe.Pointer(&ifr[0])))
     if errno != 0 {
         f.Close()
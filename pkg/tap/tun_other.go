@@ -0,0 +1,11 @@
+//go:build !linux
+
+package tap
+
+import (
+    "errors"
+)
+
+func OpenTUN(name string, mtu int) (*Device, error) {
+    return nil, errors.New("tun mode not supported on this platform yet")
+}
@@ -4,6 +4,27 @@ import (
     "os"
 )
 
+// Interface is a virtual ethernet interface the edge reads frames from and
+// writes frames to. *Device and *Memory implement it.
+type Interface interface {
+    Read(b []byte) (int, error)
+    Write(b []byte) (int, error)
+    Close() error
+}
+
+// Config describes the device opened by OpenConfig.
+type Config struct {
+    Name   string
+    MTU    int
+    // Queues is the number of queues (IFF_MULTI_QUEUE); 0 means 1.
+    Queues int
+    TUN    bool
+    // Offload prefixes frames with a VnetHdr and lets the kernel hand over
+    // TCP super-frames and frames without checksums (IFF_VNET_HDR).
+    Offload bool
+}
+
+// Device is a TAP device opened with Open.
 type Device struct {
     File *os.File
     Name string
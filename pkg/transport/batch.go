@@ -0,0 +1,30 @@
+package transport
+
+import (
+    "net"
+    "sync"
+)
+
+// Message is one datagram of a batch. ReadBatch fills Buf and sets N and
+// Addr; WriteBatch sends Buf[:N] to Addr.
+type Message struct {
+    Buf  []byte
+    N    int
+    Addr *net.UDPAddr
+}
+
+// MaxBatch is the number of datagrams a batch call moves at most.
+const MaxBatch = 64
+
+// NewBatch returns n messages with buffers of size bytes each.
+func NewBatch(n, size int) []Message {
+    ms := make([]Message, n)
+    for i := range ms { ms[i].Buf = make([]byte, size) }
+    return ms
+}
+
+// family is the address family of the socket, detected once.
+type family struct {
+    once sync.Once
+    v6   bool
+}
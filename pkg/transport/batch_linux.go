@@ -0,0 +1,192 @@
+//go:build linux
+
+package transport
+
+import (
+    "net"
+    "sync"
+    "unsafe"
+    "golang.org/x/sys/unix"
+)
+
+// mmsghdr is struct mmsghdr, which x/sys/unix does not define.
+type mmsghdr struct {
+    hdr unix.Msghdr
+    n   uint32
+    _   [unsafe.Sizeof(uintptr(0)) - 4]byte
+}
+
+// scratch holds the kernel side of a batch; calls may run concurrently,
+// so each takes its own from the pool.
+type scratch struct {
+    hdrs  []mmsghdr
+    iov   []unix.Iovec
+    names []unix.RawSockaddrAny
+}
+
+var scratchPool = sync.Pool{New: func() any { return new(scratch) }}
+
+func getScratch(n int) *scratch {
+    s := scratchPool.Get().(*scratch)
+    if cap(s.hdrs) < n {
+        s.hdrs = make([]mmsghdr, n)
+        s.iov = make([]unix.Iovec, n)
+        s.names = make([]unix.RawSockaddrAny, n)
+    }
+    s.hdrs, s.iov, s.names = s.hdrs[:n], s.iov[:n], s.names[:n]
+    return s
+}
+
+// prepare points header i at b and the address buffer i of length nl.
+func (s *scratch) prepare(i int, b []byte, nl uint32) {
+    h := &s.hdrs[i]
+    *h = mmsghdr{}
+    s.iov[i] = unix.Iovec{}
+    if len(b) > 0 { s.iov[i].Base = &b[0] }
+    s.iov[i].SetLen(len(b))
+    h.hdr.Name = (*byte)(unsafe.Pointer(&s.names[i]))
+    h.hdr.Namelen = nl
+    h.hdr.Iov = &s.iov[i]
+    h.hdr.SetIovlen(1)
+}
+
+// isV6 reports whether the socket is AF_INET6; Go opens wildcard binds as
+// dual stack IPv6 sockets, which need IPv4 destinations mapped.
+func (l *UDPListener) isV6() bool {
+    l.fam.once.Do(func() {
+        rc, err := l.Conn.SyscallConn()
+        if err != nil { return }
+        rc.Control(func(fd uintptr) {
+            if sa, err := unix.Getsockname(int(fd)); err == nil {
+                _, l.fam.v6 = sa.(*unix.SockaddrInet6)
+            }
+        })
+    })
+    return l.fam.v6
+}
+
+// ReadBatch reads up to len(ms) datagrams with one recvmmsg call. It
+// blocks until at least one arrives or the read deadline passes.
+func (l *UDPListener) ReadBatch(ms []Message) (int, error) {
+    if len(ms) > MaxBatch { ms = ms[:MaxBatch] }
+    rc, err := l.Conn.SyscallConn()
+    if err != nil { return 0, err }
+    s := getScratch(len(ms))
+    defer scratchPool.Put(s)
+    for i := range ms { s.prepare(i, ms[i].Buf, unix.SizeofSockaddrAny) }
+    var n int
+    var errno unix.Errno
+    err = rc.Read(func(fd uintptr) bool {
+        for {
+            r, _, e := unix.Syscall6(unix.SYS_RECVMMSG, fd, uintptr(unsafe.Pointer(&s.hdrs[0])), uintptr(len(ms)), 0, 0, 0)
+            n, errno = int(r), e
+            // a signal is not a socket error
+            if e != unix.EINTR { return e != unix.EAGAIN }
+        }
+    })
+    if err == nil && errno != 0 { err = errno }
+    if err != nil { return 0, &net.OpError{Op: "read", Net: "udp", Addr: l.Conn.LocalAddr(), Err: err} }
+    // datagrams from an address of another family cannot be answered and
+    // are left out; the messages behind move up
+    k := 0
+    for i := 0; i < n; i++ {
+        a := udpAddr(&s.names[i])
+        if a == nil { continue }
+        if k != i { ms[k], ms[i] = ms[i], ms[k] }
+        ms[k].N, ms[k].Addr = int(s.hdrs[i].n), a
+        k++
+    }
+    return k, nil
+}
+
+// WriteBatch sends the messages with as few sendmmsg calls as the socket
+// allows. A datagram the kernel refuses is skipped; WriteBatch returns
+// how many the kernel accepted and the first error.
+func (l *UDPListener) WriteBatch(ms []Message) (int, error) {
+    if len(ms) == 0 { return 0, nil }
+    rc, err := l.Conn.SyscallConn()
+    if err != nil { return 0, err }
+    v6 := l.isV6()
+    s := getScratch(len(ms))
+    defer scratchPool.Put(s)
+    // messages without a usable address are left out
+    k := 0
+    var first error
+    for i := range ms {
+        nl := putSockaddr(&s.names[k], ms[i].Addr, v6)
+        if nl == 0 {
+            if first == nil { first = &net.OpError{Op: "write", Net: "udp", Addr: ms[i].Addr, Err: unix.EAFNOSUPPORT} }
+            continue
+        }
+        s.prepare(k, ms[i].Buf[:ms[i].N], nl)
+        k++
+    }
+    // sent counts the datagrams done with, accepted those sendmmsg took
+    sent, accepted := 0, 0
+    for sent < k {
+        var errno unix.Errno
+        err = rc.Write(func(fd uintptr) bool {
+            r, _, e := unix.Syscall6(unix.SYS_SENDMMSG, fd, uintptr(unsafe.Pointer(&s.hdrs[sent])), uintptr(k-sent), 0, 0, 0)
+            if e == unix.EAGAIN { return false }
+            if e != 0 {
+                errno = e
+                return true
+            }
+            sent += int(r)
+            accepted += int(r)
+            return true
+        })
+        if err != nil { return accepted, err }
+        if errno != 0 {
+            if first == nil { first = &net.OpError{Op: "write", Net: "udp", Addr: l.Conn.LocalAddr(), Err: errno} }
+            // the first pending datagram failed
+            sent++
+        }
+    }
+    return accepted, first
+}
+
+func udpAddr(rsa *unix.RawSockaddrAny) *net.UDPAddr {
+    switch rsa.Addr.Family {
+    case unix.AF_INET:
+        sa := (*unix.RawSockaddrInet4)(unsafe.Pointer(rsa))
+        p := (*[2]byte)(unsafe.Pointer(&sa.Port))
+        return &net.UDPAddr{IP: append(net.IP(nil), sa.Addr[:]...), Port: int(p[0])<<8 | int(p[1])}
+    case unix.AF_INET6:
+        sa := (*unix.RawSockaddrInet6)(unsafe.Pointer(rsa))
+        p := (*[2]byte)(unsafe.Pointer(&sa.Port))
+        a := &net.UDPAddr{IP: append(net.IP(nil), sa.Addr[:]...), Port: int(p[0])<<8 | int(p[1])}
+        if sa.Scope_id != 0 {
+            if ifi, err := net.InterfaceByIndex(int(sa.Scope_id)); err == nil { a.Zone = ifi.Name }
+        }
+        return a
+    }
+    return nil
+}
+
+// putSockaddr writes a in the family of the socket and returns its length,
+// or 0 when the socket cannot reach it.
+func putSockaddr(rsa *unix.RawSockaddrAny, a *net.UDPAddr, v6 bool) uint32 {
+    if a == nil { return 0 }
+    if !v6 {
+        ip := a.IP.To4()
+        if ip == nil { return 0 }
+        sa := (*unix.RawSockaddrInet4)(unsafe.Pointer(rsa))
+        *sa = unix.RawSockaddrInet4{Family: unix.AF_INET}
+        p := (*[2]byte)(unsafe.Pointer(&sa.Port))
+        p[0], p[1] = byte(a.Port>>8), byte(a.Port)
+        copy(sa.Addr[:], ip)
+        return unix.SizeofSockaddrInet4
+    }
+    ip := a.IP.To16()
+    if ip == nil { return 0 }
+    sa := (*unix.RawSockaddrInet6)(unsafe.Pointer(rsa))
+    *sa = unix.RawSockaddrInet6{Family: unix.AF_INET6}
+    p := (*[2]byte)(unsafe.Pointer(&sa.Port))
+    p[0], p[1] = byte(a.Port>>8), byte(a.Port)
+    copy(sa.Addr[:], ip)
+    if a.Zone != "" {
+        if ifi, err := net.InterfaceByName(a.Zone); err == nil { sa.Scope_id = uint32(ifi.Index) }
+    }
+    return unix.SizeofSockaddrInet6
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+
+package transport
+
+// ReadBatch reads one datagram into ms[0]; batches need recvmmsg.
+func (l *UDPListener) ReadBatch(ms []Message) (int, error) {
+    n, addr, err := l.Conn.ReadFromUDP(ms[0].Buf)
+    if err != nil { return 0, err }
+    ms[0].N, ms[0].Addr = n, addr
+    return 1, nil
+}
+
+// WriteBatch sends the messages one by one. It returns how many were
+// accepted and the first error.
+func (l *UDPListener) WriteBatch(ms []Message) (int, error) {
+    n := 0
+    var first error
+    for i := range ms {
+        if _, err := l.Conn.WriteToUDP(ms[i].Buf[:ms[i].N], ms[i].Addr); err != nil {
+            if first == nil { first = err }
+            continue
+        }
+        n++
+    }
+    return n, first
+}
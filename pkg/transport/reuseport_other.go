@@ -0,0 +1,9 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package transport
+
+import "errors"
+
+func listenReuse(addr string, port, n int) ([]*UDPListener, error) {
+    return nil, errors.New("several sockets on one port need SO_REUSEPORT, not available on this platform")
+}
@@ -0,0 +1,32 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package transport
+
+import (
+    "context"
+    "net"
+    "strconv"
+    "syscall"
+    "golang.org/x/sys/unix"
+    "n2n-go/pkg/logx"
+)
+
+func listenReuse(addr string, port, n int) ([]*UDPListener, error) {
+    lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+        var serr error
+        if err := c.Control(func(fd uintptr) { serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1) }); err != nil { return err }
+        return serr
+    }}
+    var ls []*UDPListener
+    for i := 0; i < n; i++ {
+        pc, err := lc.ListenPacket(context.Background(), "udp", net.JoinHostPort(addr, strconv.Itoa(port)))
+        if err != nil {
+            for _, l := range ls { l.Close() }
+            return nil, err
+        }
+        ls = append(ls, &UDPListener{Conn: pc.(*net.UDPConn)})
+        if port == 0 { port = pc.LocalAddr().(*net.UDPAddr).Port }
+    }
+    logx.Printf(2, "udp listen %s:%d sockets=%d", addr, port, n)
+    return ls, nil
+}
@@ -0,0 +1,362 @@
+package transport
+
+import (
+    "bufio"
+    "encoding/binary"
+    "errors"
+    "io"
+    "net"
+    "os"
+    "sync"
+    "time"
+    "n2n-go/pkg/logx"
+)
+
+// Over TCP (C n2n -S2) every packet is preceded by its length as a 16 bit
+// big-endian number.
+
+// MaxTCPPacket is the largest packet a length prefix can announce.
+const MaxTCPPacket = 0xffff
+
+// tcpQueue is how many packets wait for a slow TCP peer before more are
+// dropped, like datagrams in a full socket buffer.
+const tcpQueue = 256
+
+var errTooLarge = errors.New("packet too large for TCP framing")
+
+// framing turns packets into a byte stream and back: the length prefix
+// of plain TCP, or WebSocket messages. read may answer a control message
+// by passing a frame to ctl; append frames a packet after dst.
+type framing struct {
+    read   func(r *bufio.Reader, b []byte, ctl func(p []byte)) ([]byte, error)
+    append func(dst, b []byte) []byte
+}
+
+var lengthFraming = framing{
+    read:   func(r *bufio.Reader, b []byte, _ func([]byte)) ([]byte, error) { return readFrame(r, b) },
+    append: appendFrame,
+}
+
+func readFrame(r *bufio.Reader, b []byte) ([]byte, error) {
+    var l [2]byte
+    if _, err := io.ReadFull(r, l[:]); err != nil { return nil, err }
+    n := int(binary.BigEndian.Uint16(l[:]))
+    if n > len(b) { b = make([]byte, n) }
+    if _, err := io.ReadFull(r, b[:n]); err != nil { return nil, err }
+    return b[:n], nil
+}
+
+func appendFrame(dst, b []byte) []byte {
+    dst = binary.BigEndian.AppendUint16(dst, uint16(len(b)))
+    return append(dst, b...)
+}
+
+func tcpToUDP(a net.Addr) *net.UDPAddr {
+    t, ok := a.(*net.TCPAddr)
+    if !ok { return nil }
+    return &net.UDPAddr{IP: t.IP, Port: t.Port, Zone: t.Zone}
+}
+
+// TCPClient is the transport of an edge that reaches its supernode over
+// TCP, or WebSocket when made by NewWSClient. It connects on the first
+// write, and again after the connection failed, to the address written
+// to; packets read come from that address.
+type TCPClient struct {
+    // Timeout bounds connecting (default 5s); after a failed attempt the
+    // next one waits Retry (default 1s).
+    Timeout time.Duration
+    Retry   time.Duration
+    // Connected is called after each new connection and Lost after one
+    // failed, both outside the client's lock.
+    Connected func()
+    Lost      func()
+
+    // dial connects to addr and returns the connection ready for frame
+    dial    func(addr *net.UDPAddr, timeout time.Duration) (net.Conn, *bufio.Reader, error)
+    frame   framing
+    mu      sync.Mutex
+    conn    net.Conn
+    raddr   *net.UDPAddr
+    failed  time.Time
+    wbuf    []byte
+    closed  bool
+    in      chan packet
+    done    chan struct{}
+    dlMu    sync.Mutex
+    dl      time.Time
+    dlMoved chan struct{}
+}
+
+type packet struct {
+    b    []byte
+    from *net.UDPAddr
+}
+
+// NewTCPClient returns a client that is not connected yet.
+func NewTCPClient() *TCPClient {
+    return newStreamClient(dialTCP, lengthFraming)
+}
+
+func newStreamClient(dial func(*net.UDPAddr, time.Duration) (net.Conn, *bufio.Reader, error), f framing) *TCPClient {
+    return &TCPClient{Timeout: 5 * time.Second, Retry: time.Second, dial: dial, frame: f, in: make(chan packet, tcpQueue), done: make(chan struct{}), dlMoved: make(chan struct{})}
+}
+
+func dialTCP(addr *net.UDPAddr, timeout time.Duration) (net.Conn, *bufio.Reader, error) {
+    conn, err := net.DialTimeout("tcp", addr.String(), timeout)
+    if err != nil { return nil, nil, err }
+    return conn, bufio.NewReader(conn), nil
+}
+
+// WriteTo sends b to the supernode at addr, connecting first when needed.
+func (c *TCPClient) WriteTo(b []byte, addr *net.UDPAddr) (int, error) {
+    if len(b) > MaxTCPPacket { return 0, errTooLarge }
+    var hook func()
+    defer func() {
+        if hook != nil { hook() }
+    }()
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.closed { return 0, net.ErrClosed }
+    if c.conn != nil && (addr == nil || !addr.IP.Equal(c.raddr.IP) || addr.Port != c.raddr.Port) { c.dropLocked(nil) }
+    if c.conn == nil {
+        if err := c.dialLocked(addr); err != nil { return 0, err }
+        hook = c.Connected
+    }
+    c.wbuf = c.frame.append(c.wbuf[:0], b)
+    c.conn.SetWriteDeadline(time.Now().Add(c.Timeout))
+    if _, err := c.conn.Write(c.wbuf); err != nil {
+        c.dropLocked(err)
+        hook = c.Lost
+        return 0, err
+    }
+    return len(b), nil
+}
+
+func (c *TCPClient) dialLocked(addr *net.UDPAddr) error {
+    if addr == nil { return errors.New("no supernode address") }
+    if time.Since(c.failed) < c.Retry { return errors.New("supernode not connected") }
+    conn, r, err := c.dial(addr, c.Timeout)
+    if err != nil {
+        c.failed = time.Now()
+        logx.Printf(1, "tcp connect %s failed: %v", addr, err)
+        return err
+    }
+    c.conn, c.raddr = conn, addr
+    logx.Printf(1, "tcp connected to %s", addr)
+    go c.reader(conn, r, addr)
+    return nil
+}
+
+// dropLocked closes the connection; the next write connects again.
+func (c *TCPClient) dropLocked(err error) {
+    if c.conn == nil { return }
+    c.conn.Close()
+    if err != nil { logx.Printf(1, "tcp connection to %s lost: %v", c.raddr, err) }
+    c.conn = nil
+}
+
+func (c *TCPClient) reader(conn net.Conn, r *bufio.Reader, from *net.UDPAddr) {
+    ctl := func(p []byte) {
+        c.mu.Lock()
+        if c.conn == conn {
+            conn.SetWriteDeadline(time.Now().Add(c.Timeout))
+            conn.Write(p)
+        }
+        c.mu.Unlock()
+    }
+    for {
+        b, err := c.frame.read(r, nil, ctl)
+        if err != nil {
+            c.mu.Lock()
+            lost := c.conn == conn
+            if lost { c.dropLocked(err) }
+            c.mu.Unlock()
+            if lost && c.Lost != nil { c.Lost() }
+            return
+        }
+        select {
+        case c.in <- packet{b, from}:
+        case <-c.done:
+            return
+        default:
+        }
+    }
+}
+
+// Read returns the next packet from the supernode. Without a connection
+// it waits for one until the read deadline.
+func (c *TCPClient) Read(b []byte) (int, *net.UDPAddr, error) {
+    for {
+        c.dlMu.Lock()
+        dl, moved := c.dl, c.dlMoved
+        c.dlMu.Unlock()
+        var t *time.Timer
+        var expired <-chan time.Time
+        if !dl.IsZero() {
+            t = time.NewTimer(time.Until(dl))
+            expired = t.C
+        }
+        select {
+        case p := <-c.in:
+            if t != nil { t.Stop() }
+            return copy(b, p.b), p.from, nil
+        case <-expired:
+            return 0, nil, os.ErrDeadlineExceeded
+        case <-c.done:
+            if t != nil { t.Stop() }
+            return 0, nil, net.ErrClosed
+        case <-moved:
+            if t != nil { t.Stop() }
+        }
+    }
+}
+
+// SetReadDeadline also wakes Reads waiting for the old deadline.
+func (c *TCPClient) SetReadDeadline(t time.Time) error {
+    c.dlMu.Lock()
+    c.dl = t
+    close(c.dlMoved)
+    c.dlMoved = make(chan struct{})
+    c.dlMu.Unlock()
+    return nil
+}
+
+func (c *TCPClient) Close() error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.closed { return nil }
+    c.closed = true
+    close(c.done)
+    c.dropLocked(nil)
+    return nil
+}
+
+// TCPServer accepts the TCP (or, made by ListenWS, WebSocket) connections
+// of edges for a supernode. Each connection is read by its own goroutine;
+// packets to it are queued and written by another, so a slow edge never
+// holds up the sender.
+type TCPServer struct {
+    ln    net.Listener
+    proto string
+    // upgrade runs on a new connection before its packets, nil for none
+    upgrade func(c net.Conn, r *bufio.Reader) error
+    frame   framing
+    mu      sync.Mutex
+    closed  bool
+    conns   map[string]*tcpConn
+    wg      sync.WaitGroup
+}
+
+type tcpConn struct {
+    c   net.Conn
+    out chan []byte
+}
+
+// ListenTCP opens the TCP listener of a supernode.
+func ListenTCP(addr string, port int) (*TCPServer, error) {
+    ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP(addr), Port: port})
+    if err != nil { return nil, err }
+    logx.Printf(2, "tcp listen %s:%d", addr, port)
+    return &TCPServer{ln: ln, proto: "TCP", frame: lengthFraming, conns: map[string]*tcpConn{}}, nil
+}
+
+// Addr is the address the server listens on.
+func (s *TCPServer) Addr() *net.TCPAddr { return s.ln.Addr().(*net.TCPAddr) }
+
+// Proto names the transport: "TCP" or "WS".
+func (s *TCPServer) Proto() string { return s.proto }
+
+// Serve accepts connections until Close. For each it calls accept with
+// the remote address; the function returned handles the packets read from
+// that connection, one at a time and only until it returns. Serve returns
+// once all connections are closed.
+func (s *TCPServer) Serve(accept func(from *net.UDPAddr) func(b []byte)) {
+    defer s.wg.Wait()
+    for {
+        c, err := s.ln.Accept()
+        if err != nil { return }
+        from := tcpToUDP(c.RemoteAddr())
+        tc := &tcpConn{c: c, out: make(chan []byte, tcpQueue)}
+        s.mu.Lock()
+        s.conns[from.String()] = tc
+        s.mu.Unlock()
+        logx.Printf(1, "%s connection from %s", s.proto, from)
+        s.wg.Add(2)
+        go func() {
+            defer s.wg.Done()
+            for b := range tc.out {
+                c.SetWriteDeadline(time.Now().Add(5 * time.Second))
+                if _, err := c.Write(b); err != nil { break }
+            }
+            c.Close()
+            for range tc.out {}
+        }()
+        go func() {
+            defer s.wg.Done()
+            r := bufio.NewReader(c)
+            if s.ready(c, r) {
+                handle := accept(from)
+                ctl := func(p []byte) { s.queue(tc, append([]byte(nil), p...)) }
+                buf := make([]byte, 2048)
+                for {
+                    b, err := s.frame.read(r, buf, ctl)
+                    if err != nil { break }
+                    handle(b)
+                }
+            }
+            // the writer closes the connection once the queue is out
+            s.mu.Lock()
+            if s.conns[from.String()] == tc { delete(s.conns, from.String()) }
+            s.mu.Unlock()
+            close(tc.out)
+            logx.Printf(1, "%s connection from %s closed", s.proto, from)
+        }()
+    }
+}
+
+// ready runs the upgrade of a new connection, bounded by a deadline that
+// is lifted afterwards unless Close has set its own meanwhile.
+func (s *TCPServer) ready(c net.Conn, r *bufio.Reader) bool {
+    if s.upgrade == nil { return true }
+    c.SetReadDeadline(time.Now().Add(5 * time.Second))
+    if err := s.upgrade(c, r); err != nil {
+        logx.Printf(1, "%s upgrade from %s failed: %v", s.proto, c.RemoteAddr(), err)
+        return false
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.closed { return false }
+    c.SetReadDeadline(time.Time{})
+    return true
+}
+
+func (s *TCPServer) queue(tc *tcpConn, frame []byte) {
+    select {
+    case tc.out <- frame:
+    default:
+    }
+}
+
+// WriteTo queues b for the connection from addr. It fails when there is
+// none and drops b when the connection is backed up.
+func (s *TCPServer) WriteTo(b []byte, addr *net.UDPAddr) (int, error) {
+    if len(b) > MaxTCPPacket { return 0, errTooLarge }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    tc := s.conns[addr.String()]
+    if tc == nil { return 0, net.ErrClosed }
+    s.queue(tc, s.frame.append(make([]byte, 0, 14+len(b)), b))
+    return len(b), nil
+}
+
+// Close stops accepting and reading; the connections close once the
+// packets queued for them are written.
+func (s *TCPServer) Close() error {
+    err := s.ln.Close()
+    s.mu.Lock()
+    s.closed = true
+    // a past deadline stops the readers, also on TLS connections
+    for _, tc := range s.conns { tc.c.SetReadDeadline(time.Now()) }
+    s.mu.Unlock()
+    return err
+}
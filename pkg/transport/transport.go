@@ -0,0 +1,23 @@
+package transport
+
+import (
+    "net"
+    "time"
+)
+
+// Transport carries the n2n packets of an edge to and from its supernode;
+// *UDPListener and *TCPClient implement it.
+type Transport interface {
+    Read(b []byte) (int, *net.UDPAddr, error)
+    WriteTo(b []byte, addr *net.UDPAddr) (int, error)
+    SetReadDeadline(t time.Time) error
+    Close() error
+}
+
+// BatchTransport is a Transport that also moves several datagrams per
+// call; *UDPListener implements it.
+type BatchTransport interface {
+    Transport
+    ReadBatch(ms []Message) (int, error)
+    WriteBatch(ms []Message) (int, error)
+}
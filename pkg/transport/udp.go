@@ -2,11 +2,17 @@ package transport
 
 import (
     "net"
+    "time"
     "n2n-go/pkg/logx"
 )
 
+// UDPListener is the UDP socket of an edge or supernode. Besides single
+// datagrams it moves batches with ReadBatch and WriteBatch, one system
+// call per batch on Linux (recvmmsg/sendmmsg) and one per datagram
+// elsewhere.
 type UDPListener struct {
     Conn *net.UDPConn
+    fam  family
 }
 
 func ListenUDP(addr string, port int) (*UDPListener, error) {
@@ -34,3 +40,19 @@ func (l *UDPListener) Read(buf []byte) (int, *net.UDPAddr, error) {
 func (l *UDPListener) WriteTo(buf []byte, addr *net.UDPAddr) (int, error) {
     return l.Conn.WriteToUDP(buf, addr)
 }
+
+func (l *UDPListener) SetReadDeadline(t time.Time) error {
+    return l.Conn.SetReadDeadline(t)
+}
+
+// ListenUDPReuse opens n sockets bound to the same address with
+// SO_REUSEPORT; the kernel spreads the senders across them. With port 0
+// all share the port the first one gets. n <= 1 is ListenUDP.
+func ListenUDPReuse(addr string, port, n int) ([]*UDPListener, error) {
+    if n <= 1 {
+        l, err := ListenUDP(addr, port)
+        if err != nil { return nil, err }
+        return []*UDPListener{l}, nil
+    }
+    return listenReuse(addr, port, n)
+}
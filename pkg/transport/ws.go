@@ -0,0 +1,217 @@
+package transport
+
+import (
+    "bufio"
+    "crypto/rand"
+    "crypto/sha1"
+    "crypto/tls"
+    "encoding/base64"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "net/url"
+    "strings"
+    "time"
+    "n2n-go/pkg/logx"
+)
+
+// The WebSocket transport (RFC 6455) carries each n2n packet as one binary
+// message, for networks that only let HTTP(S) out. Like over TCP, the edge
+// keeps a single connection to its supernode.
+
+const (
+    wsContinue = 0x0
+    wsBinary   = 0x2
+    wsClose    = 0x8
+    wsPing     = 0x9
+    wsPong     = 0xa
+)
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+func wsAccept(key string) string {
+    h := sha1.Sum([]byte(key + wsGUID))
+    return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// appendWS frames b as one message of type op; clients must mask theirs.
+func appendWS(dst []byte, op byte, b []byte, mask bool) []byte {
+    dst = append(dst, 0x80|op)
+    var m byte
+    if mask { m = 0x80 }
+    switch {
+    case len(b) < 126:
+        dst = append(dst, m|byte(len(b)))
+    case len(b) <= 0xffff:
+        dst = append(dst, m|126)
+        dst = binary.BigEndian.AppendUint16(dst, uint16(len(b)))
+    default:
+        dst = append(dst, m|127)
+        dst = binary.BigEndian.AppendUint64(dst, uint64(len(b)))
+    }
+    if !mask { return append(dst, b...) }
+    var k [4]byte
+    rand.Read(k[:])
+    dst = append(dst, k[:]...)
+    n := len(dst)
+    dst = append(dst, b...)
+    for i := range b { dst[n+i] ^= k[i&3] }
+    return dst
+}
+
+// readWS returns the next data message, joining its fragments. Pings are
+// answered through ctl, pongs skipped; a close message ends the stream.
+func readWS(r *bufio.Reader, b []byte, ctl func(p []byte), mask bool) ([]byte, error) {
+    msg := b[:0]
+    for {
+        var h [2]byte
+        if _, err := io.ReadFull(r, h[:]); err != nil { return nil, err }
+        fin, op := h[0]&0x80 != 0, h[0]&0x0f
+        n := uint64(h[1] & 0x7f)
+        switch n {
+        case 126:
+            var l [2]byte
+            if _, err := io.ReadFull(r, l[:]); err != nil { return nil, err }
+            n = uint64(binary.BigEndian.Uint16(l[:]))
+        case 127:
+            var l [8]byte
+            if _, err := io.ReadFull(r, l[:]); err != nil { return nil, err }
+            n = binary.BigEndian.Uint64(l[:])
+        }
+        if n > MaxTCPPacket || uint64(len(msg))+n > MaxTCPPacket { return nil, errTooLarge }
+        var k [4]byte
+        masked := h[1]&0x80 != 0
+        if masked {
+            if _, err := io.ReadFull(r, k[:]); err != nil { return nil, err }
+        }
+        var p []byte
+        if op >= wsClose {
+            p = make([]byte, n)
+        } else {
+            start := len(msg)
+            msg = append(msg, make([]byte, n)...)
+            p = msg[start:]
+        }
+        if _, err := io.ReadFull(r, p); err != nil { return nil, err }
+        if masked {
+            for i := range p { p[i] ^= k[i&3] }
+        }
+        switch op {
+        case wsClose:
+            return nil, io.EOF
+        case wsPing:
+            ctl(appendWS(nil, wsPong, p, mask))
+        case wsPong:
+        case wsContinue, wsBinary, 0x1:
+            if fin { return msg, nil }
+        default:
+            return nil, fmt.Errorf("websocket opcode %d", op)
+        }
+    }
+}
+
+func wsFraming(client bool) framing {
+    return framing{
+        read:   func(r *bufio.Reader, b []byte, ctl func([]byte)) ([]byte, error) { return readWS(r, b, ctl, client) },
+        append: func(dst, b []byte) []byte { return appendWS(dst, wsBinary, b, client) },
+    }
+}
+
+// NewWSClient returns a client that reaches the supernode through the
+// WebSocket server at rawURL (ws:// or wss://) instead of connecting to
+// the address written to, which only names the supernode. tlsConf, when
+// not nil, verifies a wss:// server, e.g. against a local certificate.
+func NewWSClient(rawURL string, tlsConf *tls.Config) (*TCPClient, error) {
+    u, err := url.Parse(rawURL)
+    if err != nil { return nil, err }
+    host := u.Host
+    switch u.Scheme {
+    case "ws":
+        if u.Port() == "" { host = net.JoinHostPort(u.Hostname(), "80") }
+    case "wss":
+        if u.Port() == "" { host = net.JoinHostPort(u.Hostname(), "443") }
+        if tlsConf == nil { tlsConf = &tls.Config{} }
+        if tlsConf.ServerName == "" {
+            tlsConf = tlsConf.Clone()
+            tlsConf.ServerName = u.Hostname()
+        }
+    default:
+        return nil, fmt.Errorf("websocket url %q: scheme must be ws or wss", rawURL)
+    }
+    dial := func(_ *net.UDPAddr, timeout time.Duration) (net.Conn, *bufio.Reader, error) {
+        d := &net.Dialer{Timeout: timeout}
+        var conn net.Conn
+        var err error
+        if u.Scheme == "wss" {
+            conn, err = tls.DialWithDialer(d, "tcp", host, tlsConf)
+        } else {
+            conn, err = d.Dial("tcp", host)
+        }
+        if err != nil { return nil, nil, err }
+        conn.SetDeadline(time.Now().Add(timeout))
+        r, err := wsHandshake(conn, u)
+        if err != nil {
+            conn.Close()
+            return nil, nil, err
+        }
+        conn.SetDeadline(time.Time{})
+        return conn, r, nil
+    }
+    return newStreamClient(dial, wsFraming(true)), nil
+}
+
+// wsHandshake sends the upgrade request for u and checks the answer.
+func wsHandshake(conn net.Conn, u *url.URL) (*bufio.Reader, error) {
+    var k [16]byte
+    rand.Read(k[:])
+    key := base64.StdEncoding.EncodeToString(k[:])
+    req := "GET " + u.RequestURI() + " HTTP/1.1\r\nHost: " + u.Host + "\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: " + key + "\r\nSec-WebSocket-Version: 13\r\n\r\n"
+    if _, err := io.WriteString(conn, req); err != nil { return nil, err }
+    r := bufio.NewReader(conn)
+    resp, err := http.ReadResponse(r, nil)
+    if err != nil { return nil, err }
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusSwitchingProtocols { return nil, fmt.Errorf("websocket upgrade: %s", resp.Status) }
+    if resp.Header.Get("Sec-WebSocket-Accept") != wsAccept(key) { return nil, errors.New("websocket upgrade: bad Sec-WebSocket-Accept") }
+    return r, nil
+}
+
+// ListenWS opens the WebSocket listener of a supernode on addr (host:port).
+// It upgrades requests for any path; with tlsConf it serves wss://.
+func ListenWS(addr string, tlsConf *tls.Config) (*TCPServer, error) {
+    ln, err := net.Listen("tcp", addr)
+    if err != nil { return nil, err }
+    if tlsConf != nil { ln = tls.NewListener(ln, tlsConf) }
+    logx.Printf(2, "websocket listen %s tls=%v", addr, tlsConf != nil)
+    return &TCPServer{ln: ln, proto: "WS", upgrade: wsUpgrade, frame: wsFraming(false), conns: map[string]*tcpConn{}}, nil
+}
+
+// wsUpgrade answers the upgrade request of a new connection.
+func wsUpgrade(c net.Conn, r *bufio.Reader) error {
+    req, err := http.ReadRequest(r)
+    if err != nil { return err }
+    key := req.Header.Get("Sec-WebSocket-Key")
+    if req.Method != http.MethodGet || !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") || !headerHas(req.Header, "Connection", "upgrade") || key == "" {
+        io.WriteString(c, "HTTP/1.1 400 Bad Request\r\nConnection: close\r\nContent-Length: 0\r\n\r\n")
+        return errors.New("not a websocket request")
+    }
+    if req.Header.Get("Sec-WebSocket-Version") != "13" {
+        io.WriteString(c, "HTTP/1.1 426 Upgrade Required\r\nSec-WebSocket-Version: 13\r\nConnection: close\r\nContent-Length: 0\r\n\r\n")
+        return errors.New("unsupported websocket version")
+    }
+    _, err = io.WriteString(c, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: "+wsAccept(key)+"\r\n\r\n")
+    return err
+}
+
+// headerHas reports whether the comma separated header name lists token.
+func headerHas(h http.Header, name, token string) bool {
+    for _, v := range h.Values(name) {
+        for _, t := range strings.Split(v, ",") {
+            if strings.EqualFold(strings.TrimSpace(t), token) { return true }
+        }
+    }
+    return false
+}
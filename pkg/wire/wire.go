@@ -2,6 +2,7 @@ package wire
 
 import (
     "encoding/binary"
+    "net"
 )
 
 const (
@@ -18,6 +19,7 @@ const (
     MsgPeerInfo = 10
     MsgQueryPeer = 11
     MsgReRegisterSuper = 12
+    MsgKeyExchange = 13
 )
 
 type Mac [6]byte
@@ -30,6 +32,27 @@ type Sock struct {
     AddrV6 [16]byte
 }
 
+// SockFrom is the UDP Sock of a: family 2 for IPv4 (also IPv4-mapped)
+// addresses and no address at all, family 10 for IPv6.
+func SockFrom(a *net.UDPAddr) Sock {
+    s := Sock{Family: 2, Type: 2}
+    if a == nil { return s }
+    s.Port = uint16(a.Port)
+    if ip4 := a.IP.To4(); ip4 != nil {
+        copy(s.AddrV4[:], ip4)
+    } else if ip6 := a.IP.To16(); ip6 != nil {
+        s.Family = 10
+        copy(s.AddrV6[:], ip6)
+    }
+    return s
+}
+
+// UDPAddr is the address s holds.
+func (s Sock) UDPAddr() *net.UDPAddr {
+    if s.Family == 10 { return &net.UDPAddr{IP: append(net.IP(nil), s.AddrV6[:]...), Port: int(s.Port)} }
+    return &net.UDPAddr{IP: net.IPv4(s.AddrV4[0], s.AddrV4[1], s.AddrV4[2], s.AddrV4[3]), Port: int(s.Port)}
+}
+
 type IPSubnet struct {
     NetAddr uint32
     Bitlen  uint8
@@ -52,6 +75,10 @@ type RegisterSuper struct {
     AuthScheme uint16
     AuthToken  []byte
     KeyTime uint32
+    // KDF is the key derivation spec of the edge (crypto.KDF String), so
+    // the supernode can spot edges of a community that derive different
+    // keys. It trails the C n2n fields and is sent only when set.
+    KDF string
 }
 
 type RegisterSuperAck struct {
@@ -83,6 +110,13 @@ type RegisterSuperNak struct {
     Reason uint16
 }
 
+// ReRegisterSuper asks an edge to register again. A supernode going down
+// sends it with Sock set to the supernode that takes over, or with a zero
+// Sock when there is none.
+type ReRegisterSuper struct {
+    Sock Sock
+}
+
 func putUint8(b []byte, i *int, v uint8) {
     b[*i] = v
     *i++
@@ -194,6 +228,7 @@ func DecodeSock(src []byte, i *int) (Sock, bool) {
     if (f&0xC000) != 0 || (f == 0) {
         s.Port = getUint16(src, i)
         if f&0x8000 != 0 {
+            if len(src)-*i < 16 { return Sock{}, false }
             s.Family = 10
             copy(s.AddrV6[:], src[*i:*i+16])
             *i += 16
@@ -218,6 +253,7 @@ func DecodeSock(src []byte, i *int) (Sock, bool) {
         *i += 4
         if len(src)-*i >= 12 { *i += 12 }
     } else {
+        if len(src)-*i < 16 { return Sock{}, false }
         copy(s.AddrV6[:], src[*i:*i+16])
         *i += 16
     }
@@ -240,6 +276,10 @@ func EncodeRegisterSuper(c Common, r RegisterSuper, dst []byte) int {
     copy(dst[i:i+len(r.AuthToken)], r.AuthToken)
     i += len(r.AuthToken)
     putUint32(dst, &i, r.KeyTime)
+    if r.KDF != "" && len(r.KDF) <= 0xff {
+        putUint8(dst, &i, uint8(len(r.KDF)))
+        i += copy(dst[i:], r.KDF)
+    }
     return i
 }
 
@@ -272,6 +312,11 @@ func DecodeRegisterSuper(src []byte, i *int) (RegisterSuper, bool) {
         }
     }
     if len(src)-*i >= 4 { r.KeyTime = getUint32(src, i) }
+    if len(src)-*i >= 1 && len(src)-*i-1 >= int(src[*i]) {
+        l := int(getUint8(src, i))
+        r.KDF = string(src[*i : *i+l])
+        *i += l
+    }
     return r, true
 }
 
@@ -401,6 +446,23 @@ func DecodeRegisterSuperNak(src []byte, i *int) (RegisterSuperNak, bool) {
     return n, true
 }
 
+func EncodeReRegisterSuper(c Common, r ReRegisterSuper, dst []byte) int {
+    i := 0
+    i += EncodeCommon(c, dst[i:])
+    if r.Sock.Port != 0 { i += EncodeSock(r.Sock, dst[i:]) }
+    return i
+}
+
+// DecodeReRegisterSuper accepts the bare header sent by C supernodes.
+func DecodeReRegisterSuper(src []byte, i *int) (ReRegisterSuper, bool) {
+    r := ReRegisterSuper{}
+    if len(src) == *i { return r, true }
+    s, ok := DecodeSock(src, i)
+    if !ok { return r, false }
+    r.Sock = s
+    return r, true
+}
+
 type Packet struct {
     SrcMac      Mac
     DstMac      Mac
@@ -471,6 +533,9 @@ type QueryPeer struct {
     SrcMac    Mac
     Sock      Sock
     TargetMac Mac
+    // TargetIP asks for the edge holding this leased address instead of
+    // TargetMac (n2n-go extension, appended only when set).
+    TargetIP  uint32
 }
 
 func EncodeQueryPeer(c Common, q QueryPeer, dst []byte) int {
@@ -482,12 +547,14 @@ func EncodeQueryPeer(c Common, q QueryPeer, dst []byte) int {
     i += EncodeSock(q.Sock, dst[i:])
     copy(dst[i:i+6], q.TargetMac[:])
     i += 6
+    if q.TargetIP != 0 { putUint32(dst, &i, q.TargetIP) }
     return i
 }
 
 func DecodeQueryPeer(src []byte, i *int) (QueryPeer, bool) {
     q := QueryPeer{}
-    if len(src)-*i < 2+6+4+16+6 {
+    // an IPv4 sock is 8 bytes, the length is checked again behind it
+    if len(src)-*i < 2+6+8+6 {
         return q, false
     }
     q.AFlags = getUint16(src, i)
@@ -498,8 +565,10 @@ func DecodeQueryPeer(src []byte, i *int) (QueryPeer, bool) {
         return q, false
     }
     q.Sock = s
+    if len(src)-*i < 6 { return q, false }
     copy(q.TargetMac[:], src[*i:*i+6])
     *i += 6
+    if len(src)-*i >= 4 { q.TargetIP = getUint32(src, i) }
     return q, true
 }
 
@@ -510,6 +579,10 @@ type PeerInfo struct {
     Sock          Sock
     PreferredSock Sock
     Load          uint32
+    // DevAddr answers a query by TargetIP: the address asked for, with Mac
+    // left zero when no edge holds it (n2n-go extension, appended only
+    // when set).
+    DevAddr       IPSubnet
 }
 
 func EncodePeerInfo(c Common, p PeerInfo, dst []byte) int {
@@ -523,6 +596,10 @@ func EncodePeerInfo(c Common, p PeerInfo, dst []byte) int {
     i += EncodeSock(p.Sock, dst[i:])
     i += EncodeSock(p.PreferredSock, dst[i:])
     putUint32(dst, &i, p.Load)
+    if p.DevAddr.NetAddr != 0 {
+        putUint32(dst, &i, p.DevAddr.NetAddr)
+        putUint8(dst, &i, p.DevAddr.Bitlen)
+    }
     return i
 }
 
@@ -548,5 +625,54 @@ func DecodePeerInfo(src []byte, i *int) (PeerInfo, bool) {
     p.PreferredSock = ps
     if len(src)-*i < 4 { return p, false }
     p.Load = getUint32(src, i)
+    if len(src)-*i >= 5 {
+        p.DevAddr.NetAddr = getUint32(src, i)
+        p.DevAddr.Bitlen = getUint8(src, i)
+    }
     return p, true
 }
+
+const (
+    KeyExchangeInit = 1
+    KeyExchangeResp = 2
+)
+
+// KeyExchange carries an ephemeral X25519 public key between two edges. It
+// is relayed by the supernode like a PACKET (src/dst MAC directly after the
+// common header); Payload is the public key sealed with the community key.
+type KeyExchange struct {
+    SrcMac  Mac
+    DstMac  Mac
+    Kind    uint8
+    Epoch   uint32
+    Payload []byte
+}
+
+func EncodeKeyExchange(c Common, k KeyExchange, dst []byte) int {
+    i := 0
+    i += EncodeCommon(c, dst[i:])
+    copy(dst[i:i+6], k.SrcMac[:])
+    i += 6
+    copy(dst[i:i+6], k.DstMac[:])
+    i += 6
+    putUint8(dst, &i, k.Kind)
+    putUint32(dst, &i, k.Epoch)
+    copy(dst[i:], k.Payload)
+    i += len(k.Payload)
+    return i
+}
+
+func DecodeKeyExchange(src []byte, i *int) (KeyExchange, bool) {
+    k := KeyExchange{}
+    if len(src)-*i < 6+6+1+4 { return k, false }
+    copy(k.SrcMac[:], src[*i:*i+6])
+    *i += 6
+    copy(k.DstMac[:], src[*i:*i+6])
+    *i += 6
+    k.Kind = getUint8(src, i)
+    k.Epoch = getUint32(src, i)
+    k.Payload = make([]byte, len(src)-*i)
+    copy(k.Payload, src[*i:])
+    *i = len(src)
+    return k, true
+}
@@ -1,6 +1,9 @@
 package wire
 
-import "testing"
+import (
+    "net"
+    "testing"
+)
 
 func TestCommonEncodeDecode(t *testing.T) {
     c := Common{TTL: 2, PC: MsgRegisterSuper, Flags: 0}
@@ -44,7 +47,13 @@ func TestRegisterSuperEncodeDecode(t *testing.T) {
     if !ok { t.Fatal("common") }
     got, rok := DecodeRegisterSuper(b[:n], &i)
     if !rok { t.Fatal("regsup") }
-    if got.AuthScheme != r.AuthScheme || got.KeyTime != r.KeyTime || string(got.AuthToken) != string(r.AuthToken) { t.Fatal("fields") }
+    if got.AuthScheme != r.AuthScheme || got.KeyTime != r.KeyTime || string(got.AuthToken) != string(r.AuthToken) || got.KDF != "" { t.Fatal("fields") }
+    r.KDF = "scrypt:n=32768,r=8,p=1"
+    n = EncodeRegisterSuper(c, r, b)
+    i = 0
+    DecodeCommon(b[:n], &i)
+    got, rok = DecodeRegisterSuper(b[:n], &i)
+    if !rok || got.KDF != r.KDF || got.KeyTime != r.KeyTime || i != n { t.Fatal("kdf") }
 }
 
 func TestRegisterAckEncodeDecode(t *testing.T) {
@@ -84,6 +93,37 @@ func TestRegisterSuperNakEncodeDecode(t *testing.T) {
     if !gok || got.Cookie != n.Cookie || got.Reason != n.Reason { t.Fatal("nak") }
 }
 
+func TestReRegisterSuperEncodeDecode(t *testing.T) {
+    c := Common{TTL: 2, PC: MsgReRegisterSuper, Flags: 0}
+    r := ReRegisterSuper{Sock: Sock{Family: 2, Type: 2, Port: 7654, AddrV4: [4]byte{192, 0, 2, 1}}}
+    b := make([]byte, 64)
+    m := EncodeReRegisterSuper(c, r, b)
+    i := 0
+    _, ok := DecodeCommon(b[:m], &i)
+    if !ok { t.Fatal("common") }
+    got, gok := DecodeReRegisterSuper(b[:m], &i)
+    if !gok || got.Sock != r.Sock { t.Fatal("re-register") }
+    m = EncodeReRegisterSuper(c, ReRegisterSuper{}, b)
+    i = 0
+    DecodeCommon(b[:m], &i)
+    got, gok = DecodeReRegisterSuper(b[:m], &i)
+    if !gok || got.Sock.Port != 0 { t.Fatal("bare re-register") }
+}
+
+func TestSockIPv6(t *testing.T) {
+    a := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 7654}
+    s := SockFrom(a)
+    if s.Family != 10 || s.UDPAddr().String() != a.String() { t.Fatalf("sock %+v", s) }
+    if m := SockFrom(&net.UDPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 1}); m.Family != 2 || m.AddrV4 != [4]byte{192, 0, 2, 1} { t.Fatalf("mapped %+v", m) }
+    b := make([]byte, 20)
+    n := EncodeSock(s, b)
+    i := 0
+    if got, ok := DecodeSock(b[:n], &i); !ok || got != s || i != 20 { t.Fatalf("decode %+v", got) }
+    // a cut off IPv6 address
+    i = 0
+    if _, ok := DecodeSock(b[:12], &i); ok { t.Fatal("short sock") }
+}
+
 func TestRegisterSuperAckAuth(t *testing.T) {
     c := Common{TTL: 2, PC: MsgRegisterSuperAck, Flags: 0}
     a := RegisterSuperAck{Cookie: 7, DevAddr: IPSubnet{NetAddr: 0x0a000000, Bitlen: 24}, Lifetime: 60}
@@ -109,3 +149,35 @@ func TestUnregisterSuperAuth(t *testing.T) {
     got, gok := DecodeUnregisterSuper(b[:n], &i)
     if !gok || got.AuthScheme != u.AuthScheme || string(got.AuthToken) != string(u.AuthToken) { t.Fatal("unauth") }
 }
+
+func TestKeyExchangeEncodeDecode(t *testing.T) {
+    c := Common{TTL: 2, PC: MsgKeyExchange, Flags: 0}
+    k := KeyExchange{SrcMac: Mac{1, 2, 3, 4, 5, 6}, DstMac: Mac{6, 5, 4, 3, 2, 1}, Kind: KeyExchangeResp, Epoch: 42, Payload: []byte("sealed")}
+    b := make([]byte, 128)
+    n := EncodeKeyExchange(c, k, b)
+    i := 0
+    d, ok := DecodeCommon(b[:n], &i)
+    if !ok || d.PC != MsgKeyExchange { t.Fatal("common") }
+    got, gok := DecodeKeyExchange(b[:n], &i)
+    if !gok || got.SrcMac != k.SrcMac || got.DstMac != k.DstMac || got.Kind != k.Kind || got.Epoch != k.Epoch || string(got.Payload) != string(k.Payload) { t.Fatal("kx") }
+}
+
+func TestQueryPeerByIP(t *testing.T) {
+    c := Common{TTL: 2, PC: MsgQueryPeer, Flags: 0}
+    q := QueryPeer{SrcMac: Mac{2, 0, 0, 0, 0, 1}, Sock: Sock{Family: 2, Type: 2, Port: 7655}, TargetIP: 0x0a000002}
+    b := make([]byte, 128)
+    n := EncodeQueryPeer(c, q, b)
+    i := 0
+    if _, ok := DecodeCommon(b[:n], &i); !ok { t.Fatal("common") }
+    got, ok := DecodeQueryPeer(b[:n], &i)
+    if !ok || got.SrcMac != q.SrcMac || got.TargetIP != q.TargetIP { t.Fatalf("query %+v", got) }
+    plain := EncodeQueryPeer(c, QueryPeer{SrcMac: q.SrcMac, Sock: q.Sock}, b)
+    if plain != n-4 { t.Fatalf("TargetIP appended when unset: %d vs %d", plain, n) }
+
+    p := PeerInfo{Mac: Mac{2, 0, 0, 0, 0, 2}, Sock: q.Sock, PreferredSock: q.Sock, DevAddr: IPSubnet{NetAddr: 0x0a000002, Bitlen: 24}}
+    n = EncodePeerInfo(Common{TTL: 2, PC: MsgPeerInfo}, p, b)
+    i = 0
+    DecodeCommon(b[:n], &i)
+    gp, ok := DecodePeerInfo(b[:n], &i)
+    if !ok || gp.Mac != p.Mac || gp.DevAddr != p.DevAddr { t.Fatalf("peer info %+v", gp) }
+}